@@ -1,7 +1,30 @@
 import MenuTabs from "./MenuTabs.tsx";
-import {useState} from "react";
+import {useState, useEffect} from "react";
 import "./logs.css";
 
+interface LogEntry {
+  id?: number;
+  time: string;
+  level: string;
+  msg: string;
+  request_id?: string;
+  pipeline?: string;
+  attrs?: Record<string, string>;
+}
+
+// the most entries kept on screen, older ones can be loaded again
+const maxEntries = 2000;
+
+function formatEntry(entry: LogEntry): string {
+  let line = `${entry.time} ${entry.level} ${entry.msg}`;
+  if (entry.pipeline) line += ` pipeline=${entry.pipeline}`;
+  if (entry.request_id) line += ` request_id=${entry.request_id}`;
+  for (const [key, value] of Object.entries(entry.attrs ?? {})) {
+    line += ` ${key}=${value}`;
+  }
+  return line;
+}
+
 export default function Logs() {
   if (localStorage.getItem("StyleSetting") == null)
     localStorage.setItem("StyleSetting", "Dark");
@@ -11,30 +34,82 @@ export default function Logs() {
   });
 
   const [ ThemeColor, setThemeColor ] = useState(localStorage.getItem("StyleSetting"));
-  const [logText, setlogText] = useState(localStorage.getItem("logsCopy") ? localStorage.getItem("logsCopy") : "");
+  // newest first, the log truck shows them bottom up
+  const [entries, setEntries] = useState<LogEntry[]>([]);
+  const [next, setNext] = useState(0);
+  const [level, setLevel] = useState("");
+  const [pipeline, setPipeline] = useState("");
+  const [requestID, setRequestID] = useState("");
 
-  async function readLogs(): Promise<void> {
-    let responseBody;
-    const response = await fetch("http://localhost:8080/getlogs", {
+  function filterQuery(): URLSearchParams {
+    const query = new URLSearchParams();
+    if (level) query.set("level", level);
+    if (pipeline) query.set("pipeline", pipeline);
+    if (requestID) query.set("request_id", requestID);
+    return query;
+  }
+
+  async function readLogs(before: number): Promise<void> {
+    const query = filterQuery();
+    if (before > 0) query.set("before", String(before));
+
+    const response = await fetch("http://localhost:8080/logs?" + query.toString(), {
       method: "GET",
     });
 
     if (response.ok) {
-      responseBody = await response.json();
-      setlogText(atob(responseBody.logs));
-      localStorage.setItem("logsCopy", atob(responseBody.logs));
+      const page = await response.json();
+      setEntries(current => before > 0 ? [...current, ...page.entries] : page.entries);
+      setNext(page.next ?? 0);
     } else {
       alert("Error requesting logs");
     }
   }
 
-  setInterval(readLogs, 3000);
+  // load the newest page and follow new entries whenever the filters change
+  useEffect(() => {
+    readLogs(0);
+
+    const stream = new EventSource("http://localhost:8080/logs/stream?" + filterQuery().toString());
+    stream.onmessage = (event) => {
+      const entry: LogEntry = JSON.parse(event.data);
+      setEntries(current => [entry, ...current].slice(0, maxEntries));
+    };
+
+    return () => stream.close();
+  }, [level, pipeline, requestID]);
 
   return (
     <>
       <div className={`${ThemeColor}_background`} />
       <MenuTabs />
-      <pre className={`${ThemeColor}_logTruck`}>{logText}</pre>
+      <div className={`${ThemeColor}_logFilters`}>
+        <select value={level} onChange={(e) => setLevel(e.target.value)}>
+          <option value="">all levels</option>
+          <option value="debug">debug</option>
+          <option value="info">info</option>
+          <option value="warn">warn</option>
+          <option value="error">error</option>
+        </select>
+        <input
+          placeholder="pipeline"
+          value={pipeline}
+          onChange={(e) => setPipeline(e.target.value)}
+        />
+        <input
+          placeholder="request id"
+          value={requestID}
+          onChange={(e) => setRequestID(e.target.value)}
+        />
+      </div>
+      <div className={`${ThemeColor}_logTruck`}>
+        {entries.map((entry, i) => (
+          <pre key={i}>{formatEntry(entry)}</pre>
+        ))}
+        {next > 0 && (
+          <button onClick={() => readLogs(next)}>Load older logs</button>
+        )}
+      </div>
     </>
   );
 }
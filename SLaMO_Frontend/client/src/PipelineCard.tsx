@@ -63,12 +63,13 @@ export default function PipelineCard({
 
   async function getModelsFromVito() {
     const dropDownOptions: {type: string; name: string}[] = [];
-    const response = await fetch(`http://localhost:8080/getmodels`, {
+    // only models that generate text can be picked, not the embedding model
+    const response = await fetch(`http://localhost:8080/getmodels?type=generation`, {
       method: "GET",
     });
 
-    let responseBody: {models: string[]};
-    let models: string[] = [];
+    let responseBody: {models: {name: string}[]};
+    let models: {name: string}[] = [];
 
     if (response.ok) {
       responseBody = await response.json();
@@ -80,7 +81,7 @@ export default function PipelineCard({
     }
 
     models.forEach((element) => {
-      dropDownOptions.push({type: element, name: element.slice(0, -5)});
+      dropDownOptions.push({type: element.name, name: element.name.slice(0, -5)});
     });
 
     setModelList(dropDownOptions);
@@ -115,6 +115,8 @@ export default function Prompt() {
             }),
           }
         );
+        const result = await response.json();
+        const sources: { id: number; url: string; title: string; score: number }[] = result.sources ?? [];
         setloadingAnimation("");
         setResponseAnswer(
           <>
@@ -123,9 +125,24 @@ export default function Prompt() {
             <p className={`${ThemeColor}_leftTitle`}>Response:</p>
             <p className={`${ThemeColor}_left`}>
               <Markdown>
-                {`${JSON.parse(JSON.stringify(await response.json())).answer}`}
+                {`${result.answer}`}
               </Markdown>
             </p>
+            {sources.length > 0 && (
+              <>
+                <p className={`${ThemeColor}_leftTitle`}>Sources:</p>
+                <ol className={`${ThemeColor}_left`}>
+                  {sources.map((source) => (
+                    <li key={source.id} value={source.id}>
+                      <a href={source.url} target="_blank" rel="noreferrer">
+                        {source.title || source.url}
+                      </a>{" "}
+                      ({source.score.toFixed(2)})
+                    </li>
+                  ))}
+                </ol>
+              </>
+            )}
           </>
         );
       } else {
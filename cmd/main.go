@@ -12,10 +12,8 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
@@ -24,57 +22,104 @@ import (
 	"time"
 
 	"github.com/StoneG24/slape/pkg/api"
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/embedding"
 	"github.com/StoneG24/slape/pkg/logging"
+	"github.com/StoneG24/slape/pkg/metrics"
+	"github.com/StoneG24/slape/pkg/models"
 	"github.com/StoneG24/slape/pkg/pipeline"
+	"github.com/StoneG24/slape/pkg/rag"
+	"github.com/StoneG24/slape/pkg/runs"
+	"github.com/StoneG24/slape/pkg/session"
+	"github.com/StoneG24/slape/pkg/tracing"
 	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/StoneG24/slape/pkg/vectorstore"
 	"github.com/docker/docker/client"
+	"go.opentelemetry.io/otel"
 )
 
 var (
 	isGPU = pipeline.IsGPU()
-	image = pipeline.PickImage()
 
 	s = pipeline.SimplePipeline{
 		// updates after created
-		Models:         []string{},
-		ContextBox:     pipeline.ContextBox{},
-		Tools:          pipeline.Tools{},
-		DockerClient:   nil,
-		ContainerImage: image,
-		GPU:            isGPU,
+		Models:       []string{},
+		ContextBox:   pipeline.ContextBox{},
+		Tools:        pipeline.Tools{},
+		DockerClient: nil,
+		GPU:          isGPU,
 	}
 
 	c = pipeline.ChainofModels{
 		// updates after created
-		Models:         []string{},
-		ContextBox:     pipeline.ContextBox{},
-		Tools:          pipeline.Tools{},
-		DockerClient:   nil,
-		ContainerImage: image,
-		GPU:            isGPU,
+		Models:       []string{},
+		ContextBox:   pipeline.ContextBox{},
+		Tools:        pipeline.Tools{},
+		DockerClient: nil,
+		GPU:          isGPU,
 	}
 
 	d = pipeline.DebateofModels{
 		// updates after created
-		Models:         []string{},
-		ContextBox:     pipeline.ContextBox{},
-		Tools:          pipeline.Tools{},
-		DockerClient:   nil,
-		ContainerImage: image,
-		GPU:            isGPU,
+		Models:       []string{},
+		ContextBox:   pipeline.ContextBox{},
+		Tools:        pipeline.Tools{},
+		DockerClient: nil,
+		GPU:          isGPU,
 	}
 
 	e = pipeline.EmbeddingPipeline{
 		// updates after created
 		// We want to keep the embedding model off of the gpu for right now.
-		DockerClient:   nil,
-		ContainerImage: vars.CpuImage,
-		GPU:            false,
+		DockerClient: nil,
+		GPU:          false,
 	}
+
+	r = pipeline.RerankPipeline{
+		// updates after created
+		// The reranker only sees a few passages at a time so it stays on the cpu as well.
+		DockerClient: nil,
+		GPU:          false,
+	}
+
+	// pipelines is loaded from the yaml definitions once the docker client exists
+	pipelines *pipeline.Pipelines
 )
 
 func main() {
 
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fatal("Error Loading Config", err)
+	}
+
+	logFile, err := logging.Setup(cfg.Log)
+	if err != nil {
+		fatal("Error Setting Up Logging", err)
+	}
+	defer logFile.Close()
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("Error Setting Up Tracing", err)
+	}
+
+	image := pipeline.PickImage(cfg.Images)
+	s.ContainerImage = image
+	c.ContainerImage = image
+	d.ContainerImage = image
+	e.ContainerImage = cfg.Images.CPU
+	r.ContainerImage = cfg.Images.CPU
+
+	s.Config = cfg
+	c.Config = cfg
+	d.Config = cfg
+	e.Config = cfg
+	r.Config = cfg
+
+	embedding.Default = embedding.New(cfg.EmbeddingClient(), cfg.Endpoints.Embedding, vars.EmbeddingCacheDir)
+
 	apiclient, err := createClient()
 	if err != nil {
 		return
@@ -84,11 +129,67 @@ func main() {
 	c.DockerClient = apiclient
 	d.DockerClient = apiclient
 	e.DockerClient = apiclient
+	r.DockerClient = apiclient
+	containers.Default.DockerClient = apiclient
 
-	logging.CreateLogFile()
-	defer logging.CloseLogging()
+	models.Default.Offline = cfg.Models.Offline
+	models.Default.HuggingFace = cfg.Models.HuggingFace
+	models.Default.Token = os.Getenv("HF_TOKEN")
 
-	fmt.Println("[+] Server Starting")
+	slog.Info("Loading vector collections")
+	store, err := vectorstore.Open(vars.VectorStoreDir)
+	if err != nil {
+		fatal("Error Loading Vector Collections", err)
+	}
+	defer store.Close()
+
+	// documents are embedded with the embedding pipeline and
+	// entities are extracted by whichever model is running on the main port
+	ragIndex, err := rag.New(store, &e, rag.LLMExtractor{Client: cfg.ModelClient()}, vars.RagDir)
+	if err != nil {
+		fatal("Error Loading RAG", err)
+	}
+
+	ingester := rag.NewIngester(ragIndex)
+
+	sessions, err := session.NewStore(vars.SessionDir)
+	if err != nil {
+		fatal("Error Loading Sessions", err)
+	}
+
+	history, err := runs.Open(vars.RunsPath)
+	if err != nil {
+		fatal("Error Opening Run History", err)
+	}
+	defer history.Close()
+
+	s.VectorStore = store
+	c.VectorStore = store
+	d.VectorStore = store
+	s.RAG = ragIndex
+	c.RAG = ragIndex
+	d.RAG = ragIndex
+	s.Sessions = sessions
+	c.Sessions = sessions
+	d.Sessions = sessions
+	s.Runs = history
+	c.Runs = history
+	d.Runs = history
+
+	// prompt templates have to load before the pipeline definitions that use them
+	err = pipeline.Prompts.LoadDir(cfg.Prompts)
+	if err != nil {
+		fatal("Error Loading Prompts", err)
+	}
+
+	// pipelines described in yaml, a bad definition doesn't stop the others from loading
+	pipelines = pipeline.NewPipelines(vars.PipelineDir, apiclient, image, isGPU, s.ContextBox)
+	err = pipelines.Load()
+	if err != nil {
+		slog.Error("Error Loading Pipeline Definitions", "err", err)
+	}
+
+	slog.Info("Server Starting")
 
 	// Default Mux for our server.
 	// For auth in the future we will want to setup a different set.
@@ -106,14 +207,44 @@ func main() {
 	mux.HandleFunc("GET  /emb/setup", e.EmbeddingPipelineSetupRequest)
 	mux.HandleFunc("POST /emb/generate", e.EmbeddingPipelineGenerateRequest)
 	mux.HandleFunc("GET /emb/shutdown", e.Shutdown)
+	mux.HandleFunc("GET /rerank/setup", r.RerankPipelineSetupRequest)
+	mux.HandleFunc("GET /rerank/shutdown", r.Shutdown)
+	mux.HandleFunc("POST /pipelines", pipelines.CreatePipelineRequest)
+	mux.HandleFunc("GET /pipelines", pipelines.ListPipelinesRequest)
+	mux.HandleFunc("POST /pipelines/{name}/setup", pipelines.PipelineSetupRequest)
+	mux.HandleFunc("POST /pipelines/{name}/generate", pipelines.PipelineGenerateRequest)
+	mux.HandleFunc("GET /pipelines/{name}/shutdown", pipelines.PipelineShutdownRequest)
+	mux.HandleFunc("POST /rag/documents", ingester.UploadDocumentsRequest)
+	mux.HandleFunc("GET /rag/documents", ingester.ListDocumentsRequest)
+	mux.HandleFunc("DELETE /rag/documents/{id}", ingester.DeleteDocumentRequest)
+	mux.HandleFunc("POST /sessions", sessions.CreateSessionRequest)
+	mux.HandleFunc("GET /sessions", sessions.ListSessionsRequest)
+	mux.HandleFunc("GET /sessions/{id}", sessions.GetSessionRequest)
+	mux.HandleFunc("DELETE /sessions/{id}", sessions.DeleteSessionRequest)
+	mux.HandleFunc("GET /containers", containers.Default.ListContainersRequest)
+	mux.HandleFunc("GET /containers/{id}/logs", containers.Default.ContainerLogsRequest)
+	mux.HandleFunc("GET /containers/{id}/stats", containers.Default.ContainerStatsRequest)
+	mux.HandleFunc("GET /runs", history.ListRunsRequest)
+	mux.HandleFunc("GET /runs/export", history.ExportRunsRequest)
+	mux.HandleFunc("GET /runs/{id}", history.GetRunRequest)
 	//mux.HandleFunc("/moe", simplerequest)
 	//mux.HandleFunc("/up", upDog)
+	mux.HandleFunc("GET /config", cfg.ConfigRequest)
+	mux.HandleFunc("GET /prompts", pipeline.Prompts.PromptsRequest)
 	mux.HandleFunc("GET /getmodels", api.GetModels)
+	mux.HandleFunc("GET /models", models.Default.ListModelsRequest)
+	mux.HandleFunc("POST /models/pull", models.Default.PullModelRequest)
+	mux.HandleFunc("GET /models/pull/{name}", models.Default.PullStatusRequest)
+	mux.HandleFunc("DELETE /models/{name}", models.Default.DeleteModelRequest)
 	mux.HandleFunc("GET /shutdownpipes", ShutdownPipes)
-	mux.HandleFunc("GET /getlogs", api.GetLogs)
+	mux.HandleFunc("GET /logs", api.GetLogs)
+	mux.HandleFunc("GET /logs/stream", api.StreamLogs)
+	mux.Handle("GET /metrics", metrics.Handler())
 
 	// This is against my religion
-	wrappingMux := NewCoors(mux)
+	// every request gets an id first so the cors preflights are logged as well,
+	// metrics go right outside the mux so they can see which route matched
+	wrappingMux := logging.Middleware(tracing.Middleware(metrics.Middleware(NewCoors(mux))))
 
 	// Create a new HTTP server.
 	srv := &http.Server{
@@ -122,51 +253,48 @@ func main() {
 	}
 
 	// Start the server in a goroutine.
-	log.Println("[+] Server started on :8080")
+	slog.Info("Server started on :8080")
 	go func() {
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("ListenAndServe(): %s", err)
+			fatal("Error Listening", err)
 		}
 	}()
 
-	// If we don't run embedding pipeline on startup,
-	// we can remove this as well.
-	log.Println("[+] Checking for models folder...")
-	if _, err := os.Stat("./models"); errors.Is(err, os.ErrNotExist) {
-		log.Println("[+] Creating models folder...")
-		os.Mkdir("models", 0744)
-	}
-
-	// If needed, download the snowflake embedding model
-	// If this is changed to gated model then the code would need to change to accept a token.
-	// Reading from an evironment variable would be the safest option.
-	if _, err := os.Stat("./models/snowflake-arctic-embed-l-v2.0-q4_k_m.gguf"); errors.Is(err, os.ErrNotExist) {
-		log.Println("[+] Downloading Embedding Model...")
-		err := downloadHuggingFaceModel(
-			"Casual-Autopsy/snowflake-arctic-embed-l-v2.0-gguf",
-			"snowflake-arctic-embed-l-v2.0-q4_k_m.gguf",
-		)
-		if err != nil {
-			log.Fatalln("[-] Error Downloading Embedding Model", err)
-		}
-		log.Println("[+] Finished Downloading Embedding Model")
+	// pulls the embedding model if it isn't in the models folder yet
+	err = models.Default.Ensure(context.Background(), models.Source{Repo: vars.EmbeddingRepo, File: vars.EmbeddingModel})
+	if err != nil {
+		fatal("Error Pulling Embedding Model", err)
 	}
 
 	// starting up the embedding pipeline
 	url := "http://localhost:8080/emb/setup"
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Fatalf("[-] Error while trying to startup the Embedding Pipeline")
+		fatal("Error while trying to startup the Embedding Pipeline", err)
 	}
 	resp.Body.Close()
 
+	// starting up the reranker if it's turned on
+	if vars.Reranker {
+		err = models.Default.Ensure(context.Background(), models.Source{Repo: vars.RerankRepo, File: vars.RerankModel})
+		if err != nil {
+			fatal("Error Pulling Reranker Model", err)
+		}
+
+		resp, err := http.Get("http://localhost:8080/rerank/setup")
+		if err != nil {
+			fatal("Error while trying to startup the Reranker", err)
+		}
+		resp.Body.Close()
+	}
+
 	// starting up the frontend on port 3000
-	if vars.Frontend {
-		log.Println("[+] Starting Frontend...")
+	if cfg.Frontend {
+		slog.Info("Starting Frontend")
 		cmd := exec.Command("deno", "run", "dev")
 		cmd.Dir = "./SLaMO_Frontend"
 		go cmd.Run()
-		log.Println("[+] Frontend has been started on port 3000")
+		slog.Info("Frontend has been started on port 3000")
 	}
 
 	// Create a channel to listen for interrupt signals.
@@ -185,13 +313,18 @@ func main() {
 
 	// Shutdown the server.
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Shutdown(): %s", err)
+		fatal("Error Shutting Down the Server", err)
 	}
 
 	// Close the pipeline to stop adding new pipelines
 	// close(keystone)
 
-	log.Println("[+] Server gracefully stopped")
+	// send the spans that are left
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Error Shutting Down Tracing", "err", err)
+	}
+
+	slog.Info("Server gracefully stopped")
 }
 
 type Coors struct {
@@ -221,46 +354,22 @@ func NewCoors(handlerToWrap http.Handler) *Coors {
 	return &Coors{handlerToWrap}
 }
 
-// DownloadHuggingFaceModel downloads a given model provided a repo and filename are given.
-// This only really works for our usecase since we are using a gguf model.
-// Note This functionality is already in llamacpp-server
-func downloadHuggingFaceModel(repo string, filename string) error {
-	url := "https://huggingface.co/" + repo + "/resolve/main/" + filename
-
-	// Send HTTP GET request
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	// Check if status is OK (200)
-	if resp.StatusCode != http.StatusOK {
-		return err
-	}
-
-	// Create the file
-	out, err := os.Create("./models/" + filename)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	// Write response body to file
-	_, err = io.Copy(out, resp.Body)
-	return err
+// fatal logs err and exits, like log.Fatalln.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
 
 func createClient() (*client.Client, error) {
-	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation(), client.WithTraceProvider(otel.GetTracerProvider()))
 	if err != nil {
-		log.Println("Error creating the docker client: ", err)
+		slog.Error("Error creating the docker client", "err", err)
 		return nil, err
 	}
 
 	_, err = apiClient.Ping(context.Background())
 	if err != nil {
-		fmt.Println("Error Connecting to Docker Socket, make sure you have docker running and the service runnning.")
+		slog.Error("Error Connecting to Docker Socket, make sure you have docker running and the service runnning", "err", err)
 		return nil, err
 	}
 
@@ -280,9 +389,9 @@ func ShutdownPipes(w http.ResponseWriter, req *http.Request) {
 func shutdownPipelines() error {
 
 	url := "http://localhost:8080/%s/shutdown"
-	pipelines := []string{"simple", "cot", "deb", "emb"}
+	builtin := []string{"simple", "cot", "deb", "emb", "rerank"}
 
-	for _, pipeline := range pipelines {
+	for _, pipeline := range builtin {
 		requrl := fmt.Sprintf(url, pipeline)
 		resp, err := http.Get(requrl)
 		if err != nil {
@@ -291,6 +400,12 @@ func shutdownPipelines() error {
 		resp.Body.Close()
 	}
 
+	if pipelines != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		pipelines.ShutdownAll(ctx)
+	}
+
 	return nil
 }
 
@@ -299,7 +414,7 @@ func gi() {
 	// TODO(v) need to shutdown frontend process for windows
 	// with every startup we spin up a server without tearing it down
 	// windows would require a admin priv to remove the server by port like this
-	log.Println("[+] Shuting Down Frontend...")
+	slog.Info("Shuting Down Frontend")
 	if runtime.GOOS == "linux" {
 		cmd := exec.Command("fuser", "-k", "3000/tcp")
 		cmd.Run()
@@ -310,11 +425,11 @@ func gi() {
 		cmd := exec.Command("taskkill", "/f", "/pid", "$(netstat -ano | findstr ':3000')")
 		cmd.Run()
 	}
-	log.Println("[+] Frontend has been stopped")
+	slog.Info("Frontend has been stopped")
 
 	err := shutdownPipelines()
 	if err != nil {
-		log.Println("ErrorShuttingDownPipelines:", err)
+		slog.Error("Error Shutting Down Pipelines", "err", err)
 	}
 
 	// clean up docker clients and free up sockets
@@ -322,6 +437,7 @@ func gi() {
 	c.DockerClient.Close()
 	d.DockerClient.Close()
 	e.DockerClient.Close()
+	r.DockerClient.Close()
 
 	return
 }
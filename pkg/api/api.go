@@ -3,88 +3,197 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/StoneG24/slape/pkg/logging"
+	"github.com/StoneG24/slape/pkg/models"
 	"github.com/StoneG24/slape/pkg/vars"
 )
 
-func UpDog(port string) bool {
-	resp, err := http.Get("http://localhost:" + port + "/health")
+// UpDog checks the health of the llama.cpp server at endpoint, the base url its openai api is on.
+func UpDog(endpoint string) bool {
+	resp, err := http.Get(serverURL(endpoint) + "/health")
 	if err != nil {
-		log.Println("Error checking model", err)
+		slog.Error("Error checking model", "err", err)
 		return false
 	}
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		log.Println("Model is ready")
+		slog.Info("Model is ready")
 		return true
 	case http.StatusServiceUnavailable:
-		log.Println("Model is not ready...")
+		slog.Info("Model is not ready")
 		return false
 	default:
-		log.Println("Model is not ready...")
+		slog.Info("Model is not ready")
 		return false
 	}
 }
 
-// swagger:model ModelsResponse
-type ModelsResponse struct {
-	// List of models to be returned to the client
-	// required: true
-	Models []string `json:"models"`
-}
+// tokenizeClient keeps a slow model from holding up prompt building.
+var tokenizeClient = http.Client{Timeout: 5 * time.Second}
 
-func GetModels(w http.ResponseWriter, req *http.Request) {
-	files, err := os.ReadDir("./models")
+// Tokenize counts the tokens in text with the tokenizer of the llama.cpp server at endpoint.
+func Tokenize(endpoint string, text string) (int, error) {
+	body, err := json.Marshal(map[string]string{"content": text})
 	if err != nil {
-		log.Println("Error reading models folder", err)
-		w.Write([]byte("Error while trying to read models files"))
+		return 0, err
 	}
 
-	bundle := []string{}
-
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		} else {
-			bundle = append(bundle, file.Name())
-		}
+	resp, err := tokenizeClient.Post(serverURL(endpoint)+"/tokenize", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
 	}
+	defer resp.Body.Close()
 
-	respBundle := ModelsResponse{
-		Models: bundle,
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("tokenize returned %s", resp.Status)
 	}
 
-	json, err := json.Marshal(respBundle)
+	var tokens struct {
+		Tokens []json.RawMessage `json:"tokens"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	if err != nil {
+		return 0, err
+	}
+	return len(tokens.Tokens), nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(json)
+// serverURL is the root of a llama.cpp server from the base url of its openai api, /health and /tokenize aren't under /v1.
+func serverURL(endpoint string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(endpoint, "/"), "/v1")
+}
 
-	return
+// GetModels, handlerfunc expects GET method, it's the older name of GET /models and is answered the same way.
+func GetModels(w http.ResponseWriter, req *http.Request) {
+	models.Default.ListModelsRequest(w, req)
 }
 
-type LogRequest struct {
-	Logs []byte `json:"logs"`
+// logFilter reads the level, pipeline and request_id filters from the query of a request.
+// Without a level every entry is kept.
+func logFilter(req *http.Request) (logging.Filter, error) {
+	query := req.URL.Query()
+	filter := logging.Filter{
+		Level:     slog.LevelDebug,
+		Pipeline:  query.Get("pipeline"),
+		RequestID: query.Get("request_id"),
+	}
+	if value := query.Get("level"); value != "" {
+		level, err := logging.ParseLevel(value)
+		if err != nil {
+			return filter, errors.New("level has to be debug, info, warn or error")
+		}
+		filter.Level = level
+	}
+	return filter, nil
 }
 
+// GetLogs, handlerfunc expects GET method and returns a page of the log files, newest first.
+// The query can have level, pipeline, request_id, limit and before, the id to start after.
 func GetLogs(w http.ResponseWriter, req *http.Request) {
-	contents, err := os.ReadFile("./logs/" + vars.Logfilename)
+	filter, err := logFilter(req)
 	if err != nil {
-		log.Panicln("Error getting logs for frontend", err)
+		http.Error(w, "Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := req.URL.Query()
+	limit := vars.LogPageLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Error limit has to be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, vars.LogMaxPage)
+	}
+	before := 0
+	if value := query.Get("before"); value != "" {
+		before, err = strconv.Atoi(value)
+		if err != nil || before <= 0 {
+			http.Error(w, "Error before has to be a positive number", http.StatusBadRequest)
+			return
+		}
 	}
 
-	logs := LogRequest{
-		Logs: contents,
+	page, err := logging.ReadPage(logging.Files(), filter, before, limit)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error getting logs for frontend", "err", err)
+		http.Error(w, "Error getting logs", http.StatusInternalServerError)
+		return
 	}
 
-	jsonLogs, err := json.Marshal(logs)
+	json, err := json.Marshal(page)
+	if err != nil {
+		http.Error(w, "Error marshaling logs", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write(jsonLogs)
+	w.Write(json)
+}
+
+// StreamLogs, handlerfunc expects GET method and sends new log entries as server sent events until the client leaves.
+// The query can have level, pipeline and request_id like GET /logs.
+func StreamLogs(w http.ResponseWriter, req *http.Request) {
+	filter, err := logFilter(req)
+	if err != nil {
+		http.Error(w, "Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, cancel := logging.Logs.Subscribe(filter)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	flusher := http.NewResponseController(w)
+	err = flusher.Flush()
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Streaming Logs", "err", err)
+		return
+	}
+
+	ping := time.NewTicker(vars.LogStreamPing * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case entry := <-entries:
+			data, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+			if err != nil {
+				return
+			}
+		case <-ping.C:
+			// keeps proxies from closing a quiet stream
+			_, err = io.WriteString(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		}
+		if flusher.Flush() != nil {
+			return
+		}
+	}
 }
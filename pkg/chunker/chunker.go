@@ -0,0 +1,496 @@
+/*
+Package chunker splits documents into overlapping pieces that fit the context of an embedding model.
+
+Chunks are measured in tokens rather than bytes, are always cut on rune boundaries,
+and keep track of where they came from so that results can be traced back to a source.
+The same chunker is used for internet search results and for RAG ingestion.
+*/
+package chunker
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Strategy decides where a document is allowed to be cut.
+type Strategy string
+
+const (
+	// Sentence cuts on sentence boundaries.
+	Sentence Strategy = "sentence"
+	// Paragraph cuts on blank lines and falls back to sentences for long paragraphs.
+	Paragraph Strategy = "paragraph"
+	// Markdown cuts on headings, keeps fenced code blocks whole and titles chunks by their heading.
+	Markdown Strategy = "markdown"
+	// Code cuts between top level blocks of source code and falls back to lines.
+	Code Strategy = "code"
+)
+
+const (
+	// DefaultMaxTokens is used when Options.MaxTokens is not set.
+	DefaultMaxTokens = 200
+	// DefaultOverlap is used when Options.Overlap is negative.
+	DefaultOverlap = 40
+)
+
+type (
+	// Chunk is a piece of a document along with the metadata needed to cite it.
+	Chunk struct {
+		// Text is the chunk exactly as it appears in the source.
+		Text string `json:"text"`
+		// Source is where the document came from, usually a url or a file path.
+		Source string `json:"source"`
+		// Title is the nearest heading or the title of the document.
+		Title string `json:"title"`
+		// Offset is the byte offset of the chunk in the original document.
+		Offset int `json:"offset"`
+		// Index is the position of the chunk in the document.
+		Index int `json:"index"`
+		// Tokens is the number of tokens counted for the chunk.
+		Tokens int `json:"tokens"`
+	}
+
+	// Options controls how a document is split.
+	Options struct {
+		Strategy Strategy
+		// MaxTokens is the largest a chunk can be.
+		MaxTokens int
+		// Overlap is how many tokens of the previous chunk are repeated at the start of the next.
+		Overlap int
+		// Source and Title are copied into every chunk.
+		Source string
+		Title  string
+		// Tokenizer counts the tokens in a string, EstimateTokens is used if this is nil.
+		Tokenizer func(string) int
+	}
+
+	// segment is the smallest piece of text that the packer works with.
+	segment struct {
+		start  int
+		end    int
+		title  string
+		tokens int
+	}
+)
+
+// Split breaks text into chunks using the strategy in opts.
+func Split(text string, opts Options) []Chunk {
+	if opts.MaxTokens <= 0 {
+		opts.MaxTokens = DefaultMaxTokens
+	}
+	if opts.Overlap < 0 {
+		opts.Overlap = DefaultOverlap
+	}
+	if opts.Overlap >= opts.MaxTokens {
+		opts.Overlap = opts.MaxTokens / 4
+	}
+	if opts.Tokenizer == nil {
+		opts.Tokenizer = EstimateTokens
+	}
+	if !utf8.ValidString(text) {
+		text = strings.ToValidUTF8(text, "")
+	}
+
+	var segs []segment
+	switch opts.Strategy {
+	case Sentence:
+		segs = sentences(text, 0, len(text), "")
+	case Markdown:
+		segs = markdownSections(text, opts)
+	case Code:
+		segs = codeBlocks(text, 0, len(text), "", opts)
+	default:
+		segs = paragraphs(text, 0, len(text), "")
+	}
+
+	return pack(text, segs, opts)
+}
+
+// pack greedily groups segments into chunks that fit opts.MaxTokens.
+func pack(text string, segs []segment, opts Options) []Chunk {
+	// measure everything up front and break anything that can never fit
+	var measured []segment
+	for _, seg := range segs {
+		if strings.TrimSpace(text[seg.start:seg.end]) == "" {
+			continue
+		}
+		seg.tokens = opts.Tokenizer(text[seg.start:seg.end])
+		if seg.tokens > opts.MaxTokens {
+			measured = append(measured, hardSplit(text, seg, opts)...)
+			continue
+		}
+		measured = append(measured, seg)
+	}
+
+	var chunks []Chunk
+	var current []segment
+	total := 0
+	// fresh is set when current holds something that isn't just overlap
+	fresh := false
+
+	flush := func() {
+		if !fresh {
+			return
+		}
+		fresh = false
+		first, last := current[0], current[len(current)-1]
+		title := first.title
+		if title == "" {
+			title = opts.Title
+		}
+		chunkText := strings.TrimSpace(text[first.start:last.end])
+		chunks = append(chunks, Chunk{
+			Text:   chunkText,
+			Source: opts.Source,
+			Title:  title,
+			Offset: first.start + strings.Index(text[first.start:last.end], chunkText),
+			Index:  len(chunks),
+			Tokens: opts.Tokenizer(chunkText),
+		})
+
+		// carry the tail of this chunk into the next one
+		var carried []segment
+		kept := 0
+		for i := len(current) - 1; i > 0; i-- {
+			if kept+current[i].tokens > opts.Overlap {
+				break
+			}
+			kept += current[i].tokens
+			carried = append([]segment{current[i]}, carried...)
+		}
+		current = carried
+		total = kept
+	}
+
+	for _, seg := range measured {
+		// never mix sections with different headings
+		if len(current) > 0 && current[len(current)-1].title != seg.title {
+			flush()
+			current, total = nil, 0
+		}
+		if total+seg.tokens > opts.MaxTokens {
+			flush()
+			// the overlap might still be too large for the new segment
+			for len(current) > 0 && total+seg.tokens > opts.MaxTokens {
+				total -= current[0].tokens
+				current = current[1:]
+			}
+		}
+		current = append(current, seg)
+		total += seg.tokens
+		fresh = true
+	}
+	flush()
+
+	return chunks
+}
+
+// hardSplit cuts a segment that is too large on whitespace, or on runes if it has to.
+func hardSplit(text string, seg segment, opts Options) []segment {
+	var out []segment
+	start := seg.start
+	for start < seg.end {
+		// binary search for the furthest rune boundary that still fits,
+		// a token is never more than a few bytes so the window can be capped.
+		lo, hi := start, snapBack(text, start, min(seg.end, start+opts.MaxTokens*32))
+		for lo < hi {
+			mid := lo + (hi-lo+1)/2
+			for mid < hi && !utf8.RuneStart(text[mid]) {
+				mid++
+			}
+			if opts.Tokenizer(text[start:mid]) <= opts.MaxTokens {
+				lo = mid
+			} else {
+				hi = snapBack(text, lo, mid-1)
+			}
+		}
+		end := lo
+
+		// back off to the last space so words stay whole
+		if end < seg.end {
+			if i := strings.LastIndexFunc(text[start:end], unicode.IsSpace); i > 0 {
+				end = start + i + 1
+			}
+		}
+		if end == start {
+			// a single rune is larger than the budget, take it anyways
+			_, size := utf8.DecodeRuneInString(text[start:seg.end])
+			end = start + size
+		}
+		out = append(out, segment{
+			start:  start,
+			end:    end,
+			title:  seg.title,
+			tokens: opts.Tokenizer(text[start:end]),
+		})
+		start = end
+	}
+	return out
+}
+
+// snapBack moves i back to the start of a rune without going past floor.
+func snapBack(text string, floor, i int) int {
+	for i > floor && i < len(text) && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	return i
+}
+
+// sentences splits text[start:end] after sentence ending punctuation and on line breaks.
+func sentences(text string, start, end int, title string) []segment {
+	var segs []segment
+	begin := start
+	for i := start; i < end; {
+		r, size := utf8.DecodeRuneInString(text[i:end])
+		next := i + size
+		boundary := false
+		switch r {
+		case '.', '!', '?':
+			if next >= end {
+				break
+			}
+			nr, _ := utf8.DecodeRuneInString(text[next:end])
+			boundary = unicode.IsSpace(nr)
+		case '\n':
+			boundary = true
+		}
+		if boundary {
+			// swallow trailing whitespace into the sentence
+			for next < end {
+				nr, nsize := utf8.DecodeRuneInString(text[next:end])
+				if !unicode.IsSpace(nr) {
+					break
+				}
+				next += nsize
+			}
+			segs = append(segs, segment{start: begin, end: next, title: title})
+			begin = next
+		}
+		i = next
+	}
+	if begin < end {
+		segs = append(segs, segment{start: begin, end: end, title: title})
+	}
+	return segs
+}
+
+// paragraphs splits text[start:end] on blank lines, each paragraph is then split into sentences
+// so that the packer can break long paragraphs without cutting words.
+func paragraphs(text string, start, end int, title string) []segment {
+	var segs []segment
+	for _, para := range splitBlankLines(text, start, end) {
+		sents := sentences(text, para.start, para.end, title)
+		if len(sents) == 0 {
+			continue
+		}
+		// keep short paragraphs whole
+		if len(sents) == 1 || para.end-para.start < 200 {
+			segs = append(segs, segment{start: para.start, end: para.end, title: title})
+			continue
+		}
+		segs = append(segs, sents...)
+	}
+	return segs
+}
+
+// splitBlankLines returns the ranges of text[start:end] separated by one or more blank lines.
+// The blank lines are kept at the end of the previous range.
+func splitBlankLines(text string, start, end int) []segment {
+	var segs []segment
+	begin := start
+	lines := lineRanges(text, start, end)
+	for i, line := range lines {
+		if strings.TrimSpace(text[line.start:line.end]) != "" {
+			continue
+		}
+		// only cut once the run of blank lines has ended
+		if i+1 < len(lines) && strings.TrimSpace(text[lines[i+1].start:lines[i+1].end]) == "" {
+			continue
+		}
+		if line.end > begin {
+			segs = append(segs, segment{start: begin, end: line.end})
+		}
+		begin = line.end
+	}
+	if begin < end {
+		segs = append(segs, segment{start: begin, end: end})
+	}
+	return segs
+}
+
+// lineRanges returns every line in text[start:end] including its newline.
+func lineRanges(text string, start, end int) []segment {
+	var lines []segment
+	for start < end {
+		i := strings.IndexByte(text[start:end], '\n')
+		if i < 0 {
+			lines = append(lines, segment{start: start, end: end})
+			break
+		}
+		lines = append(lines, segment{start: start, end: start + i + 1})
+		start += i + 1
+	}
+	return lines
+}
+
+// markdownSections splits markdown on headings. Fenced code blocks are never split by a heading
+// and are handed to the code splitter, everything else is split into paragraphs.
+func markdownSections(text string, opts Options) []segment {
+	var segs []segment
+	var title string
+	var headings []string
+
+	lines := lineRanges(text, 0, len(text))
+	proseStart := 0
+	inFence := false
+	fenceStart := 0
+
+	flushProse := func(end int) {
+		if end > proseStart {
+			segs = append(segs, paragraphs(text, proseStart, end, title)...)
+		}
+	}
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(text[line.start:line.end])
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			if !inFence {
+				flushProse(line.start)
+				inFence = true
+				fenceStart = line.start
+			} else {
+				inFence = false
+				segs = append(segs, fence(text, fenceStart, line.end, title, opts)...)
+				proseStart = line.end
+			}
+			continue
+		}
+		if inFence {
+			continue
+		}
+
+		if level, heading := parseHeading(trimmed); level > 0 {
+			flushProse(line.start)
+			// keep the breadcrumb of headings above this one
+			if level <= len(headings) {
+				headings = headings[:level-1]
+			}
+			for len(headings) < level-1 {
+				headings = append(headings, "")
+			}
+			headings = append(headings, heading)
+			title = joinHeadings(headings)
+			proseStart = line.start
+		}
+	}
+
+	if inFence {
+		segs = append(segs, fence(text, fenceStart, len(text), title, opts)...)
+	} else {
+		flushProse(len(text))
+	}
+
+	return segs
+}
+
+// fence keeps a fenced code block as one segment and lets the packer split it by line if needed.
+func fence(text string, start, end int, title string, opts Options) []segment {
+	if opts.Tokenizer(text[start:end]) <= opts.MaxTokens {
+		return []segment{{start: start, end: end, title: title}}
+	}
+	return codeBlocks(text, start, end, title, opts)
+}
+
+// parseHeading returns the level and text of an ATX style markdown heading.
+func parseHeading(line string) (int, string) {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || line[level] != ' ' {
+		return 0, ""
+	}
+	return level, strings.TrimSpace(strings.TrimRight(line[level:], "#"))
+}
+
+func joinHeadings(headings []string) string {
+	var parts []string
+	for _, heading := range headings {
+		if heading != "" {
+			parts = append(parts, heading)
+		}
+	}
+	return strings.Join(parts, " > ")
+}
+
+// codeBlocks splits source code between top level blocks.
+// A block starts on a non indented line that follows a blank line, which works for
+// most c like languages, python and go. Blocks that are too large are split by line.
+func codeBlocks(text string, start, end int, title string, opts Options) []segment {
+	var segs []segment
+	lines := lineRanges(text, start, end)
+	begin := start
+	prevBlank := false
+
+	for _, line := range lines {
+		content := text[line.start:line.end]
+		blank := strings.TrimSpace(content) == ""
+		topLevel := !blank && !unicode.IsSpace(rune(content[0])) && !strings.HasPrefix(content, "}")
+		if topLevel && prevBlank && line.start > begin {
+			segs = append(segs, codeLines(text, begin, line.start, title, opts)...)
+			begin = line.start
+		}
+		prevBlank = blank
+	}
+	if begin < end {
+		segs = append(segs, codeLines(text, begin, end, title, opts)...)
+	}
+	return segs
+}
+
+// codeLines keeps a block whole if it is small, otherwise every line becomes a segment.
+func codeLines(text string, start, end int, title string, opts Options) []segment {
+	if opts.Tokenizer(text[start:end]) <= opts.MaxTokens {
+		return []segment{{start: start, end: end, title: title}}
+	}
+	lines := lineRanges(text, start, end)
+	for i := range lines {
+		lines[i].title = title
+	}
+	return lines
+}
+
+// EstimateTokens approximates the number of tokens a BPE tokenizer would produce.
+// Words are counted as one token per four characters and punctuation as one token each.
+// This over counts slightly which is the safe direction for a budget.
+func EstimateTokens(s string) int {
+	tokens := 0
+	wordLen := 0
+	endWord := func() {
+		if wordLen > 0 {
+			tokens += (wordLen + 3) / 4
+			wordLen = 0
+		}
+	}
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			// most tokenizers split non latin scripts into a token or more per rune
+			if r > unicode.MaxLatin1 {
+				endWord()
+				tokens++
+				continue
+			}
+			wordLen++
+		case unicode.IsSpace(r):
+			endWord()
+		default:
+			endWord()
+			tokens++
+		}
+	}
+	endWord()
+	return tokens
+}
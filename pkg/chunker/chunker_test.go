@@ -0,0 +1,145 @@
+package chunker
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitRespectsBudget(t *testing.T) {
+	text := strings.Repeat("Small models can punch above their size. ", 200)
+
+	for _, strategy := range []Strategy{Sentence, Paragraph, Markdown, Code} {
+		t.Run(string(strategy), func(t *testing.T) {
+			chunks := Split(text, Options{Strategy: strategy, MaxTokens: 50, Overlap: 10, Source: "https://example.com"})
+			if len(chunks) < 2 {
+				t.Fatalf("expected several chunks, got %d", len(chunks))
+			}
+			for i, chunk := range chunks {
+				if chunk.Tokens > 50 {
+					t.Errorf("chunk %d has %d tokens, budget is 50", i, chunk.Tokens)
+				}
+				if chunk.Source != "https://example.com" {
+					t.Errorf("chunk %d lost its source: %q", i, chunk.Source)
+				}
+				if chunk.Index != i {
+					t.Errorf("chunk %d has index %d", i, chunk.Index)
+				}
+				if text[chunk.Offset:chunk.Offset+len(chunk.Text)] != chunk.Text {
+					t.Errorf("chunk %d offset %d does not point at its text", i, chunk.Offset)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitOverlap(t *testing.T) {
+	text := "One fish. Two fish. Red fish. Blue fish. Old fish. New fish. Sad fish. Glad fish."
+
+	chunks := Split(text, Options{Strategy: Sentence, MaxTokens: 10, Overlap: 4})
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	for i := 1; i < len(chunks); i++ {
+		prev, cur := chunks[i-1], chunks[i]
+		if cur.Offset >= prev.Offset+len(prev.Text) {
+			t.Errorf("chunk %d does not overlap chunk %d", i, i-1)
+		}
+	}
+}
+
+func TestSplitKeepsRunesWhole(t *testing.T) {
+	// no spaces or punctuation to cut on so the chunker has to cut between runes
+	text := strings.Repeat("日本語のテキスト", 100)
+
+	chunks := Split(text, Options{Strategy: Paragraph, MaxTokens: 16, Overlap: 0})
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	var joined strings.Builder
+	for i, chunk := range chunks {
+		if !utf8.ValidString(chunk.Text) {
+			t.Fatalf("chunk %d is not valid utf8", i)
+		}
+		joined.WriteString(chunk.Text)
+	}
+	if joined.String() != text {
+		t.Errorf("chunks without overlap should rebuild the original text")
+	}
+}
+
+func TestSplitMarkdownTitles(t *testing.T) {
+	text := `# Valgrind
+
+Valgrind finds memory leaks.
+
+## Usage
+
+Run it with the leak checker.
+
+` + "```sh\nvalgrind --leak-check=full ./a.out\n\n# not a heading\n```\n"
+
+	chunks := Split(text, Options{Strategy: Markdown, MaxTokens: 200, Title: "Docs"})
+	if len(chunks) != 2 {
+		t.Fatalf("expected one chunk per section, got %d: %+v", len(chunks), chunks)
+	}
+	if chunks[0].Title != "Valgrind" {
+		t.Errorf("unexpected title %q", chunks[0].Title)
+	}
+	if chunks[1].Title != "Valgrind > Usage" {
+		t.Errorf("unexpected title %q", chunks[1].Title)
+	}
+	if !strings.Contains(chunks[1].Text, "# not a heading") {
+		t.Errorf("fenced code should stay with its section: %q", chunks[1].Text)
+	}
+}
+
+func TestSplitCodeBlocks(t *testing.T) {
+	text := `package main
+
+func a() {
+	println("a")
+
+	println("still a")
+}
+
+func b() {
+	println("b")
+}
+`
+	chunks := Split(text, Options{Strategy: Code, MaxTokens: 25, Overlap: 0})
+	if len(chunks) < 2 {
+		t.Fatalf("expected the functions to be split apart, got %d chunks", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if strings.Contains(chunk.Text, "func a") && !strings.Contains(chunk.Text, "still a") {
+			t.Errorf("function a was split in the middle: %q", chunk.Text)
+		}
+	}
+}
+
+func TestSplitCodeUsesOptions(t *testing.T) {
+	// one block of four lines, the tokenizer counts lines so the block is over the budget of two
+	text := "func a() {\n\tprintln(\"one\")\n\tprintln(\"two\")\n}\n"
+	lines := func(s string) int {
+		return strings.Count(s, "\n") + 1
+	}
+
+	for _, strategy := range []Strategy{Code, Markdown} {
+		input := text
+		if strategy == Markdown {
+			input = "```go\n" + text + "```\n"
+		}
+		chunks := Split(input, Options{Strategy: strategy, MaxTokens: 2, Overlap: 0, Tokenizer: lines})
+		if len(chunks) < 2 {
+			t.Fatalf("%s: expected the block to be split by line, got %d chunks", strategy, len(chunks))
+		}
+		for _, chunk := range chunks {
+			before := input[strings.LastIndex(input[:chunk.Offset], "\n")+1 : chunk.Offset]
+			after, _, _ := strings.Cut(input[chunk.Offset+len(chunk.Text):], "\n")
+			if strings.TrimSpace(before+after) != "" {
+				t.Errorf("%s: expected chunks to be whole lines, got %q", strategy, chunk.Text)
+			}
+		}
+	}
+}
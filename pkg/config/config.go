@@ -0,0 +1,459 @@
+/*
+Package config loads the settings that change from one machine to the next.
+
+Settings start with the defaults in the defs file and are then overridden, in order, by
+a yaml config file, SLAPE_ environment variables and command line flags.
+Every setting has a key like model.context_length that is used for all three,
+the environment variable is the key in upper case with dots as underscores, SLAPE_MODEL_CONTEXT_LENGTH.
+*/
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultFile is loaded when it exists and no other file is given.
+	DefaultFile = "slape.yaml"
+	// FileEnv names a config file, the -config flag takes precedence over it.
+	FileEnv = "SLAPE_CONFIG"
+
+	envPrefix = "SLAPE_"
+)
+
+// Where a setting came from.
+const (
+	FromDefault = "default"
+	FromFile    = "file"
+	FromEnv     = "env"
+	FromFlag    = "flag"
+)
+
+type (
+	// Config holds the runtime settings passed to pipelines.
+	Config struct {
+		// Frontend starts the web ui with the server.
+		Frontend bool `yaml:"frontend" json:"frontend"`
+		// GenerationTimeout is how long a generate request can take (mins).
+		GenerationTimeout int `yaml:"generation_timeout" json:"generation_timeout"`
+		// Prompts is the folder of prompt templates loaded on startup.
+		Prompts   string    `yaml:"prompts" json:"prompts"`
+		Model     Model     `yaml:"model" json:"model"`
+		Images    Images    `yaml:"images" json:"images"`
+		Endpoints Endpoints `yaml:"endpoints" json:"endpoints"`
+		Log       Log       `yaml:"log" json:"log"`
+		Tracing   Tracing   `yaml:"tracing" json:"tracing"`
+		Models    Models    `yaml:"models" json:"models"`
+
+		// file is the config file that was loaded, if any
+		file string
+		// sources records where every setting came from
+		sources map[string]string
+	}
+
+	// Model settings are passed to llama.cpp and the completion requests.
+	Model struct {
+		ContextLength      int     `yaml:"context_length" json:"context_length"`
+		MaxGenTokens       int     `yaml:"max_gen_tokens" json:"max_gen_tokens"`
+		MaxGenTokensSimple int     `yaml:"max_gen_tokens_simple" json:"max_gen_tokens_simple"`
+		Temperature        float64 `yaml:"temperature" json:"temperature"`
+		// A layer count above what the model has loads the entire model on the gpu.
+		Layers int `yaml:"layers" json:"layers"`
+	}
+
+	// Images are the llama.cpp server images for each kind of hardware.
+	Images struct {
+		CPU  string `yaml:"cpu" json:"cpu"`
+		CUDA string `yaml:"cuda" json:"cuda"`
+		ROCm string `yaml:"rocm" json:"rocm"`
+	}
+
+	// Endpoints are the base urls of the openai compatible servers. The containers are published on their ports,
+	// so the host can be another machine running docker, and the models of a pipeline after the first one are
+	// on the ports after the model endpoint.
+	Endpoints struct {
+		Model     string `yaml:"model" json:"model"`
+		Embedding string `yaml:"embedding" json:"embedding"`
+	}
+
+	// Log settings are used to set up logging on startup.
+	Log struct {
+		// Level is debug, info, warn or error.
+		Level string `yaml:"level" json:"level"`
+		// Format is text or json.
+		Format string `yaml:"format" json:"format"`
+		// File is rotated once it reaches MaxSize (MB), MaxBackups rotated files are kept.
+		File       string `yaml:"file" json:"file"`
+		MaxSize    int    `yaml:"max_size" json:"max_size"`
+		MaxBackups int    `yaml:"max_backups" json:"max_backups"`
+	}
+
+	// Tracing settings pick where spans are sent.
+	Tracing struct {
+		// Exporter is none, otlp or file.
+		Exporter string `yaml:"exporter" json:"exporter"`
+		// Endpoint is the host:port of an otlp http collector.
+		Endpoint string `yaml:"endpoint" json:"endpoint"`
+		// File gets a span per line as json with the file exporter.
+		File string `yaml:"file" json:"file"`
+		// SampleRatio is the share of requests traced, from 0 to 1.
+		SampleRatio float64 `yaml:"sample_ratio" json:"sample_ratio"`
+	}
+
+	// Models settings are used by the model manager.
+	Models struct {
+		// Offline only uses the models already in the models folder, nothing is downloaded.
+		Offline bool `yaml:"offline" json:"offline"`
+		// HuggingFace is the url repos are pulled from.
+		HuggingFace string `yaml:"huggingface" json:"huggingface"`
+	}
+
+	// Response is returned by GET /config.
+	Response struct {
+		Config  *Config           `json:"config"`
+		File    string            `json:"file,omitempty"`
+		Sources map[string]string `json:"sources"`
+	}
+)
+
+// Default returns the settings from the defs file.
+func Default() *Config {
+	return &Config{
+		Frontend:          vars.Frontend,
+		GenerationTimeout: vars.GenerationTimeout,
+		Prompts:           vars.PromptDir,
+		Model: Model{
+			ContextLength:      vars.ContextLength,
+			MaxGenTokens:       vars.MaxGenTokens,
+			MaxGenTokensSimple: vars.MaxGenTokensSimple,
+			Temperature:        vars.ModelTemperature,
+			Layers:             vars.ModelLayers,
+		},
+		Images: Images{
+			CPU:  vars.CpuImage,
+			CUDA: vars.CudagpuImage,
+			ROCm: vars.RocmgpuImage,
+		},
+		Endpoints: Endpoints{
+			Model:     vars.ModelEndpoint,
+			Embedding: vars.EmbeddingEndpoint,
+		},
+		Log: Log{
+			Level:      vars.LogLevel,
+			Format:     vars.LogFormat,
+			File:       filepath.Join(vars.LogDir, vars.Logfilename),
+			MaxSize:    vars.LogMaxSize,
+			MaxBackups: vars.LogMaxBackups,
+		},
+		Tracing: Tracing{
+			Exporter:    vars.TracingExporter,
+			Endpoint:    vars.TracingEndpoint,
+			File:        vars.TracingFile,
+			SampleRatio: vars.TracingSampleRatio,
+		},
+		Models: Models{
+			Offline:     vars.ModelsOffline,
+			HuggingFace: vars.HuggingFaceURL,
+		},
+	}
+}
+
+// flags binds every setting to a flag named by its key.
+func (c *Config) flags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.Frontend, "frontend", c.Frontend, "start the frontend with the server")
+	fs.IntVar(&c.GenerationTimeout, "generation_timeout", c.GenerationTimeout, "most minutes a generate request can take")
+	fs.StringVar(&c.Prompts, "prompts", c.Prompts, "folder of prompt templates")
+	fs.IntVar(&c.Model.ContextLength, "model.context_length", c.Model.ContextLength, "context length given to llama.cpp")
+	fs.IntVar(&c.Model.MaxGenTokens, "model.max_gen_tokens", c.Model.MaxGenTokens, "most tokens generated by the bigger prompts")
+	fs.IntVar(&c.Model.MaxGenTokensSimple, "model.max_gen_tokens_simple", c.Model.MaxGenTokensSimple, "most tokens generated by the simple prompt")
+	fs.Float64Var(&c.Model.Temperature, "model.temperature", c.Model.Temperature, "sampling temperature")
+	fs.IntVar(&c.Model.Layers, "model.layers", c.Model.Layers, "layers offloaded to the gpu")
+	fs.StringVar(&c.Images.CPU, "images.cpu", c.Images.CPU, "llama.cpp image used without a gpu")
+	fs.StringVar(&c.Images.CUDA, "images.cuda", c.Images.CUDA, "llama.cpp image used with nvidia gpus")
+	fs.StringVar(&c.Images.ROCm, "images.rocm", c.Images.ROCm, "llama.cpp image used with amd gpus")
+	fs.StringVar(&c.Endpoints.Model, "endpoints.model", c.Endpoints.Model, "base url of the pipeline model")
+	fs.StringVar(&c.Endpoints.Embedding, "endpoints.embedding", c.Endpoints.Embedding, "base url of the embedding model")
+	fs.StringVar(&c.Log.Level, "log.level", c.Log.Level, "debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log.format", c.Log.Format, "text or json")
+	fs.StringVar(&c.Log.File, "log.file", c.Log.File, "file the logs are written to")
+	fs.IntVar(&c.Log.MaxSize, "log.max_size", c.Log.MaxSize, "megabytes the log file can reach before it's rotated")
+	fs.IntVar(&c.Log.MaxBackups, "log.max_backups", c.Log.MaxBackups, "rotated log files that are kept")
+	fs.StringVar(&c.Tracing.Exporter, "tracing.exporter", c.Tracing.Exporter, "none, otlp or file")
+	fs.StringVar(&c.Tracing.Endpoint, "tracing.endpoint", c.Tracing.Endpoint, "host:port of the otlp http collector")
+	fs.StringVar(&c.Tracing.File, "tracing.file", c.Tracing.File, "file the spans are written to by the file exporter")
+	fs.Float64Var(&c.Tracing.SampleRatio, "tracing.sample_ratio", c.Tracing.SampleRatio, "share of requests traced, from 0 to 1")
+	fs.BoolVar(&c.Models.Offline, "models.offline", c.Models.Offline, "only use the models already in the models folder")
+	fs.StringVar(&c.Models.HuggingFace, "models.huggingface", c.Models.HuggingFace, "url models are pulled from, for a hugging face mirror")
+}
+
+// Load builds the config from the defaults, the config file, the environment and args, in that order.
+// args are the command line arguments without the program name.
+func Load(args []string) (*Config, error) {
+	c := Default()
+	c.sources = map[string]string{}
+
+	// the file has to be read before the flags are parsed so the flags win,
+	// the only flag needed now is where the file is
+	path := os.Getenv(FileEnv)
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			value = args[i+1]
+		}
+		path = value
+	}
+	if path == "" {
+		if _, err := os.Stat(DefaultFile); err == nil {
+			path = DefaultFile
+		}
+	}
+	if path != "" {
+		keys, err := c.readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		c.file = path
+		for _, key := range keys {
+			c.sources[key] = FromFile
+		}
+	}
+
+	// environment variables are set through a flag set of their own so they
+	// aren't counted as flags below
+	env := flag.NewFlagSet("env", flag.ContinueOnError)
+	c.flags(env)
+	var errs []error
+	env.VisitAll(func(f *flag.Flag) {
+		name := EnvName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := env.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			c.sources[f.Name] = FromEnv
+		}
+	})
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	fs := flag.NewFlagSet("slape", flag.ContinueOnError)
+	fs.String("config", path, "yaml config file, "+DefaultFile+" is used if it exists")
+	c.flags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if _, ok := c.sources[f.Name]; !ok {
+			c.sources[f.Name] = FromDefault
+		}
+	})
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			c.sources[f.Name] = FromFlag
+		}
+	})
+
+	return c, c.Validate()
+}
+
+// readFile applies a yaml file on top of c and returns the keys it set.
+func (c *Config) readFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	// an empty file is fine, the decoder returns io.EOF for it
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var raw map[string]any
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return flatten("", raw), nil
+}
+
+// flatten turns nested yaml maps into dotted keys.
+func flatten(prefix string, raw map[string]any) []string {
+	var keys []string
+	for key, value := range raw {
+		if nested, ok := value.(map[string]any); ok {
+			keys = append(keys, flatten(prefix+key+".", nested)...)
+			continue
+		}
+		keys = append(keys, prefix+key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// EnvName returns the environment variable of a setting key.
+func EnvName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Validate checks that the settings make sense together.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.GenerationTimeout <= 0 {
+		errs = append(errs, errors.New("generation_timeout has to be positive"))
+	}
+	if c.Model.ContextLength <= 0 {
+		errs = append(errs, errors.New("model.context_length has to be positive"))
+	}
+	if c.Model.MaxGenTokens <= 0 || c.Model.MaxGenTokensSimple <= 0 {
+		errs = append(errs, errors.New("model.max_gen_tokens and model.max_gen_tokens_simple have to be positive"))
+	}
+	if c.Model.Temperature < 0 || c.Model.Temperature > 2 {
+		errs = append(errs, errors.New("model.temperature has to be between 0 and 2"))
+	}
+	if c.Model.Layers < 0 {
+		errs = append(errs, errors.New("model.layers can't be negative"))
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level has to be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format has to be text or json, got %q", c.Log.Format))
+	}
+	if c.Log.MaxSize <= 0 || c.Log.MaxBackups < 0 {
+		errs = append(errs, errors.New("log.max_size has to be positive and log.max_backups can't be negative"))
+	}
+	switch c.Tracing.Exporter {
+	case "none", "otlp", "file":
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter has to be none, otlp or file, got %q", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, errors.New("tracing.sample_ratio has to be between 0 and 1"))
+	}
+	for key, url := range map[string]string{
+		"endpoints.model":     c.Endpoints.Model,
+		"endpoints.embedding": c.Endpoints.Embedding,
+		"models.huggingface":  c.Models.HuggingFace,
+	} {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			errs = append(errs, fmt.Errorf("%s has to be an http url, got %q", key, url))
+		}
+	}
+	model, embedding := endpointPort(c.Endpoints.Model), endpointPort(c.Endpoints.Embedding)
+	if model == 0 || embedding == 0 {
+		errs = append(errs, errors.New("endpoints.model and endpoints.embedding need a port, the containers are published on it"))
+	} else if embedding >= model && embedding < model+vars.PipelineMaxStages {
+		errs = append(errs, fmt.Errorf("endpoints.embedding can't be on the %d ports from endpoints.model, they are used by the pipeline models", vars.PipelineMaxStages))
+	}
+	return errors.Join(errs...)
+}
+
+// MaxGenTokensCoT is the limit for chain of thought, a quarter of MaxGenTokens.
+func (c *Config) MaxGenTokensCoT() int {
+	return c.Model.MaxGenTokens / 4
+}
+
+// ModelClient is the client for the pipeline model, the first model of a pipeline.
+func (c *Config) ModelClient() openai.Client {
+	return NewClient(c.ModelURL(0))
+}
+
+// ModelURL is the base url of the i-th model of a pipeline.
+func (c *Config) ModelURL(i int) string {
+	u, err := url.Parse(c.Endpoints.Model)
+	if err != nil {
+		return c.Endpoints.Model
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), c.ModelPort(i))
+	return u.String()
+}
+
+// ModelPort is the port the container of the i-th model of a pipeline is published on.
+func (c *Config) ModelPort(i int) string {
+	return strconv.Itoa(endpointPort(c.Endpoints.Model) + i)
+}
+
+// EmbeddingPort is the port the embedding container is published on.
+func (c *Config) EmbeddingPort() string {
+	return strconv.Itoa(endpointPort(c.Endpoints.Embedding))
+}
+
+// EmbeddingClient is the client for the embedding model.
+func (c *Config) EmbeddingClient() openai.Client {
+	return NewClient(c.Endpoints.Embedding)
+}
+
+// endpointPort is the port of an endpoint, 0 if it doesn't have one.
+func endpointPort(endpoint string) int {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return port
+}
+
+// NewClient returns an openai client for the server at baseURL,
+// every request it makes is traced as a child of the span in its context.
+func NewClient(baseURL string) openai.Client {
+	return openai.NewClient(
+		option.WithBaseURL(baseURL),
+		option.WithHTTPClient(&http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}),
+	)
+}
+
+// Sources returns where each setting came from, one of FromDefault, FromFile, FromEnv or FromFlag.
+func (c *Config) Sources() map[string]string {
+	sources := make(map[string]string, len(c.sources))
+	for key, source := range c.sources {
+		sources[key] = source
+	}
+	return sources
+}
+
+// ConfigRequest, handlerfunc expects GET method and returns the effective settings and where they came from.
+func (c *Config) ConfigRequest(w http.ResponseWriter, req *http.Request) {
+	json, err := json.Marshal(Response{Config: c, File: c.file, Sources: c.Sources()})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error marshaling config", "err", err)
+		http.Error(w, "Error marshaling config", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
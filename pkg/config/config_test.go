@@ -0,0 +1,137 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "slape.yaml")
+	err := os.WriteFile(path, []byte(`
+frontend: false
+model:
+  context_length: 4096
+  temperature: 0.5
+  layers: 20
+endpoints:
+  model: http://gpu-box:8000/v1
+`), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(FileEnv, path)
+	t.Setenv("SLAPE_MODEL_TEMPERATURE", "0.7")
+	t.Setenv("SLAPE_MODEL_LAYERS", "30")
+
+	c, err := Load([]string{"-model.layers", "40"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		key    string
+		got    any
+		want   any
+		source string
+	}{
+		{"model.context_length", c.Model.ContextLength, 4096, FromFile},
+		{"model.temperature", c.Model.Temperature, 0.7, FromEnv},
+		{"model.layers", c.Model.Layers, 40, FromFlag},
+		{"endpoints.model", c.Endpoints.Model, "http://gpu-box:8000/v1", FromFile},
+		{"frontend", c.Frontend, false, FromFile},
+		{"model.max_gen_tokens", c.Model.MaxGenTokens, vars.MaxGenTokens, FromDefault},
+	}
+	sources := c.Sources()
+	for _, check := range checks {
+		if check.got != check.want {
+			t.Errorf("%s: expected %v, got %v", check.key, check.want, check.got)
+		}
+		if sources[check.key] != check.source {
+			t.Errorf("%s: expected it to come from %s, got %s", check.key, check.source, sources[check.key])
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	if _, err := Load([]string{"-model.temperature", "5"}); err == nil {
+		t.Errorf("expected a temperature out of range to fail")
+	}
+	if _, err := Load([]string{"-endpoints.model", "localhost:8000"}); err == nil {
+		t.Errorf("expected an endpoint without a scheme to fail")
+	}
+	if _, err := Load([]string{"-endpoints.model", "http://gpu-box/v1"}); err == nil {
+		t.Errorf("expected an endpoint without a port to fail")
+	}
+	if _, err := Load([]string{"-endpoints.embedding", "http://localhost:8003/v1"}); err == nil {
+		t.Errorf("expected the embedding model on a pipeline port to fail")
+	}
+	if _, err := Load([]string{"-log.level", "loud"}); err == nil {
+		t.Errorf("expected an unknown log level to fail")
+	}
+	if _, err := Load([]string{"-tracing.exporter", "jaeger"}); err == nil {
+		t.Errorf("expected an unknown exporter to fail")
+	}
+	if _, err := Load([]string{"-log.format", "xml"}); err == nil {
+		t.Errorf("expected an unknown log format to fail")
+	}
+
+	os.WriteFile("slape.yaml", []byte("model:\n  contxt_length: 10\n"), 0640)
+	if _, err := Load(nil); err == nil {
+		t.Errorf("expected an unknown key in the default file to fail")
+	}
+	os.Remove("slape.yaml")
+
+	t.Setenv("SLAPE_MODEL_LAYERS", "lots")
+	if _, err := Load(nil); err == nil {
+		t.Errorf("expected a bad environment variable to fail")
+	}
+}
+
+func TestConfigRequest(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	c, err := Load([]string{"--frontend=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c.ConfigRequest(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+
+	var resp struct {
+		Config  Config            `json:"config"`
+		Sources map[string]string `json:"sources"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Config.Frontend || resp.Sources["frontend"] != FromFlag {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if resp.Config.Model.ContextLength != vars.ContextLength {
+		t.Errorf("expected the default context length, got %d", resp.Config.Model.ContextLength)
+	}
+}
+
+func TestModelURL(t *testing.T) {
+	c := Default()
+	c.Endpoints.Model = "http://gpu-box:9000/v1"
+	c.Endpoints.Embedding = "http://gpu-box:9100/v1"
+
+	if got := c.ModelURL(2); got != "http://gpu-box:9002/v1" {
+		t.Errorf("expected the third model on the port after the second, got %s", got)
+	}
+	if c.ModelPort(0) != "9000" || c.EmbeddingPort() != "9100" {
+		t.Errorf("expected the containers on the endpoint ports, got %s and %s", c.ModelPort(0), c.EmbeddingPort())
+	}
+}
@@ -0,0 +1,338 @@
+/*
+Package containers follows the output of the llama.cpp containers that serve the models.
+
+Every model container a pipeline starts is attached to through the docker api and its last
+lines are kept, even after the container is removed, so a model that failed to load can still
+be looked into. The lines are read for the messages llama.cpp prints when it can't load a model,
+like running out of memory or an architecture it doesn't know, and turned into clear errors
+so a pipeline stops waiting on a server that is never coming up.
+*/
+package containers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+type (
+	// Line is a line of output of a container.
+	Line struct {
+		Time time.Time `json:"time"`
+		// Stream is stdout or stderr.
+		Stream string `json:"stream"`
+		Text   string `json:"text"`
+	}
+
+	// Container is a model container and its last lines of output.
+	Container struct {
+		ID       string
+		Pipeline string
+		Model    string
+		Added    time.Time
+
+		mu    sync.Mutex
+		lines []Line
+		// first is the index of the oldest line once lines is full.
+		first   int
+		failure *Failure
+		// cause is the last line that could say why loading failed, it's used if a fatal line comes
+		// within ContainerCauseLines of it.
+		cause      *Failure
+		sinceCause int
+		// following is set while the output is being read, again is set when the container
+		// was started while the last stream was still ending.
+		following bool
+		again     bool
+	}
+
+	// Info describes a container for GET /containers.
+	Info struct {
+		ID       string    `json:"id"`
+		Pipeline string    `json:"pipeline"`
+		Model    string    `json:"model"`
+		Added    time.Time `json:"added"`
+		Lines    int       `json:"lines"`
+		Error    string    `json:"error,omitempty"`
+	}
+
+	// Registry keeps the containers started by the pipelines.
+	Registry struct {
+		// DockerClient is used for stats and for containers slape didn't start.
+		DockerClient *client.Client
+
+		mu         sync.Mutex
+		containers map[string]*Container
+	}
+
+	// lineWriter splits the output of a container into lines.
+	lineWriter struct {
+		container *Container
+		stream    string
+		buf       []byte
+	}
+)
+
+// Default is the registry the pipelines add their containers to.
+var Default = New()
+
+// New returns an empty registry.
+func New() *Registry {
+	return &Registry{containers: make(map[string]*Container)}
+}
+
+// Add starts keeping the output of a container, Follow has to be called each time it's started.
+// The oldest containers are forgotten once there are too many.
+func (r *Registry) Add(id string, pipeline string, model string) *Container {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.containers[id]; ok {
+		return c
+	}
+	if len(r.containers) >= vars.ContainersKept {
+		var oldest *Container
+		for _, c := range r.containers {
+			if oldest == nil || c.Added.Before(oldest.Added) {
+				oldest = c
+			}
+		}
+		delete(r.containers, oldest.ID)
+	}
+
+	c := &Container{ID: id, Pipeline: pipeline, Model: model, Added: time.Now()}
+	r.containers[id] = c
+	return c
+}
+
+// Get returns a container by its id, or nil.
+func (r *Registry) Get(id string) *Container {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.containers[id]
+}
+
+// List describes every container, newest first.
+func (r *Registry) List() []Info {
+	r.mu.Lock()
+	list := make([]Info, 0, len(r.containers))
+	for _, c := range r.containers {
+		list = append(list, c.info())
+	}
+	r.mu.Unlock()
+
+	slices.SortFunc(list, func(a, b Info) int {
+		return b.Added.Compare(a.Added)
+	})
+	return list
+}
+
+// ForPipeline returns the containers of pipeline in the order they were added.
+func (r *Registry) ForPipeline(pipeline string) []*Container {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var list []*Container
+	for _, c := range r.containers {
+		if c.Pipeline == pipeline {
+			list = append(list, c)
+		}
+	}
+	slices.SortFunc(list, func(a, b *Container) int {
+		return a.Added.Compare(b.Added)
+	})
+	return list
+}
+
+// Follow reads the output of a container that was just started until it stops.
+// Lines already kept aren't read again, so it's called every time a container is started.
+func (r *Registry) Follow(apiClient *client.Client, id string) {
+	c := r.Get(id)
+	if c == nil || apiClient == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.following {
+		// the stream of the last start is still ending, it attaches again once it has
+		c.again = true
+		return
+	}
+	c.following = true
+	go c.follow(apiClient)
+}
+
+func (c *Container) follow(apiClient *client.Client) {
+	for {
+		err := c.read(apiClient)
+		if err != nil {
+			slog.Warn("Error Reading Container Output", "container", c.ID, "err", err)
+		}
+
+		c.mu.Lock()
+		if !c.again {
+			c.following = false
+			c.mu.Unlock()
+			return
+		}
+		c.again = false
+		c.mu.Unlock()
+	}
+}
+
+// read copies the output since the last line kept until the container stops.
+func (c *Container) read(apiClient *client.Client) error {
+	since := c.Added
+	if last, ok := c.last(); ok {
+		since = last.Time
+	}
+
+	logs, err := apiClient.ContainerLogs(context.Background(), c.ID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Timestamps: true,
+		Since:      fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()),
+	})
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	stdout := &lineWriter{container: c, stream: "stdout"}
+	stderr := &lineWriter{container: c, stream: "stderr"}
+	_, err = stdcopy.StdCopy(stdout, stderr, logs)
+	stdout.flush()
+	stderr.flush()
+	return err
+}
+
+// Write adds every full line in p, what's left is kept for the next write.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.container.addOutput(w.stream, string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+}
+
+func (w *lineWriter) flush() {
+	if len(w.buf) != 0 {
+		w.container.addOutput(w.stream, string(w.buf))
+		w.buf = nil
+	}
+}
+
+// addOutput adds a line of output with the timestamp docker puts in front of it.
+func (c *Container) addOutput(stream string, text string) {
+	line := Line{Time: time.Now(), Stream: stream, Text: strings.TrimRight(text, "\r")}
+	if stamp, rest, ok := strings.Cut(line.Text, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+			line.Time = t
+			line.Text = rest
+		}
+	}
+
+	// asking for the lines since the last one kept returns it again
+	if last, ok := c.last(); ok && !line.Time.After(last.Time) {
+		return
+	}
+	c.Add(line)
+}
+
+// Add keeps a line, dropping the oldest once there are too many, and checks if llama.cpp gave up loading the model.
+func (c *Container) Add(line Line) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.lines) < vars.ContainerLogLines {
+		c.lines = append(c.lines, line)
+	} else {
+		c.lines[c.first] = line
+		c.first = (c.first + 1) % len(c.lines)
+	}
+
+	if c.failure != nil {
+		return
+	}
+	text := strings.TrimSpace(line.Text)
+	c.sinceCause++
+	if err := Cause(text); err != nil {
+		c.cause = &Failure{Container: c.ID, Model: c.Model, Err: err, Line: text}
+		c.sinceCause = 0
+	}
+	if c.sinceCause > vars.ContainerCauseLines {
+		c.cause = nil
+	}
+	if !Fatal(text) {
+		return
+	}
+
+	// the fatal line usually only says loading failed, the reason comes in the lines before it
+	c.failure = c.cause
+	if c.failure == nil {
+		c.failure = &Failure{Container: c.ID, Model: c.Model, Err: ErrLoadFailed, Line: text}
+	}
+	slog.Error("Model Failed To Load", "container", c.ID, "model", c.Model, "err", c.failure.Err, "line", c.failure.Line)
+}
+
+// Lines returns the kept lines since a time, oldest first, the last n of them if n isn't 0.
+func (c *Container) Lines(since time.Time, n int) []Line {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lines := make([]Line, 0, len(c.lines))
+	for i := range c.lines {
+		line := c.lines[(c.first+i)%len(c.lines)]
+		if !line.Time.Before(since) {
+			lines = append(lines, line)
+		}
+	}
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// Failure returns the failure found in the output of the container, or nil.
+func (c *Container) Failure() *Failure {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failure
+}
+
+func (c *Container) last() (Line, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.lines) == 0 {
+		return Line{}, false
+	}
+	return c.lines[(c.first+len(c.lines)-1)%len(c.lines)], true
+}
+
+func (c *Container) info() Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := Info{ID: c.ID, Pipeline: c.Pipeline, Model: c.Model, Added: c.Added, Lines: len(c.lines)}
+	if c.failure != nil {
+		info.Error = c.failure.Error()
+	}
+	return info
+}
@@ -0,0 +1,183 @@
+package containers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestCause(t *testing.T) {
+	cases := []struct {
+		line  string
+		want  error
+		fatal bool
+	}{
+		{"ggml_backend_cuda_buffer_type_alloc_buffer: allocating 7338.00 MiB on device 0: cudaMalloc failed: out of memory", ErrOutOfMemory, false},
+		{"llama_model_load: error loading model: error loading model architecture: unknown model architecture: 'qwen9'", ErrUnsupportedArchitecture, true},
+		{"gguf_init_from_file_impl: invalid magic characters: 'html', expected 'GGUF'", ErrBadModel, false},
+		{"CUDA error: no kernel image is available for execution on the device", ErrUnsupportedGPU, true},
+		{"gguf_init_from_file: failed to open GGUF file '/models/missing.gguf' (No such file or directory)", ErrModelNotFound, false},
+		{"common_init_from_params: failed to load model '/models/qwen.gguf'", nil, true},
+		{"main: exiting due to model loading error", nil, true},
+		{"main: server is listening on http://0.0.0.0:8000 - starting the main loop", nil, false},
+		{"srv  update_slots: all slots are idle", nil, false},
+	}
+	for _, c := range cases {
+		if got := Cause(c.line); got != c.want {
+			t.Errorf("%q: expected %v, got %v", c.line, c.want, got)
+		}
+		if got := Fatal(c.line); got != c.fatal {
+			t.Errorf("%q: expected fatal to be %v", c.line, c.fatal)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	registry := New()
+	c := registry.Add("abc", "simple", "qwen.gguf")
+	// llama.cpp keeps going after these
+	for _, text := range []string{
+		"warning: failed to mlock 1048576-byte buffer (after previously locking 0 bytes): Cannot allocate memory",
+		"load_backend: failed to find ggml_backend_init in /app/libggml-vulkan.so: No such file or directory",
+		"main: server is listening on http://0.0.0.0:8000 - starting the main loop",
+	} {
+		c.Add(Line{Time: time.Now(), Stream: "stderr", Text: text})
+	}
+	if err := registry.Check(context.Background(), nil, "abc"); err != nil {
+		t.Errorf("expected warnings not to fail the container, got %v", err)
+	}
+
+	// a failure long after a warning isn't blamed on it
+	for range vars.ContainerCauseLines {
+		c.Add(Line{Time: time.Now(), Stream: "stderr", Text: "srv  update_slots: all slots are idle"})
+	}
+	c.Add(Line{Time: time.Now(), Stream: "stderr", Text: "llama_model_load_from_file_impl: failed to load model"})
+	if err := registry.Check(context.Background(), nil, "abc"); !errors.Is(err, ErrLoadFailed) {
+		t.Errorf("expected the load to fail without a reason, got %v", err)
+	}
+}
+
+func TestContainer(t *testing.T) {
+	registry := New()
+	c := registry.Add("abc", "cot", "qwen.gguf")
+	if registry.Add("abc", "cot", "qwen.gguf") != c {
+		t.Fatal("expected adding a container twice to return the same one")
+	}
+
+	started := time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC)
+	w := &lineWriter{container: c, stream: "stderr"}
+	for i := range vars.ContainerLogLines + 5 {
+		fmt.Fprintf(w, "%s line %d\n", started.Add(time.Duration(i)*time.Microsecond).Format(time.RFC3339Nano), i)
+	}
+	// docker sends the last line kept again when following from it
+	fmt.Fprintf(w, "%s line %d\n", started.Add(time.Duration(vars.ContainerLogLines+4)*time.Microsecond).Format(time.RFC3339Nano), vars.ContainerLogLines+4)
+	fmt.Fprintf(w, "%s cudaMalloc failed: out of memory\n%s failed to load model", started.Add(time.Second).Format(time.RFC3339Nano), started.Add(2*time.Second).Format(time.RFC3339Nano))
+	w.flush()
+
+	lines := c.Lines(time.Time{}, 0)
+	if len(lines) != vars.ContainerLogLines {
+		t.Fatalf("expected %d lines, got %d", vars.ContainerLogLines, len(lines))
+	}
+	if lines[0].Text != "line 7" || lines[len(lines)-1].Text != "failed to load model" || lines[0].Stream != "stderr" {
+		t.Errorf("expected the oldest lines to be dropped, got %+v and %+v", lines[0], lines[len(lines)-1])
+	}
+	if tail := c.Lines(started.Add(time.Second), 0); len(tail) != 2 {
+		t.Errorf("expected the lines since a time, got %d", len(tail))
+	}
+	if tail := c.Lines(time.Time{}, 3); len(tail) != 3 || tail[2].Text != "failed to load model" {
+		t.Errorf("expected the last 3 lines, got %+v", tail)
+	}
+
+	err := registry.Check(context.Background(), nil, "abc")
+	if !errors.Is(err, ErrOutOfMemory) || !strings.Contains(err.Error(), "qwen.gguf") {
+		t.Errorf("expected the model to have run out of memory, got %v", err)
+	}
+	if err := registry.Check(context.Background(), nil, "unknown"); err != nil {
+		t.Errorf("expected a container that can't be looked at to keep waiting, got %v", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := New()
+	for i := range vars.ContainersKept + 1 {
+		registry.Add(fmt.Sprint(i), "deb", "model.gguf")
+		time.Sleep(time.Millisecond)
+	}
+	if registry.Get("0") != nil || registry.Get("1") == nil {
+		t.Error("expected the oldest container to be forgotten")
+	}
+	list := registry.List()
+	if len(list) != vars.ContainersKept || list[0].ID != fmt.Sprint(vars.ContainersKept) {
+		t.Errorf("expected the newest container first, got %+v", list[0])
+	}
+	if deb := registry.ForPipeline("deb"); len(deb) != vars.ContainersKept || deb[0].ID != "1" {
+		t.Errorf("expected the containers of the pipeline oldest first, got %d", len(deb))
+	}
+}
+
+func TestStats(t *testing.T) {
+	var raw container.StatsResponse
+	raw.CPUStats.CPUUsage.TotalUsage = 3_000
+	raw.PreCPUStats.CPUUsage.TotalUsage = 1_000
+	raw.CPUStats.SystemUsage = 20_000
+	raw.PreCPUStats.SystemUsage = 10_000
+	raw.CPUStats.OnlineCPUs = 4
+	raw.MemoryStats.Usage = 600
+	raw.MemoryStats.Limit = 1000
+	raw.MemoryStats.Stats = map[string]uint64{"inactive_file": 100}
+	raw.Networks = map[string]container.NetworkStats{"eth0": {RxBytes: 10, TxBytes: 20}}
+
+	stats := statsFrom(raw)
+	if stats.CPUPercent != 80 || stats.MemoryBytes != 500 || stats.MemoryPercent != 50 || stats.NetworkTx != 20 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	registry := New()
+	c := registry.Add("abc", "simple", "qwen.gguf")
+	c.Add(Line{Time: time.Now(), Stream: "stderr", Text: "llama_model_load: error loading model: unknown model architecture: 'qwen9'"})
+	c.Add(Line{Time: time.Now(), Stream: "stderr", Text: "main: exiting due to model loading error"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers", registry.ListContainersRequest)
+	mux.HandleFunc("GET /containers/{id}/logs", registry.ContainerLogsRequest)
+	mux.HandleFunc("GET /containers/{id}/stats", registry.ContainerStatsRequest)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/containers/abc/logs?tail=1", nil))
+	var logs LogsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &logs); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs.Lines) != 1 || logs.Model != "qwen.gguf" || !strings.Contains(logs.Error, "architecture") {
+		t.Errorf("unexpected logs %+v", logs)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/containers", nil))
+	if !strings.Contains(rec.Body.String(), `"id":"abc"`) {
+		t.Errorf("expected the container to be listed, got %s", rec.Body.String())
+	}
+
+	for path, code := range map[string]int{
+		"/containers/abc/logs?tail=all": http.StatusBadRequest,
+		"/containers/nope/logs":         http.StatusNotFound,
+		"/containers/abc/stats":         http.StatusServiceUnavailable,
+	} {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package containers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// Errors for the ways llama.cpp fails to load a model.
+var (
+	ErrOutOfMemory             = errors.New("not enough memory to load the model, try a smaller quantization, a shorter context or fewer gpu layers")
+	ErrUnsupportedArchitecture = errors.New("the model architecture isn't supported by this llama.cpp image, try a newer image")
+	ErrUnsupportedGPU          = errors.New("the gpu isn't supported by this llama.cpp image")
+	ErrUnsupportedCPU          = errors.New("the cpu doesn't support the instructions this llama.cpp image was built with")
+	ErrBadModel                = errors.New("the model file isn't a valid gguf, it may be corrupt or only partly downloaded")
+	ErrModelNotFound           = errors.New("the model file wasn't found in the models folder")
+	ErrLoadFailed              = errors.New("llama.cpp couldn't load the model")
+)
+
+// fatal are messages llama.cpp prints once it has given up on loading a model, lower case.
+// The same words show up in warnings it recovers from, so only these lines make a failure.
+var fatal = []string{
+	"error loading model",
+	"failed to load model",
+	"exiting due to model loading error",
+	"failed to initialize the context",
+	"failed to create context with model",
+	"no kernel image is available",
+}
+
+// causes are messages that say why a model didn't load, lower case.
+// They are checked in order, so the specific ones come before the ones that follow every failure.
+var causes = []struct {
+	text string
+	err  error
+}{
+	{"unknown model architecture", ErrUnsupportedArchitecture},
+	{"unsupported model architecture", ErrUnsupportedArchitecture},
+	{"no kernel image is available", ErrUnsupportedGPU},
+	{"unsupported gpu architecture", ErrUnsupportedGPU},
+	{"illegal instruction", ErrUnsupportedCPU},
+	{"out of memory", ErrOutOfMemory},
+	{"failed to allocate", ErrOutOfMemory},
+	{"unable to allocate", ErrOutOfMemory},
+	{"cannot allocate memory", ErrOutOfMemory},
+	{"invalid magic", ErrBadModel},
+	{"failed to read magic", ErrBadModel},
+	{"not a gguf file", ErrBadModel},
+	{"unexpectedly reached end of file", ErrBadModel},
+	{"tensor data is not within the file bounds", ErrBadModel},
+	{"no such file or directory", ErrModelNotFound},
+}
+
+// Failure is a model container that couldn't load its model.
+type Failure struct {
+	Container string
+	Model     string
+	Err       error
+	// Line is the output the failure was found in.
+	Line string
+}
+
+func (f *Failure) Error() string {
+	if f.Line == "" {
+		return fmt.Sprintf("model %s failed to load: %v", f.Model, f.Err)
+	}
+	return fmt.Sprintf("model %s failed to load: %v (%s)", f.Model, f.Err, f.Line)
+}
+
+func (f *Failure) Unwrap() error {
+	return f.Err
+}
+
+// Fatal reports if a line of llama.cpp output says it gave up loading the model.
+func Fatal(line string) bool {
+	line = strings.ToLower(line)
+	for _, text := range fatal {
+		if strings.Contains(line, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cause returns the error for a line of llama.cpp output that says why a model couldn't be loaded, or nil.
+// The line alone doesn't mean loading failed, see Fatal.
+func Cause(line string) error {
+	line = strings.ToLower(line)
+	for _, c := range causes {
+		if strings.Contains(line, c.text) {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// Check returns why a container won't come up, nil while it's still starting.
+// It's the failure in its output, or an error once the container has exited.
+func (r *Registry) Check(ctx context.Context, apiClient *client.Client, id string) error {
+	c := r.Get(id)
+	if c != nil {
+		if failure := c.Failure(); failure != nil {
+			return failure
+		}
+	}
+	if apiClient == nil {
+		return nil
+	}
+
+	inspect, err := apiClient.ContainerInspect(ctx, id)
+	if err != nil || inspect.State == nil || inspect.State.Running || inspect.State.Status != "exited" {
+		// can't tell, keep waiting
+		return nil
+	}
+
+	model := id
+	if c != nil {
+		model = c.Model
+	}
+	state := inspect.State
+	switch {
+	case state.OOMKilled:
+		return &Failure{Container: id, Model: model, Err: ErrOutOfMemory}
+	// 128 + SIGILL
+	case state.ExitCode == 132:
+		return &Failure{Container: id, Model: model, Err: ErrUnsupportedCPU}
+	}
+
+	err = fmt.Errorf("container of model %s exited with code %d", model, state.ExitCode)
+	if c != nil {
+		if lines := c.Lines(c.Added, 1); len(lines) != 0 {
+			err = fmt.Errorf("%w: %s", err, lines[0].Text)
+		}
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package containers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// LogsResponse is returned by GET /containers/{id}/logs.
+type LogsResponse struct {
+	ID    string `json:"id"`
+	Model string `json:"model,omitempty"`
+	Lines []Line `json:"lines"`
+	// Error is the failure found in the output, if there is one.
+	Error string `json:"error,omitempty"`
+}
+
+// ListContainersRequest, handlerfunc expects GET method and returns the model containers slape knows of, newest first.
+func (r *Registry) ListContainersRequest(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, map[string][]Info{"containers": r.List()})
+}
+
+// ContainerLogsRequest, handlerfunc expects GET method and returns the output of a container, oldest first.
+// The query can have tail, how many of the last lines to return. Containers slape didn't start are asked for from docker.
+func (r *Registry) ContainerLogsRequest(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	tail := vars.ContainerLogLines
+	if value := req.URL.Query().Get("tail"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Error tail has to be a positive number", http.StatusBadRequest)
+			return
+		}
+		tail = n
+	}
+
+	if c := r.Get(id); c != nil {
+		resp := LogsResponse{ID: c.ID, Model: c.Model, Lines: c.Lines(time.Time{}, tail)}
+		if failure := c.Failure(); failure != nil {
+			resp.Error = failure.Error()
+		}
+		writeJSON(w, resp)
+		return
+	}
+
+	if r.DockerClient == nil {
+		http.Error(w, "Error container not found", http.StatusNotFound)
+		return
+	}
+	logs, err := r.DockerClient.ContainerLogs(req.Context(), id, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+		Tail:       strconv.Itoa(tail),
+	})
+	if client.IsErrNotFound(err) {
+		http.Error(w, "Error container not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Getting Container Logs", "err", err)
+		http.Error(w, "Error getting container logs", http.StatusInternalServerError)
+		return
+	}
+	defer logs.Close()
+
+	// read into a container that isn't kept to split and check the lines
+	c := &Container{ID: id, Model: id}
+	stdout := &lineWriter{container: c, stream: "stdout"}
+	stderr := &lineWriter{container: c, stream: "stderr"}
+	_, err = stdcopy.StdCopy(stdout, stderr, logs)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Getting Container Logs", "err", err)
+		http.Error(w, "Error getting container logs", http.StatusInternalServerError)
+		return
+	}
+	stdout.flush()
+	stderr.flush()
+
+	resp := LogsResponse{ID: id, Lines: c.Lines(time.Time{}, tail)}
+	if failure := c.Failure(); failure != nil {
+		resp.Error = failure.Error()
+	}
+	writeJSON(w, resp)
+}
+
+// ContainerStatsRequest, handlerfunc expects GET method and returns the cpu and memory use of a running container.
+func (r *Registry) ContainerStatsRequest(w http.ResponseWriter, req *http.Request) {
+	if r.DockerClient == nil {
+		http.Error(w, "Error docker is not set up", http.StatusServiceUnavailable)
+		return
+	}
+
+	stats, err := GetStats(req.Context(), r.DockerClient, req.PathValue("id"))
+	if client.IsErrNotFound(err) {
+		http.Error(w, "Error container not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Getting Container Stats", "err", err)
+		http.Error(w, "Error getting container stats", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, stats)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	json, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Error marshaling containers", "err", err)
+		http.Error(w, "Error marshaling containers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
@@ -0,0 +1,78 @@
+package containers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// Stats is how much of the machine a container is using.
+type Stats struct {
+	ID string `json:"id"`
+	// CPUPercent is of a single core, so it goes past 100 on several cores like docker stats.
+	CPUPercent    float64 `json:"cpu_percent"`
+	OnlineCPUs    uint32  `json:"online_cpus"`
+	MemoryBytes   uint64  `json:"memory_bytes"`
+	MemoryLimit   uint64  `json:"memory_limit_bytes"`
+	MemoryPercent float64 `json:"memory_percent"`
+	Pids          uint64  `json:"pids"`
+	NetworkRx     uint64  `json:"network_rx_bytes"`
+	NetworkTx     uint64  `json:"network_tx_bytes"`
+}
+
+// GetStats reads the stats of a container once, docker takes two samples so the cpu use can be worked out.
+func GetStats(ctx context.Context, apiClient *client.Client, id string) (Stats, error) {
+	resp, err := apiClient.ContainerStats(ctx, id, false)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer resp.Body.Close()
+
+	var raw container.StatsResponse
+	err = json.NewDecoder(resp.Body).Decode(&raw)
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := statsFrom(raw)
+	stats.ID = id
+	return stats, nil
+}
+
+// statsFrom works out the stats the same way the docker cli does.
+func statsFrom(raw container.StatsResponse) Stats {
+	stats := Stats{
+		OnlineCPUs:  raw.CPUStats.OnlineCPUs,
+		MemoryLimit: raw.MemoryStats.Limit,
+		Pids:        raw.PidsStats.Current,
+	}
+	if stats.OnlineCPUs == 0 {
+		stats.OnlineCPUs = uint32(len(raw.CPUStats.CPUUsage.PercpuUsage))
+	}
+
+	cpuDelta := float64(raw.CPUStats.CPUUsage.TotalUsage) - float64(raw.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(raw.CPUStats.SystemUsage) - float64(raw.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * float64(stats.OnlineCPUs) * 100
+	}
+
+	// the page cache isn't counted, it's inactive_file on cgroup v2 and total_inactive_file on v1
+	stats.MemoryBytes = raw.MemoryStats.Usage
+	cache := raw.MemoryStats.Stats["inactive_file"]
+	if v1, ok := raw.MemoryStats.Stats["total_inactive_file"]; ok {
+		cache = v1
+	}
+	if cache < stats.MemoryBytes {
+		stats.MemoryBytes -= cache
+	}
+	if stats.MemoryLimit != 0 {
+		stats.MemoryPercent = float64(stats.MemoryBytes) / float64(stats.MemoryLimit) * 100
+	}
+
+	for _, network := range raw.Networks {
+		stats.NetworkRx += network.RxBytes
+		stats.NetworkTx += network.TxBytes
+	}
+	return stats
+}
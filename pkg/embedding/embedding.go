@@ -0,0 +1,304 @@
+/*
+Package embedding turns text into vectors with the embedding model served by llama.cpp.
+
+The Service is called directly from go by internet search, the pipelines and rag so nothing
+loops back through the http api. Inputs are batched by their token count so a large document
+never goes over what the server can take in one request, and every vector is cached on disk
+by the hash of its text so that the same chunk is only ever embedded once per model.
+*/
+package embedding
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/api"
+	"github.com/StoneG24/slape/pkg/chunker"
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/openai/openai-go"
+)
+
+// ErrDimension is returned when the server starts returning vectors of a different size.
+var ErrDimension = errors.New("embedding dimension changed")
+
+type (
+	// Service embeds text through an OpenAI compatible server.
+	Service struct {
+		Client openai.Client
+		// URL is the base url of the server, its health is polled before the first request.
+		URL string
+		// CacheDir is where vectors are cached, caching is off if this is empty.
+		CacheDir string
+		// BatchTokens is the most tokens sent in one request, BatchSize the most texts.
+		BatchTokens int
+		BatchSize   int
+		// Model is used if the server doesn't list its models.
+		Model string
+
+		mu    sync.Mutex
+		ready bool
+		model string
+		dim   int
+	}
+
+	// Info is what was discovered about the model being served.
+	Info struct {
+		Model      string `json:"model"`
+		Dimensions int    `json:"dimensions"`
+	}
+)
+
+// Default is the service used for the embedding container, main replaces it with one for the loaded config.
+var Default = New(config.Default().EmbeddingClient(), vars.EmbeddingEndpoint, vars.EmbeddingCacheDir)
+
+// New creates a service with the batch sizes from the defs file.
+func New(client openai.Client, url string, cacheDir string) *Service {
+	return &Service{
+		Client:      client,
+		URL:         url,
+		CacheDir:    cacheDir,
+		BatchTokens: vars.EmbeddingBatchTokens,
+		BatchSize:   vars.EmbeddingBatchSize,
+		Model:       vars.EmbeddingModel,
+	}
+}
+
+// Embed returns a vector for every text in the same order.
+// Cached vectors are used where possible and the rest are sent to the server in batches.
+func (s *Service) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	err := s.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float64, len(texts))
+	var missing []int
+	for i, text := range texts {
+		if vector, ok := s.readCache(text); ok {
+			vectors[i] = vector
+			continue
+		}
+		missing = append(missing, i)
+	}
+
+	for _, batch := range s.batches(texts, missing) {
+		inputs := make([]string, len(batch))
+		for j, i := range batch {
+			inputs[j] = texts[i]
+		}
+
+		result, err := s.request(ctx, inputs)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range batch {
+			vectors[i] = result[j]
+			s.writeCache(texts[i], result[j])
+		}
+	}
+
+	return vectors, nil
+}
+
+// Info returns the model and the size of its vectors, embedding a probe if they aren't known yet.
+func (s *Service) Info(ctx context.Context) (Info, error) {
+	s.mu.Lock()
+	info := Info{Model: s.model, Dimensions: s.dim}
+	s.mu.Unlock()
+	if info.Dimensions != 0 {
+		return info, nil
+	}
+
+	err := s.wait(ctx)
+	if err != nil {
+		return info, err
+	}
+	_, err = s.request(ctx, []string{"dimension probe"})
+	if err != nil {
+		return info, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Info{Model: s.model, Dimensions: s.dim}, nil
+}
+
+// wait blocks until the server is healthy and then asks it which model it serves.
+func (s *Service) wait(ctx context.Context) error {
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+	if ready {
+		return nil
+	}
+
+	for !api.UpDog(s.URL) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	model := s.Model
+	page, err := s.Client.Models.List(ctx)
+	if err == nil && len(page.Data) > 0 {
+		model = page.Data[0].ID
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Error listing embedding models, using the default", "model", model, "err", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.model != model {
+		// a different model makes different vectors
+		s.dim = 0
+	}
+	s.model = model
+	s.ready = true
+	return nil
+}
+
+// request embeds a single batch.
+func (s *Service) request(ctx context.Context, inputs []string) ([][]float64, error) {
+	s.mu.Lock()
+	model := s.model
+	s.mu.Unlock()
+
+	result, err := s.Client.Embeddings.New(ctx, openai.EmbeddingNewParams{
+		Input: openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: inputs},
+		Model: model,
+	})
+	if err != nil {
+		// the server may have gone away, check its health again next time
+		s.mu.Lock()
+		s.ready = false
+		s.mu.Unlock()
+		return nil, err
+	}
+	if len(result.Data) != len(inputs) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(inputs), len(result.Data))
+	}
+
+	vectors := make([][]float64, len(inputs))
+	for _, embedding := range result.Data {
+		if embedding.Index < 0 || int(embedding.Index) >= len(vectors) {
+			return nil, fmt.Errorf("embedding index %d out of range", embedding.Index)
+		}
+		vectors[embedding.Index] = embedding.Embedding
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, vector := range vectors {
+		if s.dim == 0 {
+			s.dim = len(vector)
+			slog.Info("Embedding Model", "model", s.model, "dimensions", s.dim)
+		}
+		if len(vector) != s.dim {
+			return nil, fmt.Errorf("%w: expected %d, got %d", ErrDimension, s.dim, len(vector))
+		}
+	}
+	return vectors, nil
+}
+
+// batches groups the indexes of texts so each group stays under the token and size limits.
+// A text that is over the token limit on its own is sent by itself.
+func (s *Service) batches(texts []string, indexes []int) [][]int {
+	var batches [][]int
+	var current []int
+	tokens := 0
+
+	for _, i := range indexes {
+		count := chunker.EstimateTokens(texts[i])
+		full := len(current) > 0 && (tokens+count > s.BatchTokens || (s.BatchSize > 0 && len(current) >= s.BatchSize))
+		if full {
+			batches = append(batches, current)
+			current = nil
+			tokens = 0
+		}
+		current = append(current, i)
+		tokens += count
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// cachePath keys the cache by model and text so switching models never returns stale vectors.
+func (s *Service) cachePath(text string) string {
+	s.mu.Lock()
+	model := s.model
+	s.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(model + "\x00" + text))
+	hash := hex.EncodeToString(sum[:])
+	return filepath.Join(s.CacheDir, hash[:2], hash)
+}
+
+func (s *Service) readCache(text string) ([]float64, bool) {
+	if s.CacheDir == "" {
+		return nil, false
+	}
+
+	contents, err := os.ReadFile(s.cachePath(text))
+	if err != nil || len(contents) == 0 || len(contents)%8 != 0 {
+		return nil, false
+	}
+
+	vector := make([]float64, len(contents)/8)
+	for i := range vector {
+		vector[i] = math.Float64frombits(binary.LittleEndian.Uint64(contents[i*8:]))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dim != 0 && len(vector) != s.dim {
+		return nil, false
+	}
+	return vector, true
+}
+
+// writeCache writes to a temporary file first so a crash never leaves half a vector in the cache.
+func (s *Service) writeCache(text string, vector []float64) {
+	if s.CacheDir == "" {
+		return
+	}
+
+	filename := s.cachePath(text)
+	contents := make([]byte, len(vector)*8)
+	for i, v := range vector {
+		binary.LittleEndian.PutUint64(contents[i*8:], math.Float64bits(v))
+	}
+
+	err := os.MkdirAll(filepath.Dir(filename), 0750)
+	if err != nil {
+		slog.Error("Error creating the embedding cache folder", "err", err)
+		return
+	}
+	err = os.WriteFile(filename+"~", contents, 0640)
+	if err != nil {
+		slog.Error("Error writing embedding to the cache", "err", err)
+		return
+	}
+	err = os.Rename(filename+"~", filename)
+	if err != nil {
+		slog.Error("Error writing embedding to the cache", "err", err)
+	}
+}
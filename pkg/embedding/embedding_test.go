@@ -0,0 +1,109 @@
+package embedding
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/StoneG24/slape/pkg/chunker"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// fakeServer answers like llama.cpp with vectors made from the length of each input.
+func fakeServer(t *testing.T, requests *atomic.Int32) *Service {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /v1/models", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object":"list","data":[{"id":"tiny-embed.gguf","object":"model","created":0,"owned_by":"me"}]}`))
+	})
+	mux.HandleFunc("POST /v1/embeddings", func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		var body struct {
+			Input []string `json:"input"`
+			Model string   `json:"model"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		if body.Model != "tiny-embed.gguf" {
+			t.Errorf("expected the discovered model, got %s", body.Model)
+		}
+
+		var data []map[string]any
+		// answer in reverse to make sure the index is used
+		for i := len(body.Input) - 1; i >= 0; i-- {
+			data = append(data, map[string]any{
+				"object":    "embedding",
+				"index":     i,
+				"embedding": []float64{float64(len(body.Input[i])), 1, 0},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "model": body.Model, "data": data})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	s := New(openai.NewClient(option.WithBaseURL(srv.URL+"/v1")), srv.URL+"/v1", t.TempDir())
+	s.Model = "fallback.gguf"
+	return s
+}
+
+func TestEmbedBatchesAndCaches(t *testing.T) {
+	var requests atomic.Int32
+	s := fakeServer(t, &requests)
+	var texts []string
+	for _, n := range []int{40, 41, 42, 43, 44} {
+		texts = append(texts, strings.Repeat("word ", n))
+	}
+	// two texts fit in a batch but three don't
+	s.BatchTokens = 2 * chunker.EstimateTokens(texts[4])
+	s.BatchSize = 64
+
+	vectors, err := s.Embed(context.Background(), texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, vector := range vectors {
+		if vector[0] != float64(len(texts[i])) {
+			t.Errorf("vector %d is out of order: %v", i, vector)
+		}
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 batches, got %d", n)
+	}
+
+	info, err := s.Info(context.Background())
+	if err != nil || info.Model != "tiny-embed.gguf" || info.Dimensions != 3 {
+		t.Errorf("unexpected info %+v %v", info, err)
+	}
+
+	// everything is cached now, a new text is the only thing sent
+	requests.Store(0)
+	vectors, err = s.Embed(context.Background(), append(texts, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected only the new text to be sent, got %d requests", n)
+	}
+	if vectors[5][0] != 3 || vectors[2][0] != float64(len(texts[2])) {
+		t.Errorf("unexpected vectors %v", vectors)
+	}
+}
+
+func TestBatchesSizeLimit(t *testing.T) {
+	s := &Service{BatchTokens: 1000, BatchSize: 2}
+	batches := s.batches([]string{"a", "b", "c", strings.Repeat("x", 8000)}, []int{0, 1, 2, 3})
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[2]) != 1 {
+		t.Errorf("unexpected batches %v", batches)
+	}
+}
@@ -0,0 +1,308 @@
+package internetsearch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/gocolly/colly"
+)
+
+type (
+	// FetchOptions controls how websites are fetched while searching the internet.
+	FetchOptions struct {
+		// UserAgent is sent with every request and is what robots.txt is checked against.
+		UserAgent string
+		// Timeout is the longest a single request can take.
+		Timeout time.Duration
+		// CacheDir is where responses are cached, caching is off if this is empty.
+		CacheDir string
+		// CacheTTL is how long a cached response is used before it's fetched again.
+		CacheTTL time.Duration
+		// DomainDelay is the least amount of time between two requests to the same domain.
+		DomainDelay time.Duration
+		// DomainParallelism is how many requests can be made to the same domain at once.
+		DomainParallelism int
+		// RespectRobots skips pages that a websites robots.txt disallows.
+		RespectRobots bool
+		// AllowedDomains limits scraping to these domains and their subdomains if not empty.
+		AllowedDomains []string
+		// DisallowedDomains are never scraped, subdomains included.
+		DisallowedDomains []string
+		// MaxBodySize is the most bytes read from a single page.
+		MaxBodySize int
+	}
+
+	// fetcher is the http.RoundTripper shared by every collector.
+	// It keeps the cache and the per domain limits in one place since
+	// a new collector is made for every page.
+	fetcher struct {
+		opts FetchOptions
+		next http.RoundTripper
+
+		mu      sync.Mutex
+		domains map[string]*domainLimit
+	}
+
+	// domainLimit holds the state used to rate limit a single domain.
+	domainLimit struct {
+		slots chan struct{}
+		mu    sync.Mutex
+		last  time.Time
+	}
+
+	// contextTransport ties every request made through it to a context.
+	// colly does not take a context so this is how requests get canceled with the pipeline request.
+	contextTransport struct {
+		ctx  context.Context
+		next http.RoundTripper
+	}
+
+	// cachedResponse is what is written to the cache directory.
+	cachedResponse struct {
+		StatusCode int         `json:"status_code"`
+		Header     http.Header `json:"header"`
+		Body       []byte      `json:"body"`
+	}
+)
+
+var (
+	// DefaultFetchOptions are used by InternetSearch.
+	DefaultFetchOptions = FetchOptions{
+		UserAgent:         vars.SearchUserAgent,
+		Timeout:           vars.SearchTimeout * time.Second,
+		CacheDir:          vars.SearchCacheDir,
+		CacheTTL:          vars.SearchCacheTTL * time.Hour,
+		DomainDelay:       vars.SearchDomainDelay * time.Millisecond,
+		DomainParallelism: vars.SearchDomainParallelism,
+		RespectRobots:     true,
+		AllowedDomains:    vars.SearchAllowedDomains,
+		DisallowedDomains: vars.SearchDisallowedDomains,
+		MaxBodySize:       vars.SearchMaxPageBytes,
+	}
+
+	sharedFetcher = newFetcher(DefaultFetchOptions)
+)
+
+func newFetcher(opts FetchOptions) *fetcher {
+	return &fetcher{
+		opts:    opts,
+		next:    http.DefaultTransport,
+		domains: map[string]*domainLimit{},
+	}
+}
+
+// newCollector creates a collector that goes through the shared fetcher and is canceled with ctx.
+func newCollector(ctx context.Context, respectRobots bool) *colly.Collector {
+	opts := sharedFetcher.opts
+
+	collyCollector := colly.NewCollector(
+		colly.UserAgent(opts.UserAgent),
+		colly.MaxBodySize(opts.MaxBodySize),
+	)
+	collyCollector.IgnoreRobotsTxt = !(respectRobots && opts.RespectRobots)
+	collyCollector.WithTransport(&contextTransport{ctx: ctx, next: sharedFetcher})
+	collyCollector.SetRequestTimeout(opts.Timeout)
+
+	return collyCollector
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req.WithContext(t.ctx))
+}
+
+// RoundTrip serves the request from the cache if it can,
+// otherwise it waits its turn for the domain and fetches the page.
+func (f *fetcher) RoundTrip(req *http.Request) (*http.Response, error) {
+	cacheable := f.opts.CacheDir != "" && req.Method == http.MethodGet
+	if cacheable {
+		if resp, ok := f.readCache(req); ok {
+			return resp, nil
+		}
+	}
+
+	release, err := f.wait(req.Context(), req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := f.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// read the capped body now so the cache and colly see the same thing
+	var reader io.Reader = resp.Body
+	if f.opts.MaxBodySize > 0 {
+		reader = io.LimitReader(resp.Body, int64(f.opts.MaxBodySize))
+	}
+	body, err := io.ReadAll(reader)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+
+	if cacheable && resp.StatusCode == http.StatusOK {
+		f.writeCache(req, resp, body)
+	}
+
+	return resp, nil
+}
+
+// wait blocks until a request can be made to domain, the returned func must be called when done.
+func (f *fetcher) wait(ctx context.Context, domain string) (func(), error) {
+	f.mu.Lock()
+	limit, ok := f.domains[domain]
+	if !ok {
+		limit = &domainLimit{slots: make(chan struct{}, max(f.opts.DomainParallelism, 1))}
+		f.domains[domain] = limit
+	}
+	f.mu.Unlock()
+
+	select {
+	case limit.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// space requests out even when they run in parallel
+	limit.mu.Lock()
+	next := limit.last.Add(f.opts.DomainDelay)
+	now := time.Now()
+	if next.Before(now) {
+		next = now
+	}
+	limit.last = next
+	limit.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		<-limit.slots
+		return nil, ctx.Err()
+	}
+
+	return func() { <-limit.slots }, nil
+}
+
+func (f *fetcher) cachePath(u *url.URL) string {
+	sum := sha256.Sum256([]byte(u.String()))
+	hash := hex.EncodeToString(sum[:])
+	return filepath.Join(f.opts.CacheDir, hash[:2], hash)
+}
+
+func (f *fetcher) readCache(req *http.Request) (*http.Response, bool) {
+	filename := f.cachePath(req.URL)
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, false
+	}
+	if f.opts.CacheTTL > 0 && time.Since(info.ModTime()) > f.opts.CacheTTL {
+		return nil, false
+	}
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false
+	}
+	var cached cachedResponse
+	err = json.Unmarshal(contents, &cached)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error reading cached page, fetching it again", "err", err)
+		return nil, false
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(cached.StatusCode),
+		StatusCode:    cached.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cached.Header,
+		Body:          io.NopCloser(bytes.NewReader(cached.Body)),
+		ContentLength: int64(len(cached.Body)),
+		Request:       req,
+	}, true
+}
+
+// writeCache writes to a temporary file first so a crash never leaves half a page in the cache.
+func (f *fetcher) writeCache(req *http.Request, resp *http.Response, body []byte) {
+	filename := f.cachePath(req.URL)
+
+	contents, err := json.Marshal(cachedResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error marshaling page for the cache", "err", err)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0750)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error creating the search cache folder", "err", err)
+		return
+	}
+
+	err = os.WriteFile(filename+"~", contents, 0640)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error writing page to the cache", "err", err)
+		return
+	}
+	err = os.Rename(filename+"~", filename)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error writing page to the cache", "err", err)
+	}
+}
+
+// domainAllowed checks a link against the allowed and disallowed domain lists.
+// A domain in either list also covers its subdomains.
+func (o FetchOptions) domainAllowed(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	for _, domain := range o.DisallowedDomains {
+		if matchesDomain(host, domain) {
+			return false
+		}
+	}
+
+	if len(o.AllowedDomains) == 0 {
+		return true
+	}
+	for _, domain := range o.AllowedDomains {
+		if matchesDomain(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesDomain(host string, domain string) bool {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
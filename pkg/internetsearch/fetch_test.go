@@ -0,0 +1,110 @@
+package internetsearch
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testFetcher(t *testing.T, opts FetchOptions) (*fetcher, *httptest.Server, *atomic.Int32) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		io.WriteString(w, "<html>"+strings.Repeat("a", 100)+"</html>")
+	}))
+	t.Cleanup(server.Close)
+	return newFetcher(opts), server, &hits
+}
+
+func get(t *testing.T, f *fetcher, url string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := f.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestFetchCache(t *testing.T) {
+	f, server, hits := testFetcher(t, FetchOptions{CacheDir: t.TempDir(), CacheTTL: time.Hour})
+
+	first := get(t, f, server.URL+"/page")
+	second := get(t, f, server.URL+"/page")
+	if hits.Load() != 1 || first != second {
+		t.Errorf("expected the second request to come from the cache, got %d requests", hits.Load())
+	}
+
+	get(t, f, server.URL+"/other")
+	if hits.Load() != 2 {
+		t.Errorf("expected a different page to miss the cache, got %d requests", hits.Load())
+	}
+
+	// only pages that came back fine are cached
+	get(t, f, server.URL+"/missing")
+	get(t, f, server.URL+"/missing")
+	if hits.Load() != 4 {
+		t.Errorf("expected errors not to be cached, got %d requests", hits.Load())
+	}
+
+	f.opts.CacheTTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	get(t, f, server.URL+"/page")
+	if hits.Load() != 5 {
+		t.Errorf("expected an expired page to be fetched again, got %d requests", hits.Load())
+	}
+}
+
+func TestFetchMaxBodySize(t *testing.T) {
+	f, server, _ := testFetcher(t, FetchOptions{MaxBodySize: 10})
+
+	if body := get(t, f, server.URL); body != "<html>aaaa" {
+		t.Errorf("expected the body to be cut at 10 bytes, got %q", body)
+	}
+}
+
+func TestDomainAllowed(t *testing.T) {
+	opts := FetchOptions{
+		AllowedDomains:    []string{"example.com", ".docs.io"},
+		DisallowedDomains: []string{"ads.example.com"},
+	}
+	cases := map[string]bool{
+		"https://example.com/page":       true,
+		"https://www.Example.com/page":   true,
+		"https://api.docs.io":            true,
+		"https://docs.io":                true,
+		"https://ads.example.com/banner": false,
+		"https://x.ads.example.com":      false,
+		"https://notexample.com":         false,
+		"https://example.com.evil.org":   false,
+		"https://other.org":              false,
+		"://not a url":                   false,
+	}
+	for link, want := range cases {
+		if got := opts.domainAllowed(link); got != want {
+			t.Errorf("%s: expected %v, got %v", link, want, got)
+		}
+	}
+
+	// without an allow list everything but the deny list is scraped
+	opts.AllowedDomains = nil
+	if !opts.domainAllowed("https://other.org") || opts.domainAllowed("https://ads.example.com") {
+		t.Error("expected only the disallowed domains to be skipped")
+	}
+}
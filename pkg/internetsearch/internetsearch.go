@@ -1,33 +1,40 @@
 package internetsearch
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
-	"log"
+	"log/slog"
 	"math"
-	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/StoneG24/slape/pkg/chunker"
+	"github.com/StoneG24/slape/pkg/embedding"
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/StoneG24/slape/pkg/vectorstore"
 	"github.com/gocolly/colly"
-	"github.com/openai/openai-go"
 )
 
 type (
-	EmbeddingRequest struct {
-		Prompt []string `json:"prompt"`
-	}
-
-	EmbeddingResponse struct {
-		Response openai.CreateEmbeddingResponse
-	}
-
 	VectorList struct {
 		Points   []Point
 		Elements []string
-		index    int
+		// Chunks line up with Elements and carry where each element came from.
+		Chunks []chunker.Chunk
+		index  int
+		pages  []*page
+		// store indexes Points by their position
+		store *vectorstore.Index
+		// lexical indexes the text of the chunks by the same ids as store
+		lexical *vectorstore.Lexical
+	}
+
+	// page is the text scraped from a single website.
+	page struct {
+		url   string
+		title string
+		text  strings.Builder
 	}
 
 	Point struct {
@@ -39,10 +46,19 @@ type (
 		Point    Point
 		Distance float64
 	}
+
+	// Result is a single link returned by the search engine.
+	Result struct {
+		URL   string
+		Title string
+		// Rank starts at 1 for the best result.
+		Rank int
+		// Score is only set on fused results.
+		Score float64
+	}
 )
 
 const (
-	embedmodel = "snowflake-arctic-embed-l-v2.0-q4_k_m.gguf"
 	//Typical values:
 	// > 0.9 → very close (same idea, rephrased)
 	// 0.7–0.9 → somewhat related
@@ -58,145 +74,318 @@ const (
 // Internet search should not be compared with the rest of tools because it can be
 // dangerous if not used properly, hence why it is serperate.
 func InternetSearch(ctx context.Context, query string) VectorList {
+	return MultiSearch(ctx, []string{query}, vars.SearchMaxLinks)
+}
 
-	collyCollector := colly.NewCollector()
+// MultiSearch runs every query, merges the results with reciprocal rank fusion
+// and scrapes the best maxLinks websites.
+// Websites that show up for several queries are only scraped once.
+func MultiSearch(ctx context.Context, queries []string, maxLinks int) VectorList {
 
-	data := []Point{}
-	elements := []string{}
-	index := 0
+	vecs := VectorList{Points: []Point{}, Elements: []string{}}
 
-	vecs := VectorList{data, elements, index}
+	var rankings [][]Result
+	for _, query := range queries {
+		if ctx.Err() != nil {
+			break
+		}
+		results := Search(ctx, query)
+		slog.InfoContext(ctx, "Search Results", "query", query, "results", results)
+		rankings = append(rankings, results)
+	}
 
-	query = strings.ReplaceAll(query, " ", "+")
-	query = strings.ReplaceAll(query, "\n", "")
-	queryurl := fmt.Sprintf("https://html.duckduckgo.com/html/?q=%s", query)
+	fused := FuseResults(rankings)
+	if len(fused) > maxLinks {
+		fused = fused[:maxLinks]
+	}
+
+	for _, result := range fused {
+		if ctx.Err() != nil {
+			break
+		}
+		vecs.scrape(ctx, result.URL)
+	}
+
+	// send the vecs to embedding
+	embeddings := vecs.embedGuy(ctx)
 
-	log.Println(queryurl)
+	// add them to the vecs
+	vecs.addGuy(embeddings)
 
-	linkIndex := 0
-	maxlinks := 3
+	return vecs
+}
+
+// Search asks duckduckgo for a query and returns the results in the order they were ranked.
+// Ads and domains that are not allowed are left out.
+func Search(ctx context.Context, query string) []Result {
+
+	// duckduckgo is queried as a search api rather than crawled so robots.txt is not checked
+	collyCollector := newCollector(ctx, false)
+
+	query = strings.ReplaceAll(query, "\n", " ")
+	queryurl := "https://html.duckduckgo.com/html/?q=" + url.QueryEscape(strings.TrimSpace(query))
+
+	slog.DebugContext(ctx, "Searching", "url", queryurl)
+
+	results := []Result{}
+
+	// gather all of the links in the order they are shown
+	collyCollector.OnHTML(".result", func(element *colly.HTMLElement) {
+		if strings.Contains(element.Attr("class"), "result--ad") {
+			return
+		}
 
-	// Find and visit all links
-	// gather all of the elements
-	collyCollector.OnHTML(".result__url", func(element *colly.HTMLElement) {
-		//counter used to limit the number of websites
 		//searches for links on duckduckgo and creates links to individual sites to be scraped
-		link := "https://" + strings.TrimSpace(element.Text)
+		display := strings.TrimSpace(element.ChildText(".result__url"))
+		if display == "" {
+			return
+		}
+		link := "https://" + display
 
-		if linkIndex < maxlinks {
-			vecs.scrape(ctx, link)
-			linkIndex++
+		if !DefaultFetchOptions.domainAllowed(link) {
+			slog.InfoContext(ctx, "Skipping link, domain is not allowed", "link", link)
+			return
 		}
+
+		results = append(results, Result{
+			URL:   link,
+			Title: strings.TrimSpace(element.ChildText(".result__a")),
+			Rank:  len(results) + 1,
+		})
 	})
 
 	err := collyCollector.Visit(queryurl)
 	if err != nil {
-		log.Println("error while scraping duckduckgo", err)
+		slog.ErrorContext(ctx, "Error while scraping duckduckgo", "err", err)
 	}
 
-	// send the vecs to embedding
-	embeddings := vecs.embedGuy()
+	return results
+}
 
-	// add them to the vecs
-	vecs.addGuy(embeddings)
+// FuseResults merges several rankings into one using reciprocal rank fusion, see vectorstore.Fuse.
+// Duplicate urls are merged, the returned results are ranked from 1.
+func FuseResults(rankings [][]Result) []Result {
+	merged := map[string]Result{}
+	keys := make([][]string, len(rankings))
+	for i, ranking := range rankings {
+		for _, result := range ranking {
+			key := normalizeURL(result.URL)
+			if _, ok := merged[key]; !ok {
+				merged[key] = result
+			}
+			keys[i] = append(keys[i], key)
+		}
+	}
 
-	return vecs
+	order, scores := vectorstore.Fuse(keys...)
+	fused := make([]Result, 0, len(order))
+	for i, key := range order {
+		result := merged[key]
+		result.Rank = i + 1
+		result.Score = scores[key]
+		fused = append(fused, result)
+	}
+
+	return fused
+}
+
+// normalizeURL is used to find the same page under slightly different links.
+func normalizeURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	return host + strings.TrimSuffix(u.EscapedPath(), "/") + "?" + u.RawQuery
 }
 
 // used to scrape individual sites
 func (v *VectorList) scrape(ctx context.Context, link string) {
 
-	collyCollector := colly.NewCollector()
+	collyCollector := newCollector(ctx, true)
+
+	current := &page{url: link}
 
+	collyCollector.OnHTML("title", func(element *colly.HTMLElement) {
+		if current.title == "" {
+			current.title = strings.TrimSpace(element.Text)
+		}
+	})
 	//scrapes all paragraph elements from each webpage
 	collyCollector.OnHTML("p", func(element *colly.HTMLElement) {
-		//concatenates all text from paragraph elements
-		// add the guy to the element list
-		log.Println(element.Text)
-		v.Elements = append(v.Elements, element.Text)
+		// paragraphs are separated by blank lines so the chunker can find them
+		slog.DebugContext(ctx, "Scraped", "text", element.Text)
+		current.text.WriteString(strings.TrimSpace(element.Text))
+		current.text.WriteString("\n\n")
 		v.index++
 	})
 	collyCollector.OnHTML("code", func(element *colly.HTMLElement) {
-		log.Println(element.Text)
-		v.Elements = append(v.Elements, element.Text)
+		// fence code so the chunker keeps it together
+		slog.DebugContext(ctx, "Scraped", "text", element.Text)
+		current.text.WriteString("```\n")
+		current.text.WriteString(strings.TrimSpace(element.Text))
+		current.text.WriteString("\n```\n\n")
 		v.index++
 	})
 	collyCollector.OnRequest(func(req *colly.Request) {
-		log.Println("Visiting", req.URL)
+		slog.InfoContext(ctx, "Visiting", "url", req.URL)
 	})
 
 	//start scraping by visiting the page
 	err := collyCollector.Visit(link)
 	if err != nil {
-		log.Println("error while scraping webpage")
+		slog.ErrorContext(ctx, "Error while scraping webpage", "link", link, "err", err)
 	}
+
+	v.pages = append(v.pages, current)
 }
 
-func (v *VectorList) embedGuy() []openai.Embedding {
-
-	var chunkedText []string
-	text := v.Elements[:v.index]
-	bulkText := strings.Join(text, " ")
-	v.index = 0
-	for index := 0; index < len(bulkText); index += 200 {
-		if index+250 > (len(bulkText) - 1) {
-			chunkedText = append(chunkedText, bulkText[index:])
-			v.index++
-		} else {
-			chunkedText = append(chunkedText, bulkText[index:index+250])
-			v.index++
-		}
-	}
-	v.Elements = chunkedText
-	text = chunkedText
-	var prompt EmbeddingRequest
-	prompt.Prompt = text
-	embeddingPrompt, err := json.Marshal(prompt)
-	if err != nil {
-		log.Println("The fucking json Marshal didn't fucking work you STUPID MOTHERFUCKER")
-	}
-	resp, err := http.Post("http://localhost:8080/emb/generate",
-		http.DetectContentType(embeddingPrompt),
-		bytes.NewReader(embeddingPrompt),
-	)
-	if err != nil {
-		log.Println("Sorry Vito what was that? You cut out.")
+func (v *VectorList) embedGuy(ctx context.Context) [][]float64 {
+
+	// chunk each page on its own so that every chunk can be traced back to its url
+	v.Chunks = []chunker.Chunk{}
+	v.Elements = []string{}
+	for _, p := range v.pages {
+		chunks := chunker.Split(p.text.String(), chunker.Options{
+			Strategy:  chunker.Markdown,
+			MaxTokens: vars.SearchChunkTokens,
+			Overlap:   vars.SearchChunkOverlap,
+			Source:    p.url,
+			Title:     p.title,
+		})
+		for _, chunk := range chunks {
+			v.Chunks = append(v.Chunks, chunk)
+			v.Elements = append(v.Elements, chunk.Text)
+		}
 	}
-	defer resp.Body.Close()
+	v.index = len(v.Elements)
 
-	var embeddingResponse EmbeddingResponse
+	if len(v.Elements) == 0 {
+		slog.InfoContext(ctx, "Nothing was scraped, skipping embedding")
+		return nil
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&embeddingResponse)
+	vectors, err := embedding.Default.Embed(ctx, v.Elements)
 	if err != nil {
-		log.Println("Failed to Read response body in internet search")
+		slog.ErrorContext(ctx, "Error embedding the scraped chunks", "err", err)
+		return nil
 	}
 
-	vectorizedText := embeddingResponse.Response.Data
-
-	return vectorizedText
+	return vectors
 }
 
-func (v *VectorList) addGuy(embeddings []openai.Embedding) {
+func (v *VectorList) addGuy(embeddings [][]float64) {
+
+	v.store = vectorstore.NewIndex(vectorstore.DefaultConfig())
+	v.lexical = vectorstore.NewLexical()
 
 	for i := range len(embeddings) {
 		// add point to the array of data
-		point := Point{i, embeddings[i].Embedding}
-		log.Println(point)
+		point := Point{i, embeddings[i]}
 
 		v.Points = append(v.Points, point)
+
+		var payload map[string]string
+		if i < len(v.Chunks) {
+			payload = map[string]string{"source": v.Chunks[i].Source, "title": v.Chunks[i].Title}
+		}
+		err := v.store.Insert(strconv.Itoa(i), point.Vector, payload)
+		if err != nil {
+			slog.Error("Error adding embedding to the vector store", "err", err)
+		}
+		if i < len(v.Elements) {
+			v.lexical.Add(strconv.Itoa(i), v.Elements[i])
+		}
 	}
 }
 
-func normalize(vec []float64) []float64 {
-	var norm float64
-	for _, v := range vec {
-		norm += v * v
+// Nearest returns up to k points that are similar enough to query, most similar first.
+// The search goes through the HNSW index built from the scraped chunks.
+func (v *VectorList) Nearest(query []float64, k int) []Neighbor {
+	if v.store == nil {
+		return KnnSearch(v.Points, query, k)
 	}
-	norm = math.Sqrt(norm)
-	for i := range vec {
-		vec[i] /= norm
+
+	var neighbors []Neighbor
+	for _, result := range v.store.Search(query, k, 0) {
+		slog.Info("Simularity Score", "score", result.Score)
+		if result.Score < similarityThreshold {
+			// results are sorted so nothing after this will pass either
+			break
+		}
+		id, err := strconv.Atoi(result.ID)
+		if err != nil {
+			continue
+		}
+		neighbors = append(neighbors, Neighbor{Point: v.Points[id], Distance: result.Score})
 	}
-	return vec
+
+	return neighbors
+}
+
+// Hybrid searches the chunks by meaning with every vector and by their words with every query,
+// then fuses both rankings with reciprocal rank fusion and returns the best k.
+// Chunks that only match by words skip the similarity threshold, that is how exact terms
+// like version numbers get through. Distance is the best similarity to any of the vectors.
+func (v *VectorList) Hybrid(queries []string, vectors [][]float64, k int) []Neighbor {
+	similarity := map[int]float64{}
+	var semantic []vectorstore.Result
+	for _, vector := range vectors {
+		for _, neighbor := range v.Nearest(vector, k) {
+			id := neighbor.Point.ID
+			if current, ok := similarity[id]; !ok || neighbor.Distance > current {
+				similarity[id] = neighbor.Distance
+			}
+		}
+	}
+	for id, score := range similarity {
+		semantic = append(semantic, vectorstore.Result{ID: strconv.Itoa(id), Score: score})
+	}
+	sortResults(semantic)
+
+	var lexical []vectorstore.Result
+	if v.lexical != nil {
+		bm25 := map[string]float64{}
+		for _, query := range queries {
+			for _, result := range v.lexical.Search(query, k) {
+				bm25[result.ID] = max(bm25[result.ID], result.Score)
+			}
+		}
+		for id, score := range bm25 {
+			lexical = append(lexical, vectorstore.Result{ID: id, Score: score})
+		}
+		sortResults(lexical)
+	}
+
+	var neighbors []Neighbor
+	for _, result := range vectorstore.FuseRRF(semantic, lexical) {
+		if len(neighbors) == k {
+			break
+		}
+		id, err := strconv.Atoi(result.ID)
+		if err != nil || id >= len(v.Points) {
+			continue
+		}
+		score, ok := similarity[id]
+		if !ok {
+			for _, vector := range vectors {
+				score = max(score, cosineSimilarity(vector, v.Points[id].Vector))
+			}
+		}
+		neighbors = append(neighbors, Neighbor{Point: v.Points[id], Distance: score})
+	}
+
+	return neighbors
+}
+
+// sortResults orders results best first, ties are broken by id so the order is stable.
+func sortResults(results []vectorstore.Result) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].ID < results[j].ID
+		}
+		return results[i].Score > results[j].Score
+	})
 }
 
 func cosineSimilarity(vec1, vec2 []float64) float64 {
@@ -213,20 +402,20 @@ func cosineSimilarity(vec1, vec2 []float64) float64 {
 	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
 }
 
+// KnnSearch compares query against every point and returns up to k points
+// that are similar enough, most similar first. Neither query nor data are changed.
 func KnnSearch(data []Point, query []float64, k int) []Neighbor {
 	var neighbors []Neighbor
-	normquery := normalize(query)
 	for _, point := range data {
-		normpoint := normalize(point.Vector)
-		dist := cosineSimilarity(normquery, normpoint)
-		log.Println("Simularity Score", dist)
+		dist := cosineSimilarity(query, point.Vector)
+		slog.Info("Simularity Score", "score", dist)
 		if dist >= similarityThreshold {
 			neighbors = append(neighbors, Neighbor{Point: point, Distance: dist})
 		}
 	}
 
 	sort.Slice(neighbors, func(i, j int) bool {
-		return neighbors[i].Distance < neighbors[j].Distance
+		return neighbors[i].Distance > neighbors[j].Distance
 	})
 
 	if len(neighbors) < k {
@@ -0,0 +1,83 @@
+package internetsearch
+
+import "testing"
+
+func TestFuseResults(t *testing.T) {
+	rankings := [][]Result{
+		{
+			{URL: "https://a.com/page"},
+			{URL: "https://b.com"},
+			{URL: "https://c.com"},
+		},
+		{
+			{URL: "https://www.b.com"},
+			{URL: "https://c.com/"},
+		},
+	}
+
+	fused := FuseResults(rankings)
+	if len(fused) != 3 {
+		t.Fatalf("expected duplicates to be merged into 3 results, got %d: %+v", len(fused), fused)
+	}
+
+	// b and c show up for both queries so they beat a
+	if fused[0].URL != "https://b.com" {
+		t.Errorf("expected b to rank first, got %s", fused[0].URL)
+	}
+	if fused[2].URL != "https://a.com/page" {
+		t.Errorf("expected a to rank last, got %s", fused[2].URL)
+	}
+	for i, result := range fused {
+		if result.Rank != i+1 {
+			t.Errorf("result %d has rank %d", i, result.Rank)
+		}
+	}
+}
+
+func TestKnnSearch(t *testing.T) {
+	data := []Point{
+		{ID: 0, Vector: []float64{0, 3}},
+		{ID: 1, Vector: []float64{3, 0}},
+		{ID: 2, Vector: []float64{2, 1}},
+	}
+	query := []float64{2, 0}
+
+	neighbors := KnnSearch(data, query, 2)
+	if len(neighbors) != 2 {
+		t.Fatalf("expected 2 neighbors, got %d", len(neighbors))
+	}
+	if neighbors[0].Point.ID != 1 || neighbors[1].Point.ID != 2 {
+		t.Errorf("expected the most similar points first, got %+v", neighbors)
+	}
+	if query[0] != 2 || data[1].Vector[0] != 3 {
+		t.Errorf("KnnSearch changed its inputs")
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	var v VectorList
+	v.Elements = []string{
+		"the xz backdoor was found by a postgres developer",
+		"CVE-2024-3094 affects xz 5.6.0 and 5.6.1",
+		"compression libraries are everywhere",
+	}
+	v.addGuy([][]float64{{1, 0}, {0, 1}, {0.9, 0.1}})
+
+	// the vector only finds the first and last chunk, the query finds the cve by its id
+	neighbors := v.Hybrid([]string{"CVE-2024-3094"}, [][]float64{{1, 0}}, 3)
+	if len(neighbors) != 3 {
+		t.Fatalf("expected 3 neighbors, got %+v", neighbors)
+	}
+	found := false
+	for _, neighbor := range neighbors {
+		if neighbor.Point.ID == 1 {
+			found = true
+			if neighbor.Distance != 0 {
+				t.Errorf("expected the similarity of the lexical match to be kept, got %f", neighbor.Distance)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected the exact match to be found, got %+v", neighbors)
+	}
+}
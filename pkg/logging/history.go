@@ -0,0 +1,186 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page is a page of entries read back from the log files, newest first.
+type Page struct {
+	Entries []Entry `json:"entries"`
+	// Next is passed as before to get the next page, it's 0 on the last page.
+	Next int `json:"next,omitempty"`
+}
+
+// Files returns the log file and its rotated backups, oldest first.
+func Files() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if path == "" {
+		return nil
+	}
+	var files []string
+	for i := backups; i > 0; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", path, i))
+	}
+	return append(files, path)
+}
+
+// ReadPage returns up to limit entries of files that match filter, newest first.
+// Entries are numbered from 1 by their line across the files, only the ones below before are read
+// unless before is 0. Numbers move along when the files are rotated.
+func ReadPage(files []string, filter Filter, before int, limit int) (Page, error) {
+	// the newest matches are kept in a ring so big files don't have to fit in memory
+	ring := make([]Entry, limit)
+	found := 0
+	id := 0
+
+	for _, name := range files {
+		file, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return Page{}, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			id++
+			if before > 0 && id >= before {
+				break
+			}
+
+			entry := ParseLine(line)
+			entry.ID = id
+			if filter.Match(entry) {
+				ring[found%limit] = entry
+				found++
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return Page{}, err
+		}
+		if before > 0 && id >= before {
+			break
+		}
+	}
+
+	page := Page{Entries: make([]Entry, 0, min(found, limit))}
+	for i := found - 1; i >= 0 && i >= found-limit; i-- {
+		page.Entries = append(page.Entries, ring[i%limit])
+	}
+	if found > limit {
+		page.Next = page.Entries[len(page.Entries)-1].ID
+	}
+	return page, nil
+}
+
+// ParseLine reads a line written by the text or json handler.
+// Lines it can't make sense of are kept whole as the message.
+func ParseLine(line string) Entry {
+	var fields map[string]any
+	if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &fields) == nil {
+		return entryFrom(fields)
+	}
+
+	fields = parseText(line)
+	if _, ok := fields["msg"]; !ok {
+		return Entry{Message: line}
+	}
+	return entryFrom(fields)
+}
+
+// entryFrom builds an entry out of the keys of a record, nested groups become dotted keys.
+func entryFrom(fields map[string]any) Entry {
+	var entry Entry
+	var add func(prefix string, fields map[string]any)
+	add = func(prefix string, fields map[string]any) {
+		for key, value := range fields {
+			switch v := value.(type) {
+			case map[string]any:
+				add(prefix+key+".", v)
+				continue
+			case string:
+				if prefix == "" && entry.set(key, v) {
+					continue
+				}
+			}
+			if entry.Attrs == nil {
+				entry.Attrs = make(map[string]string)
+			}
+			entry.Attrs[prefix+key] = fmt.Sprint(value)
+		}
+	}
+	add("", fields)
+	return entry
+}
+
+// set fills in the field of the entry key belongs to, it returns false for other keys.
+func (e *Entry) set(key string, value string) bool {
+	switch key {
+	case "time":
+		e.Time, _ = time.Parse(time.RFC3339Nano, value)
+	case "level":
+		e.Level = value
+	case "msg":
+		e.Message = value
+	case "request_id":
+		e.RequestID = value
+	case "pipeline":
+		e.Pipeline = value
+	default:
+		return false
+	}
+	return true
+}
+
+// parseText splits a line of key=value pairs, quoted keys and values are unquoted.
+func parseText(line string) map[string]any {
+	fields := make(map[string]any)
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		key, rest, ok := readValue(line, "=")
+		if !ok || !strings.HasPrefix(rest, "=") {
+			break
+		}
+		value, rest, ok := readValue(rest[1:], " ")
+		if !ok {
+			break
+		}
+		fields[key] = value
+		line = rest
+	}
+	return fields
+}
+
+// readValue reads a quoted string or everything up to end off the start of s.
+func readValue(s string, end string) (string, string, bool) {
+	if strings.HasPrefix(s, `"`) {
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", s, false
+		}
+		value, err := strconv.Unquote(quoted)
+		return value, s[len(quoted):], err == nil
+	}
+	i := strings.Index(s, end)
+	if i < 0 {
+		return s, "", true
+	}
+	return s[:i], s[i:], true
+}
@@ -1,55 +1,114 @@
-// Package logging is for logging the performance and prompting outputs of the pipelines.
+/*
+Package logging sets up the structured logs of the server.
+
+Logs go through log/slog to the terminal and to a log file that is rotated by size.
+The standard log package is routed through the same handler so nothing is lost.
+Every http request gets an id that travels in its context, anything logged with
+that context, like container operations and model calls, carries the id as request_id.
+Records are also handed to the clients following GET /logs/stream, and the files are read back for GET /logs.
+*/
 package logging
 
 import (
-	"errors"
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
+	"sync"
+
+	"github.com/StoneG24/slape/pkg/config"
+	"go.opentelemetry.io/otel/trace"
+)
 
-	"github.com/StoneG24/slape/pkg/vars"
+var (
+	mu sync.Mutex
+	// path is the file the logs are written to, empty before Setup.
+	path string
+	// backups is how many rotated files are kept next to path.
+	backups int
 )
 
-// CreateLogFile is used to check and see if a logfile is already created.
-// It then creates a logger for the log file and returns it.
-func CreateLogFile() *os.File {
-	// If we don't run embedding pipeline on startup,
-	// we can remove this as well.
-	log.Println("[+] Checking for logs folder...")
-	if _, err := os.Stat("./models"); errors.Is(err, os.ErrNotExist) {
-		log.Println("[+] Creating logs folder...")
-		os.Mkdir("logs", 0744)
+// contextHandler adds the request id, pipeline and trace id in the context to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+// Setup makes the default slog logger write to the terminal and the log file in cfg.
+// The returned closer closes the log file.
+func Setup(cfg config.Log) (io.Closer, error) {
+	file, err := NewRotatingFile(cfg.File, int64(cfg.MaxSize)*1024*1024, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
 	}
 
-	logFile, err := os.OpenFile("./logs/"+vars.Logfilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	handler, err := NewHandler(io.MultiWriter(os.Stderr, file), cfg)
 	if err != nil {
-		log.Println("Error creating the log file")
+		file.Close()
+		return nil, err
 	}
-	log.Println("[+] Found the logs folder")
+	slog.SetDefault(slog.New(handler))
 
-	log.SetOutput(logFile)
-	return logFile
-}
+	mu.Lock()
+	path = cfg.File
+	backups = cfg.MaxBackups
+	mu.Unlock()
 
-// CloseLogging moves the current runs logs to a trunk log file.
-func CloseLogging() {
+	return file, nil
+}
 
-	// read all of the contents of the log file
-	content, err := os.ReadFile("./logs/" + vars.Logfilename)
+// NewHandler returns a handler writing to w with the level and format in cfg.
+func NewHandler(w io.Writer, cfg config.Log) (slog.Handler, error) {
+	level, err := ParseLevel(cfg.Level)
 	if err != nil {
-		log.Println("Error trying to read ", vars.Logfilename)
+		return nil, err
 	}
 
-	// open the trunk file for appending
-	trunkFile, err := os.OpenFile("./logs/"+vars.Trunkfilename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
-	if err != nil {
-		log.Println("Error creating the trunk file")
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch cfg.Format {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text", "":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
 	}
+	return contextHandler{streamHandler{Handler: handler, stream: Logs}}, nil
+}
 
-	// move to the big log file
-	_, err = trunkFile.Write(content)
-	if err != nil {
-		log.Println("Error while trying to update old logs with current run")
+// ParseLevel reads debug, info, warn or error.
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(strings.ToLower(level)))
+	return l, err
+}
+
+// Path is the file the logs are written to.
+func Path() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return path
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
 	}
+	if pipeline := Pipeline(ctx); pipeline != "" {
+		r.AddAttrs(slog.String("pipeline", pipeline))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
 
-	trunkFile.Close()
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
 }
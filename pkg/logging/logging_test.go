@@ -0,0 +1,219 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/vars"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "logs.txt")
+	file, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: expected %q, got %q", filepath.Base(name), want, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept")
+	}
+
+	// a reopened file keeps appending
+	file.Close()
+	file, err = NewRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("fifth\n"))
+	if got, _ := os.ReadFile(path); string(got) != "fourth\nfifth\n" {
+		t.Errorf("expected the file to be appended to, got %q", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var out bytes.Buffer
+	handler, err := NewHandler(&out, config.Log{Level: "warn", Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(handler)
+
+	ctx := WithRequestID(context.Background(), "abc123")
+	logger.InfoContext(ctx, "quiet")
+	logger.WarnContext(ctx, "loud", "model", "m")
+
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single json record, got %q", out.String())
+	}
+	if record["msg"] != "loud" || record["request_id"] != "abc123" || record["model"] != "m" {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	out.Reset()
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx = trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}))
+	logger.WarnContext(ctx, "traced")
+	if !strings.Contains(out.String(), `"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`) {
+		t.Errorf("expected the trace id in the record, got %q", out.String())
+	}
+
+	if _, err := NewHandler(&out, config.Log{Level: "loud"}); err == nil {
+		t.Errorf("expected an unknown level to fail")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	handler, _ := NewHandler(&out, config.Log{Level: "info", Format: "text"})
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(handler))
+
+	var seen string
+	server := Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = RequestID(req.Context())
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/simple/generate", nil))
+	if len(seen) != 16 || rec.Header().Get(vars.RequestIDHeader) != seen {
+		t.Errorf("expected a new id in the context and the response, got %q and %q", seen, rec.Header().Get(vars.RequestIDHeader))
+	}
+	if !strings.Contains(out.String(), "request_id="+seen) || !strings.Contains(out.String(), "status=418") {
+		t.Errorf("expected the request to be logged with its id and status, got %q", out.String())
+	}
+
+	// the client's id is kept, a bad one is replaced
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(vars.RequestIDHeader, "client-id.1")
+	server.ServeHTTP(httptest.NewRecorder(), req)
+	if seen != "client-id.1" {
+		t.Errorf("expected the client's id, got %q", seen)
+	}
+	req.Header.Set(vars.RequestIDHeader, "bad id\n")
+	server.ServeHTTP(httptest.NewRecorder(), req)
+	if seen == "bad id\n" || seen == "" {
+		t.Errorf("expected a bad id to be replaced, got %q", seen)
+	}
+}
+
+func TestStream(t *testing.T) {
+	handler, _ := NewHandler(io.Discard, config.Log{Level: "debug", Format: "text"})
+	logger := slog.New(handler).With("model", "qwen.gguf")
+
+	entries, cancel := Logs.Subscribe(Filter{Level: slog.LevelWarn, Pipeline: "cot"})
+	defer cancel()
+
+	ctx := WithPipeline(WithRequestID(context.Background(), "abc123"), "cot")
+	logger.InfoContext(ctx, "quiet")
+	logger.WarnContext(context.Background(), "other pipeline")
+	logger.WarnContext(ctx, "Error Starting Container", "err", "no gpu")
+
+	select {
+	case entry := <-entries:
+		if entry.Message != "Error Starting Container" || entry.Level != "WARN" || entry.RequestID != "abc123" || entry.Pipeline != "cot" {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+		if entry.Attrs["model"] != "qwen.gguf" || entry.Attrs["err"] != "no gpu" {
+			t.Errorf("expected the attributes of the record, got %v", entry.Attrs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an entry on the stream")
+	}
+	select {
+	case entry := <-entries:
+		t.Errorf("expected the other entries to be filtered out, got %+v", entry)
+	default:
+	}
+}
+
+func TestReadPage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs.txt")
+
+	// the backup is in json, the current file in text like after changing log.format
+	var backup, current bytes.Buffer
+	jsonHandler, _ := NewHandler(&backup, config.Log{Level: "debug", Format: "json"})
+	textHandler, _ := NewHandler(&current, config.Log{Level: "debug", Format: "text"})
+	ctx := WithPipeline(context.Background(), "deb")
+	for i := range 3 {
+		slog.New(jsonHandler).InfoContext(ctx, "old", "round", i)
+	}
+	current.WriteString("2025/01/02 15:04:05 [+] Server started\n")
+	for i := range 4 {
+		slog.New(textHandler).WarnContext(ctx, "new line", "round", i, "prompt", "a = b")
+	}
+	slog.New(textHandler).Error("unrelated")
+	os.WriteFile(path+".1", backup.Bytes(), 0640)
+	os.WriteFile(path, current.Bytes(), 0640)
+	files := []string{path + ".2", path + ".1", path}
+
+	page, err := ReadPage(files, Filter{Level: slog.LevelDebug, Pipeline: "deb"}, 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 5 || page.Next == 0 {
+		t.Fatalf("expected a full page with more to come, got %+v", page)
+	}
+	first := page.Entries[0]
+	if first.Message != "new line" || first.Level != "WARN" || first.Attrs["round"] != "3" || first.Attrs["prompt"] != "a = b" || first.Time.IsZero() {
+		t.Errorf("unexpected newest entry %+v", first)
+	}
+	if last := page.Entries[4]; last.Message != "old" || last.Attrs["round"] != "2" {
+		t.Errorf("expected the json backup to be read, got %+v", last)
+	}
+
+	page, err = ReadPage(files, Filter{Level: slog.LevelDebug, Pipeline: "deb"}, page.Next, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 2 || page.Next != 0 || page.Entries[1].Attrs["round"] != "0" {
+		t.Errorf("expected the last two entries, got %+v", page)
+	}
+
+	page, _ = ReadPage(files, Filter{Level: slog.LevelDebug}, 0, 100)
+	if len(page.Entries) != 9 {
+		t.Fatalf("expected every line, got %d", len(page.Entries))
+	}
+	if raw := page.Entries[5]; raw.Message != "2025/01/02 15:04:05 [+] Server started" {
+		t.Errorf("expected a line from before slog to be kept whole, got %+v", raw)
+	}
+	page, _ = ReadPage(files, Filter{Level: slog.LevelError}, 0, 100)
+	if len(page.Entries) != 1 || page.Entries[0].Message != "unrelated" {
+		t.Errorf("expected only the error, got %+v", page.Entries)
+	}
+}
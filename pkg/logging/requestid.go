@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+// validID keeps ids sent by clients short and printable.
+var validID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type (
+	requestIDKey struct{}
+
+	// StatusWriter remembers the status code sent, for the request log and the metrics.
+	StatusWriter struct {
+		http.ResponseWriter
+		Status int
+	}
+)
+
+// NewRequestID returns a random id.
+func NewRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// WithRequestID returns a context that carries id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id in ctx, or an empty string.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Middleware gives every request an id, keeping the one the client sent in the
+// X-Request-ID header if it's valid, and logs the request once it's done.
+// The id is sent back in the same header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(vars.RequestIDHeader)
+		if !validID.MatchString(id) {
+			id = NewRequestID()
+		}
+		w.Header().Set(vars.RequestIDHeader, id)
+
+		ctx := WithRequestID(req.Context(), id)
+		sw := NewStatusWriter(w)
+		started := time.Now()
+
+		next.ServeHTTP(sw, req.WithContext(ctx))
+
+		slog.InfoContext(ctx, "Request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", sw.Status,
+			"duration_ms", time.Since(started).Milliseconds(),
+		)
+	})
+}
+
+// NewStatusWriter wraps w, the status is 200 until another one is sent.
+func NewStatusWriter(w http.ResponseWriter) *StatusWriter {
+	return &StatusWriter{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (w *StatusWriter) WriteHeader(status int) {
+	w.Status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the writer underneath, for flushing.
+func (w *StatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
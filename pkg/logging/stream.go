@@ -0,0 +1,178 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+type (
+	// Entry is a single log record as it's sent to the frontend.
+	Entry struct {
+		// ID is the position of the entry in the log files, only set for entries read back from them.
+		ID        int               `json:"id,omitempty"`
+		Time      time.Time         `json:"time"`
+		Level     string            `json:"level"`
+		Message   string            `json:"msg"`
+		RequestID string            `json:"request_id,omitempty"`
+		Pipeline  string            `json:"pipeline,omitempty"`
+		Attrs     map[string]string `json:"attrs,omitempty"`
+	}
+
+	// Filter picks the entries a client wants, empty fields match everything.
+	Filter struct {
+		// Level is the lowest level kept.
+		Level     slog.Level
+		Pipeline  string
+		RequestID string
+	}
+
+	// Stream hands every record logged to the clients following the logs.
+	Stream struct {
+		mu   sync.Mutex
+		subs map[chan Entry]Filter
+	}
+
+	// streamHandler publishes records to a Stream before passing them on.
+	streamHandler struct {
+		slog.Handler
+		stream *Stream
+		// attrs were added with WithAttrs, already prefixed with their groups.
+		attrs  []slog.Attr
+		prefix string
+	}
+
+	pipelineKey struct{}
+)
+
+// Logs is the stream the default logger publishes to.
+var Logs = NewStream()
+
+// NewStream returns a stream without clients.
+func NewStream() *Stream {
+	return &Stream{subs: make(map[chan Entry]Filter)}
+}
+
+// Subscribe returns a channel getting the entries that match filter from now on.
+// Entries are dropped for a client that falls too far behind, cancel has to be called once it's done.
+func (s *Stream) Subscribe(filter Filter) (entries <-chan Entry, cancel func()) {
+	ch := make(chan Entry, vars.LogStreamBuffer)
+	s.mu.Lock()
+	s.subs[ch] = filter
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subs, ch)
+		s.mu.Unlock()
+	}
+}
+
+// Publish sends entry to every client whose filter matches it.
+func (s *Stream) Publish(entry Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch, filter := range s.subs {
+		if !filter.Match(entry) {
+			continue
+		}
+		select {
+		case ch <- entry:
+		default:
+			// a client that can't keep up misses entries rather than holding up logging
+		}
+	}
+}
+
+// Match reports whether entry passes the filter.
+// Entries without a level that can be read, like lines from before slog, count as info.
+func (f Filter) Match(entry Entry) bool {
+	level, err := ParseLevel(entry.Level)
+	if err != nil {
+		level = slog.LevelInfo
+	}
+	if level < f.Level {
+		return false
+	}
+	if f.Pipeline != "" && entry.Pipeline != f.Pipeline {
+		return false
+	}
+	if f.RequestID != "" && entry.RequestID != f.RequestID {
+		return false
+	}
+	return true
+}
+
+// WithPipeline returns a context whose logs are marked with the pipeline they were made by.
+func WithPipeline(ctx context.Context, pipeline string) context.Context {
+	return context.WithValue(ctx, pipelineKey{}, pipeline)
+}
+
+// Pipeline returns the pipeline in ctx, or an empty string.
+func Pipeline(ctx context.Context) string {
+	pipeline, _ := ctx.Value(pipelineKey{}).(string)
+	return pipeline
+}
+
+func (h streamHandler) Handle(ctx context.Context, r slog.Record) error {
+	entry := Entry{
+		Time:    r.Time,
+		Level:   r.Level.String(),
+		Message: r.Message,
+	}
+	for _, attr := range h.attrs {
+		entry.add(attr.Key, attr.Value)
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		entry.add(h.prefix+attr.Key, attr.Value)
+		return true
+	})
+	h.stream.Publish(entry)
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h streamHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := h
+	next.Handler = h.Handler.WithAttrs(attrs)
+	next.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	next.attrs = append(next.attrs, h.attrs...)
+	for _, attr := range attrs {
+		next.attrs = append(next.attrs, slog.Attr{Key: h.prefix + attr.Key, Value: attr.Value})
+	}
+	return next
+}
+
+func (h streamHandler) WithGroup(name string) slog.Handler {
+	next := h
+	next.Handler = h.Handler.WithGroup(name)
+	next.prefix = h.prefix + name + "."
+	return next
+}
+
+// add sets key on the entry, groups are flattened into dotted keys.
+func (e *Entry) add(key string, value slog.Value) {
+	value = value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, attr := range value.Group() {
+			e.add(strings.TrimPrefix(key+"."+attr.Key, "."), attr.Value)
+		}
+		return
+	}
+
+	switch key {
+	case "request_id":
+		e.RequestID = value.String()
+	case "pipeline":
+		e.Pipeline = value.String()
+	default:
+		if e.Attrs == nil {
+			e.Attrs = make(map[string]string)
+		}
+		e.Attrs[key] = value.String()
+	}
+}
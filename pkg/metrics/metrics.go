@@ -0,0 +1,164 @@
+/*
+Package metrics exports the prometheus metrics of slape on GET /metrics.
+
+Requests are counted per route and per pipeline and mode, the stages of a pipeline
+(starting containers, waiting on llama.cpp, thinking, searching and generating) are timed,
+and every completion adds its tokens and time to its model so tokens per second can be graphed.
+The dashboard in YAML/grafana-dashboard.json is built on these metrics.
+*/
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Stages of a pipeline run.
+const (
+	StageContainerStart = "container_start"
+	StageReadiness      = "readiness_wait"
+	StageThinking       = "thinking"
+	StageSearch         = "search"
+	StageDocuments      = "documents"
+	StageGeneration     = "generation"
+)
+
+// Registry holds every slape metric along with the go runtime and process metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slape_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "slape_http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests by route.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"route", "method"})
+
+	pipelineRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slape_pipeline_requests_total",
+		Help: "Generate requests by pipeline, prompt mode and status, ok or error.",
+	}, []string{"pipeline", "mode", "status"})
+
+	pipelineDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "slape_pipeline_request_duration_seconds",
+		Help:    "Time taken by generate requests by pipeline and prompt mode.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"pipeline", "mode"})
+
+	stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "slape_stage_duration_seconds",
+		Help:    "Time taken by each stage of a pipeline.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2.5, 12),
+	}, []string{"pipeline", "stage"})
+
+	activeJobs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "slape_active_jobs",
+		Help: "Generate requests being worked on by pipeline.",
+	}, []string{"pipeline"})
+
+	tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slape_model_tokens_total",
+		Help: "Tokens read and generated by each model, kind is prompt or completion.",
+	}, []string{"model", "kind"})
+
+	completionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "slape_model_completion_duration_seconds",
+		Help:    "Time taken by each completion by model.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 12),
+	}, []string{"model"})
+
+	completionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slape_model_completion_errors_total",
+		Help: "Completions that failed by model.",
+	}, []string{"model"})
+
+	containerRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slape_container_restarts_total",
+		Help: "Containers started again by pipelines that swap models between rounds.",
+	}, []string{"pipeline"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration,
+		pipelineRequests, pipelineDuration, stageDuration, activeJobs,
+		tokens, completionDuration, completionErrors,
+		containerRestarts,
+	)
+}
+
+// Handler serves the metrics for GET /metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// JobStarted counts a generate request that is being worked on.
+func JobStarted(pipeline string) {
+	activeJobs.WithLabelValues(pipeline).Inc()
+}
+
+// JobFinished records a generate request once it's done, an empty mode is counted as none.
+func JobFinished(pipeline string, mode string, took time.Duration, err error) {
+	if mode == "" {
+		mode = "none"
+	}
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+
+	activeJobs.WithLabelValues(pipeline).Dec()
+	pipelineRequests.WithLabelValues(pipeline, mode, status).Inc()
+	pipelineDuration.WithLabelValues(pipeline, mode).Observe(took.Seconds())
+}
+
+// Stage records how long a stage of a pipeline took since started.
+func Stage(pipeline string, stage string, started time.Time) {
+	stageDuration.WithLabelValues(pipeline, stage).Observe(time.Since(started).Seconds())
+}
+
+// Completion records the tokens and time of a completion, failed ones are only counted.
+func Completion(model string, promptTokens int64, completionTokens int64, took time.Duration, err error) {
+	if err != nil {
+		completionErrors.WithLabelValues(model).Inc()
+		return
+	}
+	tokens.WithLabelValues(model, "prompt").Add(float64(promptTokens))
+	tokens.WithLabelValues(model, "completion").Add(float64(completionTokens))
+	completionDuration.WithLabelValues(model).Observe(took.Seconds())
+}
+
+// ContainerRestarted counts a container a pipeline started again.
+func ContainerRestarted(pipeline string) {
+	containerRestarts.WithLabelValues(pipeline).Inc()
+}
+
+// Middleware counts and times every request by the route pattern that matched it,
+// so ids in the path don't make a new series. It has to wrap the mux itself for the pattern to be set.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := logging.NewStatusWriter(w)
+		started := time.Now()
+
+		next.ServeHTTP(sw, req)
+
+		route := req.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(route, req.Method, strconv.Itoa(sw.Status)).Inc()
+		httpDuration.WithLabelValues(route, req.Method).Observe(time.Since(started).Seconds())
+	})
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestJobs(t *testing.T) {
+	JobStarted("simple")
+	if got := testutil.ToFloat64(activeJobs.WithLabelValues("simple")); got != 1 {
+		t.Errorf("expected 1 active job, got %v", got)
+	}
+	JobFinished("simple", "cot", time.Second, nil)
+	JobStarted("simple")
+	JobFinished("simple", "", time.Second, errors.New("model went away"))
+
+	if got := testutil.ToFloat64(activeJobs.WithLabelValues("simple")); got != 0 {
+		t.Errorf("expected no active jobs, got %v", got)
+	}
+	if got := testutil.ToFloat64(pipelineRequests.WithLabelValues("simple", "cot", "ok")); got != 1 {
+		t.Errorf("expected 1 ok request, got %v", got)
+	}
+	if got := testutil.ToFloat64(pipelineRequests.WithLabelValues("simple", "none", "error")); got != 1 {
+		t.Errorf("expected 1 failed request without a mode, got %v", got)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	Completion("qwen.gguf", 100, 40, 2*time.Second, nil)
+	Completion("qwen.gguf", 0, 0, time.Second, errors.New("refused"))
+
+	if got := testutil.ToFloat64(tokens.WithLabelValues("qwen.gguf", "completion")); got != 40 {
+		t.Errorf("expected 40 completion tokens, got %v", got)
+	}
+	if got := testutil.ToFloat64(completionErrors.WithLabelValues("qwen.gguf")); got != 1 {
+		t.Errorf("expected 1 failed completion, got %v", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /runs/{id}", func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	mux.Handle("GET /metrics", Handler())
+	server := Middleware(mux)
+
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/runs/abc", nil))
+	Stage("deb", StageReadiness, time.Now())
+	ContainerRestarted("deb")
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`slape_http_requests_total{code="404",method="GET",route="GET /runs/{id}"} 1`,
+		`slape_stage_duration_seconds_count{pipeline="deb",stage="readiness_wait"} 1`,
+		`slape_container_restarts_total{pipeline="deb"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the metrics to contain %s", want)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+// States of a pull.
+const (
+	StateResolving   = "resolving"
+	StateDownloading = "downloading"
+	StateVerifying   = "verifying"
+	StateDone        = "done"
+	StateFailed      = "failed"
+)
+
+type (
+	// Progress is how far along a pull is, it's sent as the events of POST /models/pull.
+	Progress struct {
+		Name  string `json:"name"`
+		State string `json:"state"`
+		// Total is 0 when the size isn't known.
+		Total int64  `json:"total"`
+		Done  int64  `json:"done"`
+		Error string `json:"error,omitempty"`
+	}
+
+	// Pull is a model being downloaded, everyone pulling the same model shares it.
+	Pull struct {
+		mu       sync.Mutex
+		progress Progress
+		err      error
+		// changed is closed and replaced every time progress is sent
+		changed chan struct{}
+		sent    time.Time
+		done    chan struct{}
+	}
+)
+
+func (p Progress) finished() bool {
+	return p.State == StateDone || p.State == StateFailed
+}
+
+// Progress returns where the pull is now.
+func (p *Pull) Progress() Progress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.progress
+}
+
+// Watch returns where the pull is now and a channel that is closed when that changes.
+func (p *Pull) Watch() (Progress, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.progress, p.changed
+}
+
+// Wait blocks until the pull is over or ctx is done, the download keeps going either way.
+func (p *Pull) Wait(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// update changes the progress, watchers are only told at most every ModelProgressInterval unless force is set.
+func (p *Pull) update(force bool, change func(*Progress)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	change(&p.progress)
+	if !force && time.Since(p.sent) < vars.ModelProgressInterval*time.Millisecond {
+		return
+	}
+	p.sent = time.Now()
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// finish ends the pull with err, nil when the model is in place.
+func (p *Pull) finish(err error) {
+	p.update(true, func(progress *Progress) {
+		progress.State = StateDone
+		if err != nil {
+			progress.State = StateFailed
+			progress.Error = err.Error()
+		}
+	})
+	p.err = err
+	close(p.done)
+}
+
+// Write counts the bytes downloaded.
+func (p *Pull) Write(b []byte) (int, error) {
+	p.update(false, func(progress *Progress) {
+		progress.Done += int64(len(b))
+	})
+	return len(b), nil
+}
+
+// Start begins pulling a model, or returns the pull of it that is already running.
+func (m *Manager) Start(src Source) (*Pull, error) {
+	if m.Offline {
+		return nil, ErrOffline
+	}
+	name, err := src.name()
+	if err != nil {
+		return nil, err
+	}
+	// only hugging face publishes checksums, a url has to bring its own
+	if src.URL != "" && src.SHA256 == "" {
+		return nil, fmt.Errorf("%w: a url needs the sha256 of the model", ErrInvalid)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pull, ok := m.pulls[name]; ok && !pull.Progress().finished() {
+		return pull, nil
+	}
+	pull := &Pull{
+		progress: Progress{Name: name, State: StateResolving},
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	m.pulls[name] = pull
+
+	go func() {
+		err := m.download(context.Background(), src, name, pull)
+		if err != nil {
+			slog.Error("Error Pulling Model", "model", name, "err", err)
+		} else {
+			slog.Info("Pulled Model", "model", name)
+		}
+		pull.finish(err)
+	}()
+	return pull, nil
+}
+
+// Pulling returns the last pull of a model, nil if it wasn't pulled since slape started.
+func (m *Manager) Pulling(name string) *Pull {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pulls[name]
+}
+
+// Pull downloads a model and waits for it.
+func (m *Manager) Pull(ctx context.Context, src Source) error {
+	pull, err := m.Start(src)
+	if err != nil {
+		return err
+	}
+	return pull.Wait(ctx)
+}
+
+// Ensure pulls a model if it isn't in the folder yet. In offline mode a missing model is an error.
+func (m *Manager) Ensure(ctx context.Context, src Source) error {
+	name, err := src.name()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(m.Dir, name))
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if m.Offline {
+		return fmt.Errorf("%w: %s isn't in %s", ErrOffline, name, m.Dir)
+	}
+
+	slog.InfoContext(ctx, "Pulling Model", "model", name)
+	return m.Pull(ctx, src)
+}
+
+// name is the file the model is saved as.
+func (src Source) name() (string, error) {
+	name := src.Name
+	switch {
+	case name != "":
+	case src.URL != "":
+		u, err := url.Parse(src.URL)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		name = path.Base(u.Path)
+	case src.Repo != "" && src.File != "":
+		name = path.Base(src.File)
+	default:
+		return "", fmt.Errorf("%w: a repo and file or a url is needed", ErrInvalid)
+	}
+	return name, validName(name)
+}
+
+// download fetches a model into its partial file, checks it and moves it into the folder.
+func (m *Manager) download(ctx context.Context, src Source, name string, pull *Pull) error {
+	link, expected, size, err := m.resolve(ctx, src)
+	if err != nil {
+		return err
+	}
+	pull.update(true, func(progress *Progress) {
+		progress.State = StateDownloading
+		progress.Total = size
+	})
+
+	part := m.partPath(name)
+	err = os.MkdirAll(filepath.Dir(part), 0750)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// hash what was downloaded before so it doesn't have to be read again once the rest is in
+	hasher := sha256.New()
+	offset, err := io.Copy(hasher, file)
+	if err != nil {
+		return err
+	}
+	pull.update(true, func(progress *Progress) {
+		progress.Done = offset
+	})
+
+	err = m.fetch(ctx, src, link, file, hasher, offset, pull)
+	if err != nil {
+		return err
+	}
+
+	pull.update(true, func(progress *Progress) {
+		progress.State = StateVerifying
+	})
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if expected != "" && sum != expected {
+		file.Close()
+		os.Remove(part)
+		return fmt.Errorf("%w: %s should be %s, got %s", ErrChecksum, name, expected, sum)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(part, filepath.Join(m.Dir, name))
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filepath.Join(m.Dir, name))
+	if err != nil {
+		return err
+	}
+	return m.record(Model{
+		Name:   name,
+		Size:   info.Size(),
+		SHA256: sum,
+		Repo:   src.Repo,
+		File:   src.File,
+		URL:    src.URL,
+		Pulled: time.Now().UTC(),
+	})
+}
+
+// fetch downloads the rest of a model into file from offset, the server decides if it can be resumed.
+func (m *Manager) fetch(ctx context.Context, src Source, link string, file *os.File, hasher hash.Hash, offset int64, pull *Pull) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return err
+	}
+	m.authorize(req, src)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the partial file is already all there
+		return nil
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+	case resp.StatusCode == http.StatusOK:
+		// the server sent the whole file, start over
+		err = file.Truncate(0)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return err
+		}
+		hasher.Reset()
+		pull.update(true, func(progress *Progress) {
+			progress.Done = 0
+			if resp.ContentLength > 0 {
+				progress.Total = resp.ContentLength
+			}
+		})
+	default:
+		return fmt.Errorf("error downloading %s: %s", link, resp.Status)
+	}
+
+	_, err = io.Copy(io.MultiWriter(file, hasher, pull), resp.Body)
+	return err
+}
+
+// resolve returns the url of a model and the sha256 and size hugging face has for it, if it has them.
+// The checksum in the source is used over the one from hugging face.
+func (m *Manager) resolve(ctx context.Context, src Source) (string, string, int64, error) {
+	expected := strings.ToLower(src.SHA256)
+	if expected != "" && !isSHA256(expected) {
+		return "", "", 0, fmt.Errorf("%w: sha256 has to be 64 hex characters", ErrInvalid)
+	}
+	if src.URL != "" {
+		return src.URL, expected, 0, nil
+	}
+
+	revision := src.Revision
+	if revision == "" {
+		revision = "main"
+	}
+	link := strings.TrimSuffix(m.HuggingFace, "/") + "/" + src.Repo + "/resolve/" + url.PathEscape(revision) + "/" + src.File
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, link, nil)
+	if err != nil {
+		return "", "", 0, err
+	}
+	m.authorize(req, src)
+
+	// the checksum is on the redirect to the file storage, so it's not followed
+	client := *m.Client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", 0, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return "", "", 0, fmt.Errorf("error pulling %s/%s: %s, gated models need HF_TOKEN to be set", src.Repo, src.File, resp.Status)
+	case resp.StatusCode == http.StatusNotFound:
+		return "", "", 0, fmt.Errorf("%w: %s/%s on hugging face", ErrNotFound, src.Repo, src.File)
+	case resp.StatusCode >= 400:
+		return "", "", 0, fmt.Errorf("error pulling %s/%s: %s", src.Repo, src.File, resp.Status)
+	}
+
+	etag := strings.Trim(strings.TrimPrefix(resp.Header.Get("X-Linked-Etag"), "W/"), `"`)
+	if expected == "" && isSHA256(etag) {
+		expected = strings.ToLower(etag)
+	}
+	size, _ := strconv.ParseInt(resp.Header.Get("X-Linked-Size"), 10, 64)
+	if size == 0 && resp.StatusCode == http.StatusOK {
+		size = resp.ContentLength
+	}
+	return link, expected, max(size, 0), nil
+}
+
+// authorize adds the token to requests to hugging face.
+func (m *Manager) authorize(req *http.Request, src Source) {
+	if m.Token != "" && src.URL == "" {
+		req.Header.Set("Authorization", "Bearer "+m.Token)
+	}
+}
+
+func isSHA256(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,369 @@
+package models
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Types of model, what llama.cpp serves them as.
+const (
+	TypeGeneration = "generation"
+	TypeEmbedding  = "embedding"
+	TypeRerank     = "rerank"
+)
+
+// Types are the types of model there are.
+var Types = []string{TypeGeneration, TypeEmbedding, TypeRerank}
+
+var (
+	// ErrNotGGUF is returned for a file that isn't a gguf model llama.cpp can read.
+	ErrNotGGUF = errors.New("not a valid gguf file")
+	// ErrWrongType is returned for a model that can't be used for what it was picked for.
+	ErrWrongType = errors.New("wrong type of model")
+)
+
+// Metadata is what the header of a gguf file says about the model.
+type Metadata struct {
+	// Version is the version of the gguf format.
+	Version      uint32 `json:"gguf_version"`
+	Name         string `json:"name,omitempty"`
+	Architecture string `json:"architecture"`
+	// Parameters is counted from the tensors in the file.
+	Parameters   uint64 `json:"parameters"`
+	Quantization string `json:"quantization,omitempty"`
+	// ContextLength is the context the model was trained with.
+	ContextLength   uint64 `json:"context_length,omitempty"`
+	EmbeddingLength uint64 `json:"embedding_length,omitempty"`
+	ChatTemplate    string `json:"chat_template,omitempty"`
+	Type            string `json:"type"`
+}
+
+// Check returns ErrWrongType if the model isn't of type kind.
+func (meta Metadata) Check(kind string) error {
+	if meta.Type != kind {
+		return fmt.Errorf("%w: %s is for %s, not %s", ErrWrongType, meta.Architecture, meta.Type, kind)
+	}
+	return nil
+}
+
+// gguf value types
+const (
+	ggufUint8 uint32 = iota
+	ggufInt8
+	ggufUint16
+	ggufInt16
+	ggufUint32
+	ggufInt32
+	ggufFloat32
+	ggufBool
+	ggufString
+	ggufArray
+	ggufUint64
+	ggufInt64
+	ggufFloat64
+)
+
+// fixed size of the gguf value types that aren't strings or arrays
+var ggufSizes = map[uint32]int64{
+	ggufUint8: 1, ggufInt8: 1, ggufBool: 1,
+	ggufUint16: 2, ggufInt16: 2,
+	ggufUint32: 4, ggufInt32: 4, ggufFloat32: 4,
+	ggufUint64: 8, ggufInt64: 8, ggufFloat64: 8,
+}
+
+// fileTypes are the names of general.file_type, llama_ftype in llama.cpp.
+var fileTypes = map[uint64]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 7: "Q8_0", 8: "Q5_0", 9: "Q5_1",
+	10: "Q2_K", 11: "Q3_K_S", 12: "Q3_K_M", 13: "Q3_K_L", 14: "Q4_K_S", 15: "Q4_K_M",
+	16: "Q5_K_S", 17: "Q5_K_M", 18: "Q6_K", 19: "IQ2_XXS", 20: "IQ2_XS", 21: "Q2_K_S",
+	22: "IQ3_XS", 23: "IQ3_XXS", 24: "IQ1_S", 25: "IQ4_NL", 26: "IQ3_S", 27: "IQ3_M",
+	28: "IQ2_S", 29: "IQ2_M", 30: "IQ4_XS", 31: "IQ1_M", 32: "BF16", 36: "TQ1_0", 37: "TQ2_0",
+}
+
+// tensorTypes are the names of ggml_type, used when a file has no general.file_type.
+var tensorTypes = map[uint32]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 6: "Q5_0", 7: "Q5_1", 8: "Q8_0", 9: "Q8_1",
+	10: "Q2_K", 11: "Q3_K", 12: "Q4_K", 13: "Q5_K", 14: "Q6_K", 15: "Q8_K",
+	16: "IQ2_XXS", 17: "IQ2_XS", 18: "IQ3_XXS", 19: "IQ1_S", 20: "IQ4_NL", 21: "IQ3_S",
+	22: "IQ2_S", 23: "IQ4_XS", 24: "I8", 25: "I16", 26: "I32", 27: "I64", 28: "F64",
+	29: "IQ1_M", 30: "BF16", 34: "TQ1_0", 35: "TQ2_0",
+}
+
+// encoders are architectures that only make embeddings.
+var encoders = []string{"bert", "nomic-bert", "nomic-bert-moe", "jina-bert-v2", "modern-bert", "neo-bert", "t5encoder"}
+
+const (
+	// longest key or string value read, chat templates are the longest ones kept
+	ggufMaxString = 16 << 20
+	// ggml tensors have at most 4 dimensions
+	ggufMaxDims = 4
+	// llama_pooling_type rank, used by rerankers
+	poolingRank = 4
+)
+
+// ReadMetadata reads the header of the gguf file at path.
+func ReadMetadata(path string) (Metadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer file.Close()
+
+	return ParseGGUF(file)
+}
+
+// ParseGGUF reads the metadata and tensor infos at the start of a gguf file, the tensors themselves aren't read.
+func ParseGGUF(r io.Reader) (Metadata, error) {
+	g := &ggufReader{r: bufio.NewReaderSize(r, 1<<16)}
+	meta, err := g.parse()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = fmt.Errorf("%w: the header ends early", ErrNotGGUF)
+	}
+	return meta, err
+}
+
+type ggufReader struct {
+	r *bufio.Reader
+}
+
+func (g *ggufReader) parse() (Metadata, error) {
+	var meta Metadata
+
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(g.r, magic)
+	if err != nil {
+		return meta, err
+	}
+	if string(magic) != "GGUF" {
+		return meta, fmt.Errorf("%w: bad magic %q", ErrNotGGUF, magic)
+	}
+	meta.Version, err = g.uint32()
+	if err != nil {
+		return meta, err
+	}
+	// version 1 used 32 bit counts and is no longer loaded by llama.cpp
+	if meta.Version < 2 || meta.Version > 3 {
+		return meta, fmt.Errorf("%w: unsupported version %d", ErrNotGGUF, meta.Version)
+	}
+
+	tensors, err := g.uint64()
+	if err != nil {
+		return meta, err
+	}
+	count, err := g.uint64()
+	if err != nil {
+		return meta, err
+	}
+
+	// values are kept by key until the architecture is known, it's the prefix of most keys
+	values := map[string]any{}
+	for range count {
+		key, err := g.string()
+		if err != nil {
+			return meta, err
+		}
+		kind, err := g.uint32()
+		if err != nil {
+			return meta, err
+		}
+		value, err := g.value(kind)
+		if err != nil {
+			return meta, fmt.Errorf("%w (key %s)", err, key)
+		}
+		if value != nil {
+			values[key] = value
+		}
+	}
+
+	meta.Architecture, _ = values["general.architecture"].(string)
+	if meta.Architecture == "" {
+		return meta, fmt.Errorf("%w: general.architecture is missing", ErrNotGGUF)
+	}
+	meta.Name, _ = values["general.name"].(string)
+	meta.ChatTemplate, _ = values["tokenizer.chat_template"].(string)
+	meta.ContextLength, _ = unsigned(values[meta.Architecture+".context_length"])
+	meta.EmbeddingLength, _ = unsigned(values[meta.Architecture+".embedding_length"])
+	if fileType, ok := unsigned(values["general.file_type"]); ok {
+		meta.Quantization = fileTypes[fileType]
+	}
+
+	// the most used tensor type stands in for a missing file type
+	elements := map[uint32]uint64{}
+	for range tensors {
+		_, err := g.string()
+		if err != nil {
+			return meta, err
+		}
+		dims, err := g.uint32()
+		if err != nil {
+			return meta, err
+		}
+		if dims > ggufMaxDims {
+			return meta, fmt.Errorf("%w: tensor with %d dimensions", ErrNotGGUF, dims)
+		}
+		n := uint64(1)
+		for range dims {
+			dim, err := g.uint64()
+			if err != nil {
+				return meta, err
+			}
+			n *= dim
+		}
+		kind, err := g.uint32()
+		if err != nil {
+			return meta, err
+		}
+		// offset of the tensor data
+		_, err = g.uint64()
+		if err != nil {
+			return meta, err
+		}
+		meta.Parameters += n
+		elements[kind] += n
+	}
+	if meta.Quantization == "" && len(elements) != 0 {
+		kinds := make([]uint32, 0, len(elements))
+		for kind := range elements {
+			kinds = append(kinds, kind)
+		}
+		most := slices.MaxFunc(kinds, func(a, b uint32) int {
+			return cmp.Compare(elements[a], elements[b])
+		})
+		meta.Quantization = tensorTypes[most]
+	}
+
+	meta.Type = modelType(meta.Architecture, values)
+	return meta, nil
+}
+
+// modelType works out if a model generates text, makes embeddings or ranks documents
+// from its pooling, its attention and its architecture.
+func modelType(arch string, values map[string]any) string {
+	pooling, hasPooling := unsigned(values[arch+".pooling_type"])
+	causal, hasCausal := values[arch+".attention.causal"].(bool)
+	switch {
+	case hasPooling && pooling == poolingRank:
+		return TypeRerank
+	case hasPooling && pooling != 0:
+		return TypeEmbedding
+	case hasCausal && !causal:
+		return TypeEmbedding
+	case slices.Contains(encoders, arch):
+		return TypeEmbedding
+	}
+	return TypeGeneration
+}
+
+// value reads a value of type kind, only strings, bools and integers are kept, the rest is skipped.
+func (g *ggufReader) value(kind uint32) (any, error) {
+	switch kind {
+	case ggufString:
+		return g.string()
+	case ggufArray:
+		return nil, g.skipArray()
+	case ggufBool:
+		b, err := g.r.ReadByte()
+		return b != 0, err
+	case ggufUint8, ggufInt8:
+		b, err := g.r.ReadByte()
+		return uint64(b), err
+	case ggufUint16, ggufInt16:
+		var v uint16
+		err := binary.Read(g.r, binary.LittleEndian, &v)
+		return uint64(v), err
+	case ggufUint32, ggufInt32:
+		v, err := g.uint32()
+		return uint64(v), err
+	case ggufUint64, ggufInt64:
+		return g.uint64()
+	case ggufFloat32, ggufFloat64:
+		_, err := g.r.Discard(int(ggufSizes[kind]))
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: unknown value type %d", ErrNotGGUF, kind)
+}
+
+// skipArray reads past an array, like the vocabulary of the tokenizer.
+func (g *ggufReader) skipArray() error {
+	kind, err := g.uint32()
+	if err != nil {
+		return err
+	}
+	n, err := g.uint64()
+	if err != nil {
+		return err
+	}
+
+	if size, ok := ggufSizes[kind]; ok {
+		if n > math.MaxInt64/uint64(size) {
+			return fmt.Errorf("%w: array of %d values", ErrNotGGUF, n)
+		}
+		_, err = io.CopyN(io.Discard, g.r, int64(n)*size)
+		return err
+	}
+	for range n {
+		switch kind {
+		case ggufString:
+			err = g.skipString()
+		case ggufArray:
+			err = g.skipArray()
+		default:
+			err = fmt.Errorf("%w: unknown value type %d", ErrNotGGUF, kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *ggufReader) string() (string, error) {
+	n, err := g.uint64()
+	if err != nil {
+		return "", err
+	}
+	if n > ggufMaxString {
+		return "", fmt.Errorf("%w: string of %d bytes", ErrNotGGUF, n)
+	}
+	var b strings.Builder
+	_, err = io.CopyN(&b, g.r, int64(n))
+	return b.String(), err
+}
+
+func (g *ggufReader) skipString() error {
+	n, err := g.uint64()
+	if err != nil {
+		return err
+	}
+	if n > ggufMaxString {
+		return fmt.Errorf("%w: string of %d bytes", ErrNotGGUF, n)
+	}
+	_, err = io.CopyN(io.Discard, g.r, int64(n))
+	return err
+}
+
+func (g *ggufReader) uint32() (uint32, error) {
+	var v uint32
+	err := binary.Read(g.r, binary.LittleEndian, &v)
+	return v, err
+}
+
+func (g *ggufReader) uint64() (uint64, error) {
+	var v uint64
+	err := binary.Read(g.r, binary.LittleEndian, &v)
+	return v, err
+}
+
+// unsigned returns an integer value read from the header.
+func unsigned(value any) (uint64, bool) {
+	v, ok := value.(uint64)
+	return v, ok
+}
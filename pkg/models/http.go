@@ -0,0 +1,131 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ListModelsRequest, handlerfunc expects GET method and returns the models in the folder with where they came from
+// and what their gguf header says about them. The query can have type, one of generation, embedding or rerank,
+// to only list the models llama.cpp can load as that type.
+func (m *Manager) ListModelsRequest(w http.ResponseWriter, req *http.Request) {
+	kind := req.URL.Query().Get("type")
+	if kind != "" && !slices.Contains(Types, kind) {
+		http.Error(w, "Error type has to be one of "+strings.Join(Types, ", "), http.StatusBadRequest)
+		return
+	}
+
+	list, err := m.List()
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Listing Models", "err", err)
+		http.Error(w, "Error listing models", http.StatusInternalServerError)
+		return
+	}
+	if kind != "" {
+		list = slices.DeleteFunc(list, func(model Model) bool {
+			return model.Metadata == nil || model.Metadata.Type != kind
+		})
+	}
+
+	json, err := json.Marshal(map[string]any{"models": list, "offline": m.Offline})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error marshaling models", "err", err)
+		http.Error(w, "Error marshaling models", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// PullModelRequest, handlerfunc expects POST method with a Source and streams the progress of the pull as server sent events.
+// The download keeps going if the client goes away, pulling the same model again picks the progress back up.
+func (m *Manager) PullModelRequest(w http.ResponseWriter, req *http.Request) {
+	var src Source
+	err := json.NewDecoder(req.Body).Decode(&src)
+	if err != nil {
+		http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
+		return
+	}
+
+	pull, err := m.Start(src)
+	switch {
+	case errors.Is(err, ErrOffline):
+		http.Error(w, "Error "+err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, ErrInvalid):
+		http.Error(w, "Error "+err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		slog.ErrorContext(req.Context(), "Error Pulling Model", "err", err)
+		http.Error(w, "Error pulling model", http.StatusInternalServerError)
+		return
+	}
+
+	streamProgress(w, req, pull)
+}
+
+// PullStatusRequest, handlerfunc expects GET method and streams the progress of a pull as server sent events.
+func (m *Manager) PullStatusRequest(w http.ResponseWriter, req *http.Request) {
+	pull := m.Pulling(req.PathValue("name"))
+	if pull == nil {
+		http.Error(w, "Error model is not being pulled", http.StatusNotFound)
+		return
+	}
+
+	streamProgress(w, req, pull)
+}
+
+// DeleteModelRequest, handlerfunc expects DELETE method and removes a model from the folder.
+func (m *Manager) DeleteModelRequest(w http.ResponseWriter, req *http.Request) {
+	err := m.Delete(req.PathValue("name"))
+	switch {
+	case errors.Is(err, ErrInvalid):
+		http.Error(w, "Error "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "Error model not found", http.StatusNotFound)
+	case errors.Is(err, ErrPulling):
+		http.Error(w, "Error model is being pulled", http.StatusConflict)
+	case err != nil:
+		slog.ErrorContext(req.Context(), "Error Deleting Model", "err", err)
+		http.Error(w, "Error deleting model", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// streamProgress sends the progress of a pull until it's over or the client leaves.
+func streamProgress(w http.ResponseWriter, req *http.Request, pull *Pull) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	flusher := http.NewResponseController(w)
+	for {
+		progress, changed := pull.Watch()
+		data, err := json.Marshal(progress)
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		if err != nil || flusher.Flush() != nil {
+			return
+		}
+		if progress.finished() {
+			return
+		}
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-changed:
+		}
+	}
+}
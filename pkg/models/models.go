@@ -0,0 +1,291 @@
+/*
+Package models manages the gguf models in the models folder.
+
+Models are pulled from a hugging face repo or a plain url. Downloads go to a partial file first
+so a pull that is cut off picks up where it stopped, and a model is only moved into the folder once
+its sha256 matches the one hugging face publishes for the file, or the one given with a url. A catalog records where every
+model came from and its checksum. In offline mode nothing is downloaded and only the models
+already in the folder are used.
+*/
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+var (
+	// ErrOffline is returned for a pull in offline mode.
+	ErrOffline = errors.New("models are offline, only the models already in the models folder can be used")
+	// ErrChecksum is returned when a download doesn't match its sha256.
+	ErrChecksum = errors.New("checksum mismatch")
+	// ErrNotFound is returned for a model that isn't in the folder.
+	ErrNotFound = errors.New("model not found")
+	// ErrPulling is returned when deleting a model that is being pulled.
+	ErrPulling = errors.New("model is being pulled")
+	// ErrInvalid is returned for a pull without a source or with a bad name.
+	ErrInvalid = errors.New("invalid model")
+)
+
+type (
+	// Source is where a model is pulled from, a hugging face repo and file or a url.
+	// It's the body of POST /models/pull.
+	Source struct {
+		Repo string `json:"repo,omitempty"`
+		// File is the path of the model in the repo.
+		File string `json:"file,omitempty"`
+		// Revision is a branch, tag or commit of the repo, main by default.
+		Revision string `json:"revision,omitempty"`
+		URL      string `json:"url,omitempty"`
+		// Name is what the model is saved as, the name of the file by default.
+		Name string `json:"name,omitempty"`
+		// SHA256 is checked instead of the one hugging face has, it's required for urls.
+		SHA256 string `json:"sha256,omitempty"`
+	}
+
+	// Model is a model in the folder, with where it came from if it was pulled.
+	Model struct {
+		Name   string    `json:"name"`
+		Size   int64     `json:"size"`
+		SHA256 string    `json:"sha256,omitempty"`
+		Repo   string    `json:"repo,omitempty"`
+		File   string    `json:"file,omitempty"`
+		URL    string    `json:"url,omitempty"`
+		Pulled time.Time `json:"pulled,omitzero"`
+		// Metadata is read from the header of the file, it's nil when the file can't be read.
+		Metadata *Metadata `json:"metadata,omitempty"`
+		// Error is why the header couldn't be read.
+		Error string `json:"error,omitempty"`
+	}
+
+	// Manager pulls, lists and deletes the models in Dir.
+	Manager struct {
+		Dir     string
+		Catalog string
+		// HuggingFace is the url repos are pulled from.
+		HuggingFace string
+		// Token is sent to hugging face for gated models.
+		Token   string
+		Offline bool
+		Client  *http.Client
+
+		mu      sync.Mutex
+		catalog map[string]Model
+		pulls   map[string]*Pull
+		headers map[string]header
+	}
+
+	// header is the metadata of a file, kept until the file changes.
+	header struct {
+		size     int64
+		modified time.Time
+		metadata Metadata
+		err      error
+	}
+)
+
+// Default is the manager of the models folder.
+var Default = New(vars.ModelDir, vars.ModelCatalog)
+
+// New returns a manager of the models in dir that keeps its catalog at catalog.
+func New(dir string, catalog string) *Manager {
+	return &Manager{
+		Dir:         dir,
+		Catalog:     catalog,
+		HuggingFace: vars.HuggingFaceURL,
+		Client:      http.DefaultClient,
+		pulls:       make(map[string]*Pull),
+		headers:     make(map[string]header),
+	}
+}
+
+// List returns the gguf files in the folder sorted by name, with what the catalog and their headers say about them.
+func (m *Manager) List() ([]Model, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Model{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Model{}
+	for _, entry := range entries {
+		if entry.IsDir() || validName(entry.Name()) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		m.mu.Lock()
+		model, ok := m.loadCatalog()[entry.Name()]
+		m.mu.Unlock()
+		if !ok {
+			model = Model{Name: entry.Name()}
+		}
+		model.Size = info.Size()
+
+		metadata, err := m.metadata(info)
+		if err != nil {
+			model.Error = err.Error()
+		} else {
+			model.Metadata = &metadata
+		}
+		list = append(list, model)
+	}
+	slices.SortFunc(list, func(a, b Model) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list, nil
+}
+
+// Metadata returns what the header of a model in the folder says about it.
+func (m *Manager) Metadata(name string) (Metadata, error) {
+	path, err := m.Path(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Metadata{}, fmt.Errorf("%w: %s isn't in %s", ErrNotFound, name, m.Dir)
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+	return m.metadata(info)
+}
+
+// metadata reads the header of a file once, it's read again when the file changes.
+func (m *Manager) metadata(info os.FileInfo) (Metadata, error) {
+	m.mu.Lock()
+	cached, ok := m.headers[info.Name()]
+	m.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modified.Equal(info.ModTime()) {
+		return cached.metadata, cached.err
+	}
+
+	metadata, err := ReadMetadata(filepath.Join(m.Dir, info.Name()))
+	m.mu.Lock()
+	m.headers[info.Name()] = header{size: info.Size(), modified: info.ModTime(), metadata: metadata, err: err}
+	m.mu.Unlock()
+	return metadata, err
+}
+
+// Path returns where a model is kept, it fails for names that would leave the folder.
+func (m *Manager) Path(name string) (string, error) {
+	if err := validName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(m.Dir, name), nil
+}
+
+// Delete removes a model and its partial download, one that is being pulled can't be deleted.
+func (m *Manager) Delete(name string) error {
+	path, err := m.Path(name)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if pull, ok := m.pulls[name]; ok && !pull.Progress().finished() {
+		return ErrPulling
+	}
+	delete(m.pulls, name)
+	delete(m.headers, name)
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(m.partPath(name))
+
+	catalog := m.loadCatalog()
+	if _, ok := catalog[name]; ok {
+		delete(catalog, name)
+		return m.saveCatalog()
+	}
+	return nil
+}
+
+// partPath is where a model is downloaded to before it's verified.
+func (m *Manager) partPath(name string) string {
+	return filepath.Join(m.Dir, vars.ModelDownload, name+".part")
+}
+
+// record adds a pulled model to the catalog.
+func (m *Manager) record(model Model) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.loadCatalog()[model.Name] = model
+	return m.saveCatalog()
+}
+
+// loadCatalog reads the catalog the first time it's needed, the caller has to hold the lock.
+func (m *Manager) loadCatalog() map[string]Model {
+	if m.catalog != nil {
+		return m.catalog
+	}
+
+	m.catalog = make(map[string]Model)
+	data, err := os.ReadFile(m.Catalog)
+	if errors.Is(err, os.ErrNotExist) {
+		return m.catalog
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &m.catalog)
+	}
+	if err != nil {
+		slog.Error("Error Loading Model Catalog, starting a new one", "err", err)
+		m.catalog = make(map[string]Model)
+	}
+	return m.catalog
+}
+
+// saveCatalog writes the catalog to a temp file and renames it over the old one, the caller has to hold the lock.
+func (m *Manager) saveCatalog() error {
+	data, err := json.MarshalIndent(m.catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(m.Catalog), 0750)
+	if err != nil {
+		return err
+	}
+
+	tmp := m.Catalog + "~"
+	err = os.WriteFile(tmp, data, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.Catalog)
+}
+
+// validName keeps model names to plain gguf file names in the folder.
+func validName(name string) error {
+	if name == "" || filepath.Base(name) != name || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%w: %q has to be a file name", ErrInvalid, name)
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".gguf") {
+		return fmt.Errorf("%w: %q has to be a .gguf file", ErrInvalid, name)
+	}
+	return nil
+}
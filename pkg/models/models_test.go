@@ -0,0 +1,424 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeHub serves a file the way hugging face does, the checksum is on a redirect and downloads can be resumed.
+func fakeHub(t *testing.T, content []byte, ranges *atomic.Int32) *httptest.Server {
+	sum := sha256.Sum256(content)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/org/repo/resolve/main/model.gguf", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodHead {
+			w.Header().Set("X-Linked-Etag", `"`+hex.EncodeToString(sum[:])+`"`)
+			w.Header().Set("X-Linked-Size", fmt.Sprint(len(content)))
+			http.Redirect(w, req, "/storage/model.gguf", http.StatusFound)
+			return
+		}
+		http.Redirect(w, req, "/storage/model.gguf", http.StatusFound)
+	})
+	mux.HandleFunc("/storage/model.gguf", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		http.ServeContent(w, req, "model.gguf", time.Time{}, bytes.NewReader(content))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testManager(t *testing.T, hub string) *Manager {
+	dir := t.TempDir()
+	m := New(filepath.Join(dir, "models"), filepath.Join(dir, "data", "models.json"))
+	m.HuggingFace = hub
+	return m
+}
+
+func TestPull(t *testing.T) {
+	content := bytes.Repeat([]byte("GGUF"), 4096)
+	var ranges atomic.Int32
+	m := testManager(t, fakeHub(t, content, &ranges).URL)
+
+	// half of the model is left over from a pull that was cut off
+	err := os.MkdirAll(filepath.Dir(m.partPath("model.gguf")), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(m.partPath("model.gguf"), content[:len(content)/2], 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Pull(context.Background(), Source{Repo: "org/repo", File: "model.gguf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranges.Load() != 1 {
+		t.Error("expected the download to be resumed")
+	}
+	got, err := os.ReadFile(filepath.Join(m.Dir, "model.gguf"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("expected the model to be in the folder, got %d bytes and %v", len(got), err)
+	}
+	if _, err := os.Stat(m.partPath("model.gguf")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("expected the partial file to be gone")
+	}
+	progress := m.Pulling("model.gguf").Progress()
+	if progress.State != StateDone || progress.Done != int64(len(content)) || progress.Total != int64(len(content)) {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	// the catalog is read again by a new manager
+	m = New(m.Dir, m.Catalog)
+	list, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	if len(list) != 1 || list[0].SHA256 != hex.EncodeToString(sum[:]) || list[0].Repo != "org/repo" || list[0].Size != int64(len(content)) {
+		t.Errorf("unexpected models %+v", list)
+	}
+
+	err = m.Delete("model.gguf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := m.List(); len(list) != 0 {
+		t.Errorf("expected the model to be deleted, got %+v", list)
+	}
+	if err := m.Delete("model.gguf"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the model to be gone, got %v", err)
+	}
+}
+
+func TestPullChecksum(t *testing.T) {
+	content := []byte("GGUF not quite the model")
+	var ranges atomic.Int32
+	m := testManager(t, fakeHub(t, content, &ranges).URL)
+
+	err := m.Pull(context.Background(), Source{Repo: "org/repo", File: "model.gguf", SHA256: strings.Repeat("ab", 32)})
+	if !errors.Is(err, ErrChecksum) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	for _, path := range []string{filepath.Join(m.Dir, "model.gguf"), m.partPath("model.gguf")} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %s to be removed", path)
+		}
+	}
+	if progress := m.Pulling("model.gguf").Progress(); progress.State != StateFailed || progress.Error == "" {
+		t.Errorf("expected the pull to fail, got %+v", progress)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	m := testManager(t, "http://127.0.0.1:1")
+	m.Offline = true
+
+	if _, err := m.Start(Source{Repo: "org/repo", File: "model.gguf"}); !errors.Is(err, ErrOffline) {
+		t.Errorf("expected pulls to be refused, got %v", err)
+	}
+	if err := m.Ensure(context.Background(), Source{Repo: "org/repo", File: "model.gguf"}); !errors.Is(err, ErrOffline) {
+		t.Errorf("expected a missing model to be an error, got %v", err)
+	}
+
+	err := os.MkdirAll(m.Dir, 0750)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(m.Dir, "model.gguf"), []byte("GGUF"), 0640)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Ensure(context.Background(), Source{Repo: "org/repo", File: "model.gguf"}); err != nil {
+		t.Errorf("expected the model in the folder to be used, got %v", err)
+	}
+}
+
+func TestSourceName(t *testing.T) {
+	cases := []struct {
+		src  Source
+		want string
+	}{
+		{Source{Repo: "org/repo", File: "q4/model-Q4_K_M.gguf"}, "model-Q4_K_M.gguf"},
+		{Source{URL: "https://example.com/files/model.gguf?download=true"}, "model.gguf"},
+		{Source{URL: "https://example.com/files/model.gguf", Name: "renamed.gguf"}, "renamed.gguf"},
+		{Source{Repo: "org/repo"}, ""},
+		{Source{URL: "https://example.com/model.bin"}, ""},
+		{Source{Repo: "org/repo", File: "model.gguf", Name: "../model.gguf"}, ""},
+		{Source{Repo: "org/repo", File: ".hidden.gguf"}, ""},
+	}
+	for _, c := range cases {
+		name, err := c.src.name()
+		if c.want == "" {
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("%+v: expected an invalid source, got %q", c.src, name)
+			}
+			continue
+		}
+		if err != nil || name != c.want {
+			t.Errorf("%+v: expected %q, got %q and %v", c.src, c.want, name, err)
+		}
+	}
+}
+
+func TestRequests(t *testing.T) {
+	content := bytes.Repeat([]byte("GGUF"), 1024)
+	var ranges atomic.Int32
+	m := testManager(t, fakeHub(t, content, &ranges).URL)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /models", m.ListModelsRequest)
+	mux.HandleFunc("POST /models/pull", m.PullModelRequest)
+	mux.HandleFunc("GET /models/pull/{name}", m.PullStatusRequest)
+	mux.HandleFunc("DELETE /models/{name}", m.DeleteModelRequest)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/models/pull", strings.NewReader(`{"repo":"org/repo","file":"model.gguf"}`)))
+	if rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %s", rec.Code, rec.Body.String())
+	}
+	events := strings.Split(strings.TrimSpace(rec.Body.String()), "\n\n")
+	var last Progress
+	err := json.Unmarshal([]byte(strings.TrimPrefix(events[len(events)-1], "data: ")), &last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.State != StateDone || last.Done != int64(len(content)) {
+		t.Errorf("expected the last event to be the finished pull, got %+v", last)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/models/pull/model.gguf", nil))
+	if !strings.Contains(rec.Body.String(), `"state":"done"`) {
+		t.Errorf("expected the status of the pull, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/models", nil))
+	if !strings.Contains(rec.Body.String(), `"name":"model.gguf"`) {
+		t.Errorf("expected the model to be listed, got %s", rec.Body.String())
+	}
+
+	// the pulled file isn't a real model so it can't be used for generation
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/models?type=generation", nil))
+	if !strings.Contains(rec.Body.String(), `"models":[]`) {
+		t.Errorf("expected no generation models, got %s", rec.Body.String())
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodGet, "/models?type=chat", "", http.StatusBadRequest},
+		{http.MethodPost, "/models/pull", `{"repo":"org/repo"}`, http.StatusBadRequest},
+		{http.MethodPost, "/models/pull", `{"url":"https://example.com/model.gguf"}`, http.StatusBadRequest},
+		{http.MethodPost, "/models/pull", `not json`, http.StatusUnprocessableEntity},
+		{http.MethodGet, "/models/pull/other.gguf", "", http.StatusNotFound},
+		{http.MethodDelete, "/models/model.gguf", "", http.StatusNoContent},
+		{http.MethodDelete, "/models/model.gguf", "", http.StatusNotFound},
+		{http.MethodDelete, "/models/model.bin", "", http.StatusBadRequest},
+	} {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if rec.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.code, rec.Code)
+		}
+	}
+
+	m.Offline = true
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/models/pull", strings.NewReader(`{"repo":"org/repo","file":"model.gguf"}`)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected pulls to be refused offline, got %d", rec.Code)
+	}
+}
+
+// gguf builds the header of a gguf file.
+type gguf struct {
+	b    []byte
+	keys int
+}
+
+func (g *gguf) str(s string) {
+	g.b = binary.LittleEndian.AppendUint64(g.b, uint64(len(s)))
+	g.b = append(g.b, s...)
+}
+
+func (g *gguf) key(key string, kind uint32) {
+	g.keys++
+	g.str(key)
+	g.b = binary.LittleEndian.AppendUint32(g.b, kind)
+}
+
+func (g *gguf) String(key, value string) {
+	g.key(key, ggufString)
+	g.str(value)
+}
+
+func (g *gguf) Uint32(key string, value uint32) {
+	g.key(key, ggufUint32)
+	g.b = binary.LittleEndian.AppendUint32(g.b, value)
+}
+
+func (g *gguf) Bool(key string, value bool) {
+	g.key(key, ggufBool)
+	if value {
+		g.b = append(g.b, 1)
+	} else {
+		g.b = append(g.b, 0)
+	}
+}
+
+// header returns the file with the keys written so far and tensors of the given type and dimensions.
+func (g *gguf) header(tensors map[string]struct {
+	kind uint32
+	dims []uint64
+}) []byte {
+	b := binary.LittleEndian.AppendUint32([]byte("GGUF"), 3)
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(tensors)))
+	b = binary.LittleEndian.AppendUint64(b, uint64(g.keys))
+	b = append(b, g.b...)
+
+	t := &gguf{b: b}
+	for name, tensor := range tensors {
+		t.str(name)
+		t.b = binary.LittleEndian.AppendUint32(t.b, uint32(len(tensor.dims)))
+		for _, dim := range tensor.dims {
+			t.b = binary.LittleEndian.AppendUint64(t.b, dim)
+		}
+		t.b = binary.LittleEndian.AppendUint32(t.b, tensor.kind)
+		t.b = binary.LittleEndian.AppendUint64(t.b, 0)
+	}
+	return t.b
+}
+
+func TestParseGGUF(t *testing.T) {
+	type tensors = map[string]struct {
+		kind uint32
+		dims []uint64
+	}
+
+	llama := &gguf{}
+	llama.String("general.architecture", "llama")
+	llama.String("general.name", "Tiny Llama")
+	llama.Uint32("general.file_type", 15)
+	llama.Uint32("llama.context_length", 8192)
+	llama.Uint32("llama.embedding_length", 2048)
+	// the vocabulary and scores are skipped
+	llama.key("tokenizer.ggml.tokens", ggufArray)
+	llama.b = binary.LittleEndian.AppendUint32(llama.b, ggufString)
+	llama.b = binary.LittleEndian.AppendUint64(llama.b, 3)
+	for _, token := range []string{"<s>", "</s>", "hello"} {
+		llama.str(token)
+	}
+	llama.key("tokenizer.ggml.scores", ggufArray)
+	llama.b = binary.LittleEndian.AppendUint32(llama.b, ggufFloat32)
+	llama.b = binary.LittleEndian.AppendUint64(llama.b, 3)
+	llama.b = append(llama.b, make([]byte, 12)...)
+	llama.String("tokenizer.chat_template", "{% for message in messages %}{{ message.content }}{% endfor %}")
+
+	meta, err := ParseGGUF(bytes.NewReader(llama.header(tensors{
+		"token_embd.weight":   {12, []uint64{2048, 32000}},
+		"blk.0.attn_q.weight": {12, []uint64{2048, 2048}},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{
+		Version:         3,
+		Name:            "Tiny Llama",
+		Architecture:    "llama",
+		Parameters:      2048*32000 + 2048*2048,
+		Quantization:    "Q4_K_M",
+		ContextLength:   8192,
+		EmbeddingLength: 2048,
+		ChatTemplate:    "{% for message in messages %}{{ message.content }}{% endfor %}",
+		Type:            TypeGeneration,
+	}
+	if meta != want {
+		t.Errorf("expected %+v, got %+v", want, meta)
+	}
+
+	bert := &gguf{}
+	bert.String("general.architecture", "bert")
+	bert.Bool("bert.attention.causal", false)
+	qwen := &gguf{}
+	qwen.String("general.architecture", "qwen3")
+	qwen.Uint32("qwen3.pooling_type", 3)
+	reranker := &gguf{}
+	reranker.String("general.architecture", "bert")
+	reranker.Uint32("bert.pooling_type", 4)
+	for want, g := range map[string]*gguf{TypeEmbedding: bert, TypeRerank: reranker, TypeEmbedding + " qwen": qwen} {
+		meta, err := ParseGGUF(bytes.NewReader(g.header(tensors{
+			"a": {1, []uint64{10}},
+			"b": {8, []uint64{100}},
+		})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(want, meta.Type) || meta.Quantization != "Q8_0" || meta.Parameters != 110 {
+			t.Errorf("%s: unexpected metadata %+v", want, meta)
+		}
+	}
+	if err := (Metadata{Architecture: "bert", Type: TypeEmbedding}).Check(TypeGeneration); !errors.Is(err, ErrWrongType) {
+		t.Errorf("expected an embedding model to be refused, got %v", err)
+	}
+
+	broken := llama.header(nil)
+	for name, b := range map[string][]byte{
+		"html":      []byte("<!DOCTYPE html><html>Entry not found</html>"),
+		"truncated": broken[:len(broken)-20],
+		"version 1": binary.LittleEndian.AppendUint32([]byte("GGUF"), 1),
+		"empty":     nil,
+	} {
+		if _, err := ParseGGUF(bytes.NewReader(b)); !errors.Is(err, ErrNotGGUF) {
+			t.Errorf("%s: expected ErrNotGGUF, got %v", name, err)
+		}
+	}
+}
+
+func TestListMetadata(t *testing.T) {
+	m := testManager(t, "http://127.0.0.1:1")
+	llama := &gguf{}
+	llama.String("general.architecture", "llama")
+	err := os.MkdirAll(m.Dir, 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		"llama.gguf": llama.header(nil),
+		"junk.gguf":  []byte("Entry not found"),
+		"notes.txt":  []byte("not a model"),
+	} {
+		if err := os.WriteFile(filepath.Join(m.Dir, name), content, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "junk.gguf" || list[0].Error == "" || list[1].Metadata == nil || list[1].Metadata.Type != TypeGeneration {
+		t.Errorf("unexpected models %+v", list)
+	}
+	if _, err := m.Metadata("missing.gguf"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a missing model, got %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package pipeline
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/api"
+	"github.com/StoneG24/slape/pkg/chunker"
+	"github.com/StoneG24/slape/pkg/prompt"
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+// tokenCacheSize is how many counts a tokenizer remembers, the history is counted on every prompt.
+const tokenCacheSize = 1024
+
+// tokenizeBackoff is how long tokens are estimated after the server couldn't count them.
+var tokenizeBackoff = 10 * time.Second
+
+// fitted is the context of the system prompt after it was cut down to the budget.
+type fitted struct {
+	thoughts  string
+	context   string
+	history   string
+	questions string
+}
+
+// llamaTokenizer counts tokens with the llama.cpp server at endpoint.
+// When the server can't be reached the tokens are estimated for a while before it's asked again.
+func llamaTokenizer(endpoint string) func(string) int {
+	var mu sync.Mutex
+	var retry time.Time
+	cache := map[string]int{}
+
+	return func(text string) int {
+		mu.Lock()
+		tokens, ok := cache[text]
+		down := time.Now().Before(retry)
+		mu.Unlock()
+		if ok {
+			return tokens
+		}
+		if down {
+			return chunker.EstimateTokens(text)
+		}
+
+		// the lock isn't held while the server counts so other counts don't wait on it
+		tokens, err := api.Tokenize(endpoint, text)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if !time.Now().Before(retry) {
+				slog.Error("Error Tokenizing, estimating tokens for now", "err", err)
+			}
+			retry = time.Now().Add(tokenizeBackoff)
+			return chunker.EstimateTokens(text)
+		}
+		if len(cache) >= tokenCacheSize {
+			clear(cache)
+		}
+		cache[text] = tokens
+		return tokens
+	}
+}
+
+// count returns the tokens in text, estimated when the ContextBox has no tokenizer.
+func (c *ContextBox) count(text string) int {
+	if c.Tokenizer == nil {
+		return chunker.EstimateTokens(text)
+	}
+	return c.Tokenizer(text)
+}
+
+// contextBudget is how many tokens the context can use, the context length
+// minus the answer, the prompt template, the conversation so far and the question.
+func (c *ContextBox) contextBudget() int {
+	cfg := c.settings()
+
+	// a limit as big as the context would leave no room at all,
+	// so at most half of the context is kept for the answer
+	answer := int(c.MaxTokens)
+	if answer == 0 {
+		answer = cfg.Model.MaxGenTokens
+	}
+	answer = min(answer, cfg.Model.ContextLength/2)
+
+	empty, err := c.Template.Execute(prompt.Data{})
+	if err != nil {
+		empty = c.Template.Text
+	}
+
+	return cfg.Model.ContextLength - answer - c.count(empty) - c.sessionTokens() - c.count(c.Prompt) - vars.BudgetReserve
+}
+
+// fitContext cuts the thoughts, context, previous answers and questions down so the system prompt
+// fits in the context length. Each part starts with a share of the budget and what it doesn't
+// need goes to the others. Past that the oldest answers and the least relevant sources go first.
+func (c *ContextBox) fitContext() fitted {
+	questions := c.FutureQuestions
+	if questions == "" {
+		questions = "None"
+	}
+	full := fitted{
+		thoughts:  c.Thoughts,
+		context:   c.joinContext(c.Documents, c.InternetSearchResults),
+		history:   c.joinHistory(c.ConversationHistory, 0),
+		questions: questions,
+	}
+
+	need := []int{c.count(full.thoughts), c.count(full.context), c.count(full.history), c.count(full.questions)}
+	budget := c.contextBudget()
+	if need[0]+need[1]+need[2]+need[3] <= budget {
+		return full
+	}
+
+	alloc := allocate(budget, need, []int{vars.BudgetThoughts, vars.BudgetContext, vars.BudgetHistory, vars.BudgetQuestions})
+	slog.Info("Context doesn't fit, cutting it down", "budget", budget,
+		"thoughts", alloc[0], "thoughts_needed", need[0],
+		"context", alloc[1], "context_needed", need[1],
+		"previous_answers", alloc[2], "previous_answers_needed", need[2],
+		"questions", alloc[3], "questions_needed", need[3])
+
+	return fitted{
+		thoughts:  c.truncate(full.thoughts, alloc[0]),
+		context:   c.fitSources(alloc[1]),
+		history:   c.fitHistory(alloc[2]),
+		questions: c.truncate(full.questions, alloc[3]),
+	}
+}
+
+// allocate splits total between parts that need need[i] tokens in proportion to share[i].
+// A part that needs less than its share only gets what it needs and the rest is split again.
+func allocate(total int, need []int, share []int) []int {
+	alloc := make([]int, len(need))
+	if total <= 0 {
+		return alloc
+	}
+
+	open := make([]int, len(need))
+	for i := range open {
+		open[i] = i
+	}
+	for len(open) != 0 {
+		shares := 0
+		for _, i := range open {
+			shares += share[i]
+		}
+
+		var still []int
+		used := 0
+		for _, i := range open {
+			if need[i] <= total*share[i]/shares {
+				alloc[i] = need[i]
+				used += need[i]
+			} else {
+				still = append(still, i)
+			}
+		}
+
+		// nobody fits in their share so the rest is split as is
+		if len(still) == len(open) {
+			for _, i := range open {
+				alloc[i] = total * share[i] / shares
+			}
+			break
+		}
+		total -= used
+		open = still
+	}
+
+	return alloc
+}
+
+// truncate cuts text down to budget tokens at a sentence boundary.
+func (c *ContextBox) truncate(text string, budget int) string {
+	if c.count(text) <= budget {
+		return text
+	}
+	// room for the marker
+	budget -= 2
+	if budget <= 0 {
+		return ""
+	}
+
+	chunks := chunker.Split(text, chunker.Options{Strategy: chunker.Sentence, MaxTokens: budget, Tokenizer: c.count})
+	if len(chunks) == 0 {
+		return ""
+	}
+	return chunks[0].Text + " …"
+}
+
+// joinContext builds the additional context section from the documents and search results.
+func (c *ContextBox) joinContext(documents, results []string) string {
+	var sections []string
+	if len(documents) != 0 {
+		sections = append(sections, "Documents:\n"+strings.Join(documents, "\n\n"))
+	}
+	if len(results) != 0 {
+		sections = append(sections, "Internet Search Results:\n"+strings.Join(results, "\n\n"))
+	}
+	if len(sections) == 0 {
+		return "None"
+	}
+	if len(c.Sources) != 0 {
+		sections = append(sections, citationInstructions)
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+// fitSources keeps the documents and then the search results, in order of relevance, that fit in budget.
+// Sources keep their numbers so citations still line up when some are left out.
+func (c *ContextBox) fitSources(budget int) string {
+	var documents, results []string
+	// the headers and the citation instructions
+	used := c.count("Documents:\n\nInternet Search Results:\n\n" + citationInstructions)
+
+	keep := func(list []string, kept *[]string) {
+		for _, entry := range list {
+			tokens := c.count(entry) + 2
+			if used+tokens > budget {
+				continue
+			}
+			used += tokens
+			*kept = append(*kept, entry)
+		}
+	}
+	// documents were picked for the request so they go before search results
+	keep(c.Documents, &documents)
+	keep(c.InternetSearchResults, &results)
+
+	return c.joinContext(documents, results)
+}
+
+// joinHistory joins the previous answers, noting how many older ones were left out.
+func (c *ContextBox) joinHistory(history []string, dropped int) string {
+	if len(history) == 0 && dropped == 0 {
+		return "None"
+	}
+	joined := strings.Join(history, "\n")
+	if dropped != 0 {
+		joined = fmt.Sprintf("(%d earlier answers were left out)\n", dropped) + joined
+	}
+	return joined
+}
+
+// fitHistory keeps the newest previous answers that fit in budget.
+// If not even the newest one fits it's cut short.
+func (c *ContextBox) fitHistory(budget int) string {
+	history := c.ConversationHistory
+	// the note about left out answers
+	used := c.count(c.joinHistory(nil, len(history)))
+
+	start := len(history)
+	for start > 0 {
+		tokens := c.count(history[start-1]) + 1
+		if used+tokens > budget {
+			break
+		}
+		used += tokens
+		start--
+	}
+
+	if start == len(history) && len(history) != 0 {
+		newest := c.truncate(history[len(history)-1], budget-used)
+		if newest == "" {
+			return c.joinHistory(nil, len(history))
+		}
+		return c.joinHistory([]string{newest}, len(history)-1)
+	}
+	return c.joinHistory(history[start:], start)
+}
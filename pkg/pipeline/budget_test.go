@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/chunker"
+	"github.com/StoneG24/slape/pkg/config"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		total int
+		need  []int
+		want  []int
+	}{
+		// everything fits
+		{100, []int{10, 20, 30, 10}, []int{10, 20, 30, 10}},
+		// what thoughts and questions don't use goes to the context and history
+		{100, []int{5, 200, 200, 5}, []int{5, 48, 42, 5}},
+		// nobody fits so everyone gets their share
+		{100, []int{100, 100, 100, 100}, []int{15, 40, 35, 10}},
+		{-5, []int{1, 1, 1, 1}, []int{0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		got := allocate(tt.total, tt.need, []int{15, 40, 35, 10})
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("allocate(%d, %v) = %v, expected %v", tt.total, tt.need, got, tt.want)
+		}
+	}
+}
+
+func TestPromptBuilderBudget(t *testing.T) {
+	cfg := config.Default()
+	cfg.Model.ContextLength = 2048
+
+	tmpl, _ := processPrompt("simple", cfg)
+	c := ContextBox{Template: tmpl, MaxTokens: 512, Config: cfg, Prompt: "What changed?", Thoughts: "a short thought"}
+	for i := range 20 {
+		c.ConversationHistory = append(c.ConversationHistory, fmt.Sprintf("answer %d. ", i)+strings.Repeat("The debate went on. ", 30))
+		c.addSource(Source{Title: fmt.Sprintf("result %d", i), Snippet: strings.Repeat("Some scraped text. ", 40)})
+	}
+
+	err := c.promptBuilder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tokens := chunker.EstimateTokens(c.SystemPrompt + c.Prompt); tokens > 2048-512 {
+		t.Errorf("expected the prompt to leave room for the answer, it has %d tokens", tokens)
+	}
+	for _, want := range []string{"a short thought", "answer 19.", "earlier answers were left out", "[1] result 0", citationInstructions} {
+		if !strings.Contains(c.SystemPrompt, want) {
+			t.Errorf("expected the prompt to contain %q", want)
+		}
+	}
+	if strings.Contains(c.SystemPrompt, "answer 0.") || strings.Contains(c.SystemPrompt, "[20] result 19") {
+		t.Errorf("expected the oldest answers and least relevant results to be left out")
+	}
+
+	// a small context is left alone
+	c = ContextBox{Template: tmpl, Config: cfg, Thoughts: "a short thought", ConversationHistory: []string{"only answer"}}
+	c.promptBuilder()
+	if strings.Contains(c.SystemPrompt, "left out") || !strings.Contains(c.SystemPrompt, "only answer") {
+		t.Errorf("unexpected prompt %q", c.SystemPrompt)
+	}
+}
+
+func TestLlamaTokenizer(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		if req.URL.Path != "/tokenize" || down.Load() {
+			http.Error(w, "loading model", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"tokens":[1,2,3]}`))
+	}))
+	defer server.Close()
+	old := tokenizeBackoff
+	tokenizeBackoff = 50 * time.Millisecond
+	t.Cleanup(func() { tokenizeBackoff = old })
+
+	count := llamaTokenizer(server.URL + "/v1")
+	if got := count("anything"); got != 3 {
+		t.Errorf("expected the server count, got %d", got)
+	}
+	count("anything")
+	if calls.Load() != 1 {
+		t.Errorf("expected the count to be cached, the server was called %d times", calls.Load())
+	}
+
+	down.Store(true)
+	if got, want := count("something else entirely"), chunker.EstimateTokens("something else entirely"); got != want {
+		t.Errorf("expected an estimate while the server is down, got %d", got)
+	}
+	count("another text")
+	if calls.Load() != 2 {
+		t.Errorf("expected the server to be left alone after an error, it was called %d times", calls.Load())
+	}
+
+	// the server is asked again once the backoff is over
+	down.Store(false)
+	time.Sleep(2 * tokenizeBackoff)
+	if got := count("another text"); got != 3 {
+		t.Errorf("expected the server count after the backoff, got %d", got)
+	}
+}
@@ -4,18 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
 
-	"github.com/StoneG24/slape/pkg/api"
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/metrics"
 	"github.com/StoneG24/slape/pkg/prompt"
-	"github.com/StoneG24/slape/pkg/vars"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
 )
 
 type (
@@ -54,6 +54,25 @@ type (
 
 		// Should we have a thinking step involved
 		InternetSearch string `json:"search"`
+
+		// Should a hypothetical answer be used to find search results, optional
+		HyDE string `json:"hyde"`
+
+		// Should passages from indexed documents be included, optional
+		RAG string `json:"rag"`
+
+		// Collection to retrieve documents from and how many passages to use, optional
+		Collection string `json:"collection"`
+		TopK       int    `json:"topk"`
+
+		// RagMode is naive or mini, optional
+		RagMode string `json:"rag_mode"`
+
+		// Should the reranker sort search results and documents, optional
+		Rerank string `json:"rerank"`
+
+		// Session continues a conversation started with POST /sessions, optional
+		Session string `json:"session"`
 	}
 
 	chainSetupPayload struct {
@@ -61,7 +80,13 @@ type (
 	}
 
 	chainResponse struct {
-		Answer string `json:"answer"`
+		Answer  string   `json:"answer"`
+		Sources []Source `json:"sources"`
+
+		// Session is the conversation the answer was added to.
+		Session string `json:"session,omitempty"`
+		// Run is the id of the run in GET /runs/{id}.
+		Run string `json:"run,omitempty"`
 	}
 )
 
@@ -75,11 +100,18 @@ func (c *ChainofModels) ChainPipelineSetupRequest(w http.ResponseWriter, req *ht
 
 	err := json.NewDecoder(req.Body).Decode(&setupPayload)
 	if err != nil {
-		log.Println("Error Request Format: ", err)
+		slog.ErrorContext(ctx, "Error Request Format", "err", err)
 		http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
 		return
 	}
 
+	err = checkModels(setupPayload.Models)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Checking Models", "err", err)
+		http.Error(w, "Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	c.Models = setupPayload.Models
 
 	c.Setup(ctx)
@@ -93,65 +125,120 @@ func (c *ChainofModels) ChainPipelineGenerateRequest(w http.ResponseWriter, req
 	var payload chainRequest
 
 	// use this to scope the context to the request
-	ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(vars.GenerationTimeout*time.Minute))
+	ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(time.Duration(c.settings().GenerationTimeout)*time.Minute))
 	defer cancel()
 
 	err := json.NewDecoder(req.Body).Decode(&payload)
 	if err != nil {
-		log.Println("Error Request Format", err)
+		slog.ErrorContext(ctx, "Error Request Format", "err", err)
 		http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
 		return
 	}
 
-	promptChoice, maxtokens := processPrompt(payload.Mode)
+	promptChoice, maxtokens := processPrompt(payload.Mode, c.settings())
 
-	c.ContextBox.SystemPrompt = promptChoice
+	c.ContextBox.Template = promptChoice
+	c.ContextBox.MaxTokens = maxtokens
 	c.ContextBox.Prompt = payload.Prompt
 	c.Thinking, err = strconv.ParseBool(payload.Thinking)
 	if err != nil {
-		log.Println("Error Parsing thinking value:", err)
+		slog.ErrorContext(ctx, "Error Parsing thinking value", "err", err)
 		http.Error(w, "Error parsing thinking value. Expecting sound boolean definitions.", http.StatusBadRequest)
 	}
 	c.InternetSearch, err = strconv.ParseBool(payload.InternetSearch)
 	if err != nil {
-		log.Println("Error Parsing InternetSearch value:", err)
+		slog.ErrorContext(ctx, "Error Parsing InternetSearch value", "err", err)
 		http.Error(w, "Error parsing InternetSearch value. Expecting sound boolean definitions.", http.StatusBadRequest)
 	}
 
+	hyde, err := parseOptionalBool(payload.HyDE)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Parsing HyDE value", "err", err)
+		http.Error(w, "Error parsing HyDE value. Expecting sound boolean definitions.", http.StatusBadRequest)
+		return
+	}
+
+	rerank, err := parseOptionalBool(payload.Rerank)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Parsing Rerank value", "err", err)
+		http.Error(w, "Error parsing Rerank value. Expecting sound boolean definitions.", http.StatusBadRequest)
+		return
+	}
+
+	ragOpts, err := parseRAGOptions(payload.RAG, payload.Collection, payload.RagMode, payload.TopK, rerank)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Parsing RAG values", "err", err)
+		http.Error(w, "Error parsing RAG values. Expecting a boolean, a valid mode and a positive topk.", http.StatusBadRequest)
+		return
+	}
+
+	err = c.useSession(payload.Session)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Loading Session", "err", err)
+		message, code := sessionError(err)
+		http.Error(w, message, code)
+		return
+	}
+	ctx, run := c.startRun(ctx, "cot", promptChoice.Mode, payload)
+
+	c.InternetSearchResults = []string{}
+	c.Documents = []string{}
+	c.Sources = []Source{}
+
+	if ragOpts.enabled {
+		c.getDocuments(ctx, ragOpts)
+	}
+
+	// search and thinking use the model, so they fail if it doesn't come up
 	if c.InternetSearch {
-		c.getInternetSearch(ctx)
-	} else {
-		c.InternetSearchResults = []string{}
+		err = c.getInternetSearch(ctx, c.DockerClient, firstContainer(c.containers), hyde, rerank)
 	}
-	if c.Thinking {
-		c.getThoughts(ctx)
-	} else {
+	if c.Thinking && err == nil {
+		err = c.getThoughts(ctx, c.DockerClient, firstContainer(c.containers))
+	} else if !c.Thinking {
 		c.Thoughts = "None"
 	}
+	if err != nil {
+		c.finishRun(ctx, run, "", err)
+		slog.ErrorContext(ctx, "Error Waiting for the Model", "err", err)
+		http.Error(w, generationError(err), http.StatusInternalServerError)
+		return
+	}
 
 	// wait on go routines then generate a response
 	result, err := c.Generate(ctx, payload.Prompt, promptChoice, maxtokens)
+	c.finishRun(ctx, run, result, err)
 	if err != nil {
-		log.Println("Error getting generation from model", err)
-		http.Error(w, "Error getting generation from model", http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error getting generation from model", "err", err)
+		http.Error(w, generationError(err), http.StatusInternalServerError)
 		return
 	}
 
 	// for debugging streaming
-	log.Println(result)
+	slog.DebugContext(ctx, "Answer", "answer", result)
+
+	err = c.saveTurn(result)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Saving Session", "err", err)
+	}
 
 	respPayload := chainResponse{
-		Answer: result,
+		Answer:  result,
+		Sources: c.Sources,
+		Session: c.sessionID(),
+		Run:     c.runID(run),
 	}
 
 	json, err := json.Marshal(respPayload)
 	if err != nil {
-		log.Println("Error marshaling response from model", err)
+		slog.ErrorContext(ctx, "Error marshaling response from model", "err", err)
 		http.Error(w, "Error marshaling your response from model", http.StatusInternalServerError)
 		return
 	}
 
 	c.InternetSearchResults = []string{}
+	c.Documents = []string{}
+	c.Sources = []Source{}
 	c.Thoughts = ""
 
 	w.Header().Set("Content-Type", "application/json")
@@ -165,11 +252,11 @@ func (c *ChainofModels) Setup(ctx context.Context) error {
 	defer cancel()
 
 	/*
-		log.Println("PullingImage: ", c.ContainerImage)
+		slog.InfoContext(ctx, "Pulling Image", "image", c.ContainerImage)
 
 		reader, err := PullImage(c.DockerClient, childctx, c.ContainerImage)
 		if err != nil {
-			log.Println("Error Pulling Docker Image for Containers", err)
+			slog.ErrorContext(ctx, "Error Pulling Docker Image for Containers", "err", err)
 			return err
 		}
 		// prints out the status of the download
@@ -180,62 +267,67 @@ func (c *ChainofModels) Setup(ctx context.Context) error {
 	for i, model := range c.Models {
 		createResponse, err := CreateCPPContainer(
 			c.DockerClient,
-			"800"+strconv.Itoa(i),
+			c.settings().ModelPort(i),
 			"",
 			childctx,
 			model,
 			c.ContainerImage,
 			c.GPU,
+			c.settings(),
 		)
 
 		if err != nil {
-			log.Println("Create Container Warning", createResponse.Warnings)
-			log.Println("Error Creating Container", err)
+			slog.WarnContext(ctx, "Create Container Warning", "warnings", createResponse.Warnings)
+			slog.ErrorContext(ctx, "Error Creating Container", "err", err)
 			return err
 		}
 
-		log.Println("Container Created With ID", createResponse.ID)
+		slog.InfoContext(ctx, "Container Created With ID", "container", createResponse.ID)
 		c.containers = append(c.containers, createResponse)
+		containers.Default.Add(createResponse.ID, "cot", model)
 	}
 
 	// start container
+	started := time.Now()
 	err := (c.DockerClient).ContainerStart(childctx, c.containers[0].ID, container.StartOptions{})
 	if err != nil {
-		log.Println("Error Starting Container: ", err)
+		slog.ErrorContext(ctx, "Error Starting Container", "err", err)
 		return err
 	}
-	log.Println("Starting Container", c.containers[0].ID)
+	metrics.Stage("cot", metrics.StageContainerStart, started)
+	containers.Default.Follow(c.DockerClient, c.containers[0].ID)
+	slog.InfoContext(ctx, "Starting Container", "container", c.containers[0].ID)
 
 	return nil
 }
 
 // ChainofModels.Generate is the facilitator of model orchestration based on the chain of model pipeline.
 // Since the pipeline is based on the Chan of Thought prompting technique, it follows this style, mimicing its behavior.
-func (c *ChainofModels) Generate(ctx context.Context, uprompt string, systemprompt string, maxtokens int64) (string, error) {
+func (c *ChainofModels) Generate(ctx context.Context, uprompt string, systemprompt *prompt.Template, maxtokens int64) (string, error) {
 	var result string
 
 	for i, model := range c.containers {
-		fmt.Println("ContainerIndex ", i)
 		// start container
-		err := (c.DockerClient).ContainerStart(ctx, model.ID, container.StartOptions{})
+		err := restartContainer(ctx, c.DockerClient, model.ID)
 		if err != nil {
-			log.Println("Error Starting Container", err)
+			slog.ErrorContext(ctx, "Error Starting Container", "err", err)
 			return "", err
 		}
-		log.Println("ContainerIndex ", i)
+		slog.InfoContext(ctx, "Starting Container", "container", i)
 
-		for {
-			// sleep and give server guy a break
-			time.Sleep(time.Duration(1 * time.Second))
-
-			if api.UpDog("800" + strconv.Itoa(i)) {
-				break
-			}
+		err = waitReady(ctx, c.DockerClient, model.ID, c.settings().ModelURL(i))
+		if err != nil {
+			slog.ErrorContext(ctx, "Error Waiting On Model", "err", err)
+			return "", err
 		}
 
-		openaiClient := openai.NewClient(
-			option.WithBaseURL("http://localhost:800" + strconv.Itoa(i) + "/v1"),
-		)
+		openaiClient := config.NewClient(c.settings().ModelURL(i))
+		c.Tokenizer = llamaTokenizer(c.settings().ModelURL(i))
+
+		err = c.compactSession(ctx, openaiClient, c.Models[i])
+		if err != nil {
+			slog.ErrorContext(ctx, "Error Summarizing Session", "err", err)
+		}
 
 		err = c.promptBuilder()
 		if err != nil {
@@ -245,20 +337,17 @@ func (c *ChainofModels) Generate(ctx context.Context, uprompt string, systemprom
 		// Answer the initial question.
 		// If it's the first model, there will not be any questions from the previous model.
 		param := openai.ChatCompletionNewParams{
-			Messages: []openai.ChatCompletionMessageParamUnion{
-				openai.SystemMessage(c.SystemPrompt),
-				openai.UserMessage(c.Prompt),
-			},
+			Messages:    c.chat(c.SystemPrompt),
 			Seed:        openai.Int(0),
 			Model:       c.Models[i],
-			Temperature: openai.Float(vars.ModelTemperature),
+			Temperature: openai.Float(c.settings().Model.Temperature),
 			MaxTokens:   openai.Int(maxtokens),
 		}
 
 		// ans the question
 		result, err = GenerateCompletion(ctx, param, "", openaiClient)
 		if err != nil {
-			log.Println("Error Generating Completion", err)
+			slog.ErrorContext(ctx, "Error Generating Completion", "err", err)
 			return "", err
 		}
 
@@ -276,19 +365,19 @@ func (c *ChainofModels) Generate(ctx context.Context, uprompt string, systemprom
 			summarizePrompt := fmt.Sprintf(prompt.SummarizingPrompt, result)
 			param = openai.ChatCompletionNewParams{
 				Messages: []openai.ChatCompletionMessageParamUnion{
-					openai.SystemMessage(prompt.SimplePrompt),
+					openai.SystemMessage(prompt.AssistantPrompt),
 					openai.UserMessage(summarizePrompt),
 					//openai.UserMessage(s.FutureQuestions),
 				},
 				Seed:        openai.Int(0),
 				Model:       c.Models[i],
-				Temperature: openai.Float(vars.ModelTemperature),
+				Temperature: openai.Float(c.settings().Model.Temperature),
 				MaxTokens:   openai.Int(maxtokens),
 			}
 
 			result, err = GenerateCompletion(ctx, param, "", openaiClient)
 			if err != nil {
-				log.Println("Error Generating Completion", err)
+				slog.ErrorContext(ctx, "Error Generating Completion", "err", err)
 				return "", err
 			}
 
@@ -311,13 +400,13 @@ func (c *ChainofModels) Generate(ctx context.Context, uprompt string, systemprom
 				},
 				Seed:        openai.Int(0),
 				Model:       c.Models[i],
-				Temperature: openai.Float(vars.ModelTemperature),
+				Temperature: openai.Float(c.settings().Model.Temperature),
 				MaxTokens:   openai.Int(maxtokens),
 			}
 
 			result, err = GenerateCompletion(ctx, param, "", openaiClient)
 			if err != nil {
-				log.Println("Error Generating Completion", err)
+				slog.ErrorContext(ctx, "Error Generating Completion", "err", err)
 				return "", err
 			}
 
@@ -330,19 +419,19 @@ func (c *ChainofModels) Generate(ctx context.Context, uprompt string, systemprom
 			//log.Println("SystemPrompt", systemprompt, "Prompt", uprompt)
 		}
 
-		log.Println("Stopping Container, ContainerIndex", i)
+		slog.InfoContext(ctx, "Stopping Container", "container", i)
 		(c.DockerClient).ContainerStop(ctx, model.ID, container.StopOptions{})
 	}
 
 	c.ConversationHistory = []string{}
 
 	// start container
-	err := (c.DockerClient).ContainerStart(ctx, c.containers[0].ID, container.StartOptions{})
+	err := restartContainer(ctx, c.DockerClient, c.containers[0].ID)
 	if err != nil {
-		log.Println("Error Starting Container: ", err)
+		slog.ErrorContext(ctx, "Error Starting Container", "err", err)
 		return result, err
 	}
-	log.Println("Starting Container For next Potential run", c.containers[0].ID)
+	slog.InfoContext(ctx, "Starting Container For next Potential run", "container", c.containers[0].ID)
 
 	return result, nil
 }
@@ -363,5 +452,5 @@ func (c *ChainofModels) Shutdown(w http.ResponseWriter, req *http.Request) {
 		(c.DockerClient).ContainerRemove(childctx, model.ID, container.RemoveOptions{})
 	}
 
-	log.Println("Shutting Down...")
+	slog.InfoContext(req.Context(), "Shutting Down")
 }
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Source is a piece of retrieved context that was given to the models.
+// Sources are numbered in the system prompt so that the models can cite them like [1],
+// and are returned with the answer so that a reviewer can check those claims.
+type Source struct {
+	// ID is the number the models use to cite the source.
+	ID int `json:"id"`
+	// Kind is where the source came from, a search result or a document.
+	Kind string `json:"kind"`
+	// URL is the page the snippet was scraped from, or the path of the document.
+	URL string `json:"url"`
+	// Title is the title of the page or the heading the snippet was found under.
+	Title string `json:"title"`
+	// Snippet is the exact text that was put into the context.
+	Snippet string `json:"snippet"`
+	// Score is the similarity between the snippet and the prompt.
+	Score float64 `json:"score"`
+	// RerankScore is set when the sources were reranked, higher is more relevant.
+	RerankScore *float64 `json:"rerank_score,omitempty"`
+	// Document is the id of the rag document the snippet is from.
+	Document string `json:"document,omitempty"`
+}
+
+// Kinds of sources.
+const (
+	SearchSource   = "search"
+	DocumentSource = "document"
+)
+
+// citationInstructions is appended to the numbered sources in the system prompt.
+const citationInstructions = "When you use information from a numbered source, cite it with its number in square brackets, like [1]."
+
+// addSource numbers a search result and adds it to the ContextBox.
+func (c *ContextBox) addSource(source Source) {
+	source.ID = len(c.Sources) + 1
+	c.Sources = append(c.Sources, source)
+	c.InternetSearchResults = append(c.InternetSearchResults, source.String())
+}
+
+// addDocument numbers a retrieved passage and adds it to the ContextBox.
+// Documents and search results share numbers so every citation is unique.
+func (c *ContextBox) addDocument(source Source) {
+	source.ID = len(c.Sources) + 1
+	c.Sources = append(c.Sources, source)
+	c.Documents = append(c.Documents, source.String())
+}
+
+// String formats the source the way it is shown to the models.
+func (s Source) String() string {
+	var header strings.Builder
+	fmt.Fprintf(&header, "[%d]", s.ID)
+	if s.Title != "" {
+		fmt.Fprintf(&header, " %s", s.Title)
+	}
+	if s.URL != "" {
+		fmt.Fprintf(&header, " (%s)", s.URL)
+	}
+	return header.String() + "\n" + s.Snippet
+}
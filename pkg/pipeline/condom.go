@@ -2,7 +2,7 @@ package pipeline
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -33,12 +33,12 @@ func CreateOllamaContainer(apiClient *client.Client, portNum string, name string
 	if runtime.GOOS == "windows" {
 		ex, err := os.Executable()
 		if err != nil {
-			log.Println("idk something else")
+			slog.ErrorContext(ctx, "Error Finding The Executable", "err", err)
 		}
 
 		currentPath := filepath.Dir(ex)
 
-		log.Println(currentPath)
+		slog.DebugContext(ctx, "Mounting Models", "path", currentPath)
 
 		mountString = currentPath + "\\models"
 	}
@@ -3,14 +3,20 @@ package pipeline
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
-	"time"
 
-	"github.com/StoneG24/slape/pkg/api"
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/embedding"
 	"github.com/StoneG24/slape/pkg/internetsearch"
+	"github.com/StoneG24/slape/pkg/metrics"
 	"github.com/StoneG24/slape/pkg/prompt"
+	"github.com/StoneG24/slape/pkg/rag"
+	"github.com/StoneG24/slape/pkg/runs"
+	"github.com/StoneG24/slape/pkg/session"
 	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/StoneG24/slape/pkg/vectorstore"
+	"github.com/docker/docker/client"
 	"github.com/openai/openai-go"
 )
 
@@ -20,6 +26,13 @@ import (
 // the gven situation more.
 // This information should be kept within a pipeline for privacy and safety reasons.
 type ContextBox struct {
+	// Template is the prompt mode, promptBuilder fills it in as the SystemPrompt.
+	Template *prompt.Template
+	// MaxTokens is the limit of the answer, the context has to leave room for it.
+	MaxTokens int64
+	// Tokenizer counts tokens for the model, they're estimated if it's nil.
+	Tokenizer func(string) int
+
 	// Simple prompt components
 	SystemPrompt        string
 	Thoughts            string
@@ -31,40 +44,62 @@ type ContextBox struct {
 	// These will come from the internet search package.
 	InternetSearchResults []string
 
+	// These will come from the documents indexed for rag.
+	Documents []string
+
+	// Sources are the numbered documents and search results that the models can cite.
+	// Each one lines up with an entry in Documents or InternetSearchResults.
+	Sources []Source
+
 	// These will come from tool calls
 	ToolResults *[]string
-}
 
-// PromptBuilder takes the ContextBox and builds the system prompt
-func (c *ContextBox) promptBuilder() error {
+	// VectorStore keeps search results between requests, nothing is kept if it's nil.
+	VectorStore *vectorstore.Store
 
-	// since we are operating on a parameter its
-	// safer to create a local copy
-	if len(c.ConversationHistory) == 0 {
-		c.PreviousAnswer = "None"
-	} else {
-		c.PreviousAnswer = strings.Join(c.ConversationHistory, "\n")
-	}
+	// RAG holds the documents that have been indexed for retrieval.
+	RAG *rag.RAG
 
-	// information generated as prelinary thoughts
-	// TODO(v) move to generation functions like thoughts
-	var additionalContex string
-	if len(c.InternetSearchResults) != 0 {
-		additionalContex = strings.Join(c.InternetSearchResults, "\n")
-	} else {
-		additionalContex = "None"
-	}
+	// Sessions keeps conversations between requests, requests can't name a session if it's nil.
+	Sessions *session.Store
+	// Session is the conversation the current request continues, if any.
+	Session *session.Session
+
+	// Runs keeps the history of every run, nothing is kept if it's nil.
+	Runs *runs.Store
 
-	var questions string
-	if len(c.FutureQuestions) == 0 {
-		questions = "None"
-	} else {
-		questions = c.FutureQuestions
+	// Config holds the runtime settings, the defaults are used if it's nil.
+	Config *config.Config
+}
+
+// settings returns the runtime settings of the pipeline.
+func (c *ContextBox) settings() *config.Config {
+	return orDefault(c.Config)
+}
+
+// PromptBuilder takes the ContextBox and builds the system prompt.
+// The context is cut down first so the prompt and the answer fit in the context length.
+func (c *ContextBox) promptBuilder() error {
+	if c.Template == nil {
+		c.Template, _ = Prompts.Get("simple")
 	}
 
-	log.Printf("Thoughts: %s\nAdditionalContext: %s\nPreviousAnswer: %s\nQuestions: %s\n", c.Thoughts, additionalContex, c.PreviousAnswer, questions)
-	c.SystemPrompt = fmt.Sprintf(c.SystemPrompt, c.Thoughts, additionalContex, c.PreviousAnswer, questions)
-	log.Println(c.SystemPrompt)
+	parts := c.fitContext()
+	c.PreviousAnswer = parts.history
+
+	slog.Debug("Prompt Parts", "thoughts", parts.thoughts, "context", parts.context, "previous_answers", parts.history, "questions", parts.questions)
+	systemPrompt, err := c.Template.Execute(prompt.Data{
+		Thoughts:        parts.thoughts,
+		Context:         parts.context,
+		PreviousAnswers: parts.history,
+		Questions:       parts.questions,
+		Prompt:          c.Prompt,
+	})
+	if err != nil {
+		return err
+	}
+	c.SystemPrompt = systemPrompt
+	slog.Debug("System Prompt", "prompt", c.SystemPrompt)
 
 	return nil
 }
@@ -72,13 +107,21 @@ func (c *ContextBox) promptBuilder() error {
 // getThought is used to generate initial thoughts about a given question.
 // This is supposed to create some guardrails for thought.
 // This will not be good for slms but llms that are centered around reasoning
-func (c *ContextBox) getThoughts(ctx context.Context) {
+// It waits for the container with id on port 8000 first and returns why it didn't come up.
+func (c *ContextBox) getThoughts(ctx context.Context, apiClient *client.Client, id string) error {
+	ctx, done := startStage(ctx, metrics.StageThinking)
+	defer done()
 
-	fmt.Println("Thinking...")
+	slog.InfoContext(ctx, "Thinking")
 	err := c.promptBuilder()
-	log.Println(err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Building Prompt", "err", err)
+	}
 
-	tprompt := vars.ThinkingPrompt + "\n**Internet Search Results:**\n" + strings.Join(c.InternetSearchResults, "\n")
+	tprompt := vars.ThinkingPrompt + "\n**Internet Search Results:**\n" + strings.Join(c.InternetSearchResults, "\n\n")
+	if len(c.Documents) != 0 {
+		tprompt += "\n**Documents:**\n" + strings.Join(c.Documents, "\n\n")
+	}
 
 	param := openai.ChatCompletionNewParams{
 		Messages: []openai.ChatCompletionMessageParamUnion{
@@ -89,21 +132,17 @@ func (c *ContextBox) getThoughts(ctx context.Context) {
 		Seed: openai.Int(0),
 		//Model:       openai.String(pipeline.Model),
 		Temperature: openai.Float(0.4),
-		MaxTokens:   openai.Int(vars.MaxGenTokens),
+		MaxTokens:   openai.Int(int64(c.settings().Model.MaxGenTokens)),
 	}
 
-	for {
-		// sleep and give server guy a break
-		time.Sleep(time.Duration(1 * time.Second))
-
-		// Single model, single port, assuming one pipeline is running at a time
-		if api.UpDog("8000") {
-			break
-		}
+	// Single model, single port, assuming one pipeline is running at a time
+	err = waitReady(ctx, apiClient, id, c.settings().ModelURL(0))
+	if err != nil {
+		return err
 	}
 
-	result, err := GenerateCompletion(ctx, param, "", vars.OpenaiClient)
-	log.Println(result)
+	result, err := GenerateCompletion(ctx, param, "", c.settings().ModelClient())
+	slog.DebugContext(ctx, "Thoughts", "thoughts", result)
 	if err != nil {
 		c.Thoughts = "None"
 	}
@@ -112,126 +151,138 @@ func (c *ContextBox) getThoughts(ctx context.Context) {
 
 	param = openai.ChatCompletionNewParams{
 		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.SystemMessage(prompt.SimplePrompt),
+			openai.SystemMessage(prompt.AssistantPrompt),
 			openai.UserMessage(sprompt),
 			//openai.UserMessage(s.FutureQuestions),
 		},
 		Seed: openai.Int(0),
 		//Model:       c.Models[i],
-		Temperature: openai.Float(vars.ModelTemperature),
+		Temperature: openai.Float(c.settings().Model.Temperature),
 		MaxTokens:   openai.Int(4092),
 	}
 
-	result, err = GenerateCompletion(ctx, param, "", vars.OpenaiClient)
+	result, err = GenerateCompletion(ctx, param, "", c.settings().ModelClient())
 	if err != nil {
-		log.Println("Error Generating Thinking Summarization", err)
+		slog.ErrorContext(ctx, "Error Generating Thinking Summarization", "err", err)
 	}
 
 	//log.Println("Debug Thinking result", result)
 
 	c.Thoughts = result
 
-	fmt.Println("Finished thinking")
+	slog.InfoContext(ctx, "Finished thinking")
 
-	return
+	return nil
 }
 
 // getInternetSearch is used to generate initial context about a given question.
-func (c *ContextBox) getInternetSearch(ctx context.Context) error {
-	fmt.Println("Searching the Internet...")
+// The model plans several search queries which are searched and merged together.
+// If hyde is set, a hypothetical answer is embedded alongside the prompt to find better matches.
+// If rerank is set, more chunks are found and the reranker picks the best of them.
+// The model with id on port 8000 plans the queries, an error is returned if it doesn't come up.
+func (c *ContextBox) getInternetSearch(ctx context.Context, apiClient *client.Client, id string, hyde bool, rerank bool) error {
+	ctx, done := startStage(ctx, metrics.StageSearch)
+	defer done()
+	slog.InfoContext(ctx, "Searching the Internet")
+
+	// the model plans the search so it has to be up first
+	err := waitReady(ctx, apiClient, id, c.settings().ModelURL(0))
+	if err != nil {
+		return err
+	}
 
-	embCh := make(chan []float64, 1)
-	searchCh := make(chan internetsearch.VectorList, 1)
+	queries := c.planQueries(ctx)
 
-	// Generate embedding of prompt
-	go func(context.Context, chan []float64) {
-		embedparam := openai.EmbeddingNewParams{
-			Input:      openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: []string{c.Prompt}},
-			Model:      embedmodel,
-			Dimensions: openai.Int(1024),
+	embedInputs := []string{c.Prompt}
+	if hyde {
+		passage, err := c.hypotheticalAnswer(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error Generating Hypothetical Answer", "err", err)
+		} else if strings.TrimSpace(passage) != "" {
+			embedInputs = append(embedInputs, passage)
 		}
+	}
 
-		for {
-			// sleep and give server guy a break
-			time.Sleep(time.Duration(2 * time.Second))
-
-			// Single model, single port, assuming one pipeline is running at a time
-			if api.UpDog("8082") {
-				break
-			}
-		}
+	embCh := make(chan [][]float64, 1)
+	searchCh := make(chan internetsearch.VectorList, 1)
 
-		result, err := GenerateEmbedding(ctx, embedparam, vars.EmbeddingClient)
-		log.Println(result)
+	// Generate embeddings of the prompt and the hypothetical answer
+	go func(context.Context, chan [][]float64) {
+		vectors, err := embedding.Default.Embed(ctx, embedInputs)
 		if err != nil {
+			slog.ErrorContext(ctx, "Error Generating Prompt Embedding", "err", err)
+			embCh <- nil
 			return
 		}
-		embCh <- result.Data[0].Embedding
-		//close(embCh)
+		embCh <- vectors
 	}(ctx, embCh)
 
-	// Generate the query and run internetsearch
+	// run every query and merge the results
 	go func(context.Context, chan internetsearch.VectorList) {
-		// take care of upDog on our own
-		for {
-			// sleep and give server guy a break
-			time.Sleep(time.Duration(1 * time.Second))
-
-			// Single model, single port, assuming one pipeline is running at a time
-			if api.UpDog("8000") {
-				break
-			}
-		}
-
-		/*
-		   queryPrompt := `
-		   Act as a internet search guru who knows how to search up anything on duckduckgo.com.
-		   Generate a query, using the provided question, for searching the internet.
-		   Only return the question.
-		   `
-		*/
-		// take the result and run the internetsearch
-		vecs := internetsearch.InternetSearch(ctx, c.Prompt)
+		vecs := internetsearch.MultiSearch(ctx, queries, vars.SearchMaxLinks)
 
 		searchCh <- vecs
 	}(ctx, searchCh)
 
 	// Combine the two and search the graph for relative neighbors
-	var embedding []float64
+	var embeddings [][]float64
 	var vecs internetsearch.VectorList
 	for i := 0; i < 2; i++ {
 		select {
-		case vector, ok := <-embCh:
+		case vectors, ok := <-embCh:
 			if ok {
-				embedding = vector
-				log.Println("Embedding Retrieved Properly")
+				embeddings = vectors
+				slog.InfoContext(ctx, "Embedding Retrieved Properly")
 			}
 		case v, ok := <-searchCh:
 			if ok {
 				vecs = v
-				log.Println("Neighbors Retrieved Properly")
+				slog.InfoContext(ctx, "Neighbors Retrieved Properly")
 			}
 		}
 	}
 
-	neighbors := internetsearch.KnnSearch(
-		// nearest neighbors
-		vecs.Points,
-		// embedding vector
-		embedding,
-		// change this to get less results back from the vector store
-		5,
-	)
+	// the reranker gets more candidates to choose from
+	k := 5
+	candidates := k
+	if rerank {
+		candidates = k * vars.RerankCandidates
+	}
+
+	// search with every query vector and every query, so exact terms are found as well as similar meaning
+	neighbors := vecs.Hybrid(queries, embeddings, candidates)
 
-	log.Println("Internet Search result [nearest neighbors]", neighbors)
+	slog.InfoContext(ctx, "Internet Search result [nearest neighbors]", "neighbors", neighbors)
 
+	var sources []Source
 	for _, neighbor := range neighbors {
-		c.InternetSearchResults = append(c.InternetSearchResults, vecs.Elements[neighbor.Point.ID])
+		chunk := vecs.Chunks[neighbor.Point.ID]
+		sources = append(sources, Source{
+			Kind:    SearchSource,
+			URL:     chunk.Source,
+			Title:   chunk.Title,
+			Snippet: chunk.Text,
+			Score:   neighbor.Distance,
+		})
+	}
+
+	// results from earlier searches compete with the new ones
+	sources = mergeSources(sources, c.recallSearch(embeddings, candidates), candidates)
+	c.rememberSearch(vecs)
+
+	if rerank {
+		sources = c.rerankSources(ctx, sources, k)
+	} else if len(sources) > k {
+		sources = sources[:k]
+	}
+
+	for _, source := range sources {
+		c.addSource(source)
 	}
 
-	log.Println("Internet Search result ", c.InternetSearchResults)
+	slog.InfoContext(ctx, "Internet Search result", "results", c.InternetSearchResults)
 
-	fmt.Println("Finished searching the internet")
+	slog.InfoContext(ctx, "Finished searching the internet")
 
 	return nil
 }
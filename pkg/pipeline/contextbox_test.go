@@ -0,0 +1,38 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/StoneG24/slape/pkg/config"
+)
+
+func TestPromptBuilder(t *testing.T) {
+	for _, mode := range Prompts.Modes() {
+		t.Run(mode, func(t *testing.T) {
+			tmpl, _ := processPrompt(mode, config.Default())
+			c := ContextBox{Template: tmpl, Thoughts: "first thought", Documents: []string{"a document"}}
+
+			err := c.promptBuilder()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.ConversationHistory = append(c.ConversationHistory, "the first answer")
+			c.FutureQuestions = "what next?"
+			err = c.promptBuilder()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the prompt is filled in again from the template, not from the last prompt
+			for _, want := range []string{"first thought", "a document", "the first answer", "what next?"} {
+				if !strings.Contains(c.SystemPrompt, want) {
+					t.Errorf("expected the prompt to contain %q", want)
+				}
+			}
+			if strings.Contains(c.SystemPrompt, "%!") || strings.Contains(c.SystemPrompt, "{{") {
+				t.Errorf("prompt wasn't filled in properly %q", c.SystemPrompt)
+			}
+		})
+	}
+}
@@ -4,19 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/StoneG24/slape/pkg/api"
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/metrics"
 	"github.com/StoneG24/slape/pkg/prompt"
-	"github.com/StoneG24/slape/pkg/vars"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
 )
 
 var (
@@ -59,6 +59,25 @@ type (
 		Thinking string `json:"thinking"`
 
 		InternetSearch string `json:"search"`
+
+		// Should a hypothetical answer be used to find search results, optional
+		HyDE string `json:"hyde"`
+
+		// Should passages from indexed documents be included, optional
+		RAG string `json:"rag"`
+
+		// Collection to retrieve documents from and how many passages to use, optional
+		Collection string `json:"collection"`
+		TopK       int    `json:"topk"`
+
+		// RagMode is naive or mini, optional
+		RagMode string `json:"rag_mode"`
+
+		// Should the reranker sort search results and documents, optional
+		Rerank string `json:"rerank"`
+
+		// Session continues a conversation started with POST /sessions, optional
+		Session string `json:"session"`
 	}
 
 	debateSetupPayload struct {
@@ -66,7 +85,13 @@ type (
 	}
 
 	debateResponse struct {
-		Answer string `json:"answer"`
+		Answer  string   `json:"answer"`
+		Sources []Source `json:"sources"`
+
+		// Session is the conversation the answer was added to.
+		Session string `json:"session,omitempty"`
+		// Run is the id of the run in GET /runs/{id}.
+		Run string `json:"run,omitempty"`
 	}
 )
 
@@ -79,17 +104,24 @@ func (d *DebateofModels) DebatePipelineSetupRequest(w http.ResponseWriter, req *
 
 	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		log.Println("Error creating the docker client: ", err)
+		slog.ErrorContext(ctx, "Error creating the docker client", "err", err)
 		return
 	}
 
 	err = json.NewDecoder(req.Body).Decode(&setupPayload)
 	if err != nil {
-		log.Println("Error Request Format: ", err)
+		slog.ErrorContext(ctx, "Error Request Format", "err", err)
 		http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
 		return
 	}
 
+	err = checkModels(setupPayload.Models)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Checking Models", "err", err)
+		http.Error(w, "Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	d.Models = setupPayload.Models
 	d.DockerClient = apiClient
 
@@ -103,62 +135,117 @@ func (d *DebateofModels) DebatePipelineGenerateRequest(w http.ResponseWriter, re
 	var payload debateRequest
 
 	// use this to scope the context to the request
-	ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(vars.GenerationTimeout*time.Minute))
+	ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(time.Duration(d.settings().GenerationTimeout)*time.Minute))
 	defer cancel()
 
 	err := json.NewDecoder(req.Body).Decode(&payload)
 	if err != nil {
-		log.Println("Error Request Format", err)
+		slog.ErrorContext(ctx, "Error Request Format", "err", err)
 		http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
 		return
 	}
 
-	promptChoice, maxtokens := processPrompt(payload.Mode)
+	promptChoice, maxtokens := processPrompt(payload.Mode, d.settings())
 
-	d.ContextBox.SystemPrompt = promptChoice
+	d.ContextBox.Template = promptChoice
+	d.ContextBox.MaxTokens = maxtokens
 	d.ContextBox.Prompt = payload.Prompt
 	d.Thinking, err = strconv.ParseBool(payload.Thinking)
 	if err != nil {
-		log.Println("Error Parsing thinking value:", err)
+		slog.ErrorContext(ctx, "Error Parsing thinking value", "err", err)
 		http.Error(w, "Error parsing thinking value. Expecting sound boolean definitions.", http.StatusBadRequest)
 	}
 	d.InternetSearch, err = strconv.ParseBool(payload.InternetSearch)
 	if err != nil {
-		log.Println("Error Parsing InternetSearch value:", err)
+		slog.ErrorContext(ctx, "Error Parsing InternetSearch value", "err", err)
 		http.Error(w, "Error parsing InternetSearch value. Expecting sound boolean definitions.", http.StatusBadRequest)
 	}
 
+	hyde, err := parseOptionalBool(payload.HyDE)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Parsing HyDE value", "err", err)
+		http.Error(w, "Error parsing HyDE value. Expecting sound boolean definitions.", http.StatusBadRequest)
+		return
+	}
+
+	rerank, err := parseOptionalBool(payload.Rerank)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Parsing Rerank value", "err", err)
+		http.Error(w, "Error parsing Rerank value. Expecting sound boolean definitions.", http.StatusBadRequest)
+		return
+	}
+
+	ragOpts, err := parseRAGOptions(payload.RAG, payload.Collection, payload.RagMode, payload.TopK, rerank)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Parsing RAG values", "err", err)
+		http.Error(w, "Error parsing RAG values. Expecting a boolean, a valid mode and a positive topk.", http.StatusBadRequest)
+		return
+	}
+
+	err = d.useSession(payload.Session)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Loading Session", "err", err)
+		message, code := sessionError(err)
+		http.Error(w, message, code)
+		return
+	}
+	ctx, run := d.startRun(ctx, "deb", promptChoice.Mode, payload)
+
+	d.InternetSearchResults = []string{}
+	d.Documents = []string{}
+	d.Sources = []Source{}
+
+	if ragOpts.enabled {
+		d.getDocuments(ctx, ragOpts)
+	}
+
+	// search and thinking use the model, so they fail if it doesn't come up
 	if d.InternetSearch {
-		d.getInternetSearch(ctx)
-	} else {
-		d.InternetSearchResults = []string{}
+		err = d.getInternetSearch(ctx, d.DockerClient, firstContainer(d.containers), hyde, rerank)
 	}
-	if d.Thinking {
-		d.getThoughts(ctx)
-	} else {
+	if d.Thinking && err == nil {
+		err = d.getThoughts(ctx, d.DockerClient, firstContainer(d.containers))
+	} else if !d.Thinking {
 		d.Thoughts = "None"
 	}
+	if err != nil {
+		d.finishRun(ctx, run, "", err)
+		slog.ErrorContext(ctx, "Error Waiting for the Model", "err", err)
+		http.Error(w, generationError(err), http.StatusInternalServerError)
+		return
+	}
 
 	// wait for all tasks to complete then generate a response
 	result, err := d.Generate(ctx, maxtokens)
+	d.finishRun(ctx, run, result, err)
 	if err != nil {
-		log.Println("Error getting generation from model", err)
-		http.Error(w, "Error getting generation from model", http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error getting generation from model", "err", err)
+		http.Error(w, generationError(err), http.StatusInternalServerError)
 		return
 	}
 
+	err = d.saveTurn(result)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Saving Session", "err", err)
+	}
+
 	respPayload := debateResponse{
-		Answer: result,
+		Answer:  result,
+		Sources: d.Sources,
+		Session: d.sessionID(),
+		Run:     d.runID(run),
 	}
 
 	json, err := json.Marshal(respPayload)
 	if err != nil {
-		log.Println("Error marshaling response from model", err)
+		slog.ErrorContext(ctx, "Error marshaling response from model", "err", err)
 		http.Error(w, "Error marshaling your response from model", http.StatusInternalServerError)
 		return
 	}
 
 	d.InternetSearchResults = []string{}
+	d.Documents = []string{}
+	d.Sources = []Source{}
 	d.Thoughts = ""
 
 	w.Header().Set("Content-Type", "application/json")
@@ -174,11 +261,11 @@ func (d *DebateofModels) Setup(ctx context.Context) error {
 	defer cancel()
 
 	/*
-		log.Println("PullingImage: ", d.ContainerImage)
+		slog.InfoContext(ctx, "Pulling Image", "image", d.ContainerImage)
 
 		reader, err := PullImage(d.DockerClient, ctx, d.ContainerImage)
 		if err != nil {
-			log.Println("Error Pulling Container Image: ", err)
+			slog.ErrorContext(ctx, "Error Pulling Container Image", "err", err)
 			return err
 		}
 		// prints out the status of the download
@@ -189,30 +276,35 @@ func (d *DebateofModels) Setup(ctx context.Context) error {
 	for i, model := range d.Models {
 		createResponse, err := CreateCPPContainer(
 			d.DockerClient,
-			"800"+strconv.Itoa(i),
+			d.settings().ModelPort(i),
 			"",
 			ctx,
 			model,
 			d.ContainerImage,
 			d.GPU,
+			d.settings(),
 		)
 		if err != nil {
-			log.Println("Create Container Warning: ", createResponse.Warnings)
-			log.Println("Error Creating Container: ", err)
+			slog.WarnContext(ctx, "Create Container Warning", "warnings", createResponse.Warnings)
+			slog.ErrorContext(ctx, "Error Creating Container", "err", err)
 			return err
 		}
 
-		log.Println("Created Container With ContainerID", createResponse.ID)
+		slog.InfoContext(ctx, "Created Container With ContainerID", "container", createResponse.ID)
 		d.containers = append(d.containers, createResponse)
+		containers.Default.Add(createResponse.ID, "deb", model)
 	}
 
 	// start container
+	started := time.Now()
 	err := (d.DockerClient).ContainerStart(childctx, d.containers[0].ID, container.StartOptions{})
 	if err != nil {
-		log.Println("Error Starting Container: ", err)
+		slog.ErrorContext(ctx, "Error Starting Container", "err", err)
 		return err
 	}
-	log.Println("Starting Container: ", d.containers[0].ID)
+	metrics.Stage("deb", metrics.StageContainerStart, started)
+	containers.Default.Follow(d.DockerClient, d.containers[0].ID)
+	slog.InfoContext(ctx, "Starting Container", "container", d.containers[0].ID)
 
 	return nil
 }
@@ -221,30 +313,29 @@ func (d *DebateofModels) Generate(ctx context.Context, maxtokens int64) (string,
 	var result string
 
 	for j := range rounds {
-		log.Println("RoundCount", j+1)
+		slog.InfoContext(ctx, "Round", "round", j+1)
 		for i, model := range d.containers {
-			fmt.Println("Container Index", i)
-			fmt.Println("Round Index", j)
 			// start container
-			err := (d.DockerClient).ContainerStart(ctx, model.ID, container.StartOptions{})
+			err := restartContainer(ctx, d.DockerClient, model.ID)
 			if err != nil {
-				log.Println("Error Starting Container", err)
+				slog.ErrorContext(ctx, "Error Starting Container", "err", err)
 				return "", err
 			}
-			log.Println("StartingContainer, ContainerIndex", i)
+			slog.InfoContext(ctx, "Starting Container", "container", i)
 
-			for {
-				// sleep and give server guy a break
-				time.Sleep(time.Duration(1 * time.Second))
-
-				if api.UpDog("800" + strconv.Itoa(i)) {
-					break
-				}
+			err = waitReady(ctx, d.DockerClient, model.ID, d.settings().ModelURL(i))
+			if err != nil {
+				slog.ErrorContext(ctx, "Error Waiting On Model", "err", err)
+				return "", err
 			}
 
-			openaiClient := openai.NewClient(
-				option.WithBaseURL("http://localhost:800" + strconv.Itoa(i) + "/v1"),
-			)
+			openaiClient := config.NewClient(d.settings().ModelURL(i))
+			d.Tokenizer = llamaTokenizer(d.settings().ModelURL(i))
+
+			err = d.compactSession(ctx, openaiClient, d.Models[i])
+			if err != nil {
+				slog.ErrorContext(ctx, "Error Summarizing Session", "err", err)
+			}
 
 			//log.Println("SystemPrompt: ", d.ContextBox.SystemPrompt, "Prompt: ", d.ContextBox.Prompt)
 
@@ -257,20 +348,16 @@ func (d *DebateofModels) Generate(ctx context.Context, maxtokens int64) (string,
 			if i == len(d.containers)-1 || rounds == j-1 {
 				// answer the question
 				param := openai.ChatCompletionNewParams{
-					Messages: []openai.ChatCompletionMessageParamUnion{
-						openai.SystemMessage(d.SystemPrompt),
-						openai.UserMessage(d.Prompt),
-						//openai.UserMessage(s.FutureQuestions),
-					},
+					Messages:    d.chat(d.SystemPrompt),
 					Seed:        openai.Int(0),
 					Model:       d.Models[i],
-					Temperature: openai.Float(vars.ModelTemperature),
+					Temperature: openai.Float(d.settings().Model.Temperature),
 					MaxTokens:   openai.Int(maxtokens),
 				}
 
 				result, err = GenerateCompletion(ctx, param, "", openaiClient)
 				if err != nil {
-					log.Println("Error Generating Completion", err)
+					slog.ErrorContext(ctx, "Error Generating Completion", "err", err)
 					return "", err
 				}
 
@@ -280,20 +367,16 @@ func (d *DebateofModels) Generate(ctx context.Context, maxtokens int64) (string,
 			// Answer the initial question.
 			// If it's the first model, there will not be any questions from the previous model.
 			param := openai.ChatCompletionNewParams{
-				Messages: []openai.ChatCompletionMessageParamUnion{
-					openai.SystemMessage(d.SystemPrompt),
-					openai.UserMessage(d.Prompt),
-					//openai.UserMessage(d.FutureQuestions),
-				},
+				Messages:    d.chat(d.SystemPrompt),
 				Seed:        openai.Int(0),
 				Model:       d.Models[i],
-				Temperature: openai.Float(vars.ModelTemperature),
+				Temperature: openai.Float(d.settings().Model.Temperature),
 				MaxTokens:   openai.Int(maxtokens),
 			}
 
 			result, err = GenerateCompletion(ctx, param, "", openaiClient)
 			if err != nil {
-				log.Println("Error Generating Completion", err)
+				slog.ErrorContext(ctx, "Error Generating Completion", "err", err)
 				return "", err
 			}
 
@@ -307,19 +390,19 @@ func (d *DebateofModels) Generate(ctx context.Context, maxtokens int64) (string,
 			summarizePrompt := fmt.Sprintf(prompt.SummarizingPrompt, result)
 			param = openai.ChatCompletionNewParams{
 				Messages: []openai.ChatCompletionMessageParamUnion{
-					openai.SystemMessage(prompt.SimplePrompt),
+					openai.SystemMessage(prompt.AssistantPrompt),
 					openai.UserMessage(summarizePrompt),
 					//openai.UserMessage(s.FutureQuestions),
 				},
 				Seed:        openai.Int(0),
 				Model:       d.Models[i],
-				Temperature: openai.Float(vars.ModelTemperature),
+				Temperature: openai.Float(d.settings().Model.Temperature),
 				MaxTokens:   openai.Int(maxtokens),
 			}
 
 			result, err = GenerateCompletion(ctx, param, "", openaiClient)
 			if err != nil {
-				log.Println("Error Generating Completion", err)
+				slog.ErrorContext(ctx, "Error Generating Completion", "err", err)
 				return "", err
 			}
 
@@ -340,19 +423,19 @@ func (d *DebateofModels) Generate(ctx context.Context, maxtokens int64) (string,
 				summarizePrompt := fmt.Sprintf(prompt.SummarizingPrompt, strings.Join(d.ConversationHistory, "\n"))
 				param = openai.ChatCompletionNewParams{
 					Messages: []openai.ChatCompletionMessageParamUnion{
-						openai.SystemMessage(prompt.SimplePrompt),
+						openai.SystemMessage(prompt.AssistantPrompt),
 						openai.UserMessage(summarizePrompt),
 						//openai.UserMessage(s.FutureQuestions),
 					},
 					Seed:        openai.Int(0),
 					Model:       d.Models[i],
-					Temperature: openai.Float(vars.ModelTemperature),
+					Temperature: openai.Float(d.settings().Model.Temperature),
 					MaxTokens:   openai.Int(maxtokens),
 				}
 
 				result, err = GenerateCompletion(ctx, param, "", openaiClient)
 				if err != nil {
-					log.Println("Error Generating Completion", err)
+					slog.ErrorContext(ctx, "Error Generating Completion", "err", err)
 					return "", err
 				}
 
@@ -365,10 +448,10 @@ func (d *DebateofModels) Generate(ctx context.Context, maxtokens int64) (string,
 				}
 			}
 
-			log.Println("Stopping Container", i)
+			slog.InfoContext(ctx, "Stopping Container", "container", i)
 			(d.DockerClient).ContainerStop(ctx, model.ID, container.StopOptions{})
 		}
-		//log.Println("Stopping Container, ContainerIndex", i)
+		//log.Println("Stopping Container", i)
 		(d.DockerClient).ContainerStop(ctx, d.containers[len(d.containers)-1].ID, container.StopOptions{})
 	}
 
@@ -393,5 +476,5 @@ func (d *DebateofModels) Shutdown(w http.ResponseWriter, req *http.Request) {
 		(d.DockerClient).ContainerRemove(childctx, d.Models[i], container.RemoveOptions{})
 	}
 
-	log.Println("Shutting Down...")
+	slog.InfoContext(req.Context(), "Shutting Down")
 }
@@ -0,0 +1,649 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/metrics"
+	"github.com/StoneG24/slape/pkg/prompt"
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/openai/openai-go"
+	"gopkg.in/yaml.v3"
+)
+
+// errPipelineExists is returned when creating a pipeline with a name that is taken.
+var errPipelineExists = errors.New("pipeline already exists")
+
+type (
+	// DeclarativePipeline runs a pipeline described by a Definition.
+	// Every stage gets a container on its own port, only one of them runs at a time.
+	DeclarativePipeline struct {
+		Definition     Definition
+		ContainerImage string
+		GPU            bool
+		DockerClient   *client.Client
+
+		// embedded structs
+		ContextBox
+		Tools
+
+		// for internal use to store the models in
+		containers []container.CreateResponse
+	}
+
+	// Pipelines holds the declarative pipelines and serves their endpoints.
+	Pipelines struct {
+		dir            string
+		containerImage string
+		gpu            bool
+		dockerClient   *client.Client
+		// shared holds the stores and config every pipeline is given
+		shared ContextBox
+
+		mu        sync.Mutex
+		pipelines map[string]*DeclarativePipeline
+	}
+
+	declarativeRequest struct {
+		Prompt string `json:"prompt"`
+
+		// These are optional, leaving them out uses the definition.
+		Thinking       string `json:"thinking"`
+		InternetSearch string `json:"search"`
+		HyDE           string `json:"hyde"`
+		RAG            string `json:"rag"`
+		Rerank         string `json:"rerank"`
+
+		// These are optional and only used when rag is on.
+		Collection string `json:"collection"`
+		TopK       int    `json:"topk"`
+		RagMode    string `json:"rag_mode"`
+
+		// Session continues a conversation started with POST /sessions.
+		Session string `json:"session"`
+	}
+
+	declarativeResponse struct {
+		Answer  string   `json:"answer"`
+		Sources []Source `json:"sources"`
+
+		// Session is the conversation the answer was added to.
+		Session string `json:"session,omitempty"`
+		// Run is the id of the run in GET /runs/{id}.
+		Run string `json:"run,omitempty"`
+	}
+
+	// PipelinesResponse lists the declarative pipelines.
+	PipelinesResponse struct {
+		Pipelines []Definition `json:"pipelines"`
+	}
+)
+
+// NewPipelines creates an empty set of declarative pipelines that are saved to dir.
+// Pipelines are given the stores and config in shared, the same ones the built in pipelines use.
+func NewPipelines(dir string, dockerClient *client.Client, containerImage string, gpu bool, shared ContextBox) *Pipelines {
+	return &Pipelines{
+		dir:            dir,
+		containerImage: containerImage,
+		gpu:            gpu,
+		dockerClient:   dockerClient,
+		shared: ContextBox{
+			VectorStore: shared.VectorStore,
+			RAG:         shared.RAG,
+			Sessions:    shared.Sessions,
+			Runs:        shared.Runs,
+			Config:      shared.Config,
+		},
+		pipelines: map[string]*DeclarativePipeline{},
+	}
+}
+
+// Load adds every definition in the pipelines folder.
+// Definitions that don't validate are logged and skipped.
+func (p *Pipelines) Load() error {
+	defs, err := LoadDefinitions(p.dir, p.shared.Config)
+	for _, def := range defs {
+		p.add(def)
+		slog.Info("Loaded Pipeline", "pipeline", def.Name)
+	}
+	return err
+}
+
+// Get returns the named pipeline.
+func (p *Pipelines) Get(name string) (*DeclarativePipeline, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pipe, ok := p.pipelines[name]
+	return pipe, ok
+}
+
+// Definitions returns every definition sorted by name.
+func (p *Pipelines) Definitions() []Definition {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	defs := make([]Definition, 0, len(p.pipelines))
+	for _, pipe := range p.pipelines {
+		defs = append(defs, pipe.Definition)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Name < defs[j].Name
+	})
+	return defs
+}
+
+func (p *Pipelines) add(def Definition) *DeclarativePipeline {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.insert(def)
+}
+
+// create saves a new definition and adds it, a name that is taken in memory or on disk is errPipelineExists.
+func (p *Pipelines) create(def Definition) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.pipelines[def.Name]; ok {
+		return errPipelineExists
+	}
+	err := p.save(def)
+	if err != nil {
+		return err
+	}
+	p.insert(def)
+	return nil
+}
+
+// insert adds a pipeline for def, the caller has to hold the lock.
+func (p *Pipelines) insert(def Definition) *DeclarativePipeline {
+	pipe := &DeclarativePipeline{
+		Definition:     def,
+		ContainerImage: p.containerImage,
+		GPU:            p.gpu,
+		DockerClient:   p.dockerClient,
+		ContextBox:     p.shared,
+		Tools:          Tools(def.Tools),
+	}
+	p.pipelines[def.Name] = pipe
+	return pipe
+}
+
+// CreatePipelineRequest, handlerfunc expects POST method with a definition in YAML or JSON as the body.
+// The definition is validated, saved to the pipelines folder and can be set up right away.
+func (p *Pipelines) CreatePipelineRequest(w http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(req.Body, vars.PipelineMaxBytes+1))
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Reading Pipeline Definition", "err", err)
+		http.Error(w, "Error reading the pipeline definition", http.StatusBadRequest)
+		return
+	}
+	if len(data) > vars.PipelineMaxBytes {
+		http.Error(w, "Error pipeline definition is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	def, err := ParseDefinition(data, p.shared.Config)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Parsing Pipeline Definition", "err", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	err = p.create(def)
+	if errors.Is(err, errPipelineExists) {
+		http.Error(w, "Error a pipeline named "+def.Name+" already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Saving Pipeline Definition", "err", err)
+		http.Error(w, "Error saving the pipeline definition", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(req.Context(), "Added Pipeline", "pipeline", def.Name)
+
+	json, err := json.Marshal(def)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error marshaling pipeline definition", "err", err)
+		http.Error(w, "Error marshaling the pipeline definition", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+// ListPipelinesRequest, handlerfunc expects GET method and returns every declarative pipeline.
+func (p *Pipelines) ListPipelinesRequest(w http.ResponseWriter, req *http.Request) {
+	json, err := json.Marshal(PipelinesResponse{Pipelines: p.Definitions()})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error marshaling pipelines", "err", err)
+		http.Error(w, "Error marshaling pipelines", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// PipelineSetupRequest, handlerfunc expects POST method on /pipelines/{name}/setup and returns nothing.
+func (p *Pipelines) PipelineSetupRequest(w http.ResponseWriter, req *http.Request) {
+	pipe, ok := p.Get(req.PathValue("name"))
+	if !ok {
+		http.Error(w, "Error pipeline not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(30*time.Second))
+	defer cancel()
+
+	err := pipe.Setup(ctx)
+	if err != nil {
+		http.Error(w, "Error setting up the pipeline", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// PipelineGenerateRequest, handlerfunc expects POST method on /pipelines/{name}/generate.
+// The json is the same as the other pipelines, without a mode since the stages pick their prompts.
+func (p *Pipelines) PipelineGenerateRequest(w http.ResponseWriter, req *http.Request) {
+	pipe, ok := p.Get(req.PathValue("name"))
+	if !ok {
+		http.Error(w, "Error pipeline not found", http.StatusNotFound)
+		return
+	}
+
+	pipe.GenerateRequest(w, req)
+}
+
+// PipelineShutdownRequest, handlerfunc expects GET method on /pipelines/{name}/shutdown.
+func (p *Pipelines) PipelineShutdownRequest(w http.ResponseWriter, req *http.Request) {
+	pipe, ok := p.Get(req.PathValue("name"))
+	if !ok {
+		http.Error(w, "Error pipeline not found", http.StatusNotFound)
+		return
+	}
+
+	pipe.Shutdown(w, req)
+}
+
+// ShutdownAll stops and removes the containers of every declarative pipeline.
+func (p *Pipelines) ShutdownAll(ctx context.Context) {
+	p.mu.Lock()
+	pipes := make([]*DeclarativePipeline, 0, len(p.pipelines))
+	for _, pipe := range p.pipelines {
+		pipes = append(pipes, pipe)
+	}
+	p.mu.Unlock()
+
+	for _, pipe := range pipes {
+		pipe.shutdown(ctx)
+	}
+}
+
+// save writes a new definition to the pipelines folder so it's loaded again on startup.
+// A file that is already there for the name is never replaced, even one that didn't load.
+func (p *Pipelines) save(def Definition) error {
+	err := os.MkdirAll(p.dir, 0750)
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(def)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(filepath.Join(p.dir, def.Name+".yml"))
+	if err == nil {
+		return errPipelineExists
+	}
+	// the file is claimed first so the rename can't replace one written in the meantime
+	path := filepath.Join(p.dir, def.Name+".yaml")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if errors.Is(err, os.ErrExist) {
+		return errPipelineExists
+	}
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0640)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		os.Remove(path)
+	}
+	return err
+}
+
+// GenerateRequest runs the pipeline for a single prompt.
+func (d *DeclarativePipeline) GenerateRequest(w http.ResponseWriter, req *http.Request) {
+	var payload declarativeRequest
+
+	// use this to scope the context to the request
+	ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(time.Duration(d.settings().GenerationTimeout)*time.Minute))
+	defer cancel()
+
+	err := json.NewDecoder(req.Body).Decode(&payload)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Request Format", "err", err)
+		http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
+		return
+	}
+
+	def := d.Definition
+	thinking, search, hyde, rerank := def.Thinking, def.Search, def.HyDE, def.Rerank
+	ragEnabled := def.RAG != nil
+	for _, toggle := range []struct {
+		name  string
+		value string
+		field *bool
+	}{
+		{"thinking", payload.Thinking, &thinking},
+		{"search", payload.InternetSearch, &search},
+		{"hyde", payload.HyDE, &hyde},
+		{"rerank", payload.Rerank, &rerank},
+		{"rag", payload.RAG, &ragEnabled},
+	} {
+		if toggle.value == "" {
+			continue
+		}
+		*toggle.field, err = strconv.ParseBool(toggle.value)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error Parsing "+toggle.name+" value", "err", err)
+			http.Error(w, "Error parsing "+toggle.name+" value. Expecting sound boolean definitions.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ragOpts := def.ragOptions(rerank)
+	if payload.Collection != "" || payload.TopK != 0 || payload.RagMode != "" {
+		ragOpts, err = parseRAGOptions("true", payload.Collection, payload.RagMode, payload.TopK, rerank)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error Parsing RAG values", "err", err)
+			http.Error(w, "Error parsing RAG values. Expecting a boolean, a valid mode and a positive topk.", http.StatusBadRequest)
+			return
+		}
+	}
+	ragOpts.enabled = ragEnabled
+
+	d.ContextBox.Prompt = payload.Prompt
+	err = d.useSession(payload.Session)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Loading Session", "err", err)
+		message, code := sessionError(err)
+		http.Error(w, message, code)
+		return
+	}
+	ctx, run := d.startRun(ctx, "pipelines/"+d.Definition.Name, "", payload)
+
+	d.InternetSearchResults = []string{}
+	d.Documents = []string{}
+	d.Sources = []Source{}
+
+	if ragOpts.enabled {
+		d.getDocuments(ctx, ragOpts)
+	}
+
+	// search and thinking use the model, so they fail if it doesn't come up
+	if search {
+		err = d.getInternetSearch(ctx, d.DockerClient, firstContainer(d.containers), hyde, rerank)
+	}
+	if thinking && err == nil {
+		err = d.getThoughts(ctx, d.DockerClient, firstContainer(d.containers))
+	} else if !thinking {
+		d.Thoughts = "None"
+	}
+	if err != nil {
+		d.finishRun(ctx, run, "", err)
+		slog.ErrorContext(ctx, "Error Waiting for the Model", "err", err)
+		http.Error(w, generationError(err), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := d.Generate(ctx)
+	d.finishRun(ctx, run, result, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting generation from model", "err", err)
+		http.Error(w, generationError(err), http.StatusInternalServerError)
+		return
+	}
+
+	err = d.saveTurn(result)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Saving Session", "err", err)
+	}
+
+	respPayload := declarativeResponse{
+		Answer:  result,
+		Sources: d.Sources,
+		Session: d.sessionID(),
+		Run:     d.runID(run),
+	}
+
+	json, err := json.Marshal(respPayload)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error marshaling response from model", "err", err)
+		http.Error(w, "Error marshaling your response from model", http.StatusInternalServerError)
+		return
+	}
+
+	d.InternetSearchResults = []string{}
+	d.Documents = []string{}
+	d.Sources = []Source{}
+	d.Thoughts = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// Setup creates a container for every stage and starts the first one.
+func (d *DeclarativePipeline) Setup(ctx context.Context) error {
+	if len(d.containers) != 0 {
+		return nil
+	}
+
+	childctx, cancel := context.WithDeadline(ctx, time.Now().Add(30*time.Second))
+	defer cancel()
+
+	for i, stage := range d.Definition.Stages {
+		createResponse, err := CreateCPPContainer(
+			d.DockerClient,
+			d.settings().ModelPort(i),
+			"",
+			childctx,
+			stage.Model,
+			d.ContainerImage,
+			d.GPU,
+			d.settings(),
+		)
+		if err != nil {
+			slog.WarnContext(ctx, "Create Container Warning", "warnings", createResponse.Warnings)
+			slog.ErrorContext(ctx, "Error Creating Container", "err", err)
+			return err
+		}
+
+		slog.InfoContext(ctx, "Container Created", "container", createResponse.ID, "stage", stage.Name)
+		d.containers = append(d.containers, createResponse)
+		containers.Default.Add(createResponse.ID, "pipelines/"+d.Definition.Name, stage.Model)
+	}
+
+	// the first stage is up for the search and thinking steps
+	started := time.Now()
+	err := (d.DockerClient).ContainerStart(childctx, d.containers[0].ID, container.StartOptions{})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Starting Container", "err", err)
+		return err
+	}
+	metrics.Stage("pipelines/"+d.Definition.Name, metrics.StageContainerStart, started)
+	containers.Default.Follow(d.DockerClient, d.containers[0].ID)
+	slog.InfoContext(ctx, "Starting Container", "container", d.containers[0].ID)
+
+	return nil
+}
+
+// Generate runs every stage in order for each round and returns the last answer.
+func (d *DeclarativePipeline) Generate(ctx context.Context) (string, error) {
+	if len(d.containers) == 0 {
+		return "", errors.New("pipeline " + d.Definition.Name + " is not set up")
+	}
+
+	var result string
+	stages := d.Definition.Stages
+
+	for round := range d.Definition.Rounds {
+		for i, stage := range stages {
+			slog.InfoContext(ctx, "Round", "round", round+1, "stage", stage.Name)
+
+			err := restartContainer(ctx, d.DockerClient, d.containers[i].ID)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error Starting Container", "err", err)
+				return "", err
+			}
+
+			endpoint := d.settings().ModelURL(i)
+			err = waitReady(ctx, d.DockerClient, d.containers[i].ID, endpoint)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error Waiting On Model", "err", err)
+				return "", err
+			}
+
+			openaiClient := config.NewClient(endpoint)
+
+			system, maxtokens := stage.prompt(d.settings())
+			d.Template = system
+			d.MaxTokens = maxtokens
+			d.Tokenizer = llamaTokenizer(endpoint)
+			err = d.compactSession(ctx, openaiClient, stage.Model)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error Summarizing Session", "err", err)
+			}
+
+			err = d.promptBuilder()
+			if err != nil {
+				return "", err
+			}
+
+			result, err = d.complete(ctx, openaiClient, stage, d.chat(d.SystemPrompt), maxtokens)
+			if err != nil {
+				return "", err
+			}
+
+			last := round == d.Definition.Rounds-1 && i == len(stages)-1
+			if !last {
+				d.FutureQuestions = "None"
+				answer := result
+
+				if stage.Summarize {
+					answer, err = d.complete(ctx, openaiClient, stage, assistant(fmt.Sprintf(prompt.SummarizingPrompt, result)), maxtokens)
+					if err != nil {
+						return "", err
+					}
+				}
+				d.ConversationHistory = append(d.ConversationHistory, answer)
+
+				if stage.Questions {
+					d.FutureQuestions, err = d.complete(ctx, openaiClient, stage, assistant(fmt.Sprintf(prompt.QuestioningPrompt, answer)), maxtokens)
+					if err != nil {
+						return "", err
+					}
+				}
+			}
+
+			// only one model is loaded at a time, a single stage just stays up
+			if len(stages) > 1 {
+				slog.InfoContext(ctx, "Stopping Container", "stage", stage.Name)
+				(d.DockerClient).ContainerStop(ctx, d.containers[i].ID, container.StopOptions{})
+			}
+		}
+	}
+
+	d.ConversationHistory = []string{}
+	d.FutureQuestions = ""
+
+	err := restartContainer(ctx, d.DockerClient, d.containers[0].ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Starting Container", "err", err)
+		return result, err
+	}
+	slog.InfoContext(ctx, "Starting Container For next Potential run", "container", d.containers[0].ID)
+
+	return result, nil
+}
+
+// complete sends a single system and user message to the model of a stage.
+func (d *DeclarativePipeline) complete(ctx context.Context, openaiClient openai.Client, stage Stage, messages []openai.ChatCompletionMessageParamUnion, maxtokens int64) (string, error) {
+	param := openai.ChatCompletionNewParams{
+		Messages:    messages,
+		Seed:        openai.Int(0),
+		Model:       stage.Model,
+		Temperature: openai.Float(stage.temperature(d.settings())),
+		MaxTokens:   openai.Int(maxtokens),
+	}
+
+	result, err := GenerateCompletion(ctx, param, "", openaiClient)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Generating Completion", "err", err)
+		return "", err
+	}
+	return result, nil
+}
+
+// assistant returns the messages for the small jobs between answers.
+func assistant(user string) []openai.ChatCompletionMessageParamUnion {
+	return []openai.ChatCompletionMessageParamUnion{
+		openai.SystemMessage(prompt.AssistantPrompt),
+		openai.UserMessage(user),
+	}
+}
+
+// Shutdown stops and removes the containers of the pipeline.
+func (d *DeclarativePipeline) Shutdown(w http.ResponseWriter, req *http.Request) {
+	childctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(30*time.Second))
+	defer cancel()
+
+	d.shutdown(childctx)
+}
+
+func (d *DeclarativePipeline) shutdown(ctx context.Context) {
+	if len(d.containers) == 0 {
+		return
+	}
+
+	// turn off the containers if they aren't already off
+	for _, model := range d.containers {
+		(d.DockerClient).ContainerStop(ctx, model.ID, container.StopOptions{})
+	}
+
+	// remove the containers, seperate incase it's already stopped
+	for _, model := range d.containers {
+		(d.DockerClient).ContainerRemove(ctx, model.ID, container.RemoveOptions{})
+	}
+	d.containers = nil
+
+	slog.InfoContext(ctx, "Shutting Down Pipeline", "pipeline", d.Definition.Name)
+}
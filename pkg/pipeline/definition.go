@@ -0,0 +1,251 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/prompt"
+	"github.com/StoneG24/slape/pkg/vars"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrDefinition is wrapped by every problem found while validating a pipeline definition.
+	ErrDefinition = errors.New("invalid pipeline definition")
+
+	definitionName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+)
+
+type (
+	// Definition describes a pipeline so it can be added without rebuilding slape.
+	// The stages run in order, once per round, like a chain of models.
+	// With more than one round the last stage hands back to the first, like a debate.
+	Definition struct {
+		Name        string  `yaml:"name" json:"name"`
+		Description string  `yaml:"description" json:"description,omitempty"`
+		Stages      []Stage `yaml:"stages" json:"stages"`
+		// Rounds defaults to 1.
+		Rounds int `yaml:"rounds" json:"rounds"`
+
+		// Defaults for the steps before generation, requests can turn them on or off.
+		Thinking bool           `yaml:"thinking" json:"thinking"`
+		Search   bool           `yaml:"search" json:"search"`
+		HyDE     bool           `yaml:"hyde" json:"hyde"`
+		Rerank   bool           `yaml:"rerank" json:"rerank"`
+		RAG      *RAGDefinition `yaml:"rag" json:"rag,omitempty"`
+
+		Tools []string `yaml:"tools" json:"tools,omitempty"`
+	}
+
+	// Stage is a single model in a pipeline definition.
+	Stage struct {
+		Name string `yaml:"name" json:"name"`
+		// Model is a gguf file in the models folder.
+		Model string `yaml:"model" json:"model"`
+		// Mode picks one of the prompts, the same as the mode of a request.
+		Mode string `yaml:"mode" json:"mode,omitempty"`
+		// System replaces the prompt picked by Mode, it's a template like the prompts in the prompt folder.
+		// It can place the context with {{.Thoughts}}, {{.Context}} and so on, otherwise the context is added at the end.
+		System      string   `yaml:"system" json:"system,omitempty"`
+		MaxTokens   int64    `yaml:"max_tokens" json:"max_tokens,omitempty"`
+		Temperature *float64 `yaml:"temperature" json:"temperature,omitempty"`
+		// Summarize shortens the answer before it's passed on, Questions has the model
+		// write questions for the next stage. Neither is done after the final answer.
+		Summarize bool `yaml:"summarize" json:"summarize"`
+		Questions bool `yaml:"questions" json:"questions"`
+	}
+
+	// RAGDefinition turns on document retrieval for a pipeline.
+	RAGDefinition struct {
+		Collection string `yaml:"collection" json:"collection,omitempty"`
+		TopK       int    `yaml:"topk" json:"topk,omitempty"`
+		Mode       string `yaml:"mode" json:"mode,omitempty"`
+	}
+)
+
+// ParseDefinition reads a definition written in YAML, JSON works as well since it's valid YAML.
+// Unknown fields are an error so typos don't get silently ignored. Limits come from cfg.
+func ParseDefinition(data []byte, cfg *config.Config) (Definition, error) {
+	var def Definition
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&def)
+	if err != nil {
+		return def, fmt.Errorf("%w: %v", ErrDefinition, err)
+	}
+
+	def.setDefaults()
+	return def, def.Validate(cfg)
+}
+
+// LoadDefinitions parses every .yaml and .yml file in dir.
+// Files that don't parse are returned as errors and the rest are still loaded.
+func LoadDefinitions(dir string, cfg *config.Config) ([]Definition, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var defs []Definition
+	var errs []error
+	names := map[string]string{}
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		def, err := ParseDefinition(data, cfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		if other, ok := names[def.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s: %w: name %s is already used by %s", path, ErrDefinition, def.Name, other))
+			continue
+		}
+		names[def.Name] = path
+		defs = append(defs, def)
+	}
+
+	return defs, errors.Join(errs...)
+}
+
+func (d *Definition) setDefaults() {
+	if d.Rounds == 0 {
+		d.Rounds = 1
+	}
+	for i := range d.Stages {
+		if d.Stages[i].Name == "" {
+			d.Stages[i].Name = fmt.Sprintf("stage-%d", i+1)
+		}
+	}
+}
+
+// Validate checks everything that can be checked before the pipeline is set up,
+// including that every model is in the models folder and generates text.
+// A nil cfg checks against the defaults.
+func (d Definition) Validate(cfg *config.Config) error {
+	cfg = orDefault(cfg)
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{ErrDefinition}, args...)...))
+	}
+
+	if !definitionName.MatchString(d.Name) {
+		add("name %q has to be lowercase letters, numbers, - and _", d.Name)
+	}
+	if len(d.Stages) == 0 || len(d.Stages) > vars.PipelineMaxStages {
+		add("needs between 1 and %d stages, got %d", vars.PipelineMaxStages, len(d.Stages))
+	}
+	if d.Rounds < 1 || d.Rounds > vars.PipelineMaxRounds {
+		add("rounds has to be between 1 and %d, got %d", vars.PipelineMaxRounds, d.Rounds)
+	}
+
+	stageNames := map[string]bool{}
+	for i, stage := range d.Stages {
+		if stageNames[stage.Name] {
+			add("stage %d: name %q is used twice", i+1, stage.Name)
+		}
+		stageNames[stage.Name] = true
+
+		switch {
+		case stage.Model == "":
+			add("stage %s: model is required", stage.Name)
+		default:
+			if err := checkModel(stage.Model); err != nil {
+				add("stage %s: %v", stage.Name, err)
+			}
+		}
+
+		if _, ok := Prompts.Get(stage.Mode); stage.Mode != "" && !ok {
+			add("stage %s: mode %q is not one of %s", stage.Name, stage.Mode, strings.Join(Prompts.Modes(), ", "))
+		}
+		if _, err := stage.template(); err != nil {
+			add("stage %s: system prompt: %v", stage.Name, err)
+		}
+		if stage.MaxTokens < 0 || stage.MaxTokens > int64(cfg.Model.MaxGenTokens) {
+			add("stage %s: max_tokens has to be between 0 and %d", stage.Name, cfg.Model.MaxGenTokens)
+		}
+		if stage.Temperature != nil && (*stage.Temperature < 0 || *stage.Temperature > 2) {
+			add("stage %s: temperature has to be between 0 and 2", stage.Name)
+		}
+	}
+
+	if d.RAG != nil {
+		if _, err := parseRAGOptions("true", d.RAG.Collection, d.RAG.Mode, d.RAG.TopK, false); err != nil {
+			add("rag: %v", err)
+		}
+		if d.RAG.TopK > vars.RagMaxTopK {
+			add("rag: topk can't be more than %d", vars.RagMaxTopK)
+		}
+	}
+
+	for _, tool := range d.Tools {
+		if strings.TrimSpace(tool) == "" {
+			add("tool names can't be empty")
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// template parses the inline system prompt of a stage, it's nil without one.
+func (s Stage) template() (*prompt.Template, error) {
+	if s.System == "" {
+		return nil, nil
+	}
+	system := s.System
+	if !strings.Contains(system, "{{") {
+		system += prompt.ContextTemplate
+	}
+	return prompt.Parse(s.Name, system)
+}
+
+// prompt returns the system prompt template and token limit of a stage.
+func (s Stage) prompt(cfg *config.Config) (*prompt.Template, int64) {
+	system, maxtokens := processPrompt(s.Mode, cfg)
+	// already checked by Validate
+	if inline, _ := s.template(); inline != nil {
+		system = inline
+	}
+	if s.MaxTokens != 0 {
+		maxtokens = s.MaxTokens
+	}
+	return system, maxtokens
+}
+
+// temperature returns the sampling temperature of a stage.
+func (s Stage) temperature(cfg *config.Config) float64 {
+	if s.Temperature != nil {
+		return *s.Temperature
+	}
+	return cfg.Model.Temperature
+}
+
+// ragOptions returns the rag options a definition turns on.
+func (d Definition) ragOptions(rerank bool) ragOptions {
+	if d.RAG == nil {
+		return ragOptions{}
+	}
+	// already checked by Validate
+	opts, _ := parseRAGOptions("true", d.RAG.Collection, d.RAG.Mode, d.RAG.TopK, rerank)
+	return opts
+}
@@ -0,0 +1,193 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/models"
+	"github.com/StoneG24/slape/pkg/prompt"
+)
+
+// useModels points the models folder at a temp dir holding llama models that are only a gguf header.
+func useModels(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range names {
+		writeModel(t, dir, name, "llama")
+	}
+	old := models.Default
+	models.Default = models.New(dir, filepath.Join(dir, "catalog.json"))
+	t.Cleanup(func() { models.Default = old })
+	return dir
+}
+
+// writeModel writes a gguf header with just the architecture of a model.
+func writeModel(t *testing.T, dir string, name string, arch string) {
+	t.Helper()
+	str := func(b []byte, s string) []byte {
+		return append(binary.LittleEndian.AppendUint64(b, uint64(len(s))), s...)
+	}
+	header := binary.LittleEndian.AppendUint32([]byte("GGUF"), 3)
+	// no tensors and one string value
+	header = binary.LittleEndian.AppendUint64(header, 0)
+	header = binary.LittleEndian.AppendUint64(header, 1)
+	header = str(header, "general.architecture")
+	header = binary.LittleEndian.AppendUint32(header, 8)
+	header = str(header, arch)
+	if err := os.WriteFile(filepath.Join(dir, name), header, 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const reviewDefinition = `
+name: review
+description: a draft that gets critiqued
+search: true
+rounds: 2
+rag:
+  collection: advisories
+  topk: 3
+stages:
+  - model: small.gguf
+    mode: cot
+    summarize: true
+    questions: true
+  - name: critic
+    model: big.gguf
+    system: Point out what the previous answer got wrong.
+    max_tokens: 512
+    temperature: 0.3
+`
+
+func TestParseDefinition(t *testing.T) {
+	useModels(t, "small.gguf", "big.gguf")
+
+	def, err := ParseDefinition([]byte(reviewDefinition), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Stages[0].Name != "stage-1" || def.Rounds != 2 || !def.Search {
+		t.Errorf("unexpected definition %+v", def)
+	}
+
+	system, maxtokens := def.Stages[1].prompt(config.Default())
+	filled, err := system.Execute(prompt.Data{Context: "the advisory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxtokens != 512 || !strings.Contains(filled, "got wrong") || !strings.Contains(filled, "the advisory") {
+		t.Errorf("expected the context to be added to the inline prompt, got %d %q", maxtokens, filled)
+	}
+
+	opts := def.ragOptions(false)
+	if opts.collection != "advisories" || opts.topK != 3 {
+		t.Errorf("unexpected rag options %+v", opts)
+	}
+}
+
+func TestParseDefinitionErrors(t *testing.T) {
+	dir := useModels(t, "small.gguf")
+	writeModel(t, dir, "embed.gguf", "bert")
+	os.WriteFile(filepath.Join(dir, "junk.gguf"), []byte("<html>not found</html>"), 0640)
+	cfg := config.Default()
+	cfg.Model.MaxGenTokens = 256
+
+	tests := []struct {
+		name       string
+		definition string
+		want       string
+	}{
+		{"unknown field", "name: a\nstages: [{model: small.gguf}]\nsearh: true", "searh"},
+		{"no stages", "name: a", "stages"},
+		{"missing model", "name: a\nstages: [{model: missing.gguf}]", "not found"},
+		{"model path", "name: a\nstages: [{model: ../small.gguf}]", "file name"},
+		{"embedding model", "name: a\nstages: [{model: embed.gguf}]", "bert is for embedding"},
+		{"not a model", "name: a\nstages: [{model: junk.gguf}]", "not a valid gguf"},
+		{"bad mode", "name: a\nstages: [{model: small.gguf, mode: nope}]", "mode"},
+		{"bad name", "name: A B\nstages: [{model: small.gguf}]", "name"},
+		{"duplicate stage", "name: a\nstages: [{name: x, model: small.gguf}, {name: x, model: small.gguf}]", "twice"},
+		{"bad template", "name: a\nstages: [{model: small.gguf, system: 'only {{.Thougts}}'}]", "Thougts"},
+		{"rounds", "name: a\nrounds: 50\nstages: [{model: small.gguf}]", "rounds"},
+		{"rag mode", "name: a\nrag: {mode: huge}\nstages: [{model: small.gguf}]", "rag"},
+		{"max tokens", "name: a\nstages: [{model: small.gguf, max_tokens: 512}]", "between 0 and 256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseDefinition([]byte(tt.definition), cfg)
+			if !errors.Is(err, ErrDefinition) {
+				t.Fatalf("expected ErrDefinition, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected the error to mention %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestPipelinesCreateAndLoad(t *testing.T) {
+	useModels(t, "small.gguf", "big.gguf")
+	dir := t.TempDir()
+
+	pipes := NewPipelines(dir, nil, "", false, ContextBox{})
+
+	post := func(body string) int {
+		rec := httptest.NewRecorder()
+		pipes.CreatePipelineRequest(rec, httptest.NewRequest(http.MethodPost, "/pipelines", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	if code := post(reviewDefinition); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if code := post(reviewDefinition); code != http.StatusConflict {
+		t.Errorf("expected 409 for a duplicate name, got %d", code)
+	}
+	if code := post("name: broken"); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for an invalid definition, got %d", code)
+	}
+
+	// a file that didn't load still keeps its name
+	os.WriteFile(filepath.Join(dir, "audit.yml"), []byte("name: audit\nstages: [{model: missing.gguf}]"), 0640)
+	if code := post(strings.Replace(reviewDefinition, "name: review", "name: audit", 1)); code != http.StatusConflict {
+		t.Errorf("expected 409 for a name taken on disk, got %d", code)
+	}
+
+	// only one of the same new pipeline posted at once is created
+	codes := make(chan int, 8)
+	for range cap(codes) {
+		go func() { codes <- post(strings.Replace(reviewDefinition, "name: review", "name: race", 1)) }()
+	}
+	created := 0
+	for range cap(codes) {
+		if <-codes == http.StatusCreated {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("expected one of the posts to create the pipeline, %d did", created)
+	}
+
+	// a bad file next to the saved one doesn't stop it from loading
+	os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("name: broken"), 0640)
+
+	reloaded := NewPipelines(dir, nil, "", false, ContextBox{})
+	err := reloaded.Load()
+	if err == nil {
+		t.Errorf("expected the broken definition to be reported")
+	}
+	pipe, ok := reloaded.Get("review")
+	if !ok {
+		t.Fatalf("expected the saved pipeline to be loaded again")
+	}
+	if len(pipe.Definition.Stages) != 2 || pipe.Definition.Stages[1].Name != "critic" {
+		t.Errorf("unexpected definition after reloading %+v", pipe.Definition)
+	}
+}
@@ -0,0 +1,118 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/StoneG24/slape/pkg/chunker"
+	"github.com/StoneG24/slape/pkg/metrics"
+	"github.com/StoneG24/slape/pkg/rag"
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+// ragOptions are the parsed rag values of a generate request.
+type ragOptions struct {
+	enabled    bool
+	collection string
+	topK       int
+	mode       rag.Mode
+	rerank     bool
+}
+
+// parseRAGOptions checks the rag values of a request, an empty collection or top k uses the defaults.
+func parseRAGOptions(enabled string, collection string, mode string, topK int, rerank bool) (ragOptions, error) {
+	var opts ragOptions
+	var err error
+
+	opts.enabled, err = parseOptionalBool(enabled)
+	if err != nil {
+		return opts, err
+	}
+	opts.rerank = rerank
+
+	opts.mode, err = rag.ParseMode(mode)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.collection = collection
+	if opts.collection == "" {
+		opts.collection = vars.RagCollection
+	}
+
+	switch {
+	case topK < 0:
+		return opts, fmt.Errorf("topk can't be negative: %d", topK)
+	case topK == 0:
+		opts.topK = vars.RagTopK
+	default:
+		opts.topK = min(topK, vars.RagMaxTopK)
+	}
+
+	return opts, nil
+}
+
+// getDocuments retrieves passages from a rag collection and adds them to the ContextBox as sources.
+// Passages are added best first until the documents section is out of tokens.
+func (c *ContextBox) getDocuments(ctx context.Context, opts ragOptions) {
+	ctx, done := startStage(ctx, metrics.StageDocuments)
+	defer done()
+	if c.RAG == nil {
+		slog.ErrorContext(ctx, "Error Retrieving Documents, rag is not set up")
+		return
+	}
+
+	slog.InfoContext(ctx, "Retrieving Documents")
+
+	candidates := opts.topK
+	if opts.rerank {
+		candidates = opts.topK * vars.RerankCandidates
+	}
+
+	passages, err := c.RAG.Retrieve(ctx, opts.collection, c.Prompt, opts.mode, candidates)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Retrieving Documents", "err", err)
+		return
+	}
+
+	sources := make([]Source, len(passages))
+	for i, passage := range passages {
+		sources[i] = Source{
+			Kind:     DocumentSource,
+			URL:      passage.Source,
+			Title:    passage.Title,
+			Snippet:  passage.Text,
+			Score:    passage.Score,
+			Document: passage.DocumentID,
+		}
+	}
+	if opts.rerank {
+		sources = c.rerankSources(ctx, sources, opts.topK)
+	}
+
+	budget := vars.RagContextTokens
+	for _, source := range sources {
+		text := source.Snippet
+		tokens := chunker.EstimateTokens(text)
+		if tokens > budget {
+			// the best passage is always used, even if only part of it fits
+			if len(c.Documents) != 0 {
+				break
+			}
+			cut := chunker.Split(text, chunker.Options{Strategy: chunker.Sentence, MaxTokens: budget})
+			if len(cut) == 0 {
+				break
+			}
+			text = cut[0].Text
+			tokens = cut[0].Tokens
+		}
+		budget -= tokens
+
+		source.Snippet = text
+		c.addDocument(source)
+	}
+
+	slog.InfoContext(ctx, "Retrieved Documents", "documents", len(c.Documents), "collection", opts.collection)
+	slog.InfoContext(ctx, "Finished retrieving documents")
+}
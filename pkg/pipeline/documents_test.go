@@ -0,0 +1,44 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/StoneG24/slape/pkg/rag"
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+func TestParseRAGOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    string
+		collection string
+		mode       string
+		topK       int
+		want       ragOptions
+		wantErr    bool
+	}{
+		{"defaults", "true", "", "", 0, ragOptions{enabled: true, collection: vars.RagCollection, topK: vars.RagTopK, mode: rag.Mini}, false},
+		{"off", "", "docs", "naive", 3, ragOptions{collection: "docs", topK: 3, mode: rag.Naive}, false},
+		{"topk is capped", "true", "docs", "MINI", vars.RagMaxTopK + 1, ragOptions{enabled: true, collection: "docs", topK: vars.RagMaxTopK, mode: rag.Mini}, false},
+		{"invalid mode", "true", "", "huge", 0, ragOptions{}, true},
+		{"negative topk", "true", "", "", -1, ragOptions{}, true},
+		{"invalid bool", "maybe", "", "", 0, ragOptions{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRAGOptions(tt.enabled, tt.collection, tt.mode, tt.topK, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseRAGOptions() = %+v, expected %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,12 +3,13 @@ package pipeline
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
 
-	"github.com/StoneG24/slape/pkg/api"
-	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/embedding"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/openai/openai-go"
@@ -26,6 +27,8 @@ type (
 		DockerClient   *client.Client
 		ContainerImage string
 		GPU            bool
+		// Config holds the runtime settings, the defaults are used if it's nil.
+		Config *config.Config
 
 		// for internal use
 		// 0 is embedding model
@@ -48,7 +51,7 @@ func (e *EmbeddingPipeline) EmbeddingPipelineSetupRequest(w http.ResponseWriter,
 
 	apiClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		log.Println("Error creating the docker client: ", err)
+		slog.ErrorContext(ctx, "Error creating the docker client", "err", err)
 		return
 	}
 
@@ -68,16 +71,16 @@ func (e *EmbeddingPipeline) EmbeddingPipelineGenerateRequest(w http.ResponseWrit
 
 	err := json.NewDecoder(req.Body).Decode(&payload)
 	if err != nil {
-		log.Println("Error Request Format: ", err)
+		slog.ErrorContext(ctx, "Error Request Format", "err", err)
 		http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
 		return
 	}
 
 	// generate a response
 	// TODO rewrite for embedding and rag
-	result, err := e.Generate(ctx, payload.Prompt, &vars.EmbeddingClient)
+	result, err := e.Generate(ctx, payload.Prompt)
 	if err != nil {
-		log.Println("Error getting generation from model", err)
+		slog.ErrorContext(ctx, "Error getting generation from model", "err", err)
 		http.Error(w, "Error getting generation from model", http.StatusInternalServerError)
 
 		return
@@ -89,7 +92,7 @@ func (e *EmbeddingPipeline) EmbeddingPipelineGenerateRequest(w http.ResponseWrit
 
 	json, err := json.Marshal(respPayload)
 	if err != nil {
-		log.Println("Error marshaling response from model", err)
+		slog.ErrorContext(ctx, "Error marshaling response from model", "err", err)
 		http.Error(w, "Error marshaling your response from model", http.StatusInternalServerError)
 		return
 	}
@@ -101,11 +104,11 @@ func (e *EmbeddingPipeline) EmbeddingPipelineGenerateRequest(w http.ResponseWrit
 func (e *EmbeddingPipeline) Setup(ctx context.Context) error {
 
 	/*
-		log.Println("PullingImage: ", e.ContainerImage)
+		slog.InfoContext(ctx, "Pulling Image", "image", e.ContainerImage)
 
 		reader, err := PullImage(e.DockerClient, ctx, e.ContainerImage)
 		if err != nil {
-			log.Println("Error Pulling Container Image: ", err)
+			slog.ErrorContext(ctx, "Error Pulling Container Image", "err", err)
 			return err
 		}
 		// prints out the status of the download
@@ -128,17 +131,18 @@ func (e *EmbeddingPipeline) Setup(ctx context.Context) error {
 
 	embedcreateResponse, err := CreateCPPContainer(
 		e.DockerClient,
-		"8082",
+		orDefault(e.Config).EmbeddingPort(),
 		"",
 		ctx,
 		embedmodel,
 		e.ContainerImage,
 		e.GPU,
+		orDefault(e.Config),
 	)
 
 	if err != nil {
-		log.Println("Create Container Warning: ", embedcreateResponse.Warnings)
-		log.Println("Error Creating Container: ", err)
+		slog.WarnContext(ctx, "Create Container Warning", "warnings", embedcreateResponse.Warnings)
+		slog.ErrorContext(ctx, "Error Creating Container", "err", err)
 		return err
 	}
 
@@ -154,12 +158,15 @@ func (e *EmbeddingPipeline) Setup(ctx context.Context) error {
 	// start container
 	err = (e.DockerClient).ContainerStart(ctx, embedcreateResponse.ID, container.StartOptions{})
 	if err != nil {
-		log.Println("Error Starting Container: ", err)
+		slog.ErrorContext(ctx, "Error Starting Container", "err", err)
 		return err
 	}
 
+	containers.Default.Add(embedcreateResponse.ID, "embedding", embedmodel)
+	containers.Default.Follow(e.DockerClient, embedcreateResponse.ID)
+
 	//slog.Info("%s", gencreateResponse.ID)
-	log.Println("Starting Container: ", embedcreateResponse.ID)
+	slog.InfoContext(ctx, "Starting Container", "container", embedcreateResponse.ID)
 
 	e.containers = append(e.containers, embedcreateResponse)
 	//e.containers = append(e.containers, gencreateResponse)
@@ -167,35 +174,32 @@ func (e *EmbeddingPipeline) Setup(ctx context.Context) error {
 	return nil
 }
 
-func (e *EmbeddingPipeline) Generate(ctx context.Context, payload []string, openaiClient *openai.Client) (*openai.CreateEmbeddingResponse, error) {
-	// take care of upDog on our own
-	for {
-		// sleep and give server guy a break
-		time.Sleep(time.Duration(2 * time.Second))
-
-		// Single model, single port, assuming one pipeline is running at a time
-		//if api.UpDog("8081") && api.UpDog("8082") {
-		if api.UpDog("8082") {
-
-			break
-		}
-	}
-
-	param := openai.EmbeddingNewParams{
-		Input:      openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: payload},
-		Model:      embedmodel,
-		Dimensions: openai.Int(1024),
+// Generate embeds the payload with the embedding service and returns it the way the openai api does.
+func (e *EmbeddingPipeline) Generate(ctx context.Context, payload []string) (*openai.CreateEmbeddingResponse, error) {
+	vectors, err := e.Embed(ctx, payload)
+	if err != nil {
+		return nil, err
 	}
 
-	// should return a type of openai.Embedding
-	result, err := GenerateEmbedding(ctx, param, *openaiClient)
+	info, err := embedding.Default.Info(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	result := openai.CreateEmbeddingResponse{Model: info.Model}
+	for i, vector := range vectors {
+		result.Data = append(result.Data, openai.Embedding{Embedding: vector, Index: int64(i)})
+	}
+
 	return &result, nil
 }
 
+// Embed returns a vector for every text, it lets the pipeline be used as a rag.Embedder.
+// Batching and caching are handled by the embedding service.
+func (e *EmbeddingPipeline) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	return embedding.Default.Embed(ctx, texts)
+}
+
 func (e *EmbeddingPipeline) Shutdown(w http.ResponseWriter, req *http.Request) {
 
 	childctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(30*time.Second))
@@ -211,5 +215,5 @@ func (e *EmbeddingPipeline) Shutdown(w http.ResponseWriter, req *http.Request) {
 		(e.DockerClient).ContainerRemove(childctx, model.ID, container.RemoveOptions{})
 	}
 
-	log.Println("Shutting Down...")
+	slog.InfoContext(req.Context(), "Shutting Down")
 }
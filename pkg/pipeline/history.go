@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/logging"
+	"github.com/StoneG24/slape/pkg/metrics"
+	"github.com/StoneG24/slape/pkg/runs"
+	"github.com/StoneG24/slape/pkg/tracing"
+	"github.com/StoneG24/slape/pkg/vars"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startRun starts recording a run of pipeline, the completions made with the returned context are added to it
+// and the logs made with it are marked with the pipeline. mode is a metrics label, so it has to be
+// a mode processPrompt resolved and not the one sent in the request.
+func (c *ContextBox) startRun(ctx context.Context, pipeline string, mode string, request any) (context.Context, *runs.Run) {
+	run := runs.New(pipeline, request)
+	run.Mode = mode
+	run.Session = c.sessionID()
+	metrics.JobStarted(pipeline)
+	ctx = logging.WithPipeline(ctx, pipeline)
+	ctx, _ = tracing.Start(ctx, "pipeline "+pipeline,
+		attribute.String("slape.pipeline", pipeline),
+		attribute.String("slape.mode", mode),
+		attribute.String("slape.session", run.Session),
+		attribute.String("slape.run_id", c.runID(run)),
+	)
+	return runs.WithRun(ctx, run), run
+}
+
+// finishRun saves a run with its answer or error, nothing is kept without a store.
+// It ends the span of the run started with startRun.
+func (c *ContextBox) finishRun(ctx context.Context, run *runs.Run, answer string, err error) {
+	run.Containers = containerLogs(run)
+	run.Finish(answer, err)
+	metrics.JobFinished(run.Pipeline, run.Mode, time.Since(run.Started), err)
+	tracing.End(trace.SpanFromContext(ctx), err)
+	if c.Runs == nil {
+		return
+	}
+	err = c.Runs.Save(run)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Saving Run", "err", err)
+	}
+}
+
+// containerLogs is the output the containers of the pipeline of run made while it went on.
+func containerLogs(run *runs.Run) []runs.ContainerLog {
+	var logs []runs.ContainerLog
+	for _, c := range containers.Default.ForPipeline(run.Pipeline) {
+		lines := c.Lines(run.Started, vars.RunContainerLines)
+		failure := c.Failure()
+		if len(lines) == 0 && failure == nil {
+			continue
+		}
+
+		log := runs.ContainerLog{ID: c.ID, Model: c.Model, Lines: make([]string, len(lines))}
+		for i, line := range lines {
+			log.Lines[i] = line.Text
+		}
+		if failure != nil {
+			log.Error = failure.Error()
+		}
+		logs = append(logs, log)
+	}
+	return logs
+}
+
+// runID is the id a run is saved under, empty when runs aren't kept.
+func (c *ContextBox) runID(run *runs.Run) string {
+	if c.Runs == nil {
+		return ""
+	}
+	return run.ID
+}
+
+// startStage times a stage of the run in ctx and traces it as a span under the run.
+// The returned func records the stage and ends its span once it's done.
+func startStage(ctx context.Context, name string) (context.Context, func()) {
+	started := time.Now()
+	ctx, span := tracing.Start(ctx, name)
+	return ctx, func() {
+		metrics.Stage(pipelineName(ctx), name, started)
+		span.End()
+	}
+}
+
+// pipelineName is the pipeline of the run in ctx, or none outside of a run.
+func pipelineName(ctx context.Context) string {
+	if run := runs.FromContext(ctx); run != nil {
+		return run.Pipeline
+	}
+	return "none"
+}
@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/runs"
+	"github.com/openai/openai-go"
+)
+
+func TestRunHistory(t *testing.T) {
+	history, err := runs.Open(filepath.Join(t.TempDir(), "runs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	client, _ := fakeModel(t, "Turn off password logins.")
+
+	c := ContextBox{Runs: history}
+	ctx, run := c.startRun(context.Background(), "simple", "simple", map[string]string{"prompt": "How do I harden sshd?"})
+	param := openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{openai.UserMessage("How do I harden sshd?")},
+		Model:    "m",
+	}
+	answer, err := GenerateCompletion(ctx, param, "", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := containers.Default.Add("run-history", "simple", "qwen.gguf")
+	model.Add(containers.Line{Time: time.Now(), Stream: "stderr", Text: "srv  update_slots: all slots are idle"})
+	c.finishRun(ctx, run, answer, nil)
+
+	got, err := history.Get(c.runID(run))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Steps) != 1 || got.Steps[0].Output != answer || got.Answer != answer || got.Pipeline != "simple" {
+		t.Errorf("unexpected run %+v", got)
+	}
+	if !strings.Contains(string(got.Steps[0].Messages), "harden sshd") {
+		t.Errorf("expected the step to keep its messages, got %s", got.Steps[0].Messages)
+	}
+	if len(got.Containers) != 1 || got.Containers[0].Model != "qwen.gguf" || len(got.Containers[0].Lines) != 1 {
+		t.Errorf("expected the output of the container during the run, got %+v", got.Containers)
+	}
+
+	// without a store nothing is kept
+	if (&ContextBox{}).runID(run) != "" {
+		t.Errorf("expected no run id without a store")
+	}
+}
@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/StoneG24/slape/pkg/prompt"
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/openai/openai-go"
+)
+
+// listMarker matches the bullets and numbers models put in front of list items.
+var listMarker = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)]|#+)\s*`)
+
+// planQueries asks the model to write focused search queries for the prompt.
+// The prompt itself is always the first query so a bad plan can't make the search worse.
+func (c *ContextBox) planQueries(ctx context.Context) []string {
+	queries := []string{c.Prompt}
+	planned := vars.SearchQueries - 1
+	if planned < 1 {
+		return queries
+	}
+
+	param := openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(fmt.Sprintf(prompt.QueryPlanningPrompt, planned)),
+			openai.UserMessage(c.Prompt),
+		},
+		Seed:        openai.Int(0),
+		Temperature: openai.Float(c.settings().Model.Temperature),
+		MaxTokens:   openai.Int(256),
+	}
+
+	result, err := GenerateCompletion(ctx, param, "", c.settings().ModelClient())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Generating Search Queries, using the prompt instead", "err", err)
+		return queries
+	}
+
+	queries = append(queries, parseQueries(result, planned)...)
+	slog.InfoContext(ctx, "Search Queries", "queries", queries)
+
+	return queries
+}
+
+// hypotheticalAnswer asks the model to write a passage that answers the prompt.
+// The passage is only embedded, it is never shown to the models or the user.
+func (c *ContextBox) hypotheticalAnswer(ctx context.Context) (string, error) {
+	param := openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(prompt.HypotheticalAnswerPrompt),
+			openai.UserMessage(c.Prompt),
+		},
+		Seed:        openai.Int(0),
+		Temperature: openai.Float(c.settings().Model.Temperature),
+		MaxTokens:   openai.Int(512),
+	}
+
+	return GenerateCompletion(ctx, param, "", c.settings().ModelClient())
+}
+
+// parseQueries pulls up to n queries out of a models response.
+// Models like to number, bullet and quote things even when told not to.
+func parseQueries(text string, n int) []string {
+	var queries []string
+	seen := map[string]bool{}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = listMarker.ReplaceAllString(line, "")
+		line = strings.Trim(strings.TrimSpace(line), "\"'`")
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+
+		key := strings.ToLower(line)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		queries = append(queries, line)
+		if len(queries) == n {
+			break
+		}
+	}
+
+	return queries
+}
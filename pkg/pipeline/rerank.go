@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/rerank"
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// RerankPipeline runs the reranker used to sort search results and documents.
+// It stays on the cpu like the embedding pipeline.
+type RerankPipeline struct {
+	DockerClient   *client.Client
+	ContainerImage string
+	GPU            bool
+	// Config holds the runtime settings, the defaults are used if it's nil.
+	Config *config.Config
+
+	// for internal use
+	container container.CreateResponse
+}
+
+// RerankPipelineSetupRequest, handlerfunc expects GET method and returns no content
+func (r *RerankPipeline) RerankPipelineSetupRequest(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(30*time.Second))
+	defer cancel()
+
+	err := r.Setup(ctx)
+	if err != nil {
+		http.Error(w, "Error starting the reranker", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *RerankPipeline) Setup(ctx context.Context) error {
+	createResponse, err := CreateCPPContainer(
+		r.DockerClient,
+		vars.RerankPort,
+		"",
+		ctx,
+		vars.RerankModel,
+		r.ContainerImage,
+		r.GPU,
+		orDefault(r.Config),
+		"--reranking",
+	)
+	if err != nil {
+		slog.WarnContext(ctx, "Create Container Warning", "warnings", createResponse.Warnings)
+		slog.ErrorContext(ctx, "Error Creating Container", "err", err)
+		return err
+	}
+
+	err = (r.DockerClient).ContainerStart(ctx, createResponse.ID, container.StartOptions{})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Starting Container", "err", err)
+		return err
+	}
+
+	containers.Default.Add(createResponse.ID, "rerank", vars.RerankModel)
+	containers.Default.Follow(r.DockerClient, createResponse.ID)
+
+	slog.InfoContext(ctx, "Starting Container", "container", createResponse.ID)
+	r.container = createResponse
+
+	return nil
+}
+
+func (r *RerankPipeline) Shutdown(w http.ResponseWriter, req *http.Request) {
+	if r.container.ID == "" {
+		return
+	}
+
+	childctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(30*time.Second))
+	defer cancel()
+
+	(r.DockerClient).ContainerStop(childctx, r.container.ID, container.StopOptions{})
+	(r.DockerClient).ContainerRemove(childctx, r.container.ID, container.RemoveOptions{})
+	r.container = container.CreateResponse{}
+
+	slog.InfoContext(req.Context(), "Shutting Down")
+}
+
+// rerankSources sorts sources by how well the reranker thinks they answer the prompt and keeps k.
+// If the reranker can't be reached the sources keep their order.
+func (c *ContextBox) rerankSources(ctx context.Context, sources []Source, k int) []Source {
+	if len(sources) == 0 {
+		return sources
+	}
+
+	snippets := make([]string, len(sources))
+	for i, source := range sources {
+		snippets[i] = source.Snippet
+	}
+
+	results, err := rerank.Default.Rerank(ctx, c.Prompt, snippets)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Reranking, keeping the original order", "err", err)
+		return sources[:min(k, len(sources))]
+	}
+
+	reranked := make([]Source, 0, len(results))
+	for _, result := range results {
+		source := sources[result.Index]
+		score := result.Score
+		source.RerankScore = &score
+		reranked = append(reranked, source)
+	}
+
+	return reranked[:min(k, len(reranked))]
+}
@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/internetsearch"
+	"github.com/StoneG24/slape/pkg/vectorstore"
+)
+
+const (
+	// searchCollection is where scraped chunks are kept between requests.
+	searchCollection = "internetsearch"
+	// past results have to be at least this close to the prompt to be used again
+	searchMemoryThreshold = 0.60
+)
+
+// rememberSearch saves the chunks of a search to the vector store so later requests can reuse them.
+// Chunks are keyed by their source and text so scraping the same page again doesn't add duplicates.
+func (c *ContextBox) rememberSearch(vecs internetsearch.VectorList) {
+	if c.VectorStore == nil || len(vecs.Points) == 0 {
+		return
+	}
+
+	collection, err := c.VectorStore.GetOrCreateCollection(searchCollection, vectorstore.DefaultConfig())
+	if err != nil {
+		slog.Error("Error opening the search collection", "err", err)
+		return
+	}
+
+	fetched := time.Now().UTC().Format(time.RFC3339)
+	records := make([]vectorstore.Record, 0, len(vecs.Points))
+	for _, point := range vecs.Points {
+		chunk := vecs.Chunks[point.ID]
+		records = append(records, vectorstore.Record{
+			ID:     chunkID(chunk.Source, chunk.Text),
+			Vector: point.Vector,
+			Payload: map[string]string{
+				vectorstore.TextField: chunk.Text,
+				"source":              chunk.Source,
+				"title":               chunk.Title,
+				"fetched_at":          fetched,
+			},
+		})
+	}
+
+	err = collection.Add(records...)
+	if err != nil {
+		slog.Error("Error saving search results", "err", err)
+	}
+}
+
+// recallSearch finds chunks from past searches that are close to any of the embeddings
+// or that share exact terms with the prompt.
+func (c *ContextBox) recallSearch(embeddings [][]float64, k int) []Source {
+	if c.VectorStore == nil {
+		return nil
+	}
+
+	collection, err := c.VectorStore.Collection(searchCollection)
+	if err != nil {
+		return nil
+	}
+
+	best := map[string]Source{}
+	for _, embedding := range embeddings {
+		for _, result := range collection.HybridSearch(c.Prompt, embedding, k, 0) {
+			if result.Score < searchMemoryThreshold && result.Lexical == 0 {
+				continue
+			}
+			if found, ok := best[result.ID]; ok && found.Score >= result.Score {
+				continue
+			}
+			best[result.ID] = Source{
+				Kind:    SearchSource,
+				URL:     result.Payload["source"],
+				Title:   result.Payload["title"],
+				Snippet: result.Payload[vectorstore.TextField],
+				Score:   result.Score,
+			}
+		}
+	}
+
+	sources := make([]Source, 0, len(best))
+	for _, source := range best {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Score > sources[j].Score
+	})
+	if len(sources) > k {
+		sources = sources[:k]
+	}
+	return sources
+}
+
+// mergeSources combines two lists of sources keeping the best k, the same chunk is only kept once.
+func mergeSources(a []Source, b []Source, k int) []Source {
+	seen := map[string]bool{}
+	var merged []Source
+	for _, source := range append(append([]Source{}, a...), b...) {
+		id := chunkID(source.URL, source.Snippet)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		merged = append(merged, source)
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Score > merged[j].Score
+	})
+	if len(merged) > k {
+		merged = merged[:k]
+	}
+	return merged
+}
+
+func chunkID(source string, text string) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + text))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/StoneG24/slape/pkg/prompt"
+	"github.com/StoneG24/slape/pkg/session"
+	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/openai/openai-go"
+)
+
+// errSessionsOff is returned when a request names a session but sessions aren't set up.
+var errSessionsOff = errors.New("sessions are not set up")
+
+// useSession loads the session a request continues, an empty id is a request without one.
+func (c *ContextBox) useSession(id string) error {
+	c.Session = nil
+	if id == "" {
+		return nil
+	}
+	if c.Sessions == nil {
+		return errSessionsOff
+	}
+
+	s, err := c.Sessions.Get(id)
+	if err != nil {
+		return err
+	}
+	c.Session = &s
+	return nil
+}
+
+// sessionError is the message and status sent back when useSession fails.
+func sessionError(err error) (string, int) {
+	switch {
+	case errors.Is(err, session.ErrNotFound):
+		return "Error session not found", http.StatusNotFound
+	case errors.Is(err, errSessionsOff):
+		return "Error sessions are not set up", http.StatusServiceUnavailable
+	}
+	return "Error loading session", http.StatusInternalServerError
+}
+
+// chat returns the messages for an answer, the conversation so far goes between the system prompt and the question.
+func (c *ContextBox) chat(system string) []openai.ChatCompletionMessageParamUnion {
+	messages := []openai.ChatCompletionMessageParamUnion{
+		openai.SystemMessage(system),
+	}
+	if c.Session != nil {
+		if c.Session.Summary != "" {
+			messages = append(messages, openai.SystemMessage("Summary of the conversation so far:\n"+c.Session.Summary))
+		}
+		for _, message := range c.Session.Messages {
+			switch message.Role {
+			case session.User:
+				messages = append(messages, openai.UserMessage(message.Content))
+			case session.Assistant:
+				messages = append(messages, openai.AssistantMessage(message.Content))
+			}
+		}
+	}
+	return append(messages, openai.UserMessage(c.Prompt))
+}
+
+// sessionTokens counts the conversation so far.
+func (c *ContextBox) sessionTokens() int {
+	if c.Session == nil {
+		return 0
+	}
+	tokens := c.count(c.Session.Summary)
+	for _, message := range c.Session.Messages {
+		tokens += c.count(message.Content)
+	}
+	return tokens
+}
+
+// compactSession folds the oldest messages of the session into its summary once
+// the conversation takes more than its share of the context.
+// The newest messages that fit in half of that share are kept as they are.
+func (c *ContextBox) compactSession(ctx context.Context, openaiClient openai.Client, model string) error {
+	if c.Session == nil {
+		return nil
+	}
+	budget := c.settings().Model.ContextLength * vars.SessionBudget / 100
+	if c.sessionTokens() <= budget {
+		return nil
+	}
+
+	messages := c.Session.Messages
+	keep := 0
+	used := 0
+	for keep < len(messages) {
+		tokens := c.count(messages[len(messages)-1-keep].Content)
+		if used+tokens > budget/2 {
+			break
+		}
+		used += tokens
+		keep++
+	}
+	fold := len(messages) - keep
+	if fold == 0 {
+		return nil
+	}
+
+	var conversation strings.Builder
+	if c.Session.Summary != "" {
+		fmt.Fprintf(&conversation, "Earlier summary: %s\n\n", c.Session.Summary)
+	}
+	for _, message := range messages[:fold] {
+		fmt.Fprintf(&conversation, "%s: %s\n\n", message.Role, message.Content)
+	}
+
+	slog.InfoContext(ctx, "Summarizing Session")
+	param := openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(prompt.AssistantPrompt),
+			openai.UserMessage(c.truncate(fmt.Sprintf(prompt.ConversationSummaryPrompt, conversation.String()), c.settings().Model.ContextLength/2)),
+		},
+		Seed:        openai.Int(0),
+		Model:       model,
+		Temperature: openai.Float(c.settings().Model.Temperature),
+		MaxTokens:   openai.Int(int64(budget / 2)),
+	}
+	summary, err := GenerateCompletion(ctx, param, "", openaiClient)
+	if err != nil {
+		return err
+	}
+
+	err = c.Sessions.Summarize(c.Session.ID, summary, fold)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Summarized Session", "session", c.Session.ID, "messages", fold)
+	return c.useSession(c.Session.ID)
+}
+
+// saveTurn adds the question and the answer to the session, if the request has one.
+func (c *ContextBox) saveTurn(answer string) error {
+	if c.Session == nil {
+		return nil
+	}
+	return c.Sessions.Append(c.Session.ID,
+		session.Message{Role: session.User, Content: c.Prompt},
+		session.Message{Role: session.Assistant, Content: answer},
+	)
+}
+
+// sessionID is the session of the request, empty without one.
+func (c *ContextBox) sessionID() string {
+	if c.Session == nil {
+		return ""
+	}
+	return c.Session.ID
+}
@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/session"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// fakeModel streams the same answer back to every chat completion and keeps the last request.
+func fakeModel(t *testing.T, answer string) (openai.Client, *string) {
+	t.Helper()
+	var last string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		last = string(body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":0,\"model\":\"m\",\"choices\":[{\"index\":0,\"delta\":{\"role\":\"assistant\",\"content\":%q}}]}\n\n", answer)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return openai.NewClient(option.WithBaseURL(server.URL)), &last
+}
+
+func TestSessionTurns(t *testing.T) {
+	sessions, err := session.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := sessions.Create("")
+
+	c := ContextBox{Sessions: sessions, Prompt: "How do I harden sshd?"}
+	if err := c.useSession(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.saveTurn("Turn off password logins."); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Prompt = "And root logins?"
+	if err := c.useSession(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	// system prompt, the first question and answer, then the follow up
+	if messages := c.chat("system"); len(messages) != 4 {
+		t.Errorf("expected the earlier turn in the messages, got %d messages", len(messages))
+	}
+
+	err = c.useSession("missing")
+	if _, code := sessionError(err); code != http.StatusNotFound {
+		t.Errorf("expected an unknown session to be not found, got %d for %v", code, err)
+	}
+	err = (&ContextBox{}).useSession(s.ID)
+	if _, code := sessionError(err); err != errSessionsOff || code != http.StatusServiceUnavailable {
+		t.Errorf("expected sessions to be off, got %d for %v", code, err)
+	}
+}
+
+func TestCompactSession(t *testing.T) {
+	sessions, err := session.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := sessions.Create("")
+	for i := range 10 {
+		sessions.Append(s.ID,
+			session.Message{Role: session.User, Content: fmt.Sprintf("question %d", i)},
+			session.Message{Role: session.Assistant, Content: fmt.Sprintf("answer %d. ", i) + strings.Repeat("More detail here. ", 40)},
+		)
+	}
+
+	cfg := config.Default()
+	cfg.Model.ContextLength = 2048
+	c := ContextBox{Sessions: sessions, Config: cfg}
+	c.useSession(s.ID)
+
+	client, last := fakeModel(t, "they asked ten questions")
+	err = c.compactSession(context.Background(), client, "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Session.Summary != "they asked ten questions" || c.Session.Summarized == 0 {
+		t.Fatalf("expected the start of the session to be summarized, got %+v", c.Session)
+	}
+	if !strings.Contains(*last, "question 0") {
+		t.Errorf("expected the oldest messages to be sent to the model")
+	}
+	if newest := c.Session.Messages[len(c.Session.Messages)-1].Content; !strings.HasPrefix(newest, "answer 9.") {
+		t.Errorf("expected the newest messages to be kept, got %q", newest)
+	}
+	if tokens := c.sessionTokens(); tokens > 2048*30/100 {
+		t.Errorf("expected the session to fit its budget, it has %d tokens", tokens)
+	}
+
+	// the saved session has the summary as well
+	saved, _ := sessions.Get(s.ID)
+	if saved.Summary != c.Session.Summary || len(saved.Messages) != len(c.Session.Messages) {
+		t.Errorf("expected the summary to be saved")
+	}
+}
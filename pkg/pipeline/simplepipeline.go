@@ -3,13 +3,13 @@ package pipeline
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
 
-	"github.com/StoneG24/slape/pkg/api"
-	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/metrics"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/openai/openai-go"
@@ -51,6 +51,25 @@ type (
 
 		// Should Internet Search be included in the process
 		InternetSearch string `json:"search"`
+
+		// Should a hypothetical answer be used to find search results, optional
+		HyDE string `json:"hyde"`
+
+		// Should passages from indexed documents be included, optional
+		RAG string `json:"rag"`
+
+		// Collection to retrieve documents from and how many passages to use, optional
+		Collection string `json:"collection"`
+		TopK       int    `json:"topk"`
+
+		// RagMode is naive or mini, optional
+		RagMode string `json:"rag_mode"`
+
+		// Should the reranker sort search results and documents, optional
+		Rerank string `json:"rerank"`
+
+		// Session continues a conversation started with POST /sessions, optional
+		Session string `json:"session"`
 	}
 
 	simpleSetupPayload struct {
@@ -63,6 +82,14 @@ type (
 		// Answer is a json string containing the answer is markdown format
 		// along with the models thought process
 		Answer string `json:"answer"`
+
+		// Sources are the search results the answer can cite by number
+		Sources []Source `json:"sources"`
+
+		// Session is the conversation the answer was added to.
+		Session string `json:"session,omitempty"`
+		// Run is the id of the run in GET /runs/{id}.
+		Run string `json:"run,omitempty"`
 	}
 )
 
@@ -75,11 +102,18 @@ func (s *SimplePipeline) SimplePipelineSetupRequest(w http.ResponseWriter, req *
 
 	err := json.NewDecoder(req.Body).Decode(&setupPayload)
 	if err != nil {
-		log.Println("Error Request Format: ", err)
+		slog.ErrorContext(ctx, "Error Request Format", "err", err)
 		http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
 		return
 	}
 
+	err = checkModels(setupPayload.Models)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Checking Models", "err", err)
+		http.Error(w, "Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	s.Models = setupPayload.Models
 
 	s.Setup(ctx)
@@ -92,66 +126,121 @@ func (s *SimplePipeline) SimplePipelineGenerateRequest(w http.ResponseWriter, re
 	var simplePayload simpleRequest
 
 	// use this to scope the context to the request
-	ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(vars.GenerationTimeout*time.Minute))
+	ctx, cancel := context.WithDeadline(req.Context(), time.Now().Add(time.Duration(s.settings().GenerationTimeout)*time.Minute))
 	defer cancel()
 
 	err := json.NewDecoder(req.Body).Decode(&simplePayload)
 	if err != nil {
-		log.Println("Error Request Format", err)
+		slog.ErrorContext(ctx, "Error Request Format", "err", err)
 		http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
 		return
 	}
 
-	promptChoice, maxtokens := processPrompt(simplePayload.Mode)
+	promptChoice, maxtokens := processPrompt(simplePayload.Mode, s.settings())
 
-	s.ContextBox.SystemPrompt = promptChoice
+	s.ContextBox.Template = promptChoice
+	s.ContextBox.MaxTokens = maxtokens
+	s.ContextBox.Tokenizer = llamaTokenizer(s.settings().ModelURL(0))
 	s.ContextBox.Prompt = simplePayload.Prompt
 	s.Thinking, err = strconv.ParseBool(simplePayload.Thinking)
 	if err != nil {
-		log.Println("Error Parsing thinking value:", err)
+		slog.ErrorContext(ctx, "Error Parsing thinking value", "err", err)
 		http.Error(w, "Error parsing thinking value. Expecting sound boolean definitions.", http.StatusBadRequest)
 	}
 	s.InternetSearch, err = strconv.ParseBool(simplePayload.InternetSearch)
 	if err != nil {
-		log.Println("Error Parsing InternetSearch value:", err)
+		slog.ErrorContext(ctx, "Error Parsing InternetSearch value", "err", err)
 		http.Error(w, "Error parsing InternetSearch value. Expecting sound boolean definitions.", http.StatusBadRequest)
 	}
 
-	if s.InternetSearch {
-		s.getInternetSearch(ctx)
-	} else {
-		s.InternetSearchResults = []string{}
+	hyde, err := parseOptionalBool(simplePayload.HyDE)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Parsing HyDE value", "err", err)
+		http.Error(w, "Error parsing HyDE value. Expecting sound boolean definitions.", http.StatusBadRequest)
+		return
+	}
+
+	rerank, err := parseOptionalBool(simplePayload.Rerank)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Parsing Rerank value", "err", err)
+		http.Error(w, "Error parsing Rerank value. Expecting sound boolean definitions.", http.StatusBadRequest)
+		return
+	}
+
+	ragOpts, err := parseRAGOptions(simplePayload.RAG, simplePayload.Collection, simplePayload.RagMode, simplePayload.TopK, rerank)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Parsing RAG values", "err", err)
+		http.Error(w, "Error parsing RAG values. Expecting a boolean, a valid mode and a positive topk.", http.StatusBadRequest)
+		return
 	}
 
-	if s.Thinking {
-		s.getThoughts(ctx)
-	} else {
+	err = s.useSession(simplePayload.Session)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Loading Session", "err", err)
+		message, code := sessionError(err)
+		http.Error(w, message, code)
+		return
+	}
+	ctx, run := s.startRun(ctx, "simple", promptChoice.Mode, simplePayload)
+
+	s.InternetSearchResults = []string{}
+	s.Documents = []string{}
+	s.Sources = []Source{}
+
+	if ragOpts.enabled {
+		s.getDocuments(ctx, ragOpts)
+	}
+
+	// search and thinking use the model, so they fail if it doesn't come up
+	if s.InternetSearch {
+		err = s.getInternetSearch(ctx, s.DockerClient, s.container.ID, hyde, rerank)
+	}
+	if s.Thinking && err == nil {
+		err = s.getThoughts(ctx, s.DockerClient, s.container.ID)
+	} else if !s.Thinking {
 		s.Thoughts = "None"
 	}
+	if err != nil {
+		s.finishRun(ctx, run, "", err)
+		slog.ErrorContext(ctx, "Error Waiting for the Model", "err", err)
+		http.Error(w, generationError(err), http.StatusInternalServerError)
+		return
+	}
 
-	result, err := s.Generate(ctx, maxtokens, &vars.OpenaiClient)
+	result, err := s.Generate(ctx, maxtokens, s.settings().ModelClient())
+	s.finishRun(ctx, run, result, err)
 	if err != nil {
-		log.Println("Error getting generation from model", err)
-		http.Error(w, "Error getting generation from model", http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error getting generation from model", "err", err)
+		http.Error(w, generationError(err), http.StatusInternalServerError)
 
 		return
 	}
 
 	// for debugging streaming
-	log.Println(result)
+	slog.DebugContext(ctx, "Answer", "answer", result)
+
+	err = s.saveTurn(result)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Saving Session", "err", err)
+	}
 
 	respPayload := simpleResponse{
-		Answer: result,
+		Answer:  result,
+		Sources: s.Sources,
+		Session: s.sessionID(),
+		Run:     s.runID(run),
 	}
 
 	json, err := json.Marshal(respPayload)
 	if err != nil {
-		log.Println("Error marshaling response from model", err)
+		slog.ErrorContext(ctx, "Error marshaling response from model", "err", err)
 		http.Error(w, "Error marshaling your response from model", http.StatusInternalServerError)
 		return
 	}
 
 	s.InternetSearchResults = []string{}
+	s.Documents = []string{}
+	s.Sources = []Source{}
 	s.Thoughts = ""
 
 	w.Header().Set("Content-Type", "application/json")
@@ -165,11 +254,11 @@ func (s *SimplePipeline) Setup(ctx context.Context) error {
 	defer cancel()
 
 	/*
-		log.Println("PullingImage: ", s.ContainerImage)
+		slog.InfoContext(ctx, "Pulling Image", "image", s.ContainerImage)
 
 		reader, err := PullImage(s.DockerClient, childctx, s.ContainerImage)
 		if err != nil {
-			log.Println("Error Pulling Container Image: ", err)
+			slog.ErrorContext(ctx, "Error Pulling Container Image", "err", err)
 			return err
 		}
 		// prints out the status of the download
@@ -180,67 +269,69 @@ func (s *SimplePipeline) Setup(ctx context.Context) error {
 
 	createResponse, err := CreateCPPContainer(
 		s.DockerClient,
-		"8000",
+		s.settings().ModelPort(0),
 		"",
 		childctx,
 		s.Models[0],
 		s.ContainerImage,
 		s.GPU,
+		s.settings(),
 	)
 
 	if err != nil {
-		log.Println("Create Container Warning: ", createResponse.Warnings)
-		log.Println("Error Creating Container: ", err)
+		slog.WarnContext(ctx, "Create Container Warning", "warnings", createResponse.Warnings)
+		slog.ErrorContext(ctx, "Error Creating Container", "err", err)
 		return err
 	}
 
 	// start container
+	started := time.Now()
 	err = (s.DockerClient).ContainerStart(childctx, createResponse.ID, container.StartOptions{})
 	if err != nil {
-		log.Println("Error Starting Container: ", err)
+		slog.ErrorContext(ctx, "Error Starting Container", "err", err)
 		return err
 	}
+	metrics.Stage("simple", metrics.StageContainerStart, started)
+	containers.Default.Add(createResponse.ID, "simple", s.Models[0])
+	containers.Default.Follow(s.DockerClient, createResponse.ID)
 
-	log.Println("Starting Container: ", createResponse.ID)
+	slog.InfoContext(ctx, "Starting Container", "container", createResponse.ID)
 	s.container = createResponse
 
 	return nil
 }
 
-func (s *SimplePipeline) Generate(ctx context.Context, maxtokens int64, openaiClient *openai.Client) (string, error) {
+func (s *SimplePipeline) Generate(ctx context.Context, maxtokens int64, openaiClient openai.Client) (string, error) {
 	// take care of upDog on our own
-	for {
-		// sleep and give server guy a break
-		time.Sleep(time.Duration(1 * time.Second))
-
-		// Single model, single port, assuming one pipeline is running at a time
-		if api.UpDog("8000") {
-			break
-		}
+	// Single model, single port, assuming one pipeline is running at a time
+	err := waitReady(ctx, s.DockerClient, s.container.ID, s.settings().ModelURL(0))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error Waiting On Model", "err", err)
+		return "", err
 	}
 
-	log.Println("SystemPrompt: ", s.ContextBox.SystemPrompt, "Prompt: ", s.ContextBox.Prompt)
+	slog.DebugContext(ctx, "Prompt", "prompt", s.ContextBox.Prompt)
 
-	err := s.promptBuilder()
+	// a long conversation is summarized before it's counted against the context
+	err = s.compactSession(ctx, openaiClient, s.Models[0])
 	if err != nil {
-		return "", err
+		slog.ErrorContext(ctx, "Error Summarizing Session", "err", err)
 	}
 
-	log.Println("SystemPrompt: ", s.SystemPrompt)
+	err = s.promptBuilder()
+	if err != nil {
+		return "", err
+	}
 
 	param := openai.ChatCompletionNewParams{
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.SystemMessage(s.SystemPrompt),
-			openai.UserMessage(s.Prompt),
-			//openai.UserMessage(s.FutureQuestions),
-		},
+		Messages:    s.chat(s.SystemPrompt),
 		Seed:        openai.Int(0),
 		Model:       s.Models[0],
-		Temperature: openai.Float(vars.ModelTemperature),
+		Temperature: openai.Float(s.settings().Model.Temperature),
 		MaxTokens:   openai.Int(maxtokens),
 	}
 
-	result, err := GenerateCompletion(ctx, param, "", *openaiClient)
+	result, err := GenerateCompletion(ctx, param, "", openaiClient)
 	if err != nil {
 		return "", err
 	}
@@ -256,13 +347,13 @@ func (s *SimplePipeline) Shutdown(w http.ResponseWriter, req *http.Request) {
 
 	err := (s.DockerClient).ContainerStop(childctx, s.container.ID, container.StopOptions{})
 	if err != nil {
-		log.Println("Error Stopping Conatainer: ", err)
+		slog.ErrorContext(req.Context(), "Error Stopping Conatainer", "err", err)
 	}
 
 	err = (s.DockerClient).ContainerRemove(childctx, s.container.ID, container.RemoveOptions{})
 	if err != nil {
-		log.Println("Error Removing Container: ", err)
+		slog.ErrorContext(req.Context(), "Error Removing Container", "err", err)
 	}
 
-	log.Println("Shutting Down...")
+	slog.InfoContext(req.Context(), "Shutting Down")
 }
@@ -1,55 +1,127 @@
 package pipeline
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
 
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/models"
+	"github.com/StoneG24/slape/pkg/prompt"
 	"github.com/StoneG24/slape/pkg/vars"
+	"github.com/docker/docker/api/types/container"
 	"github.com/jaypipes/ghw"
 	"github.com/jaypipes/ghw/pkg/gpu"
 )
 
-func processPrompt(mode string) (string, int64) {
-	var promptChoice string
-	var maxtokens int64
+// Prompts holds the prompt modes requests can pick from.
+// It starts with the built in prompts, main adds the prompt folder on top.
+var Prompts = prompt.NewLibrary(
+	prompt.MustParse("simple", "answers simply, used when no mode is given", prompt.LimitSimple, vars.SimplePrompt),
+	prompt.MustParse("cot", "chain of thought, for problems with clear steps", prompt.LimitCoT, vars.CotPrompt),
+	prompt.MustParse("tot", "tree of thought, three experts take turns", prompt.LimitFull, vars.TotPrompt),
+	prompt.MustParse("got", "graph of thought, experts connect their ideas", prompt.LimitFull, vars.GotPrompt),
+	prompt.MustParse("moe", "mixture of experts with a manager", prompt.LimitFull, vars.MoePrompt),
+	prompt.MustParse("thinkinghats", "six thinking hats", prompt.LimitFull, vars.ThinkingHatsPrompt),
+	// currently not a sec prompt for this
+	prompt.MustParse("goe", "experts that criticize each other, WIP", prompt.LimitFull, vars.GoePrompt),
+)
+
+// processPrompt returns the template of a mode and how many tokens it can generate.
+// Unknown modes fall back to simple.
+func processPrompt(mode string, cfg *config.Config) (*prompt.Template, int64) {
+	promptChoice, ok := Prompts.Get(mode)
+	if !ok {
+		promptChoice, _ = Prompts.Get("simple")
+	}
 
-	switch mode {
-	case "simple":
-		promptChoice = vars.SimplePrompt
-		maxtokens = int64(vars.MaxGenTokensSimple)
-	case "cot":
-		promptChoice = vars.CotPrompt
-		maxtokens = int64(vars.MaxGenTokensCoT)
-	case "tot":
-		promptChoice = vars.TotPrompt
-		maxtokens = int64(vars.MaxGenTokens)
-	case "got":
-		promptChoice = vars.GotPrompt
-		maxtokens = int64(vars.MaxGenTokens)
-	case "moe":
-		promptChoice = vars.MoePrompt
-		maxtokens = int64(vars.MaxGenTokens)
-	case "thinkinghats":
-		promptChoice = vars.ThinkingHatsPrompt
-		maxtokens = int64(vars.MaxGenTokens)
-	case "goe":
-		// currently not a sec prompt for this
-		promptChoice = vars.GoePrompt
-		maxtokens = int64(vars.MaxGenTokens)
+	var maxtokens int64
+	switch promptChoice.Limit {
+	case prompt.LimitSimple:
+		maxtokens = int64(cfg.Model.MaxGenTokensSimple)
+	case prompt.LimitCoT:
+		maxtokens = int64(cfg.MaxGenTokensCoT())
 	default:
-		promptChoice = vars.SimplePrompt
-		maxtokens = int64(vars.MaxGenTokensSimple)
+		maxtokens = int64(cfg.Model.MaxGenTokens)
 	}
 
 	return promptChoice, maxtokens
 }
 
-func PickImage() string {
+// orDefault returns cfg, or the defaults when a pipeline wasn't given a config.
+func orDefault(cfg *config.Config) *config.Config {
+	if cfg == nil {
+		return config.Default()
+	}
+	return cfg
+}
+
+// parseOptionalBool is used for request fields that can be left out.
+// An empty value is false, anything else has to be a sound boolean.
+func parseOptionalBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// generationError is the message sent back for a failed generation,
+// it says why when a model couldn't be loaded.
+func generationError(err error) string {
+	var failure *containers.Failure
+	if errors.As(err, &failure) {
+		return "Error " + failure.Error()
+	}
+	return "Error getting generation from model"
+}
+
+// firstContainer is the id of the container on port 8000, the one search and thinking use.
+func firstContainer(list []container.CreateResponse) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[0].ID
+}
+
+// checkModels returns why models can't be used to generate text, like an embedding model picked as a debater.
+func checkModels(names []string) error {
+	if len(names) == 0 {
+		return errors.New("at least one model is needed")
+	}
+	for _, name := range names {
+		err := checkModel(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkModel reads the gguf header of a model in the models folder to check it generates text.
+func checkModel(name string) error {
+	metadata, err := models.Default.Metadata(name)
+	if errors.Is(err, models.ErrInvalid) || errors.Is(err, models.ErrNotFound) {
+		return err
+	}
+	if err == nil {
+		err = metadata.Check(models.TypeGeneration)
+	}
+	if err != nil {
+		return fmt.Errorf("model %s: %w", name, err)
+	}
+	return nil
+}
+
+// PickImage returns the llama.cpp image that matches the gpu of the machine.
+func PickImage(images config.Images) string {
 	gpuTrue := IsGPU()
-	log.Println(gpuTrue)
+	slog.Info("Picking Image", "gpu", gpuTrue)
 	if gpuTrue {
 		gpus, err := GatherGPUs()
 		if err != nil {
-			return vars.CpuImage
+			return images.CPU
 		}
 		// After reading upstream, he reads the devices mounted
 		// with $ ll /sys/class/drm/
@@ -61,21 +133,20 @@ func PickImage() string {
 			}
 			switch gpu.DeviceInfo.Vendor.Name {
 			case "NVIDIA Corporation":
-				return vars.CudagpuImage
+				return images.CUDA
 			case "Advanced Micro Devices, Inc. [AMD/ATI]":
-				return vars.RocmgpuImage
+				return images.ROCm
 			}
 		}
 	}
-	return vars.CpuImage
+	return images.CPU
 }
 
 func IsGPU() bool {
 	gpuInfo, err := ghw.GPU()
 	// if there is an error continue without using a GPU
 	if err != nil {
-		log.Println("Error", "ErrorGettingGPUStruct", err)
-		log.Println("Continuing without GPU...")
+		slog.Error("Error Getting GPUs, continuing without a GPU", "err", err)
 	}
 
 	// for debugging
@@ -83,7 +154,7 @@ func IsGPU() bool {
 
 	// BUG Onboard doesn't count but this will get us by untill we can fix this later
 	if len(gpuInfo.GraphicsCards) < 2 {
-		log.Println("No GPUs, CPU only")
+		slog.Info("No GPUs, CPU only")
 		return false
 	} else {
 		return true
@@ -2,20 +2,29 @@ package pipeline
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
-
-	"github.com/StoneG24/slape/pkg/vars"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/api"
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/containers"
+	"github.com/StoneG24/slape/pkg/metrics"
+	"github.com/StoneG24/slape/pkg/runs"
+	"github.com/StoneG24/slape/pkg/tracing"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/openai/openai-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PullImage uses the docker api to pull an image down.
@@ -26,7 +35,9 @@ func PullImage(apiClient *client.Client, ctx context.Context, containerImage str
 	return reader, err
 }
 
-func CreateCPPContainer(apiClient *client.Client, portNum string, name string, ctx context.Context, modelName string, containerImage string, gpuTrue bool) (container.CreateResponse, error) {
+// CreateCPPContainer creates a llama.cpp server container for a model.
+// cfg sets the context length and gpu layers, extraArgs are appended to the server command, like --reranking for a reranker.
+func CreateCPPContainer(apiClient *client.Client, portNum string, name string, ctx context.Context, modelName string, containerImage string, gpuTrue bool, cfg *config.Config, extraArgs ...string) (container.CreateResponse, error) {
 
 	portSet := nat.PortSet{
 		nat.Port("8000/tcp"): struct{}{}, // map 11434 TCP port
@@ -46,12 +57,12 @@ func CreateCPPContainer(apiClient *client.Client, portNum string, name string, c
 	if runtime.GOOS == "windows" {
 		ex, err := os.Executable()
 		if err != nil {
-			slog.Error("idk something else")
+			slog.ErrorContext(ctx, "Error Finding The Executable", "err", err)
 		}
 
 		currentPath := filepath.Dir(ex)
 
-		slog.Debug(currentPath)
+		slog.DebugContext(ctx, "Mounting Models", "path", currentPath)
 
 		mountString = currentPath + "\\models"
 	}
@@ -63,10 +74,11 @@ func CreateCPPContainer(apiClient *client.Client, portNum string, name string, c
 	// TODO(v) add --jinja for function calling using the OpenAI API setup
 	var cmds []string
 	if gpuTrue {
-		cmds = []string{"-m", "/models/" + modelName, "--port", "8000", "--host", "0.0.0.0", "-ngl", strconv.Itoa(vars.ModelLayers), "-fa", "--no-webui", "-c", strconv.Itoa(vars.ContextLength), "-cb"}
+		cmds = []string{"-m", "/models/" + modelName, "--port", "8000", "--host", "0.0.0.0", "-ngl", strconv.Itoa(cfg.Model.Layers), "-fa", "--no-webui", "-c", strconv.Itoa(cfg.Model.ContextLength), "-cb"}
 	} else {
-		cmds = []string{"-m", "/models/" + modelName, "--port", "8000", "--host", "0.0.0.0", "-fa", "--mlock", "--no-webui", "-c", strconv.Itoa(vars.ContextLength), "-cb"}
+		cmds = []string{"-m", "/models/" + modelName, "--port", "8000", "--host", "0.0.0.0", "-fa", "--mlock", "--no-webui", "-c", strconv.Itoa(cfg.Model.ContextLength), "-cb"}
 	}
+	cmds = append(cmds, extraArgs...)
 
 	var hostconfig container.HostConfig
 
@@ -94,6 +106,8 @@ func CreateCPPContainer(apiClient *client.Client, portNum string, name string, c
 		}
 	}
 
+	slog.InfoContext(ctx, "Creating Container", "model", modelName, "port", portNum, "image", containerImage, "gpu", gpuTrue)
+
 	// create container
 	createResponse, err := apiClient.ContainerCreate(ctx, &container.Config{
 		ExposedPorts: portSet,
@@ -104,15 +118,64 @@ func CreateCPPContainer(apiClient *client.Client, portNum string, name string, c
 	return createResponse, err
 }
 
+// restartContainer starts a container the pipeline stopped, like when models are swapped between rounds.
+func restartContainer(ctx context.Context, apiClient *client.Client, id string) error {
+	ctx, done := startStage(ctx, metrics.StageContainerStart)
+	defer done()
+	metrics.ContainerRestarted(pipelineName(ctx))
+	err := apiClient.ContainerStart(ctx, id, container.StartOptions{})
+	if err != nil {
+		return err
+	}
+	containers.Default.Follow(apiClient, id)
+	return nil
+}
+
+// waitReady waits for the llama.cpp server in a container to answer at endpoint.
+// It gives up once the container has failed to load its model, or has exited.
+func waitReady(ctx context.Context, apiClient *client.Client, id string, endpoint string) error {
+	_, ready := startStage(ctx, metrics.StageReadiness)
+	defer ready()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		// sleep and give server guy a break
+		case <-time.After(time.Second):
+		}
+
+		if api.UpDog(endpoint) {
+			return nil
+		}
+		err := containers.Default.Check(ctx, apiClient, id)
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // This is very simple for right now but when we add structured outputs it will
 // get very complicated.
 //
 // prompt comes from a user and is the question being asked.
 // systemprompt is the systemprompt chosen based on the prompting style requested.
+//
+// If ctx carries a run the completion is added to it as a step.
+// The tokens and time of the completion are added to the metrics of its model.
 func GenerateCompletion(ctx context.Context, param openai.ChatCompletionNewParams, followupQuestion string, openaiClient openai.Client) (string, error) {
 
 	var result string
 
+	run := runs.FromContext(ctx)
+	started := time.Now()
+	ctx, done := startStage(ctx, metrics.StageGeneration)
+	defer done()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("slape.model", string(param.Model)))
+	// usage is sent in the last chunk for the run and the metrics
+	param.StreamOptions = openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)}
+
 	stream := openaiClient.Chat.Completions.NewStreaming(ctx, param)
 
 	// optionally, an accumulator helper can be used
@@ -125,7 +188,7 @@ func GenerateCompletion(ctx context.Context, param openai.ChatCompletionNewParam
 
 		/*
 			if content, ok := acc.JustFinishedContent(); ok {
-				println("Content stream finished:", content)
+				slog.InfoContext(ctx, "Content stream finished", "content", content)
 			}
 		*/
 
@@ -135,22 +198,33 @@ func GenerateCompletion(ctx context.Context, param openai.ChatCompletionNewParam
 		//}
 
 		if refusal, ok := acc.JustFinishedRefusal(); ok {
-			println("Refusal stream finished:", refusal)
-		}
-
-		// it's best to use chunks after handling JustFinished events
-		if len(chunk.Choices) > 0 {
-			print(chunk.Choices[0].Delta.Content)
+			slog.WarnContext(ctx, "Model Refused", "model", param.Model, "refusal", refusal)
 		}
 	}
-	println("\n")
 
 	if err := stream.Err(); err != nil {
+		slog.ErrorContext(ctx, "Error Generating Completion", "model", param.Model, "err", err)
+		metrics.Completion(string(param.Model), 0, 0, time.Since(started), err)
+		tracing.Record(span, err)
+		recordStep(run, param, acc, started, err)
 		return "", err
 	}
 
 	// After the stream is finished, acc can be used like a ChatCompletion
 	result = acc.Choices[0].Message.Content
+	recordStep(run, param, acc, started, nil)
+	metrics.Completion(string(param.Model), acc.Usage.PromptTokens, acc.Usage.CompletionTokens, time.Since(started), nil)
+	span.SetAttributes(
+		attribute.Int64("slape.prompt_tokens", acc.Usage.PromptTokens),
+		attribute.Int64("slape.completion_tokens", acc.Usage.CompletionTokens),
+	)
+	slog.InfoContext(ctx, "Completion",
+		"model", param.Model,
+		"duration_ms", time.Since(started).Milliseconds(),
+		"prompt_tokens", acc.Usage.PromptTokens,
+		"completion_tokens", acc.Usage.CompletionTokens,
+	)
+	slog.DebugContext(ctx, "Completion Output", "output", result)
 
 	// Adding this for later
 	//param.Messages.Value = append(param.Messages.Value, acc.Choices[0].Message)
@@ -159,6 +233,30 @@ func GenerateCompletion(ctx context.Context, param openai.ChatCompletionNewParam
 	return result, nil
 }
 
+// recordStep adds a completion to the run, if there is one.
+func recordStep(run *runs.Run, param openai.ChatCompletionNewParams, acc openai.ChatCompletionAccumulator, started time.Time, err error) {
+	if run == nil {
+		return
+	}
+
+	messages, _ := json.Marshal(param.Messages)
+	step := runs.Step{
+		Model:            string(param.Model),
+		Messages:         messages,
+		Started:          started,
+		Duration:         time.Since(started).Milliseconds(),
+		PromptTokens:     acc.Usage.PromptTokens,
+		CompletionTokens: acc.Usage.CompletionTokens,
+	}
+	if len(acc.Choices) != 0 {
+		step.Output = acc.Choices[0].Message.Content
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	run.Record(step)
+}
+
 // GenerateEmbedding is used as a helper function for generating embeddings.
 func GenerateEmbedding(ctx context.Context, param openai.EmbeddingNewParams, client openai.Client) (openai.CreateEmbeddingResponse, error) {
 
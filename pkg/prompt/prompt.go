@@ -16,6 +16,59 @@ var (
 	// SummarizingPrompt is used to summarizing responses in slape.
 	SummarizingPrompt = "Given this answer %s, can you summarize it"
 
+	// ConversationSummaryPrompt is used to fold the start of a long conversation into a summary.
+	// It expects the earlier summary and messages.
+	ConversationSummaryPrompt = `
+    Summarize this conversation between a user and an assistant so it can be continued later.
+    Keep the questions that were asked, the answers and facts that were given and anything the user asked to remember.
+    Only return the summary.
+
+    %s
+    `
+
+	// QueryPlanningPrompt is used to turn a question into several focused internet search queries.
+	// It expects the number of queries to write.
+	QueryPlanningPrompt = `
+    Act as a internet search guru who knows how to search up anything on duckduckgo.com.
+    Write %d short search queries that together would find the information needed to answer the question.
+    Each query should focus on a different part of the question, keep exact names, versions and identifiers.
+    Only return the queries, one per line, without numbering or explanations.
+    `
+
+	// HypotheticalAnswerPrompt is used to write a hypothetical answer whose embedding is used
+	// alongside the question to find relevant search results, also known as HyDE.
+	HypotheticalAnswerPrompt = `
+    Write a short passage, like one found in documentation or a technical article, that answers the question.
+    Do not mention that the passage is hypothetical and do not add anything before or after it.
+    `
+
+	// EntityExtractionPrompt is used to pull the entities out of a chunk of text when indexing documents for RAG.
+	// It expects the most entities to return.
+	EntityExtractionPrompt = `
+    Act as a librarian building an index of the text you are given.
+    List at most %d of the most important entities in the text, such as people, organizations, places, events, products, technologies and concepts.
+    Write one entity per line as: name | type
+    Use the name exactly as it appears in the text and a single lowercase word for the type.
+    Only return the entities, without numbering or explanations.
+    `
+
+	// ContextTemplate is added to prompts that don't place the context themselves.
+	// Prompt templates can also include it with {{template "context" .}}.
+	ContextTemplate = `
+    Please base your response on the provided information:
+    **Thoughts:** {{.Thoughts}}
+    **Additional Context:** {{.Context}}
+    **Previous Answers:** {{.PreviousAnswers}}
+    **Questions to think about:** {{.Questions}}
+    `
+
+	// AssistantPrompt is the system prompt for the small jobs between answers, like summarizing.
+	AssistantPrompt = `
+    Acting as an intelligent agent, answer problems simply.
+    While ensuring accuracy and correctness, preferring not to answer if unsure.
+    Format responses in markdown.
+    `
+
 	QuestioningPrompt = `
     Given this answer, %s, can you generate five questions to ask someone else, that pertain to the question?
     Your goal is to be concise while still maintaining the orginal message.
@@ -36,9 +89,10 @@ var (
     Format responses in markdown.
 
     Please base your response on the provided information:
-    Thoughts and Ideas: %s
-    Additional Context: %s
-    Previous Answers: %s 
+    Thoughts and Ideas: {{.Thoughts}}
+    Additional Context: {{.Context}}
+    Previous Answers: {{.PreviousAnswers}}
+    Questions to think about: {{.Questions}}
     `
 
 	// CoTPrompt is for linear progression tasks where clear steps can be seen.
@@ -47,7 +101,6 @@ var (
     Act as an intelligent agent capable of handling various tasks. 
     You excel at solving problems by breaking them down into manageable steps.
     For any given task, you approach it systematically, ensuring clarity and precision.
-    %s
 
     **Example:**
     - **Task:** Solve the following puzzle: "Find the correct combination to unlock the box."
@@ -61,9 +114,10 @@ var (
     Return your answer in markdown format, such as: **Final Answer:** [Result]
 
     Please use the following information before answering the question.
-    Thoughts: %s
-    Additional Context: %s
-    Previous Answers: %s 
+    Thoughts: {{.Thoughts}}
+    Additional Context: {{.Context}}
+    Previous Answers: {{.PreviousAnswers}}
+    Questions to think about: {{.Questions}}
     `
 
 	// ToTPrompt uses a structured approach to generating human-like responses to questions or prompts.
@@ -77,9 +131,10 @@ var (
     Return you answer in markdown format. 
 
     Please use the following information before answering the question.
-    Thoughts: %s
-    Additional Context: %s
-    Previous Answers: %s 
+    Thoughts: {{.Thoughts}}
+    Additional Context: {{.Context}}
+    Previous Answers: {{.PreviousAnswers}}
+    Questions to think about: {{.Questions}}
     `
 
 	// GoTPrompt Graphs of thought prompting are visual representations of the relationships between different aspects of a problem or situation.
@@ -99,9 +154,10 @@ var (
     Return you answer in markdown format. 
 
     Please use the following information before answering the question.
-    Thoughts: %s
-    Additional Context: %s
-    Previous Answers: %s 
+    Thoughts: {{.Thoughts}}
+    Additional Context: {{.Context}}
+    Previous Answers: {{.PreviousAnswers}}
+    Questions to think about: {{.Questions}}
     `
 
 	// MoEPrompt uses expert prompting which is a technique used in natural language processing (NLP) and machine learning (ML) to generate responses to questions or tasks that require domain knowledge or expertise.
@@ -136,9 +192,10 @@ var (
     Return you answer in markdown format. 
 
     Please use the following information before answering the question.
-    Thoughts: %s
-    Additional Context: %s
-    Previous Answers: %s 
+    Thoughts: {{.Thoughts}}
+    Additional Context: {{.Context}}
+    Previous Answers: {{.PreviousAnswers}}
+    Questions to think about: {{.Questions}}
     `
 
 	// SixThinkingHats, It is a problem-solving technique that involves the model wearing several hats.
@@ -164,9 +221,10 @@ var (
     Return you answer in markdown format. 
 
     Please use the following information before answering the question.
-    Thoughts: %s
-    Additional Context: %s
-    Previous Answers: %s 
+    Thoughts: {{.Thoughts}}
+    Additional Context: {{.Context}}
+    Previous Answers: {{.PreviousAnswers}}
+    Questions to think about: {{.Questions}}
     `
 
 	// WIP and not supposed to be used.
@@ -201,8 +259,9 @@ var (
     Return you answer in markdown format. 
 
     Please use the following information before answering the question.
-    Thoughts: %s
-    Additional Context: %s
-    Previous Answers: %s 
+    Thoughts: {{.Thoughts}}
+    Additional Context: {{.Context}}
+    Previous Answers: {{.PreviousAnswers}}
+    Questions to think about: {{.Questions}}
     `
 )
@@ -53,10 +53,10 @@ var (
     Format responses in markdown.
 
     Please base your response on the provided information:
-    **Thoughts:** %s
-    **Additional Context:** %s
-    **Previous Answers:** %s 
-    **Questions to think about:** %s
+    **Thoughts:** {{.Thoughts}}
+    **Additional Context:** {{.Context}}
+    **Previous Answers:** {{.PreviousAnswers}}
+    **Questions to think about:** {{.Questions}}
     `
 
 	// CoTPrompt is for linear progression tasks where clear steps can be seen.
@@ -78,10 +78,10 @@ var (
     Return your answer in markdown format, such as: **Final Answer:** [Result]
 
     Please base your response on the provided information:
-    **Thoughts:** %s
-    **Additional Context:** %s
-    **Previous Answers:** %s 
-    **Questions to think about:** %s
+    **Thoughts:** {{.Thoughts}}
+    **Additional Context:** {{.Context}}
+    **Previous Answers:** {{.PreviousAnswers}}
+    **Questions to think about:** {{.Questions}}
     `
 
 	// ToTPrompt uses a structured approach to generating human-like responses to questions or prompts.
@@ -95,10 +95,10 @@ var (
     Return you answer in markdown format. 
 
     Please base your response on the provided information:
-    **Thoughts:** %s
-    **Additional Context:** %s
-    **Previous Answers:** %s 
-    **Questions to think about:** %s
+    **Thoughts:** {{.Thoughts}}
+    **Additional Context:** {{.Context}}
+    **Previous Answers:** {{.PreviousAnswers}}
+    **Questions to think about:** {{.Questions}}
     `
 
 	// GoTPrompt Graphs of thought prompting are visual representations of the relationships between different aspects of a problem or situation.
@@ -118,10 +118,10 @@ var (
     Return you answer in markdown format. 
 
     Please base your response on the provided information:
-    **Thoughts:** %s
-    **Additional Context:** %s
-    **Previous Answers:** %s 
-    **Questions to think about:** %s
+    **Thoughts:** {{.Thoughts}}
+    **Additional Context:** {{.Context}}
+    **Previous Answers:** {{.PreviousAnswers}}
+    **Questions to think about:** {{.Questions}}
     `
 
 	// MoEPrompt uses expert prompting which is a technique used in natural language processing (NLP) and machine learning (ML) to generate responses to questions or tasks that require domain knowledge or expertise.
@@ -157,10 +157,10 @@ var (
     Return you answer in markdown format. 
 
     Please base your response on the provided information:
-    **Thoughts:** %s
-    **Additional Context:** %s
-    **Previous Answers:** %s 
-    **Questions to think about:** %s
+    **Thoughts:** {{.Thoughts}}
+    **Additional Context:** {{.Context}}
+    **Previous Answers:** {{.PreviousAnswers}}
+    **Questions to think about:** {{.Questions}}
     `
 
 	// SixThinkingHats, It is a problem-solving technique that involves the model wearing several hats.
@@ -186,10 +186,10 @@ var (
     Return you answer in markdown format. 
 
     Please base your response on the provided information:
-    **Thoughts:** %s
-    **Additional Context:** %s
-    **Previous Answers:** %s 
-    **Questions to think about:** %s
+    **Thoughts:** {{.Thoughts}}
+    **Additional Context:** {{.Context}}
+    **Previous Answers:** {{.PreviousAnswers}}
+    **Questions to think about:** {{.Questions}}
     `
 
 	SecMalwareObfuscation = `
@@ -212,9 +212,9 @@ var (
     Return you answer in markdown format. 
 
     Please base your response on the provided information:
-    **Thoughts:** %s
-    **Additional Context:** %s
-    **Previous Answers:** %s 
-    **Questions to think about:** %s
+    **Thoughts:** {{.Thoughts}}
+    **Additional Context:** {{.Context}}
+    **Previous Answers:** {{.PreviousAnswers}}
+    **Questions to think about:** {{.Questions}}
     `
 )
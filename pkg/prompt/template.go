@@ -0,0 +1,203 @@
+package prompt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// TemplateExt is the extension of prompt files in the prompt folder.
+const TemplateExt = ".tmpl"
+
+// Token limits a prompt mode can use, the numbers come from the runtime config.
+const (
+	LimitSimple = "simple"
+	LimitCoT    = "cot"
+	LimitFull   = "full"
+)
+
+// ErrTemplate is wrapped by every problem found while parsing a prompt template.
+var ErrTemplate = errors.New("invalid prompt template")
+
+type (
+	// Data is what a prompt template can use, {{.Thoughts}} and so on.
+	Data struct {
+		Thoughts        string
+		Context         string
+		PreviousAnswers string
+		Questions       string
+		Prompt          string
+	}
+
+	// Template is the system prompt of a mode.
+	Template struct {
+		Mode        string `json:"mode"`
+		Description string `json:"description,omitempty"`
+		// Source is builtin or the file the template was loaded from.
+		Source string `json:"source"`
+		// Limit is one of LimitSimple, LimitCoT or LimitFull.
+		Limit string `json:"limit"`
+		Text  string `json:"template"`
+
+		tmpl *template.Template
+	}
+
+	// Library holds the prompt modes by name.
+	// It's filled in on startup and only read after that.
+	Library struct {
+		templates map[string]*Template
+	}
+)
+
+// Parse checks a prompt template by filling it with sample data,
+// so a misspelled field is found before a request uses it.
+func Parse(mode, text string) (*Template, error) {
+	tmpl, err := template.New(mode).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTemplate, err)
+	}
+	_, err = tmpl.New("context").Parse(ContextTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTemplate, err)
+	}
+
+	t := &Template{Mode: mode, Source: "builtin", Limit: LimitFull, Text: text, tmpl: tmpl}
+	_, err = t.Execute(Data{Thoughts: "t", Context: "c", PreviousAnswers: "p", Questions: "q", Prompt: "u"})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// MustParse is Parse for the built in prompts, it panics on an error.
+func MustParse(mode, description, limit, text string) *Template {
+	t, err := Parse(mode, text)
+	if err != nil {
+		panic(fmt.Sprintf("prompt %s: %v", mode, err))
+	}
+	t.Description = description
+	t.Limit = limit
+	return t
+}
+
+// Execute fills the template in.
+func (t *Template) Execute(data Data) (string, error) {
+	var b strings.Builder
+	err := t.tmpl.Execute(&b, data)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrTemplate, err)
+	}
+	return b.String(), nil
+}
+
+// NewLibrary returns a library holding templates.
+func NewLibrary(templates ...*Template) *Library {
+	l := &Library{templates: map[string]*Template{}}
+	for _, t := range templates {
+		l.templates[t.Mode] = t
+	}
+	return l
+}
+
+// Get returns the template of a mode.
+func (l *Library) Get(mode string) (*Template, bool) {
+	t, ok := l.templates[mode]
+	return t, ok
+}
+
+// Modes returns the names of every mode, sorted.
+func (l *Library) Modes() []string {
+	modes := make([]string, 0, len(l.templates))
+	for mode := range l.templates {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	return modes
+}
+
+// LoadDir adds every .tmpl file in dir, named by the file without the extension.
+// A file with the name of a built in mode replaces it and keeps its token limit,
+// a new mode gets the full limit. A comment at the start of the file, {{/* like this */}},
+// becomes the description. Files that don't parse are returned as errors and the rest are still added.
+func (l *Library) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != TemplateExt {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		mode := strings.ToLower(strings.TrimSuffix(entry.Name(), TemplateExt))
+		t, err := Parse(mode, string(data))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		t.Source = path
+		t.Description = description(t.Text)
+		if old, ok := l.templates[mode]; ok {
+			t.Limit = old.Limit
+			if t.Description == "" {
+				t.Description = old.Description
+			}
+		}
+		l.templates[mode] = t
+		slog.Info("Loaded Prompt", "mode", mode, "path", path)
+	}
+
+	return errors.Join(errs...)
+}
+
+// description returns the comment at the start of a template.
+func description(text string) string {
+	text = strings.TrimSpace(text)
+	text, ok := strings.CutPrefix(text, "{{/*")
+	if !ok {
+		return ""
+	}
+	comment, _, ok := strings.Cut(text, "*/}}")
+	if !ok {
+		return ""
+	}
+	return strings.Join(strings.Fields(comment), " ")
+}
+
+// PromptsRequest, handlerfunc expects GET method and returns every prompt mode.
+func (l *Library) PromptsRequest(w http.ResponseWriter, req *http.Request) {
+	var templates []*Template
+	for _, mode := range l.Modes() {
+		templates = append(templates, l.templates[mode])
+	}
+
+	json, err := json.Marshal(templates)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error marshaling prompts", "err", err)
+		http.Error(w, "Error marshaling prompts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
@@ -0,0 +1,88 @@
+package prompt
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tmpl, err := Parse("short", "Answer {{.Prompt}}.\n{{template \"context\" .}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tmpl.Execute(Data{Prompt: "briefly", Thoughts: "none yet", Questions: "why?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Answer briefly.") || !strings.Contains(out, "none yet") || !strings.Contains(out, "why?") {
+		t.Errorf("unexpected prompt %q", out)
+	}
+
+	for _, text := range []string{"{{.Thougts}}", "{{.Thoughts", "{{template \"missing\" .}}"} {
+		if _, err := Parse("bad", text); !errors.Is(err, ErrTemplate) {
+			t.Errorf("%s: expected ErrTemplate, got %v", text, err)
+		}
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"simple.tmpl": "{{/* shorter answers */}}Be brief. {{.Context}}",
+		"haiku.tmpl":  "Answer in a haiku. {{.Context}}",
+		"broken.tmpl": "{{.Contex}}",
+		"notes.txt":   "not a prompt",
+		"Review.tmpl": "Review it. {{template \"context\" .}}",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lib := NewLibrary(MustParse("simple", "answers simply", LimitSimple, SimplePrompt))
+	err := lib.LoadDir(dir)
+	if err == nil || !strings.Contains(err.Error(), "broken.tmpl") {
+		t.Errorf("expected the broken template to be reported, got %v", err)
+	}
+
+	if got := strings.Join(lib.Modes(), ","); got != "haiku,review,simple" {
+		t.Fatalf("unexpected modes %s", got)
+	}
+	simple, _ := lib.Get("simple")
+	if simple.Limit != LimitSimple || simple.Description != "shorter answers" || simple.Source == "builtin" {
+		t.Errorf("expected the file to replace simple and keep its limit, got %+v", simple)
+	}
+	haiku, _ := lib.Get("haiku")
+	if haiku.Limit != LimitFull {
+		t.Errorf("expected a new mode to get the full limit, got %s", haiku.Limit)
+	}
+
+	if err := lib.LoadDir(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("expected a missing folder to be skipped, got %v", err)
+	}
+}
+
+func TestPromptsRequest(t *testing.T) {
+	lib := NewLibrary(
+		MustParse("simple", "answers simply", LimitSimple, SimplePrompt),
+		MustParse("cot", "chain of thought", LimitCoT, CoTPrompt),
+	)
+
+	rec := httptest.NewRecorder()
+	lib.PromptsRequest(rec, httptest.NewRequest(http.MethodGet, "/prompts", nil))
+
+	var templates []Template
+	if err := json.NewDecoder(rec.Body).Decode(&templates); err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) != 2 || templates[0].Mode != "cot" || templates[1].Limit != LimitSimple {
+		t.Errorf("unexpected prompts %+v", templates)
+	}
+}
@@ -0,0 +1,81 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/StoneG24/slape/pkg/prompt"
+	"github.com/openai/openai-go"
+)
+
+// listMarker matches the bullets and numbers models put in front of list items.
+var listMarker = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)])\s*`)
+
+// LLMExtractor asks a model served by llama.cpp to find the entities in a text.
+type LLMExtractor struct {
+	Client openai.Client
+	// MaxEntities is the most entities asked for per text.
+	MaxEntities int
+}
+
+// Extract implements Extractor.
+func (e LLMExtractor) Extract(ctx context.Context, text string) ([]Entity, error) {
+	maxEntities := e.MaxEntities
+	if maxEntities <= 0 {
+		maxEntities = 10
+	}
+
+	param := openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(fmt.Sprintf(prompt.EntityExtractionPrompt, maxEntities)),
+			openai.UserMessage(text),
+		},
+		Seed:        openai.Int(0),
+		Temperature: openai.Float(0),
+		MaxTokens:   openai.Int(256),
+	}
+
+	result, err := e.Client.Chat.Completions.New(ctx, param)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Choices) == 0 {
+		return nil, nil
+	}
+
+	return parseEntities(result.Choices[0].Message.Content, maxEntities), nil
+}
+
+// parseEntities reads the "name | type" lines written by the model.
+// Lines without a type are kept, the type is just left empty.
+func parseEntities(text string, n int) []Entity {
+	var entities []Entity
+	seen := map[string]bool{}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = listMarker.ReplaceAllString(strings.TrimSpace(line), "")
+		if line == "" {
+			continue
+		}
+
+		name, kind, _ := strings.Cut(line, "|")
+		name = strings.Trim(strings.TrimSpace(name), "*\"'`")
+		kind = strings.ToLower(strings.Trim(strings.TrimSpace(kind), "*\"'`"))
+
+		// long names are sentences the model wrote instead of entities
+		key := entityKey(name)
+		if key == "" || len(name) > 64 || seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		entities = append(entities, Entity{Name: name, Type: kind})
+		if len(entities) == n {
+			break
+		}
+	}
+
+	return entities
+}
@@ -0,0 +1,197 @@
+package rag
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type (
+	// graph is the heterogeneous graph of a collection.
+	// The text and vectors live in the vector store, the graph only keeps how things connect.
+	graph struct {
+		mu sync.RWMutex
+
+		Documents map[string]*Document   `json:"documents"`
+		Chunks    map[string]*chunkNode  `json:"chunks"`
+		Entities  map[string]*entityNode `json:"entities"`
+	}
+
+	chunkNode struct {
+		Document string   `json:"document"`
+		Entities []string `json:"entities"`
+	}
+
+	entityNode struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+		// Chunks the entity appears in.
+		Chunks map[string]bool `json:"chunks"`
+		// Related entities and the number of chunks they share with this one.
+		Related map[string]int `json:"related"`
+	}
+)
+
+func newGraph() *graph {
+	return &graph{
+		Documents: map[string]*Document{},
+		Chunks:    map[string]*chunkNode{},
+		Entities:  map[string]*entityNode{},
+	}
+}
+
+// loadGraph reads a graph from disk, a missing file is an empty graph.
+func loadGraph(path string) (*graph, error) {
+	g := newGraph()
+
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(contents, g)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// save writes the graph to a temporary file and renames it so a crash never leaves half a graph.
+// The caller has to hold the lock.
+func (g *graph) save(path string) error {
+	contents, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path+"~", contents, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+"~", path)
+}
+
+// addChunk connects a chunk to the entities found in it and the entities to each other.
+func (g *graph) addChunk(id string, document string, entities map[string]Entity) {
+	node := &chunkNode{Document: document}
+	for key := range entities {
+		node.Entities = append(node.Entities, key)
+	}
+	sort.Strings(node.Entities)
+	g.Chunks[id] = node
+
+	for _, key := range node.Entities {
+		entity, ok := g.Entities[key]
+		if !ok {
+			entity = &entityNode{
+				Name:    entities[key].Name,
+				Type:    entities[key].Type,
+				Chunks:  map[string]bool{},
+				Related: map[string]int{},
+			}
+			g.Entities[key] = entity
+		}
+		entity.Chunks[id] = true
+
+		for _, other := range node.Entities {
+			if other != key {
+				entity.Related[other]++
+			}
+		}
+	}
+}
+
+// removeDocument takes a document out of the graph.
+// It returns the ids of its chunks and the entities that no longer appear anywhere.
+func (g *graph) removeDocument(document string) ([]string, []string) {
+	var chunks []string
+	var orphans []string
+
+	for id, node := range g.Chunks {
+		if node.Document != document {
+			continue
+		}
+		chunks = append(chunks, id)
+
+		for _, key := range node.Entities {
+			entity, ok := g.Entities[key]
+			if !ok {
+				continue
+			}
+			delete(entity.Chunks, id)
+			for _, other := range node.Entities {
+				if other == key {
+					continue
+				}
+				entity.Related[other]--
+				if entity.Related[other] <= 0 {
+					delete(entity.Related, other)
+				}
+			}
+			if len(entity.Chunks) == 0 {
+				delete(g.Entities, key)
+				orphans = append(orphans, key)
+			}
+		}
+		delete(g.Chunks, id)
+	}
+	delete(g.Documents, document)
+
+	sort.Strings(chunks)
+	sort.Strings(orphans)
+	return chunks, orphans
+}
+
+// walk scores chunks by how strongly they connect to the seed entities.
+// A chunk gets the score of every seed it mentions, and a fraction of the score of seeds
+// that are related to the entities it mentions. Scores are scaled so the best chunk is 1.
+func (g *graph) walk(seeds map[string]float64) map[string]float64 {
+	scores := map[string]float64{}
+
+	for key, score := range seeds {
+		entity, ok := g.Entities[key]
+		if !ok {
+			continue
+		}
+		for chunk := range entity.Chunks {
+			scores[chunk] += score
+		}
+
+		// one hop out, weighted by how often the entities show up together
+		total := 0
+		for _, count := range entity.Related {
+			total += count
+		}
+		for other, count := range entity.Related {
+			related, ok := g.Entities[other]
+			if !ok {
+				continue
+			}
+			weight := score * hopDecay * float64(count) / float64(total)
+			for chunk := range related.Chunks {
+				scores[chunk] += weight
+			}
+		}
+	}
+
+	var best float64
+	for _, score := range scores {
+		best = max(best, score)
+	}
+	if best > 0 {
+		for chunk := range scores {
+			scores[chunk] /= best
+		}
+	}
+	return scores
+}
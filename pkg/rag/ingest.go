@@ -0,0 +1,414 @@
+package rag
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+// States of a document while it is being ingested.
+const (
+	Queued   = "queued"
+	Indexing = "indexing"
+	Done     = "done"
+	Failed   = "failed"
+)
+
+type (
+	// Ingester parses uploaded documents and indexes them one at a time in the background.
+	Ingester struct {
+		// Root is the folder paths in an IngestRequest are read from, nothing outside it can be ingested.
+		Root string
+
+		rag   *RAG
+		queue chan job
+
+		mu   sync.Mutex
+		jobs map[string]*Status
+	}
+
+	// Status is a document along with how far along its ingestion is.
+	Status struct {
+		Document
+		Collection string `json:"collection"`
+		State      string `json:"state"`
+		// Progress goes from 0 to 1.
+		Progress float64 `json:"progress"`
+		Error    string  `json:"error,omitempty"`
+	}
+
+	// IngestRequest is used to index files that are already on disk.
+	// Path is in the documents folder and can be a single file or a folder, folders are walked and unsupported files are skipped.
+	IngestRequest struct {
+		Path       string `json:"path"`
+		Collection string `json:"collection"`
+	}
+
+	// DocumentsResponse is returned by the document endpoints.
+	DocumentsResponse struct {
+		Documents []Status `json:"documents"`
+	}
+
+	job struct {
+		collection string
+		doc        Document
+		text       string
+	}
+)
+
+// NewIngester starts the background worker that indexes documents into r.
+func NewIngester(r *RAG) *Ingester {
+	i := &Ingester{
+		Root:  vars.RagDocumentsDir,
+		rag:   r,
+		queue: make(chan job, vars.RagQueueSize),
+		jobs:  map[string]*Status{},
+	}
+	go i.work()
+	return i
+}
+
+// UploadDocumentsRequest, handlerfunc expects POST method with either a multipart upload
+// of one or more files or an IngestRequest, it returns the queued documents.
+func (i *Ingester) UploadDocumentsRequest(w http.ResponseWriter, req *http.Request) {
+	var statuses []Status
+	var collection string
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		req.Body = http.MaxBytesReader(w, req.Body, vars.RagMaxUploadBytes)
+		err := req.ParseMultipartForm(32 << 20)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "Error reading uploaded documents", "err", err)
+			http.Error(w, "Error reading uploaded documents", http.StatusBadRequest)
+			return
+		}
+
+		collection = collectionOrDefault(req.FormValue("collection"))
+		if !validName(collection) {
+			http.Error(w, "Error invalid collection name", http.StatusBadRequest)
+			return
+		}
+
+		var headers = append(req.MultipartForm.File["file"], req.MultipartForm.File["files"]...)
+		if len(headers) == 0 {
+			http.Error(w, "Error no files were uploaded", http.StatusBadRequest)
+			return
+		}
+		for _, header := range headers {
+			f, err := header.Open()
+			if err != nil {
+				statuses = append(statuses, failed(collection, header.Filename, err))
+				continue
+			}
+			content, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				statuses = append(statuses, failed(collection, header.Filename, err))
+				continue
+			}
+			statuses = append(statuses, i.enqueue(collection, header.Filename, content))
+		}
+	} else {
+		var payload IngestRequest
+		err := json.NewDecoder(req.Body).Decode(&payload)
+		if err != nil || payload.Path == "" {
+			slog.ErrorContext(req.Context(), "Error Request Format", "err", err)
+			http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
+			return
+		}
+
+		collection = collectionOrDefault(payload.Collection)
+		if !validName(collection) {
+			http.Error(w, "Error invalid collection name", http.StatusBadRequest)
+			return
+		}
+
+		paths, err := documentPaths(i.Root, payload.Path)
+		if errors.Is(err, errOutsideRoot) {
+			http.Error(w, "Error path has to be in the documents folder", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(req.Context(), "Error reading documents from disk", "err", err)
+			http.Error(w, "Error reading documents from disk", http.StatusBadRequest)
+			return
+		}
+		for _, path := range paths {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				statuses = append(statuses, failed(collection, path, err))
+				continue
+			}
+			statuses = append(statuses, i.enqueue(collection, path, content))
+		}
+	}
+
+	writeDocuments(w, http.StatusAccepted, statuses)
+}
+
+// ListDocumentsRequest, handlerfunc expects GET method and returns the documents in a collection
+// along with any that are still being ingested or failed to be.
+func (i *Ingester) ListDocumentsRequest(w http.ResponseWriter, req *http.Request) {
+	collection := collectionOrDefault(req.URL.Query().Get("collection"))
+
+	docs, err := i.rag.Documents(collection)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error listing documents", "err", err)
+		http.Error(w, "Error listing documents", http.StatusBadRequest)
+		return
+	}
+
+	statuses := []Status{}
+	pending := map[string]bool{}
+
+	i.mu.Lock()
+	for _, status := range i.jobs {
+		if status.Collection == collection {
+			statuses = append(statuses, *status)
+			pending[status.ID] = true
+		}
+	}
+	i.mu.Unlock()
+
+	for _, doc := range docs {
+		if !pending[doc.ID] {
+			statuses = append(statuses, Status{Document: doc, Collection: collection, State: Done, Progress: 1})
+		}
+	}
+
+	writeDocuments(w, http.StatusOK, statuses)
+}
+
+// DeleteDocumentRequest, handlerfunc expects DELETE method and removes a document from a collection.
+func (i *Ingester) DeleteDocumentRequest(w http.ResponseWriter, req *http.Request) {
+	collection := collectionOrDefault(req.URL.Query().Get("collection"))
+	id := req.PathValue("id")
+
+	i.mu.Lock()
+	status, ok := i.jobs[jobKey(collection, id)]
+	if ok && status.State != Failed {
+		i.mu.Unlock()
+		http.Error(w, "Error document is still being ingested", http.StatusConflict)
+		return
+	}
+	delete(i.jobs, jobKey(collection, id))
+	i.mu.Unlock()
+
+	err := i.rag.Delete(req.Context(), collection, id)
+	if errors.Is(err, ErrDocumentNotFound) && !ok {
+		http.Error(w, "Error document not found", http.StatusNotFound)
+		return
+	}
+	if err != nil && !errors.Is(err, ErrDocumentNotFound) {
+		slog.ErrorContext(req.Context(), "Error deleting document", "err", err)
+		http.Error(w, "Error deleting document", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// enqueue parses a document and queues it for indexing.
+func (i *Ingester) enqueue(collection string, name string, content []byte) Status {
+	parsed, err := Parse(name, content)
+	if err != nil {
+		return failed(collection, name, err)
+	}
+	if strings.TrimSpace(parsed.Text) == "" {
+		return failed(collection, name, errors.New("document has no text"))
+	}
+
+	sum := sha256.Sum256(content)
+	doc := Document{
+		ID:       hex.EncodeToString(sum[:8]),
+		Title:    parsed.Title,
+		Source:   name,
+		Strategy: parsed.Strategy,
+	}
+	status := &Status{Document: doc, Collection: collection, State: Queued}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key := jobKey(collection, doc.ID)
+	if current, ok := i.jobs[key]; ok && current.State != Failed {
+		return *current
+	}
+
+	select {
+	case i.queue <- job{collection: collection, doc: doc, text: parsed.Text}:
+	default:
+		return failed(collection, name, errors.New("too many documents are waiting to be ingested"))
+	}
+	i.jobs[key] = status
+
+	return *status
+}
+
+// work indexes queued documents one at a time since they all share the same models.
+func (i *Ingester) work() {
+	for j := range i.queue {
+		key := jobKey(j.collection, j.doc.ID)
+		i.update(key, func(s *Status) { s.State = Indexing })
+
+		doc, err := i.rag.InsertWithProgress(context.Background(), j.collection, j.doc, j.text, func(done, total int) {
+			i.update(key, func(s *Status) {
+				if total > 0 {
+					s.Progress = float64(done) / float64(total)
+				}
+			})
+		})
+		if err != nil {
+			slog.Error("Error ingesting document", "source", j.doc.Source, "err", err)
+			i.update(key, func(s *Status) {
+				s.State = Failed
+				s.Error = err.Error()
+			})
+			continue
+		}
+
+		slog.Info("Ingested Document", "source", doc.Source, "chunks", doc.Chunks, "entities", doc.Entities)
+		// the document is listed by the rag from now on
+		i.mu.Lock()
+		delete(i.jobs, key)
+		i.mu.Unlock()
+	}
+}
+
+func (i *Ingester) update(key string, change func(*Status)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if status, ok := i.jobs[key]; ok {
+		change(status)
+	}
+}
+
+// errOutsideRoot is returned for a path that isn't in the documents folder.
+var errOutsideRoot = errors.New("path is outside the documents folder")
+
+// documentPaths returns path if it's a file, or every supported file under it if it's a folder.
+// path is relative to root, and it or any file under it that leads outside of root after following links is refused.
+func documentPaths(root string, path string) ([]string, error) {
+	root, err := filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	path, err = inRoot(root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var paths []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != path && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !supportedExtension(p) {
+			return nil
+		}
+		// a link in the folder can point anywhere
+		if _, err := inRoot(root, p); err != nil {
+			return nil
+		}
+		paths = append(paths, p)
+		return nil
+	})
+	return paths, err
+}
+
+// inRoot returns path with its links followed, or errOutsideRoot if that isn't in root.
+func inRoot(root string, path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		resolved = filepath.Clean(path)
+	} else if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", errOutsideRoot
+	}
+	return resolved, nil
+}
+
+func supportedExtension(path string) bool {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".md", ".markdown", ".html", ".htm", ".pdf", ".txt", ".text", ".rst", ".csv", ".log":
+		return true
+	default:
+		return codeExtensions[ext]
+	}
+}
+
+func failed(collection string, name string, err error) Status {
+	return Status{
+		Document:   Document{Source: name, Title: filepath.Base(name)},
+		Collection: collection,
+		State:      Failed,
+		Error:      err.Error(),
+	}
+}
+
+func collectionOrDefault(collection string) string {
+	if collection == "" {
+		return vars.RagCollection
+	}
+	return collection
+}
+
+func jobKey(collection string, id string) string {
+	return collection + "/" + id
+}
+
+func writeDocuments(w http.ResponseWriter, code int, statuses []Status) {
+	if statuses == nil {
+		statuses = []Status{}
+	}
+
+	json, err := json.Marshal(DocumentsResponse{Documents: statuses})
+	if err != nil {
+		slog.Error("Error marshaling documents", "err", err)
+		http.Error(w, "Error marshaling documents", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(json)
+}
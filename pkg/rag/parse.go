@@ -0,0 +1,136 @@
+package rag
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/StoneG24/slape/pkg/chunker"
+	"github.com/ledongthuc/pdf"
+)
+
+// ErrUnsupported is returned for files that can't be turned into text.
+var ErrUnsupported = errors.New("unsupported document type")
+
+// codeExtensions are the source files that are chunked as code.
+var codeExtensions = map[string]bool{
+	".go": true, ".py": true, ".js": true, ".jsx": true, ".ts": true, ".tsx": true,
+	".java": true, ".kt": true, ".c": true, ".h": true, ".cpp": true, ".hpp": true, ".cc": true,
+	".cs": true, ".rs": true, ".rb": true, ".php": true, ".swift": true, ".scala": true,
+	".sh": true, ".bash": true, ".ps1": true, ".lua": true, ".sql": true, ".r": true,
+	".yaml": true, ".yml": true, ".toml": true, ".json": true, ".proto": true,
+}
+
+// Parsed is the text of a document and how it should be chunked.
+type Parsed struct {
+	Text     string
+	Title    string
+	Strategy chunker.Strategy
+}
+
+// Parse turns the contents of a file into text, the type is decided by the file name
+// and falls back to sniffing the contents.
+func Parse(name string, content []byte) (Parsed, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	title := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+
+	switch {
+	case ext == ".md" || ext == ".markdown":
+		return Parsed{Text: string(content), Title: title, Strategy: chunker.Markdown}, nil
+	case ext == ".html" || ext == ".htm":
+		return parseHTML(content, title)
+	case ext == ".pdf":
+		return parsePDF(content, title)
+	case codeExtensions[ext]:
+		return Parsed{Text: string(content), Title: filepath.Base(name), Strategy: chunker.Code}, nil
+	case ext == ".txt" || ext == ".text" || ext == ".rst" || ext == ".csv" || ext == ".log":
+		return Parsed{Text: string(content), Title: title, Strategy: chunker.Paragraph}, nil
+	}
+
+	kind := http.DetectContentType(content)
+	switch {
+	case strings.HasPrefix(kind, "text/html"):
+		return parseHTML(content, title)
+	case strings.HasPrefix(kind, "application/pdf"):
+		return parsePDF(content, title)
+	case strings.HasPrefix(kind, "text/") && utf8.Valid(content):
+		return Parsed{Text: string(content), Title: title, Strategy: chunker.Paragraph}, nil
+	}
+
+	return Parsed{}, fmt.Errorf("%w: %s", ErrUnsupported, kind)
+}
+
+// parseHTML keeps the readable parts of a page and writes headings and code the way markdown does
+// so that the markdown chunker can keep sections together.
+func parseHTML(content []byte, title string) (Parsed, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(content))
+	if err != nil {
+		return Parsed{}, err
+	}
+
+	if t := strings.TrimSpace(doc.Find("title").First().Text()); t != "" {
+		title = t
+	}
+	doc.Find("script, style, noscript, nav, header, footer, aside, form, svg").Remove()
+
+	var text strings.Builder
+	doc.Find("h1, h2, h3, h4, h5, h6, p, li, pre, blockquote, td").Each(func(i int, s *goquery.Selection) {
+		// nested matches are written by their parent
+		if s.ParentsFiltered("p, li, pre, blockquote, td").Length() > 0 {
+			return
+		}
+
+		tag := goquery.NodeName(s)
+		if tag == "pre" {
+			text.WriteString("```\n" + strings.TrimRight(s.Text(), "\n") + "\n```\n\n")
+			return
+		}
+
+		line := strings.Join(strings.Fields(s.Text()), " ")
+		if line == "" {
+			return
+		}
+		switch tag {
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			line = strings.Repeat("#", int(tag[1]-'0')) + " " + line
+		case "li":
+			line = "- " + line
+		case "blockquote":
+			line = "> " + line
+		}
+		text.WriteString(line + "\n\n")
+	})
+
+	return Parsed{Text: text.String(), Title: title, Strategy: chunker.Markdown}, nil
+}
+
+// parsePDF pulls the plain text out of every page.
+// The pdf package panics on some broken files so that is turned into an error.
+func parsePDF(content []byte, title string) (parsed Parsed, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reading pdf: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return Parsed{}, err
+	}
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return Parsed{}, err
+	}
+	text, err := io.ReadAll(plain)
+	if err != nil {
+		return Parsed{}, err
+	}
+
+	return Parsed{Text: string(text), Title: title, Strategy: chunker.Paragraph}, nil
+}
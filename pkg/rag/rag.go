@@ -0,0 +1,625 @@
+/*
+Pacakge rag is for working with rag solutions in order to aid in context generation for our slms.
+These solutions should be easy to use on low end hardware since this is intended for consummer grade hardware.
+
+The index follows MiniRAG, https://github.com/HKUDS/MiniRAG. Documents are chunked and a small model
+pulls the entities out of every chunk. Chunks and entities become nodes of a graph where an entity is
+connected to the chunks it appears in and to the entities it appears next to. Retrieval mixes the
+similarity of the chunks with how well they are connected to the entities in the question,
+so a small model can still find the right passages when the wording doesn't match.
+*/
+package rag
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/chunker"
+	"github.com/StoneG24/slape/pkg/vectorstore"
+)
+
+// Mode is how passages are found during retrieval.
+type Mode string
+
+const (
+	// Naive only uses the similarity of the chunks to the query.
+	Naive Mode = "naive"
+	// Mini also walks the entity graph, this is the default.
+	Mini Mode = "mini"
+)
+
+const (
+	// number of chunks embedded in a single request
+	embedBatch = 32
+	// lexicalWeight is how much the best BM25 match counts compared to the chunk similarity
+	lexicalWeight = 0.3
+	// graphWeight is how much the entity graph counts compared to the chunk similarity
+	graphWeight = 0.5
+	// hopDecay is how much an entity one step away from a query entity counts
+	hopDecay = 0.5
+	// entities have to be at least this close to the query to be used as a starting point
+	entityThreshold = 0.5
+)
+
+var (
+	// ErrDocumentNotFound is returned when deleting a document that was never inserted.
+	ErrDocumentNotFound = errors.New("document not found")
+	// ErrMode is returned for a retrieval mode that doesn't exist.
+	ErrMode = errors.New("unknown retrieval mode")
+)
+
+type (
+	// Embedder turns text into vectors, the EmbeddingPipeline is the usual one.
+	Embedder interface {
+		Embed(ctx context.Context, texts []string) ([][]float64, error)
+	}
+
+	// Progress is called with how much of a document has been indexed.
+	Progress func(done, total int)
+
+	// Extractor pulls the entities out of a piece of text.
+	Extractor interface {
+		Extract(ctx context.Context, text string) ([]Entity, error)
+	}
+
+	// Entity is a single thing mentioned in the text.
+	Entity struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+
+	// Document is a single piece of text that was indexed.
+	Document struct {
+		ID     string `json:"id"`
+		Title  string `json:"title"`
+		Source string `json:"source"`
+		// Strategy is how the document is chunked, markdown is used if it's empty.
+		Strategy chunker.Strategy `json:"strategy,omitempty"`
+		Chunks   int              `json:"chunks"`
+		Entities int              `json:"entities"`
+		Added    time.Time        `json:"added"`
+	}
+
+	// Passage is a chunk returned by Retrieve.
+	Passage struct {
+		ID         string   `json:"id"`
+		DocumentID string   `json:"document_id"`
+		Text       string   `json:"text"`
+		Title      string   `json:"title"`
+		Source     string   `json:"source"`
+		Entities   []string `json:"entities,omitempty"`
+		Score      float64  `json:"score"`
+	}
+
+	// RAG indexes documents into collections kept in a vector store.
+	// Every collection has a vector collection for its chunks, another for its entities and a graph.
+	RAG struct {
+		store     *vectorstore.Store
+		embedder  Embedder
+		extractor Extractor
+		dir       string
+
+		mu     sync.Mutex
+		graphs map[string]*graph
+	}
+)
+
+// New creates a RAG that keeps vectors in store and graphs in dir.
+// If extractor is nil no entities are extracted and every retrieval is naive.
+func New(store *vectorstore.Store, embedder Embedder, extractor Extractor, dir string) (*RAG, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RAG{
+		store:     store,
+		embedder:  embedder,
+		extractor: extractor,
+		dir:       dir,
+		graphs:    map[string]*graph{},
+	}, nil
+}
+
+// ParseMode turns a request value into a Mode, an empty value is Mini.
+func ParseMode(value string) (Mode, error) {
+	switch Mode(strings.ToLower(strings.TrimSpace(value))) {
+	case "", Mini:
+		return Mini, nil
+	case Naive:
+		return Naive, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrMode, value)
+}
+
+// Insert chunks, embeds and indexes a document, returning it with its counts filled in.
+// If the id is empty one is made from the text, inserting a document with an existing id replaces it.
+func (r *RAG) Insert(ctx context.Context, collection string, doc Document, text string) (Document, error) {
+	return r.InsertWithProgress(ctx, collection, doc, text, nil)
+}
+
+// InsertWithProgress is Insert but calls progress as chunks are embedded and their entities extracted.
+// Every chunk is counted once for embedding and once for extraction.
+func (r *RAG) InsertWithProgress(ctx context.Context, collection string, doc Document, text string, progress Progress) (Document, error) {
+	if progress == nil {
+		progress = func(done, total int) {}
+	}
+
+	if doc.ID == "" {
+		sum := sha256.Sum256([]byte(text))
+		doc.ID = hex.EncodeToString(sum[:8])
+	}
+	if doc.Strategy == "" {
+		doc.Strategy = chunker.Markdown
+	}
+
+	chunks := chunker.Split(text, chunker.Options{
+		Strategy: doc.Strategy,
+		Source:   doc.Source,
+		Title:    doc.Title,
+	})
+	if len(chunks) == 0 {
+		return doc, errors.New("document has no text")
+	}
+
+	total := len(chunks) * 2
+	progress(0, total)
+
+	texts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		texts[i] = chunk.Text
+	}
+	var vectors [][]float64
+	for start := 0; start < len(texts); start += embedBatch {
+		batch, err := r.embed(ctx, texts[start:min(start+embedBatch, len(texts))])
+		if err != nil {
+			return doc, fmt.Errorf("embedding chunks: %w", err)
+		}
+		vectors = append(vectors, batch...)
+		progress(len(vectors), total)
+	}
+
+	// entities found in each chunk, keyed by their normalized name
+	found := make([]map[string]Entity, len(chunks))
+	names := map[string]Entity{}
+	for i, chunk := range chunks {
+		found[i] = map[string]Entity{}
+		if r.extractor == nil {
+			continue
+		}
+		entities, err := r.extractor.Extract(ctx, chunk.Text)
+		progress(len(chunks)+i+1, total)
+		if err != nil {
+			if ctx.Err() != nil {
+				return doc, ctx.Err()
+			}
+			slog.ErrorContext(ctx, "Error extracting entities, indexing the chunk without them", "err", err)
+			continue
+		}
+		for _, entity := range entities {
+			key := entityKey(entity.Name)
+			if key == "" {
+				continue
+			}
+			found[i][key] = entity
+			names[key] = entity
+		}
+	}
+
+	g, err := r.graph(collection)
+	if err != nil {
+		return doc, err
+	}
+	chunkCollection, entityCollection, err := r.collections(collection)
+	if err != nil {
+		return doc, err
+	}
+
+	// only embed the entities that the graph doesn't know about yet
+	var newKeys []string
+	var newTexts []string
+	g.mu.RLock()
+	for key, entity := range names {
+		if _, ok := g.Entities[key]; !ok {
+			newKeys = append(newKeys, key)
+			newTexts = append(newTexts, entityText(entity))
+		}
+	}
+	g.mu.RUnlock()
+	entityVectors, err := r.embed(ctx, newTexts)
+	if err != nil {
+		return doc, fmt.Errorf("embedding entities: %w", err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.Documents[doc.ID]; ok {
+		// entities that are still in the new version keep their vectors
+		err = r.deleteLocked(g, chunkCollection, entityCollection, doc.ID, names)
+		if err != nil {
+			return doc, err
+		}
+	}
+
+	records := make([]vectorstore.Record, len(chunks))
+	for i, chunk := range chunks {
+		id := doc.ID + "-" + strconv.Itoa(i)
+		records[i] = vectorstore.Record{
+			ID:     id,
+			Vector: vectors[i],
+			Payload: map[string]string{
+				"document":            doc.ID,
+				vectorstore.TextField: chunk.Text,
+				"title":               chunk.Title,
+				"source":              chunk.Source,
+			},
+		}
+		g.addChunk(id, doc.ID, found[i])
+	}
+	err = chunkCollection.Add(records...)
+	if err != nil {
+		return doc, err
+	}
+
+	var entityRecords []vectorstore.Record
+	for i, key := range newKeys {
+		entityRecords = append(entityRecords, vectorstore.Record{
+			ID:      key,
+			Vector:  entityVectors[i],
+			Payload: map[string]string{"name": names[key].Name, "type": names[key].Type},
+		})
+	}
+	err = entityCollection.Add(entityRecords...)
+	if err != nil {
+		return doc, err
+	}
+
+	doc.Chunks = len(chunks)
+	doc.Entities = len(names)
+	doc.Added = time.Now().UTC()
+	g.Documents[doc.ID] = &doc
+
+	return doc, g.save(r.graphPath(collection))
+}
+
+// Retrieve returns the k passages in a collection that best answer the query.
+func (r *RAG) Retrieve(ctx context.Context, collection string, query string, mode Mode, k int) ([]Passage, error) {
+	if k <= 0 {
+		return nil, nil
+	}
+	if mode == "" {
+		mode = Mini
+	}
+	if mode != Mini && mode != Naive {
+		return nil, fmt.Errorf("%w: %s", ErrMode, mode)
+	}
+
+	chunkCollection, err := r.store.Collection(collection + "_chunks")
+	if errors.Is(err, vectorstore.ErrCollectionNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	vectors, err := r.embed(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("embedding query: %w", err)
+	}
+	queryVector := normalize(vectors[0])
+
+	// chunks are found by meaning and by the words in them, a chunk with the exact terms of the query
+	// gets up to lexicalWeight on top of its similarity
+	candidates := chunkCollection.HybridSearch(query, queryVector, k*4, 0)
+	var maxLexical float64
+	for _, result := range candidates {
+		maxLexical = max(maxLexical, result.Lexical)
+	}
+	scores := map[string]float64{}
+	for _, result := range candidates {
+		scores[result.ID] = result.Score
+		if maxLexical > 0 {
+			scores[result.ID] += lexicalWeight * result.Lexical / maxLexical
+		}
+	}
+
+	g, err := r.graph(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == Mini && r.extractor != nil {
+		seeds := r.seedEntities(ctx, collection, query, queryVector, k)
+
+		g.mu.RLock()
+		graphScores := g.walk(seeds)
+		g.mu.RUnlock()
+
+		for id, score := range graphScores {
+			base, ok := scores[id]
+			if !ok {
+				vector, _, found := chunkCollection.Get(id)
+				if !found {
+					continue
+				}
+				base = dot(queryVector, vector)
+			}
+			scores[id] = base + graphWeight*score
+		}
+	}
+
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] == scores[ids[j]] {
+			return ids[i] < ids[j]
+		}
+		return scores[ids[i]] > scores[ids[j]]
+	})
+	if len(ids) > k {
+		ids = ids[:k]
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	passages := make([]Passage, 0, len(ids))
+	for _, id := range ids {
+		_, payload, ok := chunkCollection.Get(id)
+		if !ok {
+			continue
+		}
+		passage := Passage{
+			ID:         id,
+			DocumentID: payload["document"],
+			Text:       payload[vectorstore.TextField],
+			Title:      payload["title"],
+			Source:     payload["source"],
+			Score:      scores[id],
+		}
+		if node, ok := g.Chunks[id]; ok {
+			for _, key := range node.Entities {
+				if entity, ok := g.Entities[key]; ok {
+					passage.Entities = append(passage.Entities, entity.Name)
+				}
+			}
+		}
+		passages = append(passages, passage)
+	}
+
+	return passages, nil
+}
+
+// Delete removes a document and every entity that was only found in it.
+func (r *RAG) Delete(ctx context.Context, collection string, id string) error {
+	g, err := r.graph(collection)
+	if err != nil {
+		return err
+	}
+	chunkCollection, entityCollection, err := r.collections(collection)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.Documents[id]; !ok {
+		return ErrDocumentNotFound
+	}
+	err = r.deleteLocked(g, chunkCollection, entityCollection, id, nil)
+	if err != nil {
+		return err
+	}
+
+	return g.save(r.graphPath(collection))
+}
+
+// Documents returns every document in a collection, oldest first.
+func (r *RAG) Documents(collection string) ([]Document, error) {
+	g, err := r.graph(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	docs := make([]Document, 0, len(g.Documents))
+	for _, doc := range g.Documents {
+		docs = append(docs, *doc)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if docs[i].Added.Equal(docs[j].Added) {
+			return docs[i].ID < docs[j].ID
+		}
+		return docs[i].Added.Before(docs[j].Added)
+	})
+	return docs, nil
+}
+
+// deleteLocked removes a document from the graph and its vectors from the store.
+// Entities left without any chunks are deleted unless they are in keep.
+func (r *RAG) deleteLocked(g *graph, chunkCollection *vectorstore.Collection, entityCollection *vectorstore.Collection, id string, keep map[string]Entity) error {
+	chunks, orphans := g.removeDocument(id)
+
+	err := chunkCollection.Delete(chunks...)
+	if err != nil {
+		return err
+	}
+
+	var remove []string
+	for _, key := range orphans {
+		if _, ok := keep[key]; !ok {
+			remove = append(remove, key)
+		}
+	}
+	return entityCollection.Delete(remove...)
+}
+
+// seedEntities finds the entities in the graph that the query is about, with how sure we are of each.
+func (r *RAG) seedEntities(ctx context.Context, collection string, query string, queryVector []float64, k int) map[string]float64 {
+	seeds := map[string]float64{}
+
+	entityCollection, err := r.store.Collection(collection + "_entities")
+	if err != nil {
+		return seeds
+	}
+
+	add := func(key string, score float64) {
+		if score >= entityThreshold && score > seeds[key] {
+			seeds[key] = score
+		}
+	}
+
+	for _, result := range entityCollection.Search(queryVector, k, 0) {
+		add(result.ID, result.Score)
+	}
+
+	entities, err := r.extractor.Extract(ctx, query)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error extracting entities from the query", "err", err)
+		return seeds
+	}
+
+	var texts []string
+	for _, entity := range entities {
+		key := entityKey(entity.Name)
+		if key == "" {
+			continue
+		}
+		// an exact match is as good as it gets
+		if _, _, ok := entityCollection.Get(key); ok {
+			add(key, 1)
+			continue
+		}
+		texts = append(texts, entityText(entity))
+	}
+
+	vectors, err := r.embed(ctx, texts)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error embedding query entities", "err", err)
+		return seeds
+	}
+	for _, vector := range vectors {
+		for _, result := range entityCollection.Search(vector, 3, 0) {
+			add(result.ID, result.Score)
+		}
+	}
+
+	return seeds
+}
+
+// embed embeds texts in batches.
+func (r *RAG) embed(ctx context.Context, texts []string) ([][]float64, error) {
+	var vectors [][]float64
+	for start := 0; start < len(texts); start += embedBatch {
+		end := min(start+embedBatch, len(texts))
+		batch, err := r.embedder.Embed(ctx, texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) != end-start {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", end-start, len(batch))
+		}
+		vectors = append(vectors, batch...)
+	}
+	return vectors, nil
+}
+
+// collections returns the chunk and entity collections, creating them if needed.
+func (r *RAG) collections(collection string) (*vectorstore.Collection, *vectorstore.Collection, error) {
+	chunks, err := r.store.GetOrCreateCollection(collection+"_chunks", vectorstore.DefaultConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	entities, err := r.store.GetOrCreateCollection(collection+"_entities", vectorstore.DefaultConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	return chunks, entities, nil
+}
+
+// graph returns the graph of a collection, loading it from disk the first time.
+func (r *RAG) graph(collection string) (*graph, error) {
+	if !validName(collection) {
+		return nil, vectorstore.ErrCollectionName
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g, ok := r.graphs[collection]
+	if ok {
+		return g, nil
+	}
+	g, err := loadGraph(r.graphPath(collection))
+	if err != nil {
+		return nil, err
+	}
+	r.graphs[collection] = g
+	return g, nil
+}
+
+func (r *RAG) graphPath(collection string) string {
+	return filepath.Join(r.dir, collection+".json")
+}
+
+// validName checks a collection name against the vectorstore rules. A collection is
+// stored as <name>_chunks and <name>_entities, so the longer of the two has to fit.
+func validName(name string) bool {
+	return vectorstore.ValidCollectionName(name) && vectorstore.ValidCollectionName(name+"_entities")
+}
+
+// entityKey normalizes an entity name so the same entity written differently is one node.
+func entityKey(name string) string {
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	return strings.Trim(name, " .,;:\"'`()[]{}")
+}
+
+// entityText is what is embedded for an entity.
+func entityText(entity Entity) string {
+	if entity.Type == "" {
+		return entity.Name
+	}
+	return entity.Name + " (" + entity.Type + ")"
+}
+
+func normalize(vector []float64) []float64 {
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	out := make([]float64, len(vector))
+	if norm == 0 {
+		return out
+	}
+	norm = math.Sqrt(norm)
+	for i, v := range vector {
+		out[i] = v / norm
+	}
+	return out
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range min(len(a), len(b)) {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
@@ -0,0 +1,260 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/StoneG24/slape/pkg/vectorstore"
+)
+
+// wordEmbedder embeds text as a bag of hashed words so similar words give similar vectors.
+type wordEmbedder struct{}
+
+func (wordEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	vectors := make([][]float64, len(texts))
+	for i, text := range texts {
+		vectors[i] = make([]float64, 64)
+		for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r)
+		}) {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			vectors[i][h.Sum32()%64]++
+		}
+		vectors[i][0] += 0.01
+	}
+	return vectors, nil
+}
+
+// capitalExtractor treats every capitalized word as an entity.
+type capitalExtractor struct{}
+
+func (capitalExtractor) Extract(ctx context.Context, text string) ([]Entity, error) {
+	var entities []Entity
+	for _, word := range strings.Fields(text) {
+		word = strings.Trim(word, ".,?!")
+		if word != "" && unicode.IsUpper([]rune(word)[0]) {
+			entities = append(entities, Entity{Name: word, Type: "thing"})
+		}
+	}
+	return entities, nil
+}
+
+func newTestRAG(t *testing.T, dir string) *RAG {
+	t.Helper()
+	store, err := vectorstore.Open(dir + "/vectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	r, err := New(store, wordEmbedder{}, capitalExtractor{}, dir+"/rag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestInsertRetrieveDelete(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := newTestRAG(t, dir)
+
+	_, err := r.Insert(ctx, "docs", Document{ID: "a", Title: "Ferns"}, "Bracken grows in Wales along with other ferns.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Insert(ctx, "docs", Document{ID: "b", Title: "Castles"}, "Caernarfon is a castle in Wales built by Edward.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the question shares no words with document a besides the entity
+	passages, err := r.Retrieve(ctx, "docs", "What grows near Bracken?", Mini, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passages) != 1 || passages[0].DocumentID != "a" {
+		t.Fatalf("expected document a, got %+v", passages)
+	}
+	if passages[0].Title != "Ferns" || len(passages[0].Entities) == 0 {
+		t.Errorf("passage is missing its title or entities: %+v", passages[0])
+	}
+
+	docs, _ := r.Documents("docs")
+	if len(docs) != 2 || docs[0].ID != "a" || docs[0].Chunks != 1 {
+		t.Errorf("unexpected documents %+v", docs)
+	}
+
+	if err := r.Delete(ctx, "docs", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(ctx, "docs", "a"); err != ErrDocumentNotFound {
+		t.Errorf("expected ErrDocumentNotFound, got %v", err)
+	}
+
+	// Wales is still in document b so only Bracken should be gone
+	g, _ := r.graph("docs")
+	if _, ok := g.Entities["bracken"]; ok {
+		t.Errorf("entity only found in the deleted document was kept")
+	}
+	if _, ok := g.Entities["wales"]; !ok {
+		t.Errorf("entity still used by another document was removed")
+	}
+
+	passages, _ = r.Retrieve(ctx, "docs", "What grows near Bracken?", Naive, 5)
+	for _, p := range passages {
+		if p.DocumentID == "a" {
+			t.Errorf("deleted document was retrieved")
+		}
+	}
+}
+
+func TestRetrieveExactTerms(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRAG(t, t.TempDir())
+
+	// the test embedder drops digits so both documents get the same vector
+	_, err := r.Insert(ctx, "docs", Document{ID: "xz"}, "The advisory for CVE-2024-3094 is out.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Insert(ctx, "docs", Document{ID: "log4j"}, "The advisory for CVE-2021-44228 is out.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for query, id := range map[string]string{"CVE-2024-3094": "xz", "CVE-2021-44228": "log4j"} {
+		passages, err := r.Retrieve(ctx, "docs", "advisory for "+query, Naive, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(passages) != 1 || passages[0].DocumentID != id {
+			t.Errorf("expected %s for %s, got %+v", id, query, passages)
+		}
+	}
+}
+
+func TestGraphPersists(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	r := newTestRAG(t, dir)
+	r.Insert(ctx, "docs", Document{ID: "a"}, "Ada Lovelace wrote about the Analytical Engine.")
+	r.store.Close()
+
+	r = newTestRAG(t, dir)
+	docs, err := r.Documents("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].Entities == 0 {
+		t.Fatalf("documents were not loaded: %+v", docs)
+	}
+	passages, err := r.Retrieve(ctx, "docs", "Lovelace", Mini, 1)
+	if err != nil || len(passages) != 1 {
+		t.Fatalf("expected a passage after reopening, got %+v %v", passages, err)
+	}
+}
+
+func TestParseEntities(t *testing.T) {
+	text := "1. Go | language\n- **Docker** | software\nDocker | software\nllama.cpp\n\n" + strings.Repeat("x", 80) + " | junk"
+	entities := parseEntities(text, 10)
+	if len(entities) != 3 {
+		t.Fatalf("expected 3 entities, got %+v", entities)
+	}
+	if entities[0] != (Entity{Name: "Go", Type: "language"}) || entities[1].Name != "Docker" || entities[2].Type != "" {
+		t.Errorf("unexpected entities %+v", entities)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	if mode, err := ParseMode(""); err != nil || mode != Mini {
+		t.Errorf("empty mode should be mini, got %q %v", mode, err)
+	}
+	if _, err := ParseMode("light"); err == nil {
+		t.Errorf("expected an error for an unknown mode")
+	}
+}
+
+func TestValidName(t *testing.T) {
+	cases := map[string]bool{
+		"docs":                  true,
+		"my-docs_2":             true,
+		"":                      false,
+		"../escape":             false,
+		"a b":                   false,
+		strings.Repeat("a", 55): true,
+		strings.Repeat("a", 56): false,
+	}
+	for name, want := range cases {
+		if got := validName(name); got != want {
+			t.Errorf("%q: expected %v, got %v", name, want, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	html := `<html><head><title>Guide</title><script>alert(1)</script></head><body>
+<nav>Home</nav><h2>Install</h2><p>Run the <b>installer</b>.</p><pre>make install
+</pre><ul><li>fast</li></ul></body></html>`
+	parsed, err := Parse("guide.html", []byte(html))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "## Install\n\nRun the installer.\n\n```\nmake install\n```\n\n- fast\n\n"
+	if parsed.Text != want || parsed.Title != "Guide" {
+		t.Errorf("unexpected html text %q title %q", parsed.Text, parsed.Title)
+	}
+
+	parsed, _ = Parse("main.go", []byte("package main\n"))
+	if parsed.Strategy != "code" {
+		t.Errorf("expected go files to be chunked as code, got %s", parsed.Strategy)
+	}
+	parsed, _ = Parse("notes", []byte("just some notes"))
+	if parsed.Strategy != "paragraph" {
+		t.Errorf("expected plain text to be sniffed, got %s", parsed.Strategy)
+	}
+	if _, err := Parse("image.png", []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestDocumentPaths(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, path := range []string{
+		filepath.Join(root, "notes", "a.md"),
+		filepath.Join(root, "notes", "b.bin"),
+		filepath.Join(outside, "id_rsa.txt"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("text"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink(filepath.Join(outside, "id_rsa.txt"), filepath.Join(root, "notes", "key.txt"))
+	os.Symlink(outside, filepath.Join(root, "secrets"))
+
+	paths, err := documentPaths(root, "notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || filepath.Base(paths[0]) != "a.md" {
+		t.Errorf("expected only the markdown file in the folder, got %v", paths)
+	}
+
+	for _, path := range []string{"../", "notes/../../", outside, "/etc", "secrets", "notes/key.txt"} {
+		if _, err := documentPaths(root, path); !errors.Is(err, errOutsideRoot) {
+			t.Errorf("%s: expected the path to be refused, got %v", path, err)
+		}
+	}
+}
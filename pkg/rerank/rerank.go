@@ -0,0 +1,120 @@
+/*
+Package rerank scores passages against a query with a cross-encoder served by llama.cpp.
+
+Embedding similarity compares a query and a passage that were embedded separately,
+a reranker reads them together which is slower but a lot better at telling what actually answers
+the question. It is used as a second stage over the best candidates from internet search and rag.
+*/
+package rerank
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/StoneG24/slape/pkg/api"
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+// ErrUnavailable is returned when the reranker container isn't running.
+var ErrUnavailable = errors.New("reranker is not running")
+
+type (
+	// Reranker calls the /rerank endpoint of a llama.cpp server started with --reranking.
+	Reranker struct {
+		// Port the server listens on.
+		Port  string
+		Model string
+
+		client *http.Client
+	}
+
+	// Result is the score of a single document, Index is its position in the request.
+	Result struct {
+		Index int     `json:"index"`
+		Score float64 `json:"relevance_score"`
+	}
+
+	rerankRequest struct {
+		Model     string   `json:"model,omitempty"`
+		Query     string   `json:"query"`
+		Documents []string `json:"documents"`
+		TopN      int      `json:"top_n"`
+	}
+
+	rerankResponse struct {
+		Results []Result `json:"results"`
+	}
+)
+
+// Default is the reranker in the container started by the rerank pipeline.
+var Default = New(vars.RerankPort, vars.RerankModel)
+
+// New creates a reranker for the server on port.
+func New(port string, model string) *Reranker {
+	return &Reranker{
+		Port:   port,
+		Model:  model,
+		client: &http.Client{Timeout: vars.RerankTimeout * time.Second},
+	}
+}
+
+// Rerank scores every document against the query and returns them best first.
+func (r *Reranker) Rerank(ctx context.Context, query string, documents []string) ([]Result, error) {
+	if len(documents) == 0 {
+		return nil, nil
+	}
+	if !api.UpDog("http://localhost:" + r.Port) {
+		return nil, ErrUnavailable
+	}
+
+	body, err := json.Marshal(rerankRequest{
+		Model:     r.Model,
+		Query:     query,
+		Documents: documents,
+		TopN:      len(documents),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost:"+r.Port+"/rerank", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("reranker returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+
+	var result rerankResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range result.Results {
+		if r.Index < 0 || r.Index >= len(documents) {
+			return nil, fmt.Errorf("reranker returned index %d for %d documents", r.Index, len(documents))
+		}
+	}
+	sort.SliceStable(result.Results, func(i, j int) bool {
+		return result.Results[i].Score > result.Results[j].Score
+	})
+
+	return result.Results, nil
+}
@@ -0,0 +1,54 @@
+package rerank
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRerank(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("POST /rerank", func(w http.ResponseWriter, req *http.Request) {
+		var body rerankRequest
+		json.NewDecoder(req.Body).Decode(&body)
+
+		// documents that mention the query score higher
+		var response rerankResponse
+		for i, doc := range body.Documents {
+			score := -1.0
+			if strings.Contains(doc, body.Query) {
+				score = 2.5
+			}
+			response.Results = append(response.Results, Result{Index: i, Score: score})
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	r := New(u.Port(), "")
+
+	results, err := r.Rerank(context.Background(), "CVE-2024-3094", []string{
+		"xz is a compression library",
+		"CVE-2024-3094 is a backdoor in xz",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Index != 1 || results[0].Score != 2.5 {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	srv.Close()
+	if _, err := r.Rerank(context.Background(), "q", []string{"d"}); err != ErrUnavailable {
+		t.Errorf("expected ErrUnavailable once the server is gone, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package runs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/StoneG24/slape/pkg/vars"
+)
+
+// ListResponse is returned by GET /runs.
+type ListResponse struct {
+	Runs []Summary `json:"runs"`
+	// Next is passed as before to get the next page, it's empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// Export writes the runs that match filter as json lines, oldest first.
+func (s *Store) Export(w io.Writer, filter Filter) error {
+	encoder := json.NewEncoder(w)
+	return s.each(filter, false, func(run *Run) error {
+		return encoder.Encode(run)
+	})
+}
+
+// filterFrom reads a filter from the query of a request.
+func filterFrom(req *http.Request, limit int) (Filter, error) {
+	query := req.URL.Query()
+	filter := Filter{
+		Pipeline: query.Get("pipeline"),
+		Session:  query.Get("session"),
+		Before:   query.Get("before"),
+		Limit:    limit,
+	}
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return filter, errors.New("limit has to be a positive number")
+		}
+		filter.Limit = min(n, vars.RunsMaxList)
+	}
+	return filter, nil
+}
+
+// ListRunsRequest, handlerfunc expects GET method and returns the newest runs first.
+// The query can have pipeline, session, limit and before, the id to start after.
+func (s *Store) ListRunsRequest(w http.ResponseWriter, req *http.Request) {
+	filter, err := filterFrom(req, vars.RunsListLimit)
+	if err != nil {
+		http.Error(w, "Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summaries, err := s.List(filter)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Listing Runs", "err", err)
+		http.Error(w, "Error listing runs", http.StatusInternalServerError)
+		return
+	}
+
+	resp := ListResponse{Runs: summaries}
+	if len(summaries) == filter.Limit {
+		resp.Next = summaries[len(summaries)-1].ID
+	}
+	writeJSON(w, resp)
+}
+
+// GetRunRequest, handlerfunc expects GET method and returns the run in the path with every step.
+func (s *Store) GetRunRequest(w http.ResponseWriter, req *http.Request) {
+	run, err := s.Get(req.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Error run not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Getting Run", "err", err)
+		http.Error(w, "Error getting run", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, run)
+}
+
+// ExportRunsRequest, handlerfunc expects GET method and returns every run as json lines, oldest first.
+// The query can have pipeline, session, limit and before like GET /runs.
+func (s *Store) ExportRunsRequest(w http.ResponseWriter, req *http.Request) {
+	filter, err := filterFrom(req, 0)
+	if err != nil {
+		http.Error(w, "Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="runs.jsonl"`)
+	err = s.Export(w, filter)
+	if err != nil {
+		// the status is already sent so all that can be done is log it
+		slog.ErrorContext(req.Context(), "Error Exporting Runs", "err", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	json, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Error marshaling runs", "err", err)
+		http.Error(w, "Error marshaling runs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
@@ -0,0 +1,311 @@
+/*
+Package runs keeps a history of every pipeline run so runs can be audited and compared later.
+
+A run holds the request, every completion the models made along the way with its prompts,
+output, timing and token counts, and the final answer. Runs are kept in a bolt database.
+The run of a request travels in its context so GenerateCompletion can add a step for every completion.
+*/
+package runs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotFound is returned for a run that doesn't exist.
+var ErrNotFound = errors.New("run not found")
+
+var bucket = []byte("runs")
+
+type (
+	// Run is a single generate request and everything the models did for it.
+	Run struct {
+		ID string `json:"id"`
+		// Pipeline is the pipeline that ran, like simple or pipelines/security-review.
+		Pipeline string `json:"pipeline"`
+		// Mode is the prompt mode asked for, empty for pipeline definitions.
+		Mode     string          `json:"mode,omitempty"`
+		Session  string          `json:"session,omitempty"`
+		Request  json.RawMessage `json:"request"`
+		Started  time.Time       `json:"started"`
+		Finished time.Time       `json:"finished"`
+		// Duration is in milliseconds.
+		Duration         int64  `json:"duration_ms"`
+		Steps            []Step `json:"steps"`
+		PromptTokens     int64  `json:"prompt_tokens"`
+		CompletionTokens int64  `json:"completion_tokens"`
+		Answer           string `json:"answer"`
+		Error            string `json:"error,omitempty"`
+		// Containers is the output of the model containers while the run went on.
+		Containers []ContainerLog `json:"containers,omitempty"`
+
+		mu sync.Mutex
+	}
+
+	// Step is one completion made during a run.
+	Step struct {
+		Model string `json:"model"`
+		// Messages are the messages sent to the model, the system prompt included.
+		Messages json.RawMessage `json:"messages"`
+		Output   string          `json:"output"`
+		Started  time.Time       `json:"started"`
+		// Duration is in milliseconds.
+		Duration         int64  `json:"duration_ms"`
+		PromptTokens     int64  `json:"prompt_tokens"`
+		CompletionTokens int64  `json:"completion_tokens"`
+		Error            string `json:"error,omitempty"`
+	}
+
+	// ContainerLog is the output of a model container during a run.
+	ContainerLog struct {
+		ID    string   `json:"id"`
+		Model string   `json:"model"`
+		Lines []string `json:"lines"`
+		// Error is the failure found in the output, if there is one.
+		Error string `json:"error,omitempty"`
+	}
+
+	// Summary is a run without its steps, returned by GET /runs.
+	Summary struct {
+		ID               string    `json:"id"`
+		Pipeline         string    `json:"pipeline"`
+		Mode             string    `json:"mode,omitempty"`
+		Session          string    `json:"session,omitempty"`
+		Started          time.Time `json:"started"`
+		Duration         int64     `json:"duration_ms"`
+		Steps            int       `json:"steps"`
+		PromptTokens     int64     `json:"prompt_tokens"`
+		CompletionTokens int64     `json:"completion_tokens"`
+		// Answer is cut short to keep the list small.
+		Answer string `json:"answer"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	// Filter picks runs for List and Export, the zero value is every run.
+	Filter struct {
+		Pipeline string
+		Session  string
+		// Before only returns runs older than this id, for paging.
+		Before string
+		Limit  int
+	}
+
+	// Store keeps runs in a bolt database.
+	Store struct {
+		db *bolt.DB
+	}
+
+	runKey struct{}
+)
+
+// New starts a run of pipeline for request, which is kept as json.
+func New(pipeline string, request any) *Run {
+	started := time.Now()
+
+	random := make([]byte, 4)
+	rand.Read(random)
+
+	raw, err := json.Marshal(request)
+	if err != nil {
+		raw = nil
+	}
+
+	return &Run{
+		// ids sort by when the run started so the database keeps them in order
+		ID:       fmt.Sprintf("%016x%s", started.UnixNano(), hex.EncodeToString(random)),
+		Pipeline: pipeline,
+		Request:  raw,
+		Started:  started,
+		Steps:    []Step{},
+	}
+}
+
+// WithRun returns a context that carries run.
+func WithRun(ctx context.Context, run *Run) context.Context {
+	return context.WithValue(ctx, runKey{}, run)
+}
+
+// FromContext returns the run in ctx, or nil.
+func FromContext(ctx context.Context) *Run {
+	run, _ := ctx.Value(runKey{}).(*Run)
+	return run
+}
+
+// Record adds a step to the run, it does nothing on a nil run.
+func (r *Run) Record(step Step) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Steps = append(r.Steps, step)
+	r.PromptTokens += step.PromptTokens
+	r.CompletionTokens += step.CompletionTokens
+}
+
+// Finish sets the answer or the error of the run.
+func (r *Run) Finish(answer string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Finished = time.Now()
+	r.Duration = r.Finished.Sub(r.Started).Milliseconds()
+	r.Answer = answer
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+func (r *Run) summary() Summary {
+	answer := []rune(r.Answer)
+	if len(answer) > 200 {
+		answer = append(answer[:200], '…')
+	}
+	return Summary{
+		ID:               r.ID,
+		Pipeline:         r.Pipeline,
+		Mode:             r.Mode,
+		Session:          r.Session,
+		Started:          r.Started,
+		Duration:         r.Duration,
+		Steps:            len(r.Steps),
+		PromptTokens:     r.PromptTokens,
+		CompletionTokens: r.CompletionTokens,
+		Answer:           string(answer),
+		Error:            r.Error,
+	}
+}
+
+func (f Filter) match(r *Run) bool {
+	return (f.Pipeline == "" || r.Pipeline == f.Pipeline) && (f.Session == "" || r.Session == f.Session)
+}
+
+// Open opens or creates the database at path.
+func Open(path string) (*Store, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Save writes a run, saving a run again replaces it.
+func (s *Store) Save(run *Run) error {
+	run.mu.Lock()
+	contents, err := json.Marshal(run)
+	run.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(run.ID), contents)
+	})
+}
+
+// Get returns a run with its steps.
+func (s *Store) Get(id string) (*Run, error) {
+	var run Run
+	err := s.db.View(func(tx *bolt.Tx) error {
+		contents := tx.Bucket(bucket).Get([]byte(id))
+		if contents == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		return json.Unmarshal(contents, &run)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// List returns the newest runs that match filter first.
+func (s *Store) List(filter Filter) ([]Summary, error) {
+	summaries := []Summary{}
+	err := s.each(filter, true, func(run *Run) error {
+		summaries = append(summaries, run.summary())
+		return nil
+	})
+	return summaries, err
+}
+
+// each calls fn for the runs that match filter, newest first if newest is set.
+func (s *Store) each(filter Filter, newest bool, fn func(run *Run) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(bucket).Cursor()
+
+		var key, value []byte
+		next := cursor.Next
+		switch {
+		case newest && filter.Before != "":
+			key, value = cursor.Seek([]byte(filter.Before))
+			// seek lands on the id itself or the run after it
+			if key == nil {
+				key, value = cursor.Last()
+			} else {
+				key, value = cursor.Prev()
+			}
+			next = cursor.Prev
+		case newest:
+			key, value = cursor.Last()
+			next = cursor.Prev
+		default:
+			key, value = cursor.First()
+		}
+
+		count := 0
+		for ; key != nil; key, value = next() {
+			if !newest && filter.Before != "" && string(key) >= filter.Before {
+				break
+			}
+
+			var run Run
+			err := json.Unmarshal(value, &run)
+			if err != nil {
+				return fmt.Errorf("run %s: %w", key, err)
+			}
+			if !filter.match(&run) {
+				continue
+			}
+
+			err = fn(&run)
+			if err != nil {
+				return err
+			}
+			count++
+			if filter.Limit > 0 && count >= filter.Limit {
+				break
+			}
+		}
+		return nil
+	})
+}
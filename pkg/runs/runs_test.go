@@ -0,0 +1,172 @@
+package runs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := Open(filepath.Join(t.TempDir(), "runs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// saveRuns saves n runs, every other one of the debate pipeline.
+func saveRuns(t *testing.T, store *Store, n int) []*Run {
+	t.Helper()
+	saved := []*Run{}
+	for i := range n {
+		pipeline := "simple"
+		if i%2 == 1 {
+			pipeline = "debate"
+		}
+		run := New(pipeline, map[string]string{"prompt": fmt.Sprint("question ", i)})
+		run.Record(Step{Model: "m", Output: "thinking", PromptTokens: 10, CompletionTokens: 5})
+		run.Record(Step{Model: "m", Output: fmt.Sprint("answer ", i), PromptTokens: 20, CompletionTokens: 7})
+		run.Finish(fmt.Sprint("answer ", i), nil)
+		if err := store.Save(run); err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, run)
+	}
+	return saved
+}
+
+func TestStore(t *testing.T) {
+	store := openStore(t)
+	saved := saveRuns(t, store, 5)
+
+	got, err := store.Get(saved[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Steps) != 2 || got.PromptTokens != 30 || got.CompletionTokens != 12 || got.Answer != "answer 2" {
+		t.Errorf("unexpected run %+v", got)
+	}
+	if string(got.Request) != `{"prompt":"question 2"}` {
+		t.Errorf("expected the request to be kept, got %s", got.Request)
+	}
+
+	if _, err := store.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// newest first, a page at a time
+	first, err := store.List(Filter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || first[0].ID != saved[4].ID || first[1].ID != saved[3].ID || first[0].Steps != 2 {
+		t.Errorf("unexpected first page %+v", first)
+	}
+	second, _ := store.List(Filter{Limit: 2, Before: first[1].ID})
+	if len(second) != 2 || second[0].ID != saved[2].ID || second[1].ID != saved[1].ID {
+		t.Errorf("unexpected second page %+v", second)
+	}
+
+	debates, _ := store.List(Filter{Pipeline: "debate"})
+	if len(debates) != 2 || debates[0].ID != saved[3].ID {
+		t.Errorf("expected only the debate runs, got %+v", debates)
+	}
+
+	var out bytes.Buffer
+	if err := store.Export(&out, Filter{Before: saved[3].ID}); err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var run Run
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			t.Fatal(err)
+		}
+		if run.ID != saved[lines].ID || len(run.Steps) != 2 {
+			t.Errorf("expected run %s oldest first, got %s", saved[lines].ID, run.ID)
+		}
+		lines++
+	}
+	if lines != 3 {
+		t.Errorf("expected 3 exported runs, got %d", lines)
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != nil {
+		t.Errorf("expected no run in an empty context")
+	}
+	// recording without a run is fine
+	FromContext(context.Background()).Record(Step{})
+
+	run := New("simple", nil)
+	FromContext(WithRun(context.Background(), run)).Record(Step{PromptTokens: 3})
+	if len(run.Steps) != 1 || run.PromptTokens != 3 {
+		t.Errorf("expected the step to be added to the run, got %+v", run)
+	}
+
+	run.Finish("", errors.New("model went away"))
+	if run.Error != "model went away" || run.Finished.IsZero() {
+		t.Errorf("expected the error to be kept, got %+v", run)
+	}
+}
+
+func TestRunsRequests(t *testing.T) {
+	store := openStore(t)
+	saved := saveRuns(t, store, 3)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /runs", store.ListRunsRequest)
+	mux.HandleFunc("GET /runs/export", store.ExportRunsRequest)
+	mux.HandleFunc("GET /runs/{id}", store.GetRunRequest)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/runs?limit=2", nil))
+	var list ListResponse
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if rec.Code != http.StatusOK || len(list.Runs) != 2 || list.Next != saved[1].ID {
+		t.Errorf("unexpected list %d %+v", rec.Code, list)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/runs?before="+list.Next+"&limit=2", nil))
+	list = ListResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Runs) != 1 || list.Next != "" {
+		t.Errorf("expected the last page, got %+v", list)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/runs?limit=none", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad limit to be refused, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/runs/"+saved[0].ID, nil))
+	if rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte(`"steps":[{`)) {
+		t.Errorf("expected the run with its steps, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/runs/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/runs/export?pipeline=simple", nil))
+	if rec.Header().Get("Content-Type") != "application/x-ndjson" || bytes.Count(rec.Body.Bytes(), []byte("\n")) != 2 {
+		t.Errorf("expected 2 simple runs as json lines, got %s", rec.Body)
+	}
+}
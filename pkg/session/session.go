@@ -0,0 +1,315 @@
+/*
+Package session keeps the conversation of a user with a pipeline so that follow up questions can be asked.
+
+Every session is saved as its own json file so a restart doesn't lose it.
+Once a session gets too long for the context the oldest messages are folded into a summary,
+the summary is written by the pipeline since it has the model.
+*/
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles of a message, the same as the chat completion roles.
+const (
+	User      = "user"
+	Assistant = "assistant"
+)
+
+// ErrNotFound is returned for a session that doesn't exist.
+var ErrNotFound = errors.New("session not found")
+
+var validID = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+type (
+	// Message is a single turn of the conversation.
+	Message struct {
+		Role    string    `json:"role"`
+		Content string    `json:"content"`
+		Time    time.Time `json:"time"`
+	}
+
+	// Session is a conversation with a pipeline.
+	Session struct {
+		ID      string    `json:"id"`
+		Title   string    `json:"title,omitempty"`
+		Created time.Time `json:"created"`
+		Updated time.Time `json:"updated"`
+		// Summary covers the messages that were folded out of Messages.
+		Summary string `json:"summary,omitempty"`
+		// Summarized is how many messages the summary covers.
+		Summarized int       `json:"summarized,omitempty"`
+		Messages   []Message `json:"messages"`
+	}
+
+	// Store keeps the sessions in memory and saves each one to dir when it changes.
+	Store struct {
+		dir string
+
+		mu       sync.Mutex
+		sessions map[string]*Session
+	}
+
+	createRequest struct {
+		Title string `json:"title"`
+	}
+
+	// ListResponse is returned by GET /sessions, the messages are left out.
+	ListResponse struct {
+		Sessions []Session `json:"sessions"`
+	}
+)
+
+// NewStore loads every session saved in dir.
+func NewStore(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{dir: dir, sessions: map[string]*Session{}}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !ok || !validID.MatchString(id) {
+			continue
+		}
+
+		contents, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var session Session
+		err = json.Unmarshal(contents, &session)
+		if err != nil {
+			slog.Error("Error Loading Session", "file", entry.Name(), "err", err)
+			continue
+		}
+		s.sessions[id] = &session
+	}
+
+	return s, nil
+}
+
+// Create starts an empty session.
+func (s *Store) Create(title string) (Session, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:       hex.EncodeToString(id),
+		Title:    title,
+		Created:  now,
+		Updated:  now,
+		Messages: []Message{},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[session.ID] = session
+	return session.copy(), s.save(session)
+}
+
+// Get returns a copy of a session.
+func (s *Store) Get(id string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return session.copy(), nil
+}
+
+// List returns every session without its messages, the most recently used first.
+func (s *Store) List() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		summary := *session
+		summary.Messages = nil
+		sessions = append(sessions, summary)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Updated.After(sessions[j].Updated)
+	})
+	return sessions
+}
+
+// Append adds messages to the end of a session.
+func (s *Store) Append(id string, messages ...Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	now := time.Now()
+	for _, message := range messages {
+		if message.Time.IsZero() {
+			message.Time = now
+		}
+		session.Messages = append(session.Messages, message)
+	}
+	session.Updated = now
+	return s.save(session)
+}
+
+// Summarize replaces the first n messages of a session with summary,
+// which has to cover the old summary as well.
+func (s *Store) Summarize(id string, summary string, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	// a message could have been added while the summary was written, but none removed
+	n = min(n, len(session.Messages))
+
+	session.Summary = summary
+	session.Summarized += n
+	session.Messages = append([]Message{}, session.Messages[n:]...)
+	return s.save(session)
+}
+
+// Delete removes a session and its file.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	delete(s.sessions, id)
+
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// save writes a session to a temporary file and renames it so a crash never leaves half a session.
+// The caller has to hold the lock.
+func (s *Store) save(session *Session) error {
+	contents, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	path := s.path(session.ID)
+	err = os.WriteFile(path+"~", contents, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+"~", path)
+}
+
+func (session *Session) copy() Session {
+	c := *session
+	c.Messages = append([]Message{}, session.Messages...)
+	return c
+}
+
+// CreateSessionRequest, handlerfunc expects POST method with an optional title and returns the new session.
+func (s *Store) CreateSessionRequest(w http.ResponseWriter, req *http.Request) {
+	var payload createRequest
+
+	// the body is optional
+	if req.ContentLength != 0 {
+		err := json.NewDecoder(req.Body).Decode(&payload)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "Error Request Format", "err", err)
+			http.Error(w, "Error unexpected request format", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	session, err := s.Create(payload.Title)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Creating Session", "err", err)
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// ListSessionsRequest, handlerfunc expects GET method and returns every session without its messages.
+func (s *Store) ListSessionsRequest(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, ListResponse{Sessions: s.List()})
+}
+
+// GetSessionRequest, handlerfunc expects GET method and returns the session in the path with its messages.
+func (s *Store) GetSessionRequest(w http.ResponseWriter, req *http.Request) {
+	session, err := s.Get(req.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Error session not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, session)
+}
+
+// DeleteSessionRequest, handlerfunc expects DELETE method and returns no content.
+func (s *Store) DeleteSessionRequest(w http.ResponseWriter, req *http.Request) {
+	err := s.Delete(req.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Error session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error Deleting Session", "err", err)
+		http.Error(w, "Error deleting session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	json, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Error marshaling session", "err", err)
+		http.Error(w, "Error marshaling session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(json)
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.Create("sshd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, turn := range []string{"one", "two", "three"} {
+		err = store.Append(s.ID, Message{Role: User, Content: "question " + turn}, Message{Role: Assistant, Content: "answer " + turn})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Summarize(s.ID, "asked about one and two", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new store reads the same sessions back
+	reloaded, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := reloaded.Get(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Summary != "asked about one and two" || got.Summarized != 4 || len(got.Messages) != 2 || got.Messages[0].Content != "question three" {
+		t.Errorf("unexpected session %+v", got)
+	}
+	if got.Messages[1].Time.IsZero() {
+		t.Errorf("expected messages to get a time")
+	}
+
+	if list := reloaded.List(); len(list) != 1 || list[0].Messages != nil {
+		t.Errorf("expected the list to leave out messages, got %+v", list)
+	}
+
+	if err := reloaded.Delete(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.Get(s.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := reloaded.Append(s.ID, Message{Role: User}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSessionRequests(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	store.CreateSessionRequest(rec, httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"title":"follow ups"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	var created Session
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.ID == "" || created.Title != "follow ups" {
+		t.Fatalf("unexpected session %+v", created)
+	}
+
+	// no body at all is fine
+	rec = httptest.NewRecorder()
+	store.CreateSessionRequest(rec, httptest.NewRequest(http.MethodPost, "/sessions", nil))
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected 201 without a body, got %d", rec.Code)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions/{id}", store.GetSessionRequest)
+	mux.HandleFunc("DELETE /sessions/{id}", store.DeleteSessionRequest)
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions/"+created.ID, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/sessions/"+created.ID, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions/"+created.ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after deleting, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Package tracing sets up OpenTelemetry tracing for slape.
+
+Every request gets a span, with children for the pipeline run, each of its stages,
+the docker calls and the requests made to the models, so a slow debate can be taken apart afterwards.
+Spans are sent to an otlp http collector or written to a file as json lines for offline inspection.
+*/
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/StoneG24/slape/pkg/config"
+	"github.com/StoneG24/slape/pkg/logging"
+	"github.com/StoneG24/slape/pkg/vars"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// name is the instrumentation name of the spans made by slape.
+const name = "github.com/StoneG24/slape"
+
+// Setup sends spans to the exporter in cfg, nothing is set up for the none exporter.
+// The returned func flushes the spans that are left and has to be called before exiting.
+func Setup(ctx context.Context, cfg config.Tracing) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var closeFile func() error
+	switch cfg.Exporter {
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		var err error
+		exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpoint(cfg.Endpoint), otlptracehttp.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+	case "file":
+		err := os.MkdirAll(filepath.Dir(cfg.File), 0750)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		closeFile = file.Close
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(vars.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeFile != nil {
+			err = errors.Join(err, closeFile())
+		}
+		return err
+	}, nil
+}
+
+// Start starts a span as a child of the span in ctx.
+// The tracer is looked up every time so it follows the provider set in Setup.
+func Start(ctx context.Context, span string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(name).Start(ctx, span, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if there is one, and ends it.
+func End(span trace.Span, err error) {
+	Record(span, err)
+	span.End()
+}
+
+// Record marks span as failed with err, nothing is done for a nil err.
+func Record(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Middleware starts a span for every request, picking up a trace the client started.
+// The span is named after the route that matched once the request is done,
+// so like metrics.Middleware it has to sit between the logging middleware and the mux.
+func Middleware(next http.Handler) http.Handler {
+	named := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		span := trace.SpanFromContext(req.Context())
+		if id := logging.RequestID(req.Context()); id != "" {
+			span.SetAttributes(attribute.String("slape.request_id", id))
+		}
+		next.ServeHTTP(w, req)
+		if req.Pattern != "" {
+			span.SetName(req.Pattern)
+		}
+	})
+	return otelhttp.NewHandler(named, "request")
+}
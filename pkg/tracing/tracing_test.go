@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/StoneG24/slape/pkg/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// record sends the spans of the test to a recorder.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestSetupFile(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	file := filepath.Join(t.TempDir(), "logs", "traces.jsonl")
+	shutdown, err := Setup(context.Background(), config.Tracing{Exporter: "file", File: file, SampleRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := Start(context.Background(), "pipeline simple")
+	_, child := Start(ctx, "generation")
+	End(child, errors.New("model went away"))
+	End(span, nil)
+
+	err = shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"Name":"pipeline simple"`, `"Name":"generation"`, "model went away", `"slape"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %s in the traces, got %s", want, data)
+		}
+	}
+}
+
+func TestSetupNone(t *testing.T) {
+	shutdown, err := Setup(context.Background(), config.Tracing{Exporter: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	_, err = Setup(context.Background(), config.Tracing{Exporter: "jaeger"})
+	if err == nil {
+		t.Error("expected an unknown exporter to fail")
+	}
+}
+
+func TestEnd(t *testing.T) {
+	recorder := record(t)
+
+	_, span := Start(context.Background(), "search")
+	End(span, errors.New("no results"))
+	_, span = Start(context.Background(), "thinking")
+	End(span, nil)
+
+	ended := recorder.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(ended))
+	}
+	if ended[0].Status().Code != codes.Error || len(ended[0].Events()) != 1 {
+		t.Errorf("expected the failed span to record its error, got %v", ended[0].Status())
+	}
+	if ended[1].Status().Code == codes.Error {
+		t.Error("expected the span without an error not to fail")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := record(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /runs/{id}", func(w http.ResponseWriter, req *http.Request) {
+		_, span := Start(req.Context(), "lookup")
+		span.End()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/runs/1234", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	Middleware(mux).ServeHTTP(httptest.NewRecorder(), req)
+
+	ended := recorder.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(ended))
+	}
+	request := ended[1]
+	if request.Name() != "GET /runs/{id}" {
+		t.Errorf("expected the span to be named after the route, got %s", request.Name())
+	}
+	if ended[0].Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Error("expected spans of the handler to be children of the request")
+	}
+	if got := request.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected the trace of the client to be followed, got %s", got)
+	}
+}
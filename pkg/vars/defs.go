@@ -2,8 +2,6 @@ package vars
 
 import (
 	"github.com/StoneG24/slape/pkg/prompt"
-	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
 )
 
 const (
@@ -12,8 +10,36 @@ const (
 	CudagpuImage = "ghcr.io/ggml-org/llama.cpp:server-cuda"
 	RocmgpuImage = "ghcr.io/ggml-org/llama.cpp:server-rocm"
 
+	// Base urls of the openai compatible servers.
+	ModelEndpoint     = "http://localhost:8000/v1"
+	EmbeddingEndpoint = "http://localhost:8082/v1"
+
+	// Logs are written to LogDir/Logfilename and rotated once they reach LogMaxSize (MB),
+	// the newest LogMaxBackups rotated files are kept as logs.txt.1, logs.txt.2 and so on.
+	LogDir        = "./logs"
 	Logfilename   = "logs.txt"
-	Trunkfilename = "trunk.txt"
+	LogMaxSize    = 10
+	LogMaxBackups = 5
+	// LogLevel is debug, info, warn or error and LogFormat is text or json.
+	LogLevel  = "info"
+	LogFormat = "text"
+	// RequestIDHeader carries the id of a request, one is made up when a request comes without it.
+	RequestIDHeader = "X-Request-ID"
+	// How many log entries GET /logs returns by default and at most.
+	LogPageLimit = 200
+	LogMaxPage   = 1000
+	// Entries a slow /logs/stream client can fall behind by before entries are dropped for it,
+	// and seconds between the keep alive comments sent on the stream.
+	LogStreamBuffer = 256
+	LogStreamPing   = 15
+
+	// Spans are sent by TracingExporter, none, otlp to an otlp http collector at TracingEndpoint,
+	// or file to write them to TracingFile. TracingSampleRatio is the share of requests traced.
+	ServiceName        = "slape"
+	TracingExporter    = "none"
+	TracingEndpoint    = "localhost:4318"
+	TracingFile        = "./logs/traces.jsonl"
+	TracingSampleRatio = 1.0
 
 	// change to false to not run frontend
 	Frontend = true
@@ -30,20 +56,123 @@ const (
 
 	// Timeout for generation (mins)
 	GenerationTimeout = 20
-)
 
-var (
-	OpenaiClient = openai.NewClient(
-		option.WithBaseURL("http://localhost:8000/v1"),
-	)
+	// Size of the chunks made from scraped websites (tokens).
+	// The overlap is repeated at the start of the following chunk.
+	SearchChunkTokens  = 200
+	SearchChunkOverlap = 40
+
+	// Number of search queries searched for a prompt, the prompt itself and the ones the model writes,
+	// and the number of websites scraped once the results are merged.
+	SearchQueries  = 3
+	SearchMaxLinks = 3
+
+	// Politeness controls for internet search.
+	SearchUserAgent = "slape/1.0 (+https://github.com/StoneG24/slape)"
+	// Timeout for a single page (secs)
+	SearchTimeout = 15
+	// Scraped pages are cached on disk for SearchCacheTTL (hours)
+	SearchCacheDir = "./cache/search"
+	SearchCacheTTL = 24
+	// Least amount of time between requests to the same domain (ms)
+	SearchDomainDelay       = 1000
+	SearchDomainParallelism = 2
+	SearchMaxPageBytes      = 2 * 1024 * 1024
+
+	// Embeddings are cached here by the hash of their text.
+	EmbeddingCacheDir = "./cache/embeddings"
+	// Model name used when the embedding server doesn't list it, it's pulled from EmbeddingRepo.
+	EmbeddingModel = "snowflake-arctic-embed-l-v2.0-q4_k_m.gguf"
+	EmbeddingRepo  = "Casual-Autopsy/snowflake-arctic-embed-l-v2.0-gguf"
+	// Most tokens and texts sent to the embedding server in one request.
+	EmbeddingBatchTokens = 2048
+	EmbeddingBatchSize   = 64
+
+	// change to true to start the reranker with the server.
+	// Requests can still ask for reranking, it is skipped when the reranker isn't running.
+	Reranker = false
+	// The reranker is a cross-encoder served by llama.cpp on RerankPort.
+	RerankPort  = "8083"
+	RerankRepo  = "gpustack/bge-reranker-v2-m3-GGUF"
+	RerankModel = "bge-reranker-v2-m3-Q4_K_M.gguf"
+	// Timeout for a rerank request (secs)
+	RerankTimeout = 30
+	// Reranking looks at this many times more candidates than are kept.
+	RerankCandidates = 4
+
+	// Vector collections are persisted here and loaded on startup.
+	VectorStoreDir = "./data/vectors"
+	// The entity graphs of RAG collections are kept here.
+	RagDir = "./data/rag"
+	// Documents go into this collection when a request doesn't name one.
+	RagCollection = "documents"
+	// Paths sent to POST /rag/documents have to be in this folder.
+	RagDocumentsDir = "./documents"
+	// Number of documents that can wait to be ingested, and the largest upload allowed.
+	RagQueueSize      = 64
+	RagMaxUploadBytes = 64 * 1024 * 1024
+	// Passages retrieved per request when the request doesn't say, and the most it can ask for.
+	RagTopK    = 5
+	RagMaxTopK = 20
+	// Size of the documents section of the system prompt (tokens).
+	RagContextTokens = 1500
 
-	GenerationClient = openai.NewClient(
-		option.WithBaseURL("http://localhost:8081/v1"),
-	)
+	// Share of the context budget each part of the system prompt starts with (percent).
+	// Whatever a part doesn't need is split between the others.
+	BudgetThoughts  = 15
+	BudgetContext   = 40
+	BudgetHistory   = 35
+	BudgetQuestions = 10
+	// Tokens kept free for the chat template and anything counted short.
+	BudgetReserve = 256
 
-	EmbeddingClient = openai.NewClient(
-		option.WithBaseURL("http://localhost:8082/v1"),
-	)
+	// Conversations are saved here, one file per session.
+	SessionDir = "./data/sessions"
+	// Share of the context a session can take before its oldest messages are summarized (percent).
+	SessionBudget = 30
+
+	// Every pipeline run is kept in this database.
+	RunsPath = "./data/runs.db"
+	// How many runs GET /runs returns by default and at most.
+	RunsListLimit = 50
+	RunsMaxList   = 500
+
+	// Lines of output kept for each model container, how many containers are remembered
+	// after they are removed, and how many of their last lines are saved with a run.
+	ContainerLogLines = 1000
+	ContainersKept    = 32
+	RunContainerLines = 200
+	// Lines a reason llama.cpp printed is kept for, to explain a failed load that comes right after it.
+	ContainerCauseLines = 5
+
+	// Models are kept in ModelDir, where they came from and their checksums in ModelCatalog.
+	// Downloads go to ModelDir/.downloads until they are verified so they can be resumed.
+	ModelDir      = "./models"
+	ModelCatalog  = "./data/models.json"
+	ModelDownload = ".downloads"
+	// HuggingFaceURL is where repos are pulled from, set to a mirror if needed.
+	HuggingFaceURL = "https://huggingface.co"
+	// ModelsOffline only uses the models already in ModelDir.
+	ModelsOffline = false
+	// Least time between progress events of a download (ms).
+	ModelProgressInterval = 500
+
+	// Prompt templates here add prompt modes or replace the built in ones.
+	PromptDir = "./prompts"
+
+	// Pipeline definitions are loaded from here on startup and saved here when posted.
+	PipelineDir = "./pipelines"
+	// Every stage gets its own container and port so this keeps them below the embedding port.
+	PipelineMaxStages = 8
+	PipelineMaxRounds = 5
+	PipelineMaxBytes  = 1024 * 1024
+)
+
+var (
+	// If SearchAllowedDomains is not empty only these domains are scraped.
+	// Subdomains are included, so "github.com" also allows "gist.github.com".
+	SearchAllowedDomains    = []string{}
+	SearchDisallowedDomains = []string{}
 
 	ThinkingPrompt = prompt.SecThinkingPrompt
 	SimplePrompt   = prompt.SecSimplePrompt
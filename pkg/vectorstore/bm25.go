@@ -0,0 +1,218 @@
+package vectorstore
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// bm25K1 controls how quickly repeating a term stops adding to the score.
+	bm25K1 = 1.2
+	// bm25B controls how much long documents are penalized.
+	bm25B = 0.75
+
+	// rrfK dampens how much the very top ranks dominate reciprocal rank fusion.
+	// 60 is the value used in the original paper.
+	rrfK = 60
+)
+
+type (
+	// Lexical is a BM25 inverted index.
+	// Embeddings are good at meaning but blur exact identifiers like CVE-2024-3094 or os.ReadFile,
+	// which is exactly what a lexical index is good at, so the two are searched together.
+	Lexical struct {
+		mu          sync.RWMutex
+		docs        map[string]lexicalDoc
+		postings    map[string]map[string]int
+		totalLength int
+	}
+
+	lexicalDoc struct {
+		terms  map[string]int
+		length int
+	}
+)
+
+// NewLexical creates an empty lexical index.
+func NewLexical() *Lexical {
+	return &Lexical{
+		docs:     map[string]lexicalDoc{},
+		postings: map[string]map[string]int{},
+	}
+}
+
+// Len returns the number of documents in the index.
+func (l *Lexical) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.docs)
+}
+
+// Add indexes text under id, replacing anything already there.
+func (l *Lexical) Add(id string, text string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.remove(id)
+
+	doc := lexicalDoc{terms: map[string]int{}}
+	for _, term := range terms(text) {
+		doc.terms[term]++
+		doc.length++
+	}
+	for term, count := range doc.terms {
+		posting, ok := l.postings[term]
+		if !ok {
+			posting = map[string]int{}
+			l.postings[term] = posting
+		}
+		posting[id] = count
+	}
+	l.docs[id] = doc
+	l.totalLength += doc.length
+}
+
+// Delete removes id from the index.
+func (l *Lexical) Delete(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remove(id)
+}
+
+func (l *Lexical) remove(id string) {
+	doc, ok := l.docs[id]
+	if !ok {
+		return
+	}
+	for term := range doc.terms {
+		delete(l.postings[term], id)
+		if len(l.postings[term]) == 0 {
+			delete(l.postings, term)
+		}
+	}
+	l.totalLength -= doc.length
+	delete(l.docs, id)
+}
+
+// Search returns up to k documents that contain terms of the query, best BM25 score first.
+func (l *Lexical) Search(query string, k int) []Result {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.docs) == 0 || k <= 0 {
+		return nil
+	}
+
+	n := float64(len(l.docs))
+	avgLength := float64(l.totalLength) / n
+
+	scores := map[string]float64{}
+	seen := map[string]bool{}
+	for _, term := range terms(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+
+		posting := l.postings[term]
+		if len(posting) == 0 {
+			continue
+		}
+		df := float64(len(posting))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+		for id, tf := range posting {
+			length := float64(l.docs[id].length)
+			f := float64(tf)
+			scores[id] += idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*length/avgLength))
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, Result{ID: id, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].ID < results[j].ID
+		}
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+// terms splits text into lowercase terms.
+// Identifiers joined by - . : or / are kept whole and their parts are added as well,
+// so "CVE-2024-3094" matches itself exactly and "ReadFile" still matches "os.ReadFile".
+func terms(text string) []string {
+	var out []string
+
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' || r == ':' || r == '/')
+	})
+	for _, field := range fields {
+		field = strings.ToLower(strings.Trim(field, "-.:/"))
+		if field == "" {
+			continue
+		}
+		out = append(out, field)
+
+		parts := strings.FieldsFunc(field, func(r rune) bool {
+			return r == '-' || r == '.' || r == ':' || r == '/'
+		})
+		if len(parts) > 1 {
+			out = append(out, parts...)
+		}
+	}
+	return out
+}
+
+// FuseRRF merges rankings with reciprocal rank fusion.
+// Every result keeps the fields from the first ranking it appears in, ordered by fused score.
+func FuseRRF(rankings ...[]Result) []Result {
+	first := map[string]Result{}
+	ids := make([][]string, len(rankings))
+	for i, ranking := range rankings {
+		for _, result := range ranking {
+			if _, ok := first[result.ID]; !ok {
+				first[result.ID] = result
+			}
+			ids[i] = append(ids[i], result.ID)
+		}
+	}
+
+	order, _ := Fuse(ids...)
+	results := make([]Result, len(order))
+	for i, id := range order {
+		results[i] = first[id]
+	}
+	return results
+}
+
+// Fuse merges rankings of ids with reciprocal rank fusion and returns the ids best first with their fused scores.
+// An id scores the sum of 1/(k+rank) over every ranking it shows up in, so ids that rank well in many rankings
+// float to the top. Ties keep the order the ids were first seen in.
+func Fuse(rankings ...[]string) ([]string, map[string]float64) {
+	scores := map[string]float64{}
+	var order []string
+
+	for _, ranking := range rankings {
+		for rank, id := range ranking {
+			if _, ok := scores[id]; !ok {
+				order = append(order, id)
+			}
+			scores[id] += 1 / float64(rrfK+rank+1)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	return order, scores
+}
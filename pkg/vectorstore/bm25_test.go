@@ -0,0 +1,107 @@
+package vectorstore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLexicalSearch(t *testing.T) {
+	l := NewLexical()
+	l.Add("xz", "CVE-2024-3094 is a backdoor that was found in the xz compression library")
+	l.Add("log4j", "CVE-2021-44228, also called log4shell, is a remote code execution bug in log4j")
+	l.Add("go", "Use os.ReadFile to read a whole file in go")
+
+	results := l.Search("what is CVE-2024-3094", 3)
+	if len(results) == 0 || results[0].ID != "xz" {
+		t.Fatalf("expected the exact cve to rank first, got %+v", results)
+	}
+
+	results = l.Search("ReadFile", 3)
+	if len(results) != 1 || results[0].ID != "go" {
+		t.Errorf("expected the part of a dotted identifier to match, got %+v", results)
+	}
+
+	l.Delete("xz")
+	for _, result := range l.Search("CVE-2024-3094", 3) {
+		if result.ID == "xz" {
+			t.Errorf("deleted document was returned")
+		}
+	}
+	if l.Len() != 2 {
+		t.Errorf("expected 2 documents after deleting, got %d", l.Len())
+	}
+}
+
+func TestFuseRRF(t *testing.T) {
+	a := []Result{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+	b := []Result{{ID: "3"}, {ID: "2"}, {ID: "4"}}
+
+	fused := FuseRRF(a, b)
+	if len(fused) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(fused))
+	}
+	// 2 and 3 are in both rankings so they beat 1 which is only first in one
+	if fused[0].ID != "2" && fused[0].ID != "3" {
+		t.Errorf("expected a result from both rankings first, got %s", fused[0].ID)
+	}
+	if fused[3].ID != "4" {
+		t.Errorf("expected 4 last, got %s", fused[3].ID)
+	}
+}
+
+func TestHybridSearch(t *testing.T) {
+	dir := t.TempDir()
+	vectors := randomVectors(100, 16, 3)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := store.CreateCollection("docs", DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := make([]Record, len(vectors))
+	for i, vec := range vectors {
+		records[i] = Record{ID: fmt.Sprint(i), Vector: vec, Payload: map[string]string{TextField: fmt.Sprint("filler passage number ", i)}}
+	}
+	records[42].Payload[TextField] = "CVE-2024-3094 is a backdoor in xz"
+	if err := c.Add(records...); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		// the query vector is nowhere near record 42, only the text finds it
+		results := c.HybridSearch("CVE-2024-3094", vectors[7], 5, 0)
+		found := false
+		for _, result := range results {
+			if result.ID == "42" {
+				found = true
+				if result.Lexical <= 0 || result.Payload == nil {
+					t.Errorf("expected a lexical score and payload, got %+v", result)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("expected the lexical match in the results, got %+v", results)
+		}
+		if results[0].ID != "7" && results[0].ID != "42" {
+			t.Errorf("expected the best vector or lexical match first, got %s", results[0].ID)
+		}
+	}
+	check()
+
+	c.Compact()
+	store, c = reopen(t, store, dir, "docs")
+	defer store.Close()
+	check()
+
+	c.Delete("42")
+	for _, result := range c.HybridSearch("CVE-2024-3094", vectors[7], 5, 0) {
+		if result.ID == "42" {
+			t.Errorf("deleted record was returned")
+		}
+	}
+}
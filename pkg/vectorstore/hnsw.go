@@ -0,0 +1,563 @@
+package vectorstore
+
+import (
+	"errors"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrDimension is returned when a vector doesn't match the size of the vectors already in the index.
+	ErrDimension = errors.New("vector dimension does not match the index")
+	// ErrNotFound is returned when an id is not in the index.
+	ErrNotFound = errors.New("id not found")
+)
+
+type (
+	// Index is a HNSW graph of vectors.
+	// It is safe to use from several goroutines.
+	Index struct {
+		mu     sync.RWMutex
+		config Config
+		rng    *rand.Rand
+		// levelMult is 1/ln(M), used to pick the layer of a new node
+		levelMult float64
+
+		nodes    []*node
+		ids      map[string]int
+		entry    int
+		maxLevel int
+		dim      int
+		deleted  int
+	}
+
+	node struct {
+		id      string
+		vector  []float64
+		payload map[string]string
+		level   int
+		// neighbors[l] are the internal ids this node links to on layer l
+		neighbors [][]int
+		deleted   bool
+	}
+
+	// candidate is a node and its distance to whatever is being searched for.
+	candidate struct {
+		node     int
+		distance float64
+	}
+
+	// candidateHeap is a binary heap of candidates, see push and pop.
+	candidateHeap []candidate
+)
+
+// NewIndex creates an empty index, zero values in config are filled in from DefaultConfig.
+func NewIndex(config Config) *Index {
+	defaults := DefaultConfig()
+	if config.M <= 1 {
+		config.M = defaults.M
+	}
+	if config.EfConstruction <= 0 {
+		config.EfConstruction = defaults.EfConstruction
+	}
+	if config.EfSearch <= 0 {
+		config.EfSearch = defaults.EfSearch
+	}
+	if config.Metric == "" {
+		config.Metric = defaults.Metric
+	}
+
+	return &Index{
+		config:    config,
+		rng:       rand.New(rand.NewSource(config.Seed)),
+		levelMult: 1 / math.Log(float64(config.M)),
+		ids:       map[string]int{},
+		entry:     -1,
+	}
+}
+
+// Config returns the parameters the index was created with.
+func (h *Index) Config() Config {
+	return h.config
+}
+
+// Len returns the number of vectors in the index, deleted vectors are not counted.
+func (h *Index) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.ids)
+}
+
+// Insert adds a vector to the index. If the id is already in the index it is replaced.
+// The vector and payload are copied so the caller is free to reuse them.
+func (h *Index) Insert(id string, vector []float64, payload map[string]string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.dim != 0 && len(vector) != h.dim {
+		return ErrDimension
+	}
+	if len(vector) == 0 {
+		return ErrDimension
+	}
+	h.dim = len(vector)
+
+	if old, ok := h.ids[id]; ok {
+		h.nodes[old].deleted = true
+		h.deleted++
+	}
+
+	n := &node{
+		id:      id,
+		vector:  h.config.Metric.prepare(vector),
+		payload: maps.Clone(payload),
+		level:   h.randomLevel(),
+	}
+	n.neighbors = make([][]int, n.level+1)
+
+	internal := len(h.nodes)
+	h.nodes = append(h.nodes, n)
+	h.ids[id] = internal
+
+	if h.entry == -1 {
+		h.entry = internal
+		h.maxLevel = n.level
+		return nil
+	}
+
+	// walk down the layers above the new node greedily
+	ep := h.entry
+	for l := h.maxLevel; l > n.level; l-- {
+		ep = h.greedy(n.vector, ep, l)
+	}
+
+	entryPoints := []candidate{{ep, h.distance(n.vector, ep)}}
+	for l := min(n.level, h.maxLevel); l >= 0; l-- {
+		found := h.searchLayer(n.vector, entryPoints, h.config.EfConstruction, l, false)
+		n.neighbors[l] = h.selectNeighbors(found, h.maxNeighbors(l))
+
+		// link back and keep the neighbors lists from growing past their limit
+		for _, neighbor := range n.neighbors[l] {
+			other := h.nodes[neighbor]
+			other.neighbors[l] = append(other.neighbors[l], internal)
+			if len(other.neighbors[l]) > h.maxNeighbors(l) {
+				other.neighbors[l] = h.shrink(neighbor, other.neighbors[l], l)
+			}
+		}
+
+		entryPoints = found
+	}
+
+	if n.level > h.maxLevel {
+		h.maxLevel = n.level
+		h.entry = internal
+	}
+
+	return nil
+}
+
+// Delete removes a vector from the index.
+// The node stays in the graph so that it can still be walked through, but it's never returned.
+func (h *Index) Delete(id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	internal, ok := h.ids[id]
+	if !ok {
+		return ErrNotFound
+	}
+	h.nodes[internal].deleted = true
+	h.deleted++
+	delete(h.ids, id)
+
+	return nil
+}
+
+// Get returns a copy of the vector and payload stored for an id.
+func (h *Index) Get(id string) ([]float64, map[string]string, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	internal, ok := h.ids[id]
+	if !ok {
+		return nil, nil, false
+	}
+	n := h.nodes[internal]
+	return slices.Clone(n.vector), maps.Clone(n.payload), true
+}
+
+// Score compares query to the vector stored for id, the score is the same one Search returns.
+func (h *Index) Score(query []float64, id string) (float64, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	internal, ok := h.ids[id]
+	if !ok || h.nodes[internal].deleted || len(query) != h.dim {
+		return 0, false
+	}
+	return h.config.Metric.score(h.distance(h.config.Metric.prepare(query), internal)), true
+}
+
+// Search returns the k closest vectors to query, closest first.
+// ef is the size of the candidate list, higher values are slower with better recall.
+// If ef is zero the index's EfSearch is used.
+func (h *Index) Search(query []float64, k int, ef int) []Result {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.entry == -1 || k <= 0 || len(query) != h.dim {
+		return []Result{}
+	}
+	if ef <= 0 {
+		ef = h.config.EfSearch
+	}
+	ef = max(ef, k)
+
+	q := h.config.Metric.prepare(query)
+
+	ep := h.entry
+	for l := h.maxLevel; l > 0; l-- {
+		ep = h.greedy(q, ep, l)
+	}
+
+	found := h.searchLayer(q, []candidate{{ep, h.distance(q, ep)}}, ef, 0, true)
+
+	return h.results(found, k)
+}
+
+// Exact compares query against every vector in the index.
+// It's slow but always correct and is used to check the recall of Search.
+func (h *Index) Exact(query []float64, k int) []Result {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(query) != h.dim {
+		return []Result{}
+	}
+
+	q := h.config.Metric.prepare(query)
+	var all []candidate
+	for i, n := range h.nodes {
+		if n.deleted {
+			continue
+		}
+		all = append(all, candidate{i, h.distance(q, i)})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].distance < all[j].distance
+	})
+
+	return h.results(all, k)
+}
+
+// IDs returns every id in the index.
+func (h *Index) IDs() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ids := make([]string, 0, len(h.ids))
+	for id := range h.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// results turns sorted candidates into results.
+func (h *Index) results(found []candidate, k int) []Result {
+	results := make([]Result, 0, k)
+	for _, c := range found {
+		if len(results) == k {
+			break
+		}
+		n := h.nodes[c.node]
+		if n.deleted {
+			continue
+		}
+		results = append(results, Result{
+			ID:      n.id,
+			Score:   h.config.Metric.score(c.distance),
+			Payload: maps.Clone(n.payload),
+		})
+	}
+	return results
+}
+
+func (h *Index) randomLevel() int {
+	return int(math.Floor(-math.Log(1-h.rng.Float64()) * h.levelMult))
+}
+
+func (h *Index) maxNeighbors(level int) int {
+	if level == 0 {
+		return 2 * h.config.M
+	}
+	return h.config.M
+}
+
+func (h *Index) distance(q []float64, internal int) float64 {
+	return h.config.Metric.distance(q, h.nodes[internal].vector)
+}
+
+// greedy follows the closest neighbor on a layer until it can't get any closer.
+func (h *Index) greedy(q []float64, ep int, level int) int {
+	best := h.distance(q, ep)
+	for changed := true; changed; {
+		changed = false
+		for _, neighbor := range h.nodes[ep].neighbors[level] {
+			if d := h.distance(q, neighbor); d < best {
+				best, ep, changed = d, neighbor, true
+			}
+		}
+	}
+	return ep
+}
+
+// searchLayer is algorithm 2 from the paper, it returns up to ef candidates sorted closest first.
+// When skipDeleted is set deleted nodes are walked through but not returned.
+func (h *Index) searchLayer(q []float64, entryPoints []candidate, ef int, level int, skipDeleted bool) []candidate {
+	visited := make([]uint64, len(h.nodes)/64+1)
+	seen := func(i int) bool {
+		word, bit := i/64, uint64(1)<<(i%64)
+		if visited[word]&bit != 0 {
+			return true
+		}
+		visited[word] |= bit
+		return false
+	}
+
+	candidates := make(candidateHeap, 0, ef)
+	found := make(candidateHeap, 0, ef+1)
+
+	for _, ep := range entryPoints {
+		seen(ep.node)
+		candidates.push(ep, nearer)
+		if !skipDeleted || !h.nodes[ep.node].deleted {
+			found.push(ep, further)
+		}
+	}
+
+	for len(candidates) > 0 {
+		closest := candidates.pop(nearer)
+		if len(found) >= ef && closest.distance > found[0].distance {
+			break
+		}
+
+		for _, neighbor := range h.nodes[closest.node].neighbors[level] {
+			if seen(neighbor) {
+				continue
+			}
+
+			d := h.distance(q, neighbor)
+			if len(found) < ef || d < found[0].distance {
+				candidates.push(candidate{neighbor, d}, nearer)
+				if skipDeleted && h.nodes[neighbor].deleted {
+					continue
+				}
+				found.push(candidate{neighbor, d}, further)
+				if len(found) > ef {
+					found.pop(further)
+				}
+			}
+		}
+	}
+
+	sorted := make([]candidate, len(found))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = found.pop(further)
+	}
+	return sorted
+}
+
+// selectNeighbors is the heuristic from algorithm 4 of the paper.
+// A candidate is only kept if it is closer to the new node than to any neighbor already kept,
+// which keeps links spread out in different directions. Pruned candidates fill any space left over.
+func (h *Index) selectNeighbors(sorted []candidate, m int) []int {
+	if len(sorted) <= m {
+		out := make([]int, len(sorted))
+		for i, c := range sorted {
+			out[i] = c.node
+		}
+		return out
+	}
+
+	var kept []int
+	var pruned []int
+	for _, c := range sorted {
+		if len(kept) == m {
+			break
+		}
+		good := true
+		for _, k := range kept {
+			if h.config.Metric.distance(h.nodes[c.node].vector, h.nodes[k].vector) < c.distance {
+				good = false
+				break
+			}
+		}
+		if good {
+			kept = append(kept, c.node)
+		} else {
+			pruned = append(pruned, c.node)
+		}
+	}
+	for _, p := range pruned {
+		if len(kept) == m {
+			break
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// shrink cuts a nodes neighbor list back down to size by keeping the closest neighbors.
+// Running the selection heuristic here as well was more than half of the insert time
+// for about the same recall, so it's only used for the new node.
+func (h *Index) shrink(internal int, neighbors []int, level int) []int {
+	vec := h.nodes[internal].vector
+	sorted := make([]candidate, len(neighbors))
+	for i, neighbor := range neighbors {
+		sorted[i] = candidate{neighbor, h.config.Metric.distance(vec, h.nodes[neighbor].vector)}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].distance < sorted[j].distance
+	})
+	sorted = sorted[:h.maxNeighbors(level)]
+	out := make([]int, len(sorted))
+	for i, c := range sorted {
+		out[i] = c.node
+	}
+	return out
+}
+
+func nearer(a, b candidate) bool  { return a.distance < b.distance }
+func further(a, b candidate) bool { return a.distance > b.distance }
+
+// push and pop keep the heap ordered by less, the top of the heap is at index 0.
+// These are used over container/heap to keep candidates from being boxed into interfaces.
+func (q *candidateHeap) push(c candidate, less func(a, b candidate) bool) {
+	*q = append(*q, c)
+	heap := *q
+	for i := len(heap) - 1; i > 0; {
+		parent := (i - 1) / 2
+		if !less(heap[i], heap[parent]) {
+			break
+		}
+		heap[i], heap[parent] = heap[parent], heap[i]
+		i = parent
+	}
+}
+
+func (q *candidateHeap) pop(less func(a, b candidate) bool) candidate {
+	heap := *q
+	top := heap[0]
+	last := len(heap) - 1
+	heap[0] = heap[last]
+	heap = heap[:last]
+	for i := 0; ; {
+		smallest := i
+		left, right := 2*i+1, 2*i+2
+		if left < len(heap) && less(heap[left], heap[smallest]) {
+			smallest = left
+		}
+		if right < len(heap) && less(heap[right], heap[smallest]) {
+			smallest = right
+		}
+		if smallest == i {
+			break
+		}
+		heap[i], heap[smallest] = heap[smallest], heap[i]
+		i = smallest
+	}
+	*q = heap
+	return top
+}
+
+type (
+	// indexSnapshot is the whole graph in a form that gob can encode.
+	indexSnapshot struct {
+		Config   Config
+		Nodes    []nodeSnapshot
+		Entry    int
+		MaxLevel int
+		Dim      int
+	}
+
+	nodeSnapshot struct {
+		ID        string
+		Vector    []float64
+		Payload   map[string]string
+		Level     int
+		Neighbors [][]int
+		Deleted   bool
+	}
+)
+
+// snapshot copies the graph so it can be written to disk without rebuilding it on load.
+func (h *Index) snapshot() indexSnapshot {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	snap := indexSnapshot{
+		Config:   h.config,
+		Nodes:    make([]nodeSnapshot, len(h.nodes)),
+		Entry:    h.entry,
+		MaxLevel: h.maxLevel,
+		Dim:      h.dim,
+	}
+	for i, n := range h.nodes {
+		neighbors := make([][]int, len(n.neighbors))
+		for l := range n.neighbors {
+			neighbors[l] = append([]int(nil), n.neighbors[l]...)
+		}
+		snap.Nodes[i] = nodeSnapshot{
+			ID:        n.id,
+			Vector:    n.vector,
+			Payload:   n.payload,
+			Level:     n.level,
+			Neighbors: neighbors,
+			Deleted:   n.deleted,
+		}
+	}
+	return snap
+}
+
+// restoreIndex rebuilds an index from a snapshot.
+func restoreIndex(snap indexSnapshot) *Index {
+	h := NewIndex(snap.Config)
+	// don't repeat the layers that were already handed out
+	h.rng.Seed(snap.Config.Seed + int64(len(snap.Nodes)))
+	h.entry = snap.Entry
+	h.maxLevel = snap.MaxLevel
+	h.dim = snap.Dim
+
+	h.nodes = make([]*node, len(snap.Nodes))
+	for i, n := range snap.Nodes {
+		h.nodes[i] = &node{
+			id:        n.ID,
+			vector:    n.Vector,
+			payload:   n.Payload,
+			level:     n.Level,
+			neighbors: n.Neighbors,
+			deleted:   n.Deleted,
+		}
+		if n.Deleted {
+			h.deleted++
+		} else {
+			h.ids[n.ID] = i
+		}
+	}
+	return h
+}
+
+// tombstones is the fraction of nodes in the graph that have been deleted.
+func (h *Index) tombstones() float64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.nodes) == 0 {
+		return 0
+	}
+	return float64(h.deleted) / float64(len(h.nodes))
+}
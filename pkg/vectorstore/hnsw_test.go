@@ -0,0 +1,185 @@
+package vectorstore
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func randomVectors(n, dim int, seed int64) [][]float64 {
+	rng := rand.New(rand.NewSource(seed))
+	vectors := make([][]float64, n)
+	for i := range vectors {
+		vectors[i] = make([]float64, dim)
+		for j := range vectors[i] {
+			vectors[i][j] = rng.NormFloat64()
+		}
+	}
+	return vectors
+}
+
+func buildIndex(tb testing.TB, config Config, vectors [][]float64) *Index {
+	index := NewIndex(config)
+	for i, vec := range vectors {
+		err := index.Insert(fmt.Sprint(i), vec, map[string]string{"n": fmt.Sprint(i)})
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return index
+}
+
+// recall is the fraction of the exact neighbors that the approximate search found.
+func recall(index *Index, queries [][]float64, k int, ef int) float64 {
+	hits, total := 0, 0
+	for _, q := range queries {
+		want := map[string]bool{}
+		for _, r := range index.Exact(q, k) {
+			want[r.ID] = true
+		}
+		for _, r := range index.Search(q, k, ef) {
+			if want[r.ID] {
+				hits++
+			}
+		}
+		total += len(want)
+	}
+	return float64(hits) / float64(total)
+}
+
+func TestSearchRecall(t *testing.T) {
+	vectors := randomVectors(1000, 32, 1)
+	queries := randomVectors(30, 32, 2)
+
+	for _, metric := range []Metric{Cosine, Dot, L2} {
+		t.Run(string(metric), func(t *testing.T) {
+			config := DefaultConfig()
+			config.Metric = metric
+			index := buildIndex(t, config, vectors)
+
+			if r := recall(index, queries, 10, 100); r < 0.9 {
+				t.Errorf("recall@10 is %.3f, expected at least 0.9", r)
+			}
+		})
+	}
+}
+
+func TestSearchOrderAndPayload(t *testing.T) {
+	index := NewIndex(DefaultConfig())
+	index.Insert("x", []float64{1, 0}, map[string]string{"axis": "x"})
+	index.Insert("y", []float64{0, 1}, map[string]string{"axis": "y"})
+	index.Insert("xy", []float64{1, 1}, map[string]string{"axis": "xy"})
+
+	query := []float64{1, 0.1}
+	results := index.Search(query, 3, 0)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if results[0].ID != "x" || results[2].ID != "y" {
+		t.Errorf("results are not closest first: %+v", results)
+	}
+	if results[0].Payload["axis"] != "x" {
+		t.Errorf("payload was not returned: %+v", results[0])
+	}
+	if results[0].Score < results[1].Score {
+		t.Errorf("scores should go down: %+v", results)
+	}
+	if query[1] != 0.1 {
+		t.Errorf("search changed the query vector")
+	}
+}
+
+func TestGetCopies(t *testing.T) {
+	index := NewIndex(DefaultConfig())
+	payload := map[string]string{"axis": "x"}
+	if err := index.Insert("x", []float64{1, 0}, payload); err != nil {
+		t.Fatal(err)
+	}
+	payload["axis"] = "changed"
+
+	vector, got, _ := index.Get("x")
+	vector[0] = 5
+	got["axis"] = "changed"
+	index.Search([]float64{1, 0}, 1, 0)[0].Payload["axis"] = "changed"
+
+	vector, got, _ = index.Get("x")
+	if vector[0] != 1 || got["axis"] != "x" {
+		t.Errorf("expected the index to keep its own vector and payload, got %v %v", vector, got)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	vectors := randomVectors(500, 16, 3)
+	index := buildIndex(t, DefaultConfig(), vectors)
+
+	for i := 0; i < 250; i++ {
+		if err := index.Delete(fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if index.Len() != 250 {
+		t.Fatalf("expected 250 vectors left, got %d", index.Len())
+	}
+	if err := index.Delete("0"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+	}
+
+	for _, q := range randomVectors(20, 16, 4) {
+		results := index.Search(q, 10, 50)
+		if len(results) != 10 {
+			t.Fatalf("expected 10 results, got %d", len(results))
+		}
+		for _, r := range results {
+			var n int
+			fmt.Sscan(r.ID, &n)
+			if n < 250 {
+				t.Errorf("deleted vector %s was returned", r.ID)
+			}
+		}
+	}
+
+	// replacing an id keeps a single copy
+	index.Insert("300", vectors[0], nil)
+	if index.Len() != 250 {
+		t.Errorf("replacing a vector changed the length to %d", index.Len())
+	}
+}
+
+func TestDimensionMismatch(t *testing.T) {
+	index := NewIndex(DefaultConfig())
+	index.Insert("a", []float64{1, 2, 3}, nil)
+	if err := index.Insert("b", []float64{1, 2}, nil); err != ErrDimension {
+		t.Errorf("expected ErrDimension, got %v", err)
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	vectors := randomVectors(10000, 128, 1)
+	queries := randomVectors(100, 128, 2)
+	index := buildIndex(b, DefaultConfig(), vectors)
+
+	for _, ef := range []int{16, 64, 256} {
+		b.Run(fmt.Sprintf("hnsw/ef=%d", ef), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				index.Search(queries[i%len(queries)], 10, ef)
+			}
+			b.StopTimer()
+			b.ReportMetric(recall(index, queries, 10, ef), "recall@10")
+		})
+	}
+
+	b.Run("bruteforce", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			index.Exact(queries[i%len(queries)], 10)
+		}
+	})
+}
+
+func BenchmarkInsert(b *testing.B) {
+	vectors := randomVectors(b.N, 128, 1)
+	index := NewIndex(DefaultConfig())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.Insert(fmt.Sprint(i), vectors[i], nil)
+	}
+}
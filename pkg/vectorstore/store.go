@@ -0,0 +1,702 @@
+package vectorstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Collections are kept on disk as a snapshot of the index plus the segments written since.
+//
+//	<dir>/<collection>/config.json
+//	<dir>/<collection>/snapshot.gob
+//	<dir>/<collection>/segment-00000001.log
+//
+// Every change is appended to the newest segment and synced before it's applied to the index,
+// so a crash can only lose the write that was in progress. Each entry in a segment is framed
+// with its length and a checksum, a torn entry at the end of a segment is cut off on load.
+// Compaction writes a new snapshot and removes the segments it covers.
+
+const (
+	snapshotFile = "snapshot.gob"
+	configFile   = "config.json"
+
+	// segments are compacted into the snapshot once they get this big
+	compactSegmentBytes = 64 << 20
+	// the graph is rebuilt during compaction once this much of it has been deleted
+	rebuildTombstones = 0.2
+)
+
+var (
+	// ErrCollectionExists is returned when creating a collection that is already there.
+	ErrCollectionExists = errors.New("collection already exists")
+	// ErrCollectionNotFound is returned when a collection doesn't exist.
+	ErrCollectionNotFound = errors.New("collection not found")
+	// ErrCollectionName is returned for names that can't be used as a folder name.
+	ErrCollectionName = errors.New("collection names can only contain letters, numbers, - and _")
+
+	collectionName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+type (
+	// Store holds named collections of vectors that are persisted to disk.
+	Store struct {
+		dir string
+
+		mu          sync.Mutex
+		collections map[string]*Collection
+	}
+
+	// Collection is a named index along with the files that keep it on disk.
+	Collection struct {
+		name string
+		dir  string
+
+		// mu serializes writes, reads go straight to the index
+		// which is swapped out when compaction rebuilds it
+		mu           sync.Mutex
+		index        atomic.Pointer[Index]
+		lexical      *Lexical
+		segment      *os.File
+		segmentSeq   int
+		segmentBytes int64
+	}
+
+	// Record is a vector and its payload as they are added to a collection.
+	Record struct {
+		ID      string            `json:"id"`
+		Vector  []float64         `json:"vector"`
+		Payload map[string]string `json:"payload,omitempty"`
+	}
+
+	// entry is a single change written to a segment.
+	entry struct {
+		Op     string `json:"op"`
+		Record Record `json:"record"`
+	}
+
+	// snapshotHeader is written before the index in a snapshot file.
+	snapshotHeader struct {
+		// Seq is the last segment that is included in the snapshot
+		Seq int
+	}
+)
+
+const (
+	opAdd    = "add"
+	opDelete = "delete"
+
+	// TextField is the payload key whose value goes into the lexical index.
+	TextField = "text"
+)
+
+// Open loads every collection found in dir, creating dir if needed.
+func Open(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:         dir,
+		collections: map[string]*Collection{},
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !ValidCollectionName(e.Name()) {
+			continue
+		}
+		c, err := loadCollection(e.Name(), filepath.Join(dir, e.Name()))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("loading collection %s: %w", e.Name(), err)
+		}
+		s.collections[e.Name()] = c
+		slog.Info("Loaded Collection", "collection", e.Name(), "vectors", c.Len())
+	}
+
+	return s, nil
+}
+
+// ValidCollectionName reports whether name can be used as a collection name.
+func ValidCollectionName(name string) bool {
+	return collectionName.MatchString(name)
+}
+
+// Collection returns a collection by name.
+func (s *Store) Collection(name string) (*Collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.collections[name]
+	if !ok {
+		return nil, ErrCollectionNotFound
+	}
+	return c, nil
+}
+
+// CreateCollection makes a new empty collection.
+func (s *Store) CreateCollection(name string, config Config) (*Collection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !ValidCollectionName(name) {
+		return nil, ErrCollectionName
+	}
+	if _, ok := s.collections[name]; ok {
+		return nil, ErrCollectionExists
+	}
+
+	dir := filepath.Join(s.dir, name)
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	index := NewIndex(config)
+	contents, err := json.MarshalIndent(index.Config(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(filepath.Join(dir, configFile), contents)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Collection{name: name, dir: dir, lexical: NewLexical()}
+	c.index.Store(index)
+	err = c.openSegment(1)
+	if err != nil {
+		return nil, err
+	}
+
+	s.collections[name] = c
+	return c, nil
+}
+
+// GetOrCreateCollection returns the named collection, creating it with config if it doesn't exist.
+func (s *Store) GetOrCreateCollection(name string, config Config) (*Collection, error) {
+	c, err := s.Collection(name)
+	if err == nil {
+		return c, nil
+	}
+	c, err = s.CreateCollection(name, config)
+	if errors.Is(err, ErrCollectionExists) {
+		return s.Collection(name)
+	}
+	return c, err
+}
+
+// DropCollection closes a collection and removes its files.
+func (s *Store) DropCollection(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.collections[name]
+	if !ok {
+		return ErrCollectionNotFound
+	}
+	c.Close()
+	delete(s.collections, name)
+
+	return os.RemoveAll(c.dir)
+}
+
+// Collections returns the names of every collection, sorted.
+func (s *Store) Collections() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.collections))
+	for name := range s.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes every collection, nothing is lost by not calling it.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, c := range s.collections {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Name returns the name of the collection.
+func (c *Collection) Name() string {
+	return c.name
+}
+
+// Len returns the number of vectors in the collection.
+func (c *Collection) Len() int {
+	return c.index.Load().Len()
+}
+
+// Add writes records to disk and adds them to the index.
+// A record with an id that is already in the collection replaces it.
+func (c *Collection) Add(records ...Record) error {
+	entries := make([]entry, len(records))
+	for i, record := range records {
+		entries[i] = entry{Op: opAdd, Record: record}
+	}
+	return c.write(entries)
+}
+
+// Delete removes records from the collection, ids that aren't there are ignored.
+func (c *Collection) Delete(ids ...string) error {
+	var entries []entry
+	for _, id := range ids {
+		if _, _, ok := c.index.Load().Get(id); ok {
+			entries = append(entries, entry{Op: opDelete, Record: Record{ID: id}})
+		}
+	}
+	return c.write(entries)
+}
+
+// Search returns the k closest records to query, see Index.Search.
+func (c *Collection) Search(query []float64, k int, ef int) []Result {
+	return c.index.Load().Search(query, k, ef)
+}
+
+// HybridSearch searches the vectors with vector and the text of the records with text,
+// then fuses both rankings with reciprocal rank fusion and returns the best k.
+// Score is always the vector score, also for records only the lexical search found,
+// and Lexical is the BM25 score so callers can tell which records matched the text.
+func (c *Collection) HybridSearch(text string, vector []float64, k int, ef int) []Result {
+	index := c.index.Load()
+
+	semantic := index.Search(vector, k*2, ef)
+	lexical := c.lexical.Search(text, k*2)
+
+	bm25 := make(map[string]float64, len(lexical))
+	for i, result := range lexical {
+		bm25[result.ID] = result.Score
+
+		score, _ := index.Score(vector, result.ID)
+		_, payload, _ := index.Get(result.ID)
+		lexical[i] = Result{ID: result.ID, Score: score, Payload: payload}
+	}
+
+	results := FuseRRF(semantic, lexical)
+	if len(results) > k {
+		results = results[:k]
+	}
+	for i := range results {
+		results[i].Lexical = bm25[results[i].ID]
+	}
+	return results
+}
+
+// Get returns the stored vector and payload of a record.
+// Vectors in cosine collections are returned normalized.
+func (c *Collection) Get(id string) ([]float64, map[string]string, bool) {
+	return c.index.Load().Get(id)
+}
+
+// IDs returns the id of every record in the collection.
+func (c *Collection) IDs() []string {
+	return c.index.Load().IDs()
+}
+
+// Config returns the parameters of the collections index.
+func (c *Collection) Config() Config {
+	return c.index.Load().Config()
+}
+
+// Compact writes a new snapshot and removes the segments it replaces.
+// If enough of the graph has been deleted it's rebuilt from the records that are left.
+func (c *Collection) Compact() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.compact()
+}
+
+// Close closes the open segment.
+func (c *Collection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.segment == nil {
+		return nil
+	}
+	err := c.segment.Close()
+	c.segment = nil
+	return err
+}
+
+func (c *Collection) write(entries []entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.segment == nil {
+		return os.ErrClosed
+	}
+
+	// make sure everything can go into the index before anything is written
+	dim := c.index.Load().dim
+	for _, e := range entries {
+		if e.Op != opAdd {
+			continue
+		}
+		if len(e.Record.Vector) == 0 || (dim != 0 && len(e.Record.Vector) != dim) {
+			return fmt.Errorf("record %s: %w", e.Record.ID, ErrDimension)
+		}
+		dim = len(e.Record.Vector)
+	}
+
+	var buf []byte
+	for _, e := range entries {
+		framed, err := frame(e)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, framed...)
+	}
+
+	_, err := c.segment.Write(buf)
+	if err != nil {
+		return err
+	}
+	err = c.segment.Sync()
+	if err != nil {
+		return err
+	}
+	c.segmentBytes += int64(len(buf))
+
+	for _, e := range entries {
+		c.apply(e)
+	}
+
+	if c.segmentBytes > compactSegmentBytes {
+		err = c.compact()
+		if err != nil {
+			slog.Error("Error compacting collection", "collection", c.name, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Collection) apply(e entry) {
+	switch e.Op {
+	case opAdd:
+		err := c.index.Load().Insert(e.Record.ID, e.Record.Vector, e.Record.Payload)
+		if err != nil {
+			slog.Error("Error adding record to collection", "collection", c.name, "record", e.Record.ID, "err", err)
+			return
+		}
+		c.lexical.Add(e.Record.ID, e.Record.Payload[TextField])
+	case opDelete:
+		c.index.Load().Delete(e.Record.ID)
+		c.lexical.Delete(e.Record.ID)
+	}
+}
+
+func (c *Collection) compact() error {
+	current := c.index.Load()
+	index := current
+	if current.tombstones() > rebuildTombstones {
+		index = NewIndex(current.Config())
+		snap := current.snapshot()
+		for _, n := range snap.Nodes {
+			if !n.Deleted {
+				index.Insert(n.ID, n.Vector, n.Payload)
+			}
+		}
+	}
+
+	// the snapshot covers everything up to the current segment
+	seq := c.segmentSeq
+	err := writeSnapshot(filepath.Join(c.dir, snapshotFile), snapshotHeader{Seq: seq}, index.snapshot())
+	if err != nil {
+		return err
+	}
+	c.index.Store(index)
+
+	if c.segment != nil {
+		c.segment.Close()
+		c.segment = nil
+	}
+	segments, err := listSegments(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s <= seq {
+			os.Remove(segmentPath(c.dir, s))
+		}
+	}
+
+	return c.openSegment(seq + 1)
+}
+
+func (c *Collection) openSegment(seq int) error {
+	f, err := os.OpenFile(segmentPath(c.dir, seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.segment = f
+	c.segmentSeq = seq
+	c.segmentBytes = info.Size()
+	return nil
+}
+
+// loadCollection reads the snapshot and replays every segment written after it.
+func loadCollection(name string, dir string) (*Collection, error) {
+	config := DefaultConfig()
+	contents, err := os.ReadFile(filepath.Join(dir, configFile))
+	if err == nil {
+		err = json.Unmarshal(contents, &config)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	c := &Collection{name: name, dir: dir, lexical: NewLexical()}
+	c.index.Store(NewIndex(config))
+
+	header, snap, err := readSnapshot(filepath.Join(dir, snapshotFile))
+	switch {
+	case err == nil:
+		c.index.Store(restoreIndex(snap))
+		// the lexical index isn't saved, it's rebuilt from the payloads
+		for _, n := range snap.Nodes {
+			if !n.Deleted {
+				c.lexical.Add(n.ID, n.Payload[TextField])
+			}
+		}
+	case errors.Is(err, os.ErrNotExist):
+	default:
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	last := header.Seq + 1
+	for _, seq := range segments {
+		if seq <= header.Seq {
+			// left over from a compaction that didn't finish cleaning up
+			os.Remove(segmentPath(dir, seq))
+			continue
+		}
+		err := c.replay(segmentPath(dir, seq))
+		if err != nil {
+			return nil, err
+		}
+		last = seq
+	}
+
+	err = c.openSegment(last)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// replay applies every entry in a segment. If the end of the segment is torn
+// or corrupt it is truncated to the last good entry.
+func (c *Collection) replay(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var good int64
+	for {
+		e, n, err := unframe(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			slog.Warn("Truncating torn segment", "path", path, "at", good, "err", err)
+			return f.Truncate(good)
+		}
+		c.apply(e)
+		good += int64(n)
+	}
+}
+
+// frame encodes an entry as its length, a checksum and the json of the entry.
+func frame(e entry) ([]byte, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...), nil
+}
+
+// unframe reads a single entry, returning how many bytes it took up.
+func unframe(r io.Reader) (entry, int, error) {
+	var header [8]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return entry{}, 0, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if size > compactSegmentBytes*2 {
+		return entry{}, 0, errors.New("entry is too large")
+	}
+
+	payload := make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return entry{}, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return entry{}, 0, errors.New("checksum mismatch")
+	}
+
+	var e entry
+	err = json.Unmarshal(payload, &e)
+	if err != nil {
+		return entry{}, 0, err
+	}
+	return e, 8 + int(size), nil
+}
+
+func segmentPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("segment-%08d.log", seq))
+}
+
+// listSegments returns the sequence numbers of the segments in dir, oldest first.
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "segment-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "segment-"), ".log"))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+func writeSnapshot(path string, header snapshotHeader, snap indexSnapshot) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	err = enc.Encode(header)
+	if err == nil {
+		err = enc.Encode(snap)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func readSnapshot(path string) (snapshotHeader, indexSnapshot, error) {
+	var header snapshotHeader
+	var snap indexSnapshot
+
+	f, err := os.Open(path)
+	if err != nil {
+		return header, snap, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	err = dec.Decode(&header)
+	if err == nil {
+		err = dec.Decode(&snap)
+	}
+	return header, snap, err
+}
+
+// writeFileAtomic writes to a temporary file and renames it over path.
+func writeFileAtomic(path string, contents []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, contents, 0640)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes a rename durable, this isn't supported on windows so errors are ignored there.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
@@ -0,0 +1,164 @@
+package vectorstore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func fillCollection(t *testing.T, c *Collection, vectors [][]float64) {
+	t.Helper()
+	records := make([]Record, len(vectors))
+	for i, vec := range vectors {
+		records[i] = Record{ID: fmt.Sprint(i), Vector: vec, Payload: map[string]string{"n": fmt.Sprint(i)}}
+	}
+	if err := c.Add(records...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reopen(t *testing.T, store *Store, dir string, name string) (*Store, *Collection) {
+	t.Helper()
+	store.Close()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := store.Collection(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, c
+}
+
+func TestStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	vectors := randomVectors(200, 16, 1)
+
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := store.CreateCollection("docs", DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, vectors)
+	c.Delete("0", "1")
+	want := c.Search(vectors[5], 5, 0)
+
+	store, c = reopen(t, store, dir, "docs")
+	defer store.Close()
+
+	if c.Len() != 198 {
+		t.Fatalf("expected 198 vectors after reopening, got %d", c.Len())
+	}
+	if _, _, ok := c.Get("0"); ok {
+		t.Errorf("deleted record came back after reopening")
+	}
+	got := c.Search(vectors[5], 5, 0)
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Payload["n"] != want[i].Payload["n"] {
+			t.Fatalf("search changed after reopening: %+v != %+v", got, want)
+		}
+	}
+}
+
+func TestStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	vectors := randomVectors(200, 16, 2)
+
+	store, _ := Open(dir)
+	c, _ := store.CreateCollection("docs", DefaultConfig())
+	fillCollection(t, c, vectors)
+	for i := 0; i < 100; i++ {
+		c.Delete(fmt.Sprint(i))
+	}
+
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if tomb := c.index.Load().tombstones(); tomb != 0 {
+		t.Errorf("expected the graph to be rebuilt, %.2f is still deleted", tomb)
+	}
+	c.Add(Record{ID: "new", Vector: vectors[0]})
+
+	segments, _ := listSegments(c.dir)
+	if len(segments) != 1 {
+		t.Errorf("expected a single segment after compacting, got %v", segments)
+	}
+
+	store, c = reopen(t, store, dir, "docs")
+	defer store.Close()
+	if c.Len() != 101 {
+		t.Fatalf("expected 101 vectors after compacting and reopening, got %d", c.Len())
+	}
+	if results := c.Search(vectors[0], 1, 0); results[0].ID != "new" {
+		t.Errorf("record added after compacting was lost: %+v", results)
+	}
+}
+
+func TestStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	vectors := randomVectors(10, 8, 3)
+
+	store, _ := Open(dir)
+	c, _ := store.CreateCollection("docs", DefaultConfig())
+	fillCollection(t, c, vectors)
+	path := segmentPath(c.dir, c.segmentSeq)
+	store.Close()
+
+	// cut the last record in half like a crash in the middle of a write
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	store, c = reopen(t, store, dir, "docs")
+	defer store.Close()
+	if c.Len() != 9 {
+		t.Fatalf("expected the torn record to be dropped, got %d vectors", c.Len())
+	}
+
+	// writes after the torn one land on a clean segment
+	c.Add(Record{ID: "9", Vector: vectors[9]})
+	store, c = reopen(t, store, dir, "docs")
+	defer store.Close()
+	if c.Len() != 10 {
+		t.Fatalf("expected 10 vectors after rewriting, got %d", c.Len())
+	}
+}
+
+func TestStoreCollections(t *testing.T) {
+	store, _ := Open(t.TempDir())
+	defer store.Close()
+
+	if _, err := store.CreateCollection("../escape", DefaultConfig()); err != ErrCollectionName {
+		t.Errorf("expected ErrCollectionName, got %v", err)
+	}
+	store.CreateCollection("b", DefaultConfig())
+	if _, err := store.CreateCollection("b", DefaultConfig()); err != ErrCollectionExists {
+		t.Errorf("expected ErrCollectionExists, got %v", err)
+	}
+	if _, err := store.GetOrCreateCollection("a", DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if names := store.Collections(); len(names) != 2 || names[0] != "a" {
+		t.Errorf("unexpected collections %v", names)
+	}
+
+	c, _ := store.Collection("a")
+	if err := c.Add(Record{ID: "x", Vector: []float64{1, 2}}, Record{ID: "y", Vector: []float64{1}}); err == nil {
+		t.Errorf("expected a dimension error")
+	}
+	if c.Len() != 0 {
+		t.Errorf("a failed batch should not add anything")
+	}
+
+	if err := store.DropCollection("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Collection("a"); err != ErrCollectionNotFound {
+		t.Errorf("expected ErrCollectionNotFound, got %v", err)
+	}
+}
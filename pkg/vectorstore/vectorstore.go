@@ -1,16 +1,141 @@
 /*
 Package vectorstore is used to create independant context information for each disscussion.
 Vectorstores allow us to index information and keep relevant bits for generation.
+
+The index is a pure go implementation of Hierarchical Navigable Small World graphs,
+https://arxiv.org/abs/1603.09320, so nothing extra has to be installed or run in a container.
 */
 package vectorstore
 
-import ()
+import (
+	"math"
+)
+
+// Metric is how the distance between two vectors is measured.
+type Metric string
+
+const (
+	// Cosine compares the angle between vectors, vectors are normalized when they are added.
+	Cosine Metric = "cosine"
+	// Dot uses the inner product, this is the same as cosine for normalized vectors.
+	Dot Metric = "dot"
+	// L2 is the euclidean distance.
+	L2 Metric = "l2"
+)
+
+type (
+	// Config holds the parameters of an index.
+	Config struct {
+		// M is the number of neighbors each node keeps per layer, the bottom layer keeps 2*M.
+		// Higher values use more memory and improve recall.
+		M int `json:"m"`
+		// EfConstruction is the size of the candidate list used while inserting.
+		EfConstruction int `json:"ef_construction"`
+		// EfSearch is the default size of the candidate list used while searching.
+		EfSearch int    `json:"ef_search"`
+		Metric   Metric `json:"metric"`
+		// Seed makes the layer assignment reproducible.
+		Seed int64 `json:"seed"`
+	}
+
+	// Result is a single match returned from a search.
+	Result struct {
+		ID string
+		// Score is higher for closer matches.
+		// It is the similarity for Cosine and Dot and the negative distance for L2.
+		Score   float64
+		Payload map[string]string
+		// Lexical is the BM25 score of a hybrid search, zero when the text didn't match.
+		Lexical float64
+	}
+)
+
+// DefaultConfig returns the parameters recommended by the paper for text embeddings.
+func DefaultConfig() Config {
+	return Config{
+		M:              16,
+		EfConstruction: 200,
+		EfSearch:       64,
+		Metric:         Cosine,
+		Seed:           42,
+	}
+}
+
+// distance returns a value where lower is closer for every metric.
+func (m Metric) distance(a, b []float64) float64 {
+	if m == L2 {
+		return squaredDistance(a, b)
+	}
+	// cosine vectors are normalized on the way in so both are the dot product
+	return -dot(a, b)
+}
+
+// dot is unrolled since this is where nearly all of the time in the index is spent.
+func dot(a, b []float64) float64 {
+	var s0, s1, s2, s3 float64
+	b = b[:len(a)]
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return s0 + s1 + s2 + s3
+}
 
-// Utilize HNSW algorithim to create a vector for Internet searching
-type VectoreStore struct {
+func squaredDistance(a, b []float64) float64 {
+	var s0, s1, s2, s3 float64
+	b = b[:len(a)]
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		d0 := a[i] - b[i]
+		d1 := a[i+1] - b[i+1]
+		d2 := a[i+2] - b[i+2]
+		d3 := a[i+3] - b[i+3]
+		s0 += d0 * d0
+		s1 += d1 * d1
+		s2 += d2 * d2
+		s3 += d3 * d3
+	}
+	for ; i < len(a); i++ {
+		d := a[i] - b[i]
+		s0 += d * d
+	}
+	return s0 + s1 + s2 + s3
 }
 
-// This is a simple function to get us going and will need more work in future to implement
-// correctly. Apparently this has some openai compat
-func (v *VectoreStore) Startup() {
+// score turns a distance back into something where higher is closer.
+func (m Metric) score(distance float64) float64 {
+	switch m {
+	case L2:
+		return -math.Sqrt(distance)
+	default:
+		return -distance
+	}
+}
+
+// prepare copies a vector so the callers slice is never changed, cosine vectors are normalized.
+func (m Metric) prepare(vec []float64) []float64 {
+	out := make([]float64, len(vec))
+	copy(out, vec)
+	if m != Cosine {
+		return out
+	}
+
+	var norm float64
+	for _, v := range out {
+		norm += v * v
+	}
+	if norm == 0 {
+		return out
+	}
+	norm = math.Sqrt(norm)
+	for i := range out {
+		out[i] /= norm
+	}
+	return out
 }